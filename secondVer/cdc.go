@@ -0,0 +1,479 @@
+package kv_engine
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/reid00/kv_engine/logfile"
+)
+
+var (
+	// ErrSubscriptionClosed the subscription is closed by consumer or db.
+	ErrSubscriptionClosed = errors.New("subscription is closed")
+
+	// ErrSubscriptionLagged consumer is too slow to receive change events, the subscription is closed.
+	// Subscribe again from the last received position to resume.
+	ErrSubscriptionLagged = errors.New("subscription lagged behind, resume from the last position")
+
+	// ErrPositionCompacted the log file at the resume position has been removed by log file gc.
+	ErrPositionCompacted = errors.New("log file of the position has been compacted")
+
+	// ErrDataReset all data of the db is removed by FlushAll or Restore, the subscription is closed.
+	// Subscribing again from the last received position returns ErrPositionCompacted, read the whole db to resync.
+	ErrDataReset = errors.New("data of the db is reset")
+)
+
+const defaultSubscriptionBufferSize = 1024
+
+// ChangeOp is the operation of a change event.
+type ChangeOp uint8
+
+const (
+	// ChangePut key(or field/member) is set.
+	ChangePut ChangeOp = iota
+	// ChangeDelete key(or field/member) is deleted.
+	ChangeDelete
+	// ChangeListMeta head and tail seq of a list is updated.
+	ChangeListMeta
+)
+
+// Position is the location of a log entry in log files of a data type.
+// Positions of the same data type are ordered by fid and then offset.
+type Position struct {
+	DataType DataType
+	Fid      uint32
+	Offset   int64
+}
+
+func (p Position) before(o Position) bool {
+	if p.Fid != o.Fid {
+		return p.Fid < o.Fid
+	}
+	return p.Offset < o.Offset
+}
+
+// ChangeEvent describes a mutation written to the log files.
+// Field is the hash field, the encoded seq of a list element(see encodeListKey), or the score of a zset member.
+// Next is the position right after this event, save it and subscribe from it to resume.
+type ChangeEvent struct {
+	DataType DataType
+	Op       ChangeOp
+	Key      []byte
+	Field    []byte
+	Value    []byte
+	ExpireAt int64 // time.UnixMilli, zero if it never expires
+	Pos      Position
+	Next     Position
+
+	entry *logfile.LogEntry
+}
+
+// ChangeFilter choose which change events will be received by a subscription.
+type ChangeFilter struct {
+	// DataTypes only receive events of these data types, all data types if empty.
+	DataTypes []DataType
+
+	// KeyPrefix only receive events whose key has this prefix.
+	KeyPrefix []byte
+
+	// From resume positions of each data type, events at and after the position are read from log files first.
+	// Only new events are received for the data types not in it.
+	// Note that entries rewritten by log file gc can also be read from log files when resuming.
+	From map[DataType]Position
+
+	// BufferSize size of the event channel, default value is 1024.
+	// The subscription will be closed with ErrSubscriptionLagged if it is full.
+	BufferSize int
+}
+
+// Subscription receives change events from C until it is closed.
+type Subscription struct {
+	C <-chan *ChangeEvent
+
+	db      *RoseDB
+	filter  ChangeFilter
+	ch      chan *ChangeEvent
+	pending chan *ChangeEvent
+	// live events before these positions have been read from log files.
+	catchUp map[DataType]Position
+	ready   chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// changeQueue holds the changes of a data type in the order of their positions,
+// a change is published once all changes before it are committed or dropped.
+type changeQueue struct {
+	mu      sync.Mutex
+	size    int32 // len(changes), accessed atomically.
+	changes []*queuedChange
+}
+
+type queuedChange struct {
+	ev    *ChangeEvent
+	owner *heldLocks // the write which made the change.
+	done  bool
+	drop  bool
+}
+
+type subscribers struct {
+	sync.RWMutex
+	count int32
+	subs  map[*Subscription]struct{}
+}
+
+// Subscribe observes mutations of the db, GC rewrites are excluded.
+// Events of the same data type are received in the order they were written.
+// An event is received once its write is committed, that is the index is updated and the entry is synced if the write syncs,
+// events of failed writes are never received. Entries read from log files when resuming are not checked this way.
+// The subscription is closed with ErrDataReset once all data is removed by FlushAll or Restore.
+func (db *RoseDB) Subscribe(filter ChangeFilter) (*Subscription, error) {
+	if db.isClosed() {
+		return nil, ErrSubscriptionClosed
+	}
+	size := filter.BufferSize
+	if size <= 0 {
+		size = defaultSubscriptionBufferSize
+	}
+	ch := make(chan *ChangeEvent, size)
+	sub := &Subscription{
+		C:       ch,
+		db:      db,
+		filter:  filter,
+		ch:      ch,
+		pending: make(chan *ChangeEvent, size),
+		catchUp: make(map[DataType]Position),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	// register before taking the end positions, so that nothing is missed.
+	db.subs.Lock()
+	if db.subs.subs == nil {
+		db.subs.subs = make(map[*Subscription]struct{})
+	}
+	db.subs.subs[sub] = struct{}{}
+	atomic.AddInt32(&db.subs.count, 1)
+	db.subs.Unlock()
+
+	files := make(map[DataType][]*logfile.LogFile)
+	for dataType, from := range filter.From {
+		if !sub.accept(dataType, nil) {
+			continue
+		}
+		lfs, end, err := db.logFilesFrom(dataType, from)
+		if err != nil {
+			close(sub.ready)
+			sub.closeWithErr(err)
+			sub.unregister()
+			return nil, err
+		}
+		files[dataType] = lfs
+		sub.catchUp[dataType] = end
+	}
+	close(sub.ready)
+
+	go sub.run(files)
+	return sub, nil
+}
+
+// Close the subscription, C will be closed.
+func (s *Subscription) Close() {
+	s.closeWithErr(ErrSubscriptionClosed)
+}
+
+// Err returns the reason why the subscription is closed, nil if it is still open.
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// closeWithErr may be called by writers while holding the read lock of subscribers,
+// so the subscription is unregistered by its own goroutine.
+func (s *Subscription) closeWithErr(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+func (s *Subscription) unregister() {
+	s.db.subs.Lock()
+	defer s.db.subs.Unlock()
+	if _, ok := s.db.subs.subs[s]; ok {
+		delete(s.db.subs.subs, s)
+		atomic.AddInt32(&s.db.subs.count, -1)
+	}
+}
+
+func (s *Subscription) accept(dataType DataType, key []byte) bool {
+	if len(s.filter.DataTypes) > 0 {
+		var found bool
+		for _, typ := range s.filter.DataTypes {
+			if typ == dataType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return key == nil || bytes.HasPrefix(key, s.filter.KeyPrefix)
+}
+
+// run reads history from log files first, then forwards the live events.
+func (s *Subscription) run(files map[DataType][]*logfile.LogFile) {
+	defer close(s.ch)
+	defer s.unregister()
+
+	for dataType, lfs := range files {
+		from, end := s.filter.From[dataType], s.catchUp[dataType]
+		for _, lf := range lfs {
+			var offset int64
+			if lf.Fid == from.Fid {
+				offset = from.Offset
+			}
+			for {
+				if lf.Fid == end.Fid && offset >= end.Offset {
+					break
+				}
+				ent, size, err := lf.ReadLogEntry(offset)
+				if err != nil {
+					if err == io.EOF || err == logfile.ErrEndOfEntry {
+						break
+					}
+					s.closeWithErr(err)
+					return
+				}
+				pos := Position{DataType: dataType, Fid: lf.Fid, Offset: offset}
+				offset += size
+				ev := s.db.newChangeEvent(dataType, ent, pos, offset)
+				if !s.accept(dataType, ev.Key) {
+					continue
+				}
+				if !s.send(ev) {
+					return
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case ev := <-s.pending:
+			if !s.send(ev) {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Subscription) send(ev *ChangeEvent) bool {
+	select {
+	case s.ch <- ev:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// publish is called by writers, it never blocks.
+func (s *Subscription) publish(ev *ChangeEvent) {
+	<-s.ready
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	if end, ok := s.catchUp[ev.DataType]; ok && ev.Pos.before(end) {
+		return
+	}
+	if !s.accept(ev.DataType, ev.Key) {
+		return
+	}
+	select {
+	case s.pending <- ev:
+	default:
+		s.closeWithErr(ErrSubscriptionLagged)
+	}
+}
+
+// logFilesFrom returns the log files which contain entries at and after from, and the current end position.
+// ErrPositionCompacted is also returned if from is after the end, as the log files it was taken from are removed.
+func (db *RoseDB) logFilesFrom(dataType DataType, from Position) ([]*logfile.LogFile, Position, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	end := Position{DataType: dataType}
+	active := db.activeLogFiles[dataType]
+	if active != nil {
+		end.Fid = active.Fid
+		end.Offset = atomic.LoadInt64(&active.WriteAt)
+	}
+	if end.before(from) {
+		return nil, end, ErrPositionCompacted
+	}
+	if active == nil {
+		return nil, end, nil
+	}
+
+	var lfs []*logfile.LogFile
+	var found bool
+	for fid, lf := range db.archivedLogFiles[dataType] {
+		if fid == from.Fid {
+			found = true
+		}
+		if fid >= from.Fid {
+			lfs = append(lfs, lf)
+		}
+	}
+	if active.Fid == from.Fid {
+		found = true
+	}
+	if !found && from.Fid < active.Fid {
+		return nil, end, ErrPositionCompacted
+	}
+	if active.Fid >= from.Fid {
+		lfs = append(lfs, active)
+	}
+	sort.Slice(lfs, func(i, j int) bool {
+		return lfs[i].Fid < lfs[j].Fid
+	})
+	return lfs, end, nil
+}
+
+func (db *RoseDB) publishChange(dataType DataType, ent *logfile.LogEntry, pos *valuePos) {
+	if atomic.LoadInt32(&db.subs.count) == 0 {
+		return
+	}
+	_, size := logfile.EncodeEntry(ent)
+	db.publishEvent(db.newChangeEvent(dataType, ent, Position{DataType: dataType, Fid: pos.fid, Offset: pos.offset}, pos.offset+int64(size)))
+}
+
+func (db *RoseDB) publishEvent(ev *ChangeEvent) {
+	db.subs.RLock()
+	defer db.subs.RUnlock()
+	for sub := range db.subs.subs {
+		sub.publish(ev)
+	}
+}
+
+// queueChange queues the change of an entry appended by writeLogEntry until its write is committed, see commitChanges.
+// The append lock of the data type must be held.
+func (db *RoseDB) queueChange(dataType DataType, ent *logfile.LogEntry, pos *valuePos) {
+	if atomic.LoadInt32(&db.subs.count) == 0 {
+		return
+	}
+	_, size := logfile.EncodeEntry(ent)
+	ev := db.newChangeEvent(dataType, ent, Position{DataType: dataType, Fid: pos.fid, Offset: pos.offset}, pos.offset+int64(size))
+	owner := db.keyLocksOf(dataType).ownerOf(ev.Key)
+
+	q := &db.changes[dataType]
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.changes = append(q.changes, &queuedChange{ev: ev, owner: owner, done: owner == nil})
+	atomic.StoreInt32(&q.size, int32(len(q.changes)))
+	if owner == nil {
+		db.publishQueued(q)
+	}
+}
+
+// commitChanges marks the changes made by the write as committed, or dropped if ok is false,
+// and publishes the committed changes at the front of the queue.
+func (db *RoseDB) commitChanges(dataType DataType, held *heldLocks, ok bool) {
+	q := &db.changes[dataType]
+	if atomic.LoadInt32(&q.size) == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, c := range q.changes {
+		if c.owner == held {
+			c.done, c.drop = true, !ok
+		}
+	}
+	db.publishQueued(q)
+}
+
+// publishQueued publishes the changes at the front of the queue until one is not committed yet, q.mu must be held.
+func (db *RoseDB) publishQueued(q *changeQueue) {
+	var n int
+	for ; n < len(q.changes) && q.changes[n].done; n++ {
+		if !q.changes[n].drop {
+			db.publishEvent(q.changes[n].ev)
+		}
+		q.changes[n] = nil
+	}
+	q.changes = q.changes[n:]
+	atomic.StoreInt32(&q.size, int32(len(q.changes)))
+}
+
+// dropQueuedChanges drops all changes waiting for their writes, as the data is reset.
+func (db *RoseDB) dropQueuedChanges() {
+	for i := range db.changes {
+		q := &db.changes[i]
+		q.mu.Lock()
+		q.changes = nil
+		atomic.StoreInt32(&q.size, 0)
+		q.mu.Unlock()
+	}
+}
+
+func (db *RoseDB) closeSubscriptions() {
+	db.closeSubscriptionsWithErr(ErrSubscriptionClosed)
+}
+
+func (db *RoseDB) closeSubscriptionsWithErr(err error) {
+	db.subs.RLock()
+	defer db.subs.RUnlock()
+	for sub := range db.subs.subs {
+		sub.closeWithErr(err)
+	}
+}
+
+func (db *RoseDB) newChangeEvent(dataType DataType, ent *logfile.LogEntry, pos Position, next int64) *ChangeEvent {
+	ev := &ChangeEvent{
+		DataType: dataType,
+		Op:       ChangePut,
+		Key:      ent.Key,
+		Value:    ent.Value,
+		ExpireAt: ent.ExpireAt,
+		Pos:      pos,
+		Next:     Position{DataType: dataType, Fid: pos.Fid, Offset: next},
+		entry:    ent,
+	}
+	switch ent.Type {
+	case logfile.TypeDelete:
+		ev.Op = ChangeDelete
+	case logfile.TypeListMeta:
+		ev.Op = ChangeListMeta
+	}
+
+	switch dataType {
+	case List:
+		if ent.Type != logfile.TypeListMeta {
+			ev.Key, _ = db.decodeListKey(ent.Key)
+			ev.Field = ent.Key[:4]
+		}
+	case Hash:
+		ev.Key, ev.Field = db.decodeKey(ent.Key)
+	case ZSet:
+		// delete entry of zset holds the raw key.
+		if ent.Type != logfile.TypeDelete {
+			ev.Key, ev.Field = db.decodeKey(ent.Key)
+		}
+	}
+	return ev
+}
@@ -0,0 +1,220 @@
+package kv_engine
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reid00/kv_engine/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoseDB_Subscribe(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	sub, err := db.Subscribe(ChangeFilter{})
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.HSet([]byte("h1"), []byte("f1"), []byte("v1")))
+	assert.Nil(t, db.LPush([]byte("l1"), []byte("v1")))
+	assert.Nil(t, db.Delete([]byte("k1")))
+
+	events := receiveEvents(t, sub, 5)
+	assert.Equal(t, String, events[0].DataType)
+	assert.Equal(t, ChangePut, events[0].Op)
+	assert.Equal(t, []byte("k1"), events[0].Key)
+	assert.Equal(t, []byte("v1"), events[0].Value)
+
+	assert.Equal(t, Hash, events[1].DataType)
+	assert.Equal(t, []byte("h1"), events[1].Key)
+	assert.Equal(t, []byte("f1"), events[1].Field)
+	assert.Equal(t, []byte("v1"), events[1].Value)
+
+	assert.Equal(t, List, events[2].DataType)
+	assert.Equal(t, ChangePut, events[2].Op)
+	assert.Equal(t, []byte("l1"), events[2].Key)
+	assert.Equal(t, List, events[3].DataType)
+	assert.Equal(t, ChangeListMeta, events[3].Op)
+
+	assert.Equal(t, ChangeDelete, events[4].Op)
+	assert.Equal(t, []byte("k1"), events[4].Key)
+	assert.Equal(t, events[0].Next, events[4].Pos)
+}
+
+func TestRoseDB_Subscribe_Filter(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	sub, err := db.Subscribe(ChangeFilter{DataTypes: []DataType{String}, KeyPrefix: []byte("user:")})
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	assert.Nil(t, db.Set([]byte("order:1"), []byte("v")))
+	assert.Nil(t, db.HSet([]byte("user:1"), []byte("f"), []byte("v")))
+	assert.Nil(t, db.Set([]byte("user:1"), []byte("v")))
+
+	events := receiveEvents(t, sub, 1)
+	assert.Equal(t, []byte("user:1"), events[0].Key)
+	assert.Equal(t, String, events[0].DataType)
+}
+
+func TestRoseDB_Subscribe_Resume(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+	}
+
+	// read all from the beginning.
+	sub, err := db.Subscribe(ChangeFilter{From: map[DataType]Position{String: {DataType: String}}})
+	assert.Nil(t, err)
+	events := receiveEvents(t, sub, 10)
+	assert.Equal(t, GetKey(9), events[9].Key)
+	last := events[4].Next
+	sub.Close()
+
+	// resume from the fifth event, and receive the new writes.
+	sub, err = db.Subscribe(ChangeFilter{From: map[DataType]Position{String: last}})
+	assert.Nil(t, err)
+	defer sub.Close()
+	assert.Nil(t, db.Set(GetKey(10), GetValue16B()))
+	events = receiveEvents(t, sub, 6)
+	assert.Equal(t, GetKey(5), events[0].Key)
+	assert.Equal(t, GetKey(10), events[5].Key)
+}
+
+func TestRoseDB_Subscribe_AfterEnd(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the positions after the end were taken from log files which no longer exist.
+	_, err = db.Subscribe(ChangeFilter{From: map[DataType]Position{String: {DataType: String, Offset: 10}}})
+	assert.Equal(t, ErrPositionCompacted, err)
+
+	assert.Nil(t, db.Set(GetKey(1), GetValue16B()))
+	end := db.endPositions()[String]
+	_, err = db.Subscribe(ChangeFilter{From: map[DataType]Position{String: {DataType: String, Fid: end.Fid + 1}}})
+	assert.Equal(t, ErrPositionCompacted, err)
+	_, err = db.Subscribe(ChangeFilter{From: map[DataType]Position{String: {DataType: String, Fid: end.Fid, Offset: end.Offset + 1}}})
+	assert.Equal(t, ErrPositionCompacted, err)
+
+	// the end itself is valid.
+	sub, err := db.Subscribe(ChangeFilter{From: map[DataType]Position{String: end}})
+	assert.Nil(t, err)
+	defer sub.Close()
+	assert.Nil(t, db.Set(GetKey(2), GetValue16B()))
+	events := receiveEvents(t, sub, 1)
+	assert.Equal(t, GetKey(2), events[0].Key)
+}
+
+func TestRoseDB_Subscribe_Reset(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	sub, err := db.Subscribe(ChangeFilter{From: map[DataType]Position{String: {DataType: String}}})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set(GetKey(1), GetValue16B()))
+	last := receiveEvents(t, sub, 1)[0].Next
+
+	assert.Nil(t, db.FlushAll())
+	for range sub.C {
+	}
+	assert.Equal(t, ErrDataReset, sub.Err())
+
+	// the positions before the reset are compacted, even after the writes go past them.
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+	}
+	_, err = db.Subscribe(ChangeFilter{From: map[DataType]Position{String: last}})
+	assert.Equal(t, ErrPositionCompacted, err)
+}
+
+func TestRoseDB_Subscribe_Committed(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	fs := vfs.NewFaultFS(vfs.OS)
+	opts := DefaultOptions(path)
+	opts.FS = fs
+	opts.Sync = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	sub, err := db.Subscribe(ChangeFilter{})
+	assert.Nil(t, err)
+	defer sub.Close()
+
+	// the change of a write which fails to sync is not published.
+	assert.Nil(t, db.Set(GetKey(1), GetValue16B()))
+	fs.Inject(vfs.FailSync, "")
+	assert.NotNil(t, db.Set(GetKey(2), GetValue16B()))
+	fs.Reset()
+	assert.Nil(t, db.Recover())
+	assert.Nil(t, db.Set(GetKey(3), GetValue16B()))
+
+	events := receiveEvents(t, sub, 2)
+	assert.Equal(t, GetKey(1), events[0].Key)
+	assert.Equal(t, GetKey(3), events[1].Key)
+
+	// the write is visible once its change is received.
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = db.Set(GetKey(100+i), GetValue16B())
+		}
+	}()
+	for _, ev := range receiveEvents(t, sub, 100) {
+		_, err := db.Get(ev.Key)
+		assert.Nil(t, err)
+	}
+}
+
+func TestRoseDB_Subscribe_Lagged(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	sub, err := db.Subscribe(ChangeFilter{BufferSize: 1})
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+	}
+	for range sub.C {
+	}
+	assert.Equal(t, ErrSubscriptionLagged, sub.Err())
+}
+
+func receiveEvents(t *testing.T, sub *Subscription, n int) []*ChangeEvent {
+	var events []*ChangeEvent
+	for len(events) < n {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				t.Fatalf("subscription closed: %v", sub.Err())
+			}
+			events = append(events, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("receive events timeout, got %d, want %d", len(events), n)
+		}
+	}
+	return events
+}
@@ -0,0 +1,102 @@
+package kv_engine
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/reid00/kv_engine/logfile"
+	"github.com/reid00/kv_engine/vfs"
+)
+
+// Checkpoint is the log files of a db at a point in time, it is created by RoseDB.Checkpoint.
+type Checkpoint struct {
+	files []checkpointFile
+}
+
+type checkpointFile struct {
+	name string
+	file vfs.File
+	size int64
+}
+
+// Checkpoint captures the log files of db and the size of their contents.
+// The files are opened rather than copied, so writes are blocked only for a short while,
+// and the files can still be read after being removed by gc.
+// The checkpoint must be closed after use. It is not supported by in-memory db.
+func (db *RoseDB) Checkpoint() (_ *Checkpoint, err error) {
+	if db.opts.InMemory {
+		return nil, ErrInMemory
+	}
+	// writes hold the locks of their keys only.
+	for i := String; i < logFileTypeNum; i++ {
+		kl := db.keyLocksOf(i)
+		kl.rlockAll()
+		defer kl.runlockAll()
+	}
+	// hold the lock to prevent log files from being deleted by gc.
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	cp := &Checkpoint{}
+	defer func() {
+		if err != nil {
+			_ = cp.Close()
+		}
+	}()
+	for dataType, active := range db.activeLogFiles {
+		for fid := range db.archivedLogFiles[dataType] {
+			if err = cp.add(db.opts.FS, db.opts.DBPath, dataType, fid, -1); err != nil {
+				return nil, err
+			}
+		}
+		// the active log file is preallocated, only its written part is captured.
+		if err = cp.add(db.opts.FS, db.opts.DBPath, dataType, active.Fid, atomic.LoadInt64(&active.WriteAt)); err != nil {
+			return nil, err
+		}
+	}
+	return cp, nil
+}
+
+// add opens the log file, size is the size of the file if negative.
+func (cp *Checkpoint) add(fs vfs.FS, dir string, dataType DataType, fid uint32, size int64) error {
+	name := logfile.FileNamesMap[logfile.FileType(dataType)] + fmt.Sprintf("%09d", fid)
+	file, err := vfs.Open(fs, filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		size = info.Size()
+	}
+	cp.files = append(cp.files, checkpointFile{name: name, file: file, size: size})
+	return nil
+}
+
+// ForEach calls fn with the name, size and content of every log file in the checkpoint,
+// the files written to a directory with their names can be restored or opened like a backup.
+func (cp *Checkpoint) ForEach(fn func(name string, size int64, r io.Reader) error) error {
+	for _, f := range cp.files {
+		if err := fn(f.name, f.size, io.NewSectionReader(f.file, 0, f.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the log files of the checkpoint.
+func (cp *Checkpoint) Close() error {
+	var err error
+	for _, f := range cp.files {
+		if e := f.file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	cp.files = nil
+	return err
+}
@@ -0,0 +1,62 @@
+package kv_engine
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoseDB_Checkpoint(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-checkpoint")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 64 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue128B()))
+	}
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("field"), []byte("value")))
+	expected, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+
+	cp, err := db.Checkpoint()
+	assert.Nil(t, err)
+	defer cp.Close()
+
+	// writes and gc are not blocked by the checkpoint, and do not change it.
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue128B()))
+	}
+	assert.Nil(t, db.Set([]byte("after-checkpoint"), GetValue16B()))
+	assert.Nil(t, db.RunLogFileGC(String, -1, 0))
+
+	backupPath := filepath.Join("/tmp", "kv_engine-checkpoint-backup")
+	defer os.RemoveAll(backupPath)
+	assert.Nil(t, os.MkdirAll(backupPath, os.ModePerm))
+	err = cp.ForEach(func(name string, size int64, r io.Reader) error {
+		file, err := os.Create(filepath.Join(backupPath, name))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n, err := io.Copy(file, r)
+		assert.Equal(t, size, n)
+		return err
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Restore(backupPath))
+	v, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, v)
+	v, err = db.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	_, err = db.Get([]byte("after-checkpoint"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
@@ -0,0 +1,282 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/reid00/kv_engine"
+)
+
+var (
+	// ErrNotLeader writes and linearizable reads must be sent to the leader.
+	ErrNotLeader = errors.New("cluster: node is not the leader")
+
+	// ErrReadTimeout the leader can't catch up with the commit index in time.
+	ErrReadTimeout = errors.New("cluster: timeout waiting for applied index")
+)
+
+const (
+	raftDBName        = "raft.db"
+	snapshotsRetained = 2
+	maxPoolSize       = 3
+	readPollInterval  = time.Millisecond
+)
+
+// ApplyFunc applies a committed command to the db, it is invoked on every node in the same order.
+// It must be deterministic, the result is returned to the caller of Node.Apply on the leader.
+// ctx carries the time the leader accepted the command, see kv_engine.WithTime, pass it to the db
+// so that expiration is evaluated the same on every node and when the log is replayed.
+type ApplyFunc func(ctx context.Context, db *kv_engine.RoseDB, args [][]byte) (interface{}, error)
+
+// Options of a cluster node.
+type Options struct {
+	// NodeID unique id of the node in cluster.
+	NodeID string
+
+	// RaftAddr address for raft communication between nodes.
+	RaftAddr string
+
+	// RaftDir directory for raft log and snapshots, will be created automatically if not exist.
+	RaftDir string
+
+	// Bootstrap start a new cluster with this node as the only voter.
+	// Only set it on the first node of a new cluster, other nodes join it by Node.Join on the leader.
+	Bootstrap bool
+
+	// Timeout of applying commands and membership changes.
+	// Default value is 10 seconds.
+	Timeout time.Duration
+
+	// SnapshotInterval and SnapshotThreshold control how often snapshots are taken, see raft.Config.
+	// Default values are the same as raft.DefaultConfig.
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+
+	// HeartbeatTimeout and ElectionTimeout, see raft.Config.
+	// Default values are the same as raft.DefaultConfig.
+	HeartbeatTimeout time.Duration
+	ElectionTimeout  time.Duration
+
+	// LogOutput where the raft logs are written, default value is os.Stderr.
+	LogOutput io.Writer
+}
+
+// Node is a member of a replicated cluster of RoseDB.
+// Writes go through the raft log and are applied to the db of every node.
+type Node struct {
+	raft      *raft.Raft
+	db        *kv_engine.RoseDB
+	fsm       *fsm
+	transport *raft.NetworkTransport
+	store     *raftboltdb.BoltStore
+	opts      Options
+}
+
+// Open starts a cluster node on the db, the db must not be written directly after that.
+func Open(db *kv_engine.RoseDB, opts Options, apply ApplyFunc) (*Node, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.LogOutput == nil {
+		opts.LogOutput = os.Stderr
+	}
+	if err := os.MkdirAll(opts.RaftDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(opts.NodeID)
+	config.LogOutput = opts.LogOutput
+	if opts.SnapshotInterval > 0 {
+		config.SnapshotInterval = opts.SnapshotInterval
+	}
+	if opts.SnapshotThreshold > 0 {
+		config.SnapshotThreshold = opts.SnapshotThreshold
+	}
+	if opts.HeartbeatTimeout > 0 {
+		config.HeartbeatTimeout = opts.HeartbeatTimeout
+		config.LeaderLeaseTimeout = opts.HeartbeatTimeout
+	}
+	if opts.ElectionTimeout > 0 {
+		config.ElectionTimeout = opts.ElectionTimeout
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", opts.RaftAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(opts.RaftAddr, addr, maxPoolSize, opts.Timeout, opts.LogOutput)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(opts.RaftDir, snapshotsRetained, opts.LogOutput)
+	if err != nil {
+		_ = transport.Close()
+		return nil, err
+	}
+	// the bolt store is used as both log store and stable store.
+	store, err := raftboltdb.NewBoltStore(filepath.Join(opts.RaftDir, raftDBName))
+	if err != nil {
+		_ = transport.Close()
+		return nil, err
+	}
+
+	hasState, err := raft.HasExistingState(store, store, snapshots)
+	if err != nil {
+		_ = store.Close()
+		_ = transport.Close()
+		return nil, err
+	}
+	if err := resetForReplay(db, snapshots, hasState); err != nil {
+		_ = store.Close()
+		_ = transport.Close()
+		return nil, err
+	}
+
+	f := &fsm{db: db, apply: apply, tmpDir: opts.RaftDir}
+	r, err := raft.NewRaft(config, f, store, store, snapshots, transport)
+	if err != nil {
+		_ = store.Close()
+		_ = transport.Close()
+		return nil, err
+	}
+
+	if opts.Bootstrap {
+		if !hasState {
+			cfg := raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: transport.LocalAddr()}}}
+			if err := r.BootstrapCluster(cfg).Error(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &Node{raft: r, db: db, fsm: f, transport: transport, store: store, opts: opts}, nil
+}
+
+// resetForReplay empties the db if raft will replay the whole log to it.
+// Raft applies the log again after restart, from the latest snapshot which is restored to the db first,
+// or from the start if there is no snapshot. In the latter case the db still has the commands applied
+// before, and commands like INCR and LPUSH would be applied twice.
+func resetForReplay(db *kv_engine.RoseDB, snapshots raft.SnapshotStore, hasState bool) error {
+	if !hasState {
+		return nil
+	}
+	metas, err := snapshots.List()
+	if err != nil {
+		return err
+	}
+	if len(metas) > 0 {
+		return nil
+	}
+	return db.FlushAll()
+}
+
+// DB returns the db of this node, it can be read directly(stale reads are possible on followers).
+func (n *Node) DB() *kv_engine.RoseDB {
+	return n.db
+}
+
+// Apply replicates the command through raft log, and returns the result of ApplyFunc once committed and applied.
+func (n *Node) Apply(args [][]byte) (interface{}, error) {
+	if n.raft.State() != raft.Leader {
+		return nil, ErrNotLeader
+	}
+	future := n.raft.Apply(encodeCommand(time.Now(), args), n.opts.Timeout)
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	res, _ := future.Response().(*applyResult)
+	if res == nil {
+		return nil, nil
+	}
+	return res.value, res.err
+}
+
+// ConsistentRead blocks until a read on the local db is linearizable.
+// It confirms the leadership with a quorum, and waits for the commands before it being applied.
+func (n *Node) ConsistentRead() error {
+	readIndex := n.raft.LastIndex()
+	if err := n.raft.VerifyLeader().Error(); err != nil {
+		return ErrNotLeader
+	}
+
+	deadline := time.Now().Add(n.opts.Timeout)
+	for n.raft.AppliedIndex() < readIndex {
+		if time.Now().After(deadline) {
+			return ErrReadTimeout
+		}
+		time.Sleep(readPollInterval)
+	}
+	return nil
+}
+
+// Join adds a voter to the cluster, it must be called on the leader.
+func (n *Node) Join(nodeID, raftAddr string) error {
+	if n.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	return n.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(raftAddr), 0, n.opts.Timeout).Error()
+}
+
+// Leave removes a node from the cluster, it must be called on the leader.
+func (n *Node) Leave(nodeID string) error {
+	if n.raft.State() != raft.Leader {
+		return ErrNotLeader
+	}
+	return n.raft.RemoveServer(raft.ServerID(nodeID), 0, n.opts.Timeout).Error()
+}
+
+// Snapshot takes a snapshot of the db now, raft log before it will be truncated.
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+// IsLeader whether this node is the leader now.
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the raft address and id of the current leader, empty if unknown.
+func (n *Node) Leader() (string, string) {
+	addr, id := n.raft.LeaderWithID()
+	return string(addr), string(id)
+}
+
+// Members returns the raft address of all nodes in the cluster keyed by node id.
+func (n *Node) Members() (map[string]string, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	members := make(map[string]string)
+	for _, server := range future.Configuration().Servers {
+		members[string(server.ID)] = string(server.Address)
+	}
+	return members, nil
+}
+
+// Stats returns the raft stats of this node.
+func (n *Node) Stats() map[string]string {
+	return n.raft.Stats()
+}
+
+// Close shuts down the node, the db is not closed.
+func (n *Node) Close() error {
+	if err := n.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := n.transport.Close(); err != nil {
+		return err
+	}
+	return n.store.Close()
+}
@@ -0,0 +1,277 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/reid00/kv_engine"
+	"github.com/stretchr/testify/assert"
+)
+
+func applySet(ctx context.Context, db *kv_engine.RoseDB, args [][]byte) (interface{}, error) {
+	if len(args) != 3 || string(args[0]) != "set" {
+		return nil, ErrInvalidCommand
+	}
+	return "OK", db.SetCtx(ctx, args[1], args[2])
+}
+
+func applyAppend(ctx context.Context, db *kv_engine.RoseDB, args [][]byte) (interface{}, error) {
+	if len(args) != 3 || string(args[0]) != "append" {
+		return nil, ErrInvalidCommand
+	}
+	return "OK", db.AppendCtx(ctx, args[1], args[2])
+}
+
+func openTestNode(t *testing.T, id int, bootstrap bool) *Node {
+	return openTestNodeWith(t, id, bootstrap, applySet)
+}
+
+func openTestNodeWith(t *testing.T, id int, bootstrap bool, apply ApplyFunc) *Node {
+	path := filepath.Join("/tmp", "rosedb-cluster", fmt.Sprintf("node-%d", id))
+	opts := kv_engine.DefaultOptions(filepath.Join(path, "db"))
+	opts.LogFileSizeThreshold = 1 << 20
+	db, err := kv_engine.Open(opts)
+	assert.Nil(t, err)
+
+	node, err := Open(db, Options{
+		NodeID:           fmt.Sprintf("node-%d", id),
+		RaftAddr:         fmt.Sprintf("127.0.0.1:%d", 17000+id),
+		RaftDir:          filepath.Join(path, "raft"),
+		Bootstrap:        bootstrap,
+		HeartbeatTimeout: 200 * time.Millisecond,
+		ElectionTimeout:  200 * time.Millisecond,
+		LogOutput:        io.Discard,
+	}, apply)
+	assert.Nil(t, err)
+	return node
+}
+
+func waitLeader(t *testing.T, nodes ...*Node) *Node {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func waitValue(t *testing.T, node *Node, key, value []byte) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if v, err := node.DB().Get(key); err == nil {
+			assert.Equal(t, value, v)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("key %s is not applied on %s", key, node.opts.NodeID)
+}
+
+func TestCluster(t *testing.T) {
+	defer os.RemoveAll(filepath.Join("/tmp", "rosedb-cluster"))
+
+	node1 := openTestNode(t, 1, true)
+	leader := waitLeader(t, node1)
+	assert.Equal(t, node1, leader)
+
+	_, err := leader.Apply([][]byte{[]byte("set"), []byte("k1"), []byte("v1")})
+	assert.Nil(t, err)
+	// snapshot before others join, they will be restored from it.
+	assert.Nil(t, leader.Snapshot())
+
+	node2 := openTestNode(t, 2, false)
+	node3 := openTestNode(t, 3, false)
+	_, err = node2.Apply([][]byte{[]byte("set"), []byte("k"), []byte("v")})
+	assert.Equal(t, ErrNotLeader, err)
+	assert.Nil(t, leader.Join("node-2", "127.0.0.1:17002"))
+	assert.Nil(t, leader.Join("node-3", "127.0.0.1:17003"))
+
+	res, err := leader.Apply([][]byte{[]byte("set"), []byte("k2"), []byte("v2")})
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", res)
+	_, err = leader.Apply([][]byte{[]byte("get"), []byte("k2")})
+	assert.Equal(t, ErrInvalidCommand, err)
+
+	for _, node := range []*Node{node2, node3} {
+		waitValue(t, node, []byte("k1"), []byte("v1"))
+		waitValue(t, node, []byte("k2"), []byte("v2"))
+	}
+	assert.Nil(t, leader.ConsistentRead())
+	assert.Equal(t, ErrNotLeader, node2.ConsistentRead())
+
+	members, err := leader.Members()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(members))
+
+	// the leader fails, a new one is elected from the others.
+	assert.Nil(t, node1.Close())
+	leader = waitLeader(t, node2, node3)
+	_, err = leader.Apply([][]byte{[]byte("set"), []byte("k3"), []byte("v3")})
+	assert.Nil(t, err)
+	assert.Nil(t, leader.ConsistentRead())
+	v, err := leader.DB().Get([]byte("k3"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), v)
+
+	assert.Nil(t, leader.Leave("node-1"))
+	members, err = leader.Members()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(members))
+
+	for _, node := range []*Node{node1, node2, node3} {
+		if node != node1 {
+			assert.Nil(t, node.Close())
+		}
+		assert.Nil(t, node.DB().Close())
+	}
+}
+
+func TestNode_Restart(t *testing.T) {
+	defer os.RemoveAll(filepath.Join("/tmp", "rosedb-cluster"))
+
+	appendValue := func(node *Node, value string) {
+		_, err := node.Apply([][]byte{[]byte("append"), []byte("k"), []byte(value)})
+		assert.Nil(t, err)
+	}
+	restart := func(node *Node) *Node {
+		assert.Nil(t, node.Close())
+		assert.Nil(t, node.DB().Close())
+		node = openTestNodeWith(t, 9, true, applyAppend)
+		waitLeader(t, node)
+		assert.Nil(t, node.ConsistentRead())
+		return node
+	}
+
+	node := openTestNodeWith(t, 9, true, applyAppend)
+	waitLeader(t, node)
+	appendValue(node, "a")
+	appendValue(node, "b")
+
+	// the whole log is replayed without a snapshot, the commands are not applied twice.
+	node = restart(node)
+	v, err := node.DB().Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ab"), v)
+
+	// the log after the snapshot is replayed on the snapshot.
+	assert.Nil(t, node.Snapshot())
+	appendValue(node, "c")
+	node = restart(node)
+	v, err = node.DB().Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), v)
+
+	assert.Nil(t, node.Close())
+	assert.Nil(t, node.DB().Close())
+}
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "buffer" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+func TestFSM_SnapshotAndRestore(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb-fsm")
+	defer os.RemoveAll(path)
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+
+	openDB := func(name string) *kv_engine.RoseDB {
+		opts := kv_engine.DefaultOptions(filepath.Join(path, name))
+		opts.LogFileSizeThreshold = 1 << 20
+		db, err := kv_engine.Open(opts)
+		assert.Nil(t, err)
+		return db
+	}
+	src, dst := openDB("src"), openDB("dst")
+	defer src.Close()
+	defer dst.Close()
+
+	assert.Nil(t, src.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, dst.Set([]byte("k2"), []byte("v2")))
+
+	f := &fsm{db: src, apply: applySet, tmpDir: path}
+	snapshot, err := f.Snapshot()
+	assert.Nil(t, err)
+	// the commands applied after the snapshot is taken are not persisted.
+	assert.Nil(t, src.Set([]byte("k3"), []byte("v3")))
+	sink := &bufferSink{}
+	assert.Nil(t, snapshot.Persist(sink))
+	snapshot.Release()
+
+	f = &fsm{db: dst, apply: applySet, tmpDir: path}
+	assert.Nil(t, f.Restore(io.NopCloser(&sink.Buffer)))
+	v, err := dst.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), v)
+	_, err = dst.Get([]byte("k2"))
+	assert.Equal(t, kv_engine.ErrKeyNotFound, err)
+	_, err = dst.Get([]byte("k3"))
+	assert.Equal(t, kv_engine.ErrKeyNotFound, err)
+}
+
+func TestFSM_ApplyAt(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb-fsm-apply")
+	defer os.RemoveAll(path)
+	db, err := kv_engine.Open(kv_engine.DefaultOptions(path))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	apply := func(ctx context.Context, db *kv_engine.RoseDB, args [][]byte) (interface{}, error) {
+		switch string(args[0]) {
+		case "setex":
+			return "OK", db.SetEXCtx(ctx, args[1], args[2], time.Second)
+		case "incr":
+			return db.IncrCtx(ctx, args[1])
+		}
+		return nil, ErrInvalidCommand
+	}
+	f := &fsm{db: db, apply: apply, tmpDir: path}
+	applyAt := func(at time.Time, args ...string) *applyResult {
+		cmd := make([][]byte, len(args))
+		for i, arg := range args {
+			cmd[i] = []byte(arg)
+		}
+		return f.Apply(&raft.Log{Data: encodeCommand(at, cmd)}).(*applyResult)
+	}
+
+	// the log is replayed long after the leader accepted the commands,
+	// the key must still be alive for the incr committed within its ttl.
+	at := time.Now().Add(-time.Hour)
+	assert.Nil(t, applyAt(at, "setex", "k", "10").err)
+	res := applyAt(at.Add(500*time.Millisecond), "incr", "k")
+	assert.Nil(t, res.err)
+	assert.Equal(t, int64(11), res.value)
+
+	assert.Nil(t, applyAt(at, "setex", "k", "10").err)
+	res = applyAt(at.Add(2*time.Second), "incr", "k")
+	assert.Nil(t, res.err)
+	assert.Equal(t, int64(1), res.value)
+}
+
+func TestCommandCodec(t *testing.T) {
+	args := [][]byte{[]byte("set"), {}, []byte("value")}
+	now := time.UnixMilli(time.Now().UnixMilli())
+	at, got, err := decodeCommand(encodeCommand(now, args))
+	assert.Nil(t, err)
+	assert.Equal(t, args, got)
+	assert.True(t, now.Equal(at))
+
+	buf := encodeCommand(now, args)
+	_, _, err = decodeCommand(buf[:len(buf)-1])
+	assert.Equal(t, ErrInvalidCommand, err)
+}
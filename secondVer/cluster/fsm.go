@@ -0,0 +1,179 @@
+package cluster
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/reid00/kv_engine"
+)
+
+var ErrInvalidCommand = errors.New("cluster: invalid command")
+
+type applyResult struct {
+	value interface{}
+	err   error
+}
+
+// fsm applies raft logs to the db, snapshots are checkpoints of the db, which are restored like backups.
+type fsm struct {
+	db     *kv_engine.RoseDB
+	apply  ApplyFunc
+	tmpDir string
+}
+
+// Apply applies a command with the time it was accepted by the leader, rather than the time of this node.
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	at, args, err := decodeCommand(l.Data)
+	if err != nil {
+		return &applyResult{err: err}
+	}
+	value, err := f.apply(kv_engine.WithTime(context.Background(), at), f.db, args)
+	return &applyResult{value: value, err: err}
+}
+
+// Snapshot captures a checkpoint of the db, Apply is never called concurrently with it,
+// so the checkpoint contains exactly the commands before the snapshot index.
+// It only opens the log files, they are copied by Persist in background.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	cp, err := f.db.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	return &fsmSnapshot{cp: cp}, nil
+}
+
+// Restore replaces all data of the db with the snapshot.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	dir, err := os.MkdirTemp(f.tmpDir, "restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := untarDir(rc, dir); err != nil {
+		return err
+	}
+	return f.db.Restore(dir)
+}
+
+type fsmSnapshot struct {
+	cp *kv_engine.Checkpoint
+}
+
+// Persist writes the log files of the checkpoint as a gzipped tar, log files are mostly zero padding and compress well.
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := tarCheckpoint(s.cp, sink); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {
+	_ = s.cp.Close()
+}
+
+func tarCheckpoint(cp *kv_engine.Checkpoint, w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	err := cp.ForEach(func(name string, size int64, r io.Reader) error {
+		header := &tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func untarDir(r io.Reader, dir string) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// only plain files in the top level directory are expected.
+		name := filepath.Base(header.Name)
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// format of command:
+// +------+-------+----------+-------+----------+-------+-----+
+// | time | count | arg size |  arg  | arg size |  arg  | ... |
+// +------+-------+----------+-------+----------+-------+-----+
+// time is the unix milliseconds of the leader as varint, count and arg size are uvarint.
+func encodeCommand(at time.Time, args [][]byte) []byte {
+	size := 2 * binary.MaxVarintLen64
+	for _, arg := range args {
+		size += binary.MaxVarintLen64 + len(arg)
+	}
+	buf := make([]byte, size)
+	index := binary.PutVarint(buf, at.UnixMilli())
+	index += binary.PutUvarint(buf[index:], uint64(len(args)))
+	for _, arg := range args {
+		index += binary.PutUvarint(buf[index:], uint64(len(arg)))
+		index += copy(buf[index:], arg)
+	}
+	return buf[:index]
+}
+
+func decodeCommand(buf []byte) (time.Time, [][]byte, error) {
+	at, n := binary.Varint(buf)
+	if n <= 0 {
+		return time.Time{}, nil, ErrInvalidCommand
+	}
+	index := n
+	count, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return time.Time{}, nil, ErrInvalidCommand
+	}
+	index += n
+	args := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(buf[index:])
+		if n <= 0 || uint64(len(buf)-index-n) < size {
+			return time.Time{}, nil, ErrInvalidCommand
+		}
+		index += n
+		args = append(args, buf[index:index+int(size)])
+		index += int(size)
+	}
+	return time.UnixMilli(at), args, nil
+}
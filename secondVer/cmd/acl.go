@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/reid00/kv_engine/util"
+)
+
+const defaultUser = "default"
+
+var (
+	errNoAuth    = errors.New("NOAUTH Authentication required.")
+	errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errNoPermKey = errors.New("NOPERM No permissions to access a key")
+	errNoPassSet = errors.New("ERR AUTH <password> called without any password configured for the default user")
+)
+
+// commandSpec describes a command for ACL, the keys of a command are args[firstKey:lastKey+1:keyStep],
+// lastKey is negative if the keys run to the last arg, and the command has no key if keyStep is zero.
+type commandSpec struct {
+	categories []string
+	firstKey   int
+	lastKey    int
+	keyStep    int
+}
+
+// commands of a single key, all keys and key value pairs.
+var (
+	oneKey   = commandSpec{firstKey: 0, lastKey: 0, keyStep: 1}
+	allKeys  = commandSpec{firstKey: 0, lastKey: -1, keyStep: 1}
+	keyPairs = commandSpec{firstKey: 0, lastKey: -1, keyStep: 2}
+)
+
+func (spec commandSpec) with(categories ...string) commandSpec {
+	spec.categories = categories
+	return spec
+}
+
+// commandSpecs are the specs of all supported commands, a command must be added here to be permitted by ACL.
+var commandSpecs = map[string]commandSpec{
+	// string commands
+	"set":    oneKey.with("write", "string"),
+	"setex":  oneKey.with("write", "string"),
+	"setnx":  oneKey.with("write", "string"),
+	"get":    oneKey.with("read", "string"),
+	"mget":   allKeys.with("read", "string"),
+	"getdel": oneKey.with("write", "string"),
+	"mset":   keyPairs.with("write", "string"),
+	"msetnx": keyPairs.with("write", "string"),
+	"append": oneKey.with("write", "string"),
+	"strlen": oneKey.with("read", "string"),
+	"incr":   oneKey.with("write", "string"),
+	"incrby": oneKey.with("write", "string"),
+	"decr":   oneKey.with("write", "string"),
+	"decrby": oneKey.with("write", "string"),
+
+	// list commands
+	"lpush":  oneKey.with("write", "list"),
+	"rpush":  oneKey.with("write", "list"),
+	"lpop":   oneKey.with("write", "list"),
+	"rpop":   oneKey.with("write", "list"),
+	"llen":   oneKey.with("read", "list"),
+	"lindex": oneKey.with("read", "list"),
+	"lrange": oneKey.with("read", "list"),
+
+	// hash commands
+	"hset":    oneKey.with("write", "hash"),
+	"hmset":   oneKey.with("write", "hash"),
+	"hsetnx":  oneKey.with("write", "hash"),
+	"hget":    oneKey.with("read", "hash"),
+	"hmget":   oneKey.with("read", "hash"),
+	"hdel":    oneKey.with("write", "hash"),
+	"hexists": oneKey.with("read", "hash"),
+	"hlen":    oneKey.with("read", "hash"),
+	"hkeys":   oneKey.with("read", "hash"),
+	"hvals":   oneKey.with("read", "hash"),
+	"hgetall": oneKey.with("read", "hash"),
+	"hstrlen": oneKey.with("read", "hash"),
+
+	// generic commands
+	"type":      oneKey.with("read", "keyspace"),
+	"exists":    allKeys.with("read", "keyspace"),
+	"del":       allKeys.with("write", "keyspace"),
+	"unlink":    allKeys.with("write", "keyspace"),
+	"keys":      {categories: []string{"read", "keyspace", "dangerous"}},
+	"scan":      {categories: []string{"read", "keyspace"}},
+	"expire":    oneKey.with("write", "keyspace"),
+	"pexpire":   oneKey.with("write", "keyspace"),
+	"expireat":  oneKey.with("write", "keyspace"),
+	"pexpireat": oneKey.with("write", "keyspace"),
+	"ttl":       oneKey.with("read", "keyspace"),
+	"pttl":      oneKey.with("read", "keyspace"),
+	"persist":   oneKey.with("write", "keyspace"),
+	"dbsize":    {categories: []string{"read", "keyspace"}},
+	"flushdb":   {categories: []string{"write", "keyspace", "dangerous"}},
+	"flushall":  {categories: []string{"write", "keyspace", "dangerous"}},
+
+	// connection management commands
+	"select": {categories: []string{"connection"}},
+	"ping":   {categories: []string{"connection"}},
+	"quit":   {categories: []string{"connection"}},
+	"auth":   {categories: []string{"connection"}},
+
+	// server management commands
+	"info":    {categories: []string{"admin", "dangerous"}},
+	"cluster": {categories: []string{"admin", "dangerous"}},
+	"acl":     {categories: []string{"admin", "dangerous"}},
+	"config":  {categories: []string{"admin", "dangerous"}},
+}
+
+// aclCategories are the command categories of ACL rules, besides all.
+var aclCategories = map[string]struct{}{
+	"read": {}, "write": {}, "string": {}, "list": {}, "hash": {}, "keyspace": {},
+	"connection": {}, "admin": {}, "dangerous": {},
+}
+
+// aclUser is a user of ACL, it is immutable once added to acl, changes are made on a copy.
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// sha256 of the passwords in hex.
+	passwords []string
+	// glob-style patterns of the keys accessible, see util.GlobMatch.
+	keys []string
+	// command rules in order, which start with +@all or -@all, e.g. -@all +@read -keys.
+	cmdRules []string
+	// the result of cmdRules, commands not in it are denied.
+	commands map[string]bool
+}
+
+// newACLUser returns a user like redis, which is disabled and permitted nothing.
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, cmdRules: []string{"-@all"}, commands: map[string]bool{}}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.keys = append([]string(nil), u.keys...)
+	c.cmdRules = append([]string(nil), u.cmdRules...)
+	return &c
+}
+
+// apply applies a rule of ACL SETUSER to the user:
+//
+//	on, off                    enable or disable the user
+//	>password, <password       add or remove a password
+//	#sha256, !sha256           add or remove a hashed password
+//	nopass, resetpass          allow any password, or remove all passwords and nopass
+//	~pattern, allkeys          allow the keys matching pattern, allkeys is ~*
+//	resetkeys                  remove all key patterns
+//	+command, -command         allow or deny a command
+//	+@category, -@category     allow or deny the commands of a category, or all commands by @all
+//	allcommands, nocommands    alias of +@all and -@all
+//	reset                      same as resetpass resetkeys off -@all
+func (u *aclUser) apply(rule string) error {
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass, u.passwords = true, nil
+	case lower == "resetpass":
+		u.nopass, u.passwords = false, nil
+	case lower == "allkeys":
+		u.keys = []string{"*"}
+	case lower == "resetkeys":
+		u.keys = nil
+	case lower == "allcommands":
+		return u.apply("+@all")
+	case lower == "nocommands":
+		return u.apply("-@all")
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "off", "-@all"} {
+			_ = u.apply(r)
+		}
+	case rule == "":
+		return errors.New("syntax error")
+	case rule[0] == '>' || rule[0] == '<':
+		return u.updatePassword(rule[0] == '>', hashPassword(rule[1:]))
+	case rule[0] == '#' || rule[0] == '!':
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return errors.New("the password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		return u.updatePassword(rule[0] == '#', hash)
+	case rule[0] == '~':
+		if rule == "~*" {
+			u.keys = []string{"*"}
+		} else {
+			u.keys = append(u.keys, rule[1:])
+		}
+	case rule[0] == '+' || rule[0] == '-':
+		if lower[1:] == "@all" {
+			u.cmdRules = []string{lower}
+		} else {
+			u.cmdRules = append(u.cmdRules, lower)
+		}
+		return u.compile()
+	default:
+		return errors.New("syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) updatePassword(add bool, hash string) error {
+	for i, h := range u.passwords {
+		if h == hash {
+			if !add {
+				u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			}
+			return nil
+		}
+	}
+	if !add {
+		return errors.New("no such password")
+	}
+	u.passwords = append(u.passwords, hash)
+	u.nopass = false
+	return nil
+}
+
+// compile computes the commands permitted by cmdRules.
+func (u *aclUser) compile() error {
+	commands := make(map[string]bool)
+	for _, rule := range u.cmdRules {
+		allow, name := rule[0] == '+', rule[1:]
+		if !strings.HasPrefix(name, "@") {
+			if _, ok := commandSpecs[name]; !ok {
+				return errors.New("unknown command '" + name + "'")
+			}
+			commands[name] = allow
+			continue
+		}
+
+		category := name[1:]
+		if _, ok := aclCategories[category]; !ok && category != "all" {
+			return errors.New("unknown command category '" + category + "'")
+		}
+		for command, spec := range commandSpecs {
+			if category == "all" || spec.in(category) {
+				commands[command] = allow
+			}
+		}
+	}
+	u.commands = commands
+	return nil
+}
+
+func (spec commandSpec) in(category string) bool {
+	for _, c := range spec.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, h := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKeys returns errNoPermKey if any key of the command is not accessible by the user.
+func (u *aclUser) checkKeys(spec commandSpec, args [][]byte) error {
+	if spec.keyStep == 0 || (len(u.keys) == 1 && u.keys[0] == "*") {
+		return nil
+	}
+	last := spec.lastKey
+	if last < 0 || last >= len(args) {
+		last = len(args) - 1
+	}
+	for i := spec.firstKey; i <= last; i += spec.keyStep {
+		var ok bool
+		for _, pattern := range u.keys {
+			if ok = util.GlobMatch([]byte(pattern), args[i]); ok {
+				break
+			}
+		}
+		if !ok {
+			return errNoPermKey
+		}
+	}
+	return nil
+}
+
+// String returns the user in the format of ACL LIST, which is also a line of the acl file.
+func (u *aclUser) String() string {
+	rules := []string{"user", u.name}
+	if u.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range u.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	for _, pattern := range u.keys {
+		rules = append(rules, "~"+pattern)
+	}
+	rules = append(rules, u.cmdRules...)
+	return strings.Join(rules, " ")
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// acl is the access control of the server, users are persisted to the acl file after every change.
+type acl struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*aclUser
+}
+
+// newACL loads the users from the acl file at path, the default user permitting everything is created if not exists.
+// The password of the default user is set to requirepass if it is not empty.
+func newACL(path, requirepass string) (*acl, error) {
+	a := &acl{path: path, users: make(map[string]*aclUser)}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if _, ok := a.users[defaultUser]; !ok {
+		user := newACLUser(defaultUser)
+		for _, rule := range []string{"on", "nopass", "allkeys", "allcommands"} {
+			_ = user.apply(rule)
+		}
+		a.users[defaultUser] = user
+	}
+	if requirepass != "" {
+		user := a.users[defaultUser].clone()
+		_ = user.apply("resetpass")
+		_ = user.apply(">" + requirepass)
+		a.users[defaultUser] = user
+	}
+	return a, nil
+}
+
+func (a *acl) load() error {
+	buf, err := os.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return fmt.Errorf("invalid acl file %s, line %d: it must start with 'user <name>'", a.path, line)
+		}
+		user := newACLUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := user.apply(rule); err != nil {
+				return fmt.Errorf("invalid acl file %s, line %d: '%s' %v", a.path, line, rule, err)
+			}
+		}
+		a.users[user.name] = user
+	}
+	return scanner.Err()
+}
+
+// save writes all users to the acl file, a.mu must be held.
+func (a *acl) save() error {
+	var buf bytes.Buffer
+	for _, line := range a.listLocked() {
+		buf.WriteString(line + "\n")
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// initialUser returns the user a new connection is authenticated as, which is the default user
+// if it is enabled and has no password, empty otherwise.
+func (a *acl) initialUser() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if user := a.users[defaultUser]; user.enabled && user.nopass {
+		return defaultUser
+	}
+	return ""
+}
+
+func (a *acl) authenticate(name, password string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	user, ok := a.users[name]
+	return ok && user.enabled && user.checkPassword(password)
+}
+
+// check returns an error if the user of a connection is not permitted to run the command with args,
+// auth and quit are always permitted. A user deleted or disabled after authentication is unauthenticated.
+func (a *acl) check(name, command string, args [][]byte) error {
+	if command == "auth" || command == "quit" {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	user, ok := a.users[name]
+	if !ok || !user.enabled {
+		return errNoAuth
+	}
+	if !user.commands[command] {
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", name, command)
+	}
+	return user.checkKeys(commandSpecs[command], args)
+}
+
+// setUser creates or modifies the user by rules, nothing is changed if any rule is invalid.
+func (a *acl) setUser(name string, rules []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	user := newACLUser(name)
+	if old, ok := a.users[name]; ok {
+		user = old.clone()
+	}
+	for _, rule := range rules {
+		if err := user.apply(rule); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %v", rule, err)
+		}
+	}
+	old := a.users[name]
+	a.users[name] = user
+	if err := a.save(); err != nil {
+		if old != nil {
+			a.users[name] = old
+		} else {
+			delete(a.users, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// delUsers deletes the users and returns the number of users deleted, the default user can not be deleted.
+func (a *acl) delUsers(names []string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, name := range names {
+		if name == defaultUser {
+			return 0, errors.New("ERR The 'default' user cannot be removed")
+		}
+	}
+	deleted := make(map[string]*aclUser)
+	for _, name := range names {
+		if user, ok := a.users[name]; ok {
+			deleted[name] = user
+			delete(a.users, name)
+		}
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	if err := a.save(); err != nil {
+		for name, user := range deleted {
+			a.users[name] = user
+		}
+		return 0, err
+	}
+	return len(deleted), nil
+}
+
+func (a *acl) list() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.listLocked()
+}
+
+func (a *acl) listLocked() []string {
+	lines := make([]string, 0, len(a.users))
+	for _, user := range a.users {
+		lines = append(lines, user.String())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (a *acl) userNames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
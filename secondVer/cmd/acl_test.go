@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestACL(t *testing.T, requirepass string) *acl {
+	a, err := newACL(filepath.Join(t.TempDir(), "users.acl"), requirepass)
+	assert.Nil(t, err)
+	return a
+}
+
+func TestACLUser_Apply(t *testing.T) {
+	user := newACLUser("alice")
+	assert.False(t, user.enabled)
+	assert.False(t, user.checkPassword(""))
+
+	for _, rule := range []string{"on", ">pass1", ">pass2", "~user:*", "+@read", "-keys", "+set"} {
+		assert.Nil(t, user.apply(rule), rule)
+	}
+	assert.True(t, user.enabled)
+	assert.True(t, user.checkPassword("pass1"))
+	assert.True(t, user.checkPassword("pass2"))
+	assert.False(t, user.checkPassword("pass3"))
+	assert.Equal(t, []string{"user:*"}, user.keys)
+	assert.True(t, user.commands["get"])
+	assert.True(t, user.commands["hgetall"])
+	assert.True(t, user.commands["set"])
+	assert.False(t, user.commands["keys"])
+	assert.False(t, user.commands["del"])
+
+	// passwords are removed by <pass, and nopass allows any password.
+	assert.Nil(t, user.apply("<pass1"))
+	assert.False(t, user.checkPassword("pass1"))
+	assert.NotNil(t, user.apply("<pass1"))
+	assert.Nil(t, user.apply("nopass"))
+	assert.True(t, user.checkPassword("anything"))
+	assert.Nil(t, user.apply(">pass3"))
+	assert.False(t, user.nopass)
+	assert.False(t, user.checkPassword("anything"))
+
+	// +@all resets the command rules before it.
+	assert.Nil(t, user.apply("+@all"))
+	assert.Nil(t, user.apply("-@dangerous"))
+	assert.Equal(t, []string{"+@all", "-@dangerous"}, user.cmdRules)
+	assert.True(t, user.commands["del"])
+	assert.False(t, user.commands["flushall"])
+
+	assert.Nil(t, user.apply("off"))
+	assert.False(t, user.enabled)
+	assert.Nil(t, user.apply("reset"))
+	assert.Equal(t, "user alice off -@all", user.String())
+
+	for _, rule := range []string{"", "unknown", "+nocommand", "+@nocategory", "#1234"} {
+		assert.NotNil(t, user.apply(rule), rule)
+	}
+}
+
+func TestACL_Check(t *testing.T) {
+	a := newTestACL(t, "")
+	assert.Nil(t, a.setUser("reader", []string{"on", ">pass", "~user:*", "~shared", "+@read"}))
+
+	// commands outside the categories are denied.
+	assert.Nil(t, a.check("reader", "get", [][]byte{[]byte("user:1")}))
+	assert.NotNil(t, a.check("reader", "set", [][]byte{[]byte("user:1"), []byte("v")}))
+	assert.NotNil(t, a.check("reader", "flushall", nil))
+	assert.NotNil(t, a.check("reader", "acl", [][]byte{[]byte("list")}))
+
+	// keys outside the patterns are denied, every key of a command is checked.
+	assert.Equal(t, errNoPermKey, a.check("reader", "get", [][]byte{[]byte("admin:1")}))
+	assert.Nil(t, a.check("reader", "mget", [][]byte{[]byte("user:1"), []byte("shared")}))
+	assert.Equal(t, errNoPermKey, a.check("reader", "mget", [][]byte{[]byte("user:1"), []byte("admin:1")}))
+	assert.Nil(t, a.check("reader", "hget", [][]byte{[]byte("user:1"), []byte("admin:1")}))
+	assert.Nil(t, a.setUser("writer", []string{"on", "nopass", "~user:*", "+mset"}))
+	assert.Nil(t, a.check("writer", "mset", [][]byte{[]byte("user:1"), []byte("admin:1")}))
+	assert.Equal(t, errNoPermKey, a.check("writer", "mset", [][]byte{[]byte("admin:1"), []byte("v")}))
+
+	// auth and quit are always permitted, unknown and disabled users are not authenticated.
+	assert.Nil(t, a.check("", "auth", nil))
+	assert.Equal(t, errNoAuth, a.check("", "get", [][]byte{[]byte("user:1")}))
+	assert.Nil(t, a.setUser("reader", []string{"off"}))
+	assert.Equal(t, errNoAuth, a.check("reader", "get", [][]byte{[]byte("user:1")}))
+	assert.Nil(t, a.check(defaultUser, "flushall", nil))
+}
+
+func TestAuth(t *testing.T) {
+	svr := &Server{acl: newTestACL(t, "secret")}
+	cli := &Client{svr: svr, user: svr.acl.initialUser()}
+	assert.Equal(t, "", cli.user)
+	assert.Nil(t, svr.acl.setUser("alice", []string{"on", ">pass", "+@all"}))
+	assert.Nil(t, svr.acl.setUser("bob", []string{"off", ">pass", "+@all"}))
+
+	_, err := auth(cli, [][]byte{[]byte("wrong")})
+	assert.Equal(t, errWrongPass, err)
+	_, err = auth(cli, [][]byte{[]byte("alice"), []byte("wrong")})
+	assert.Equal(t, errWrongPass, err)
+	_, err = auth(cli, [][]byte{[]byte("bob"), []byte("pass")})
+	assert.Equal(t, errWrongPass, err)
+	_, err = auth(cli, [][]byte{[]byte("nobody"), []byte("pass")})
+	assert.Equal(t, errWrongPass, err)
+	assert.Equal(t, "", cli.user)
+
+	_, err = auth(cli, [][]byte{[]byte("secret")})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultUser, cli.user)
+	_, err = auth(cli, [][]byte{[]byte("alice"), []byte("pass")})
+	assert.Nil(t, err)
+	assert.Equal(t, "alice", cli.user)
+
+	// auth with only a password fails if the default user needs no password.
+	svr = &Server{acl: newTestACL(t, "")}
+	_, err = auth(&Client{svr: svr, user: svr.acl.initialUser()}, [][]byte{[]byte("pass")})
+	assert.Equal(t, errNoPassSet, err)
+}
+
+func TestACL_File(t *testing.T) {
+	a := newTestACL(t, "")
+	assert.Nil(t, a.setUser("alice", []string{"on", ">pass", "~user:*", "+@read", "-keys"}))
+	assert.Nil(t, a.setUser("bob", []string{"off", "nopass", "+get"}))
+	assert.Nil(t, a.setUser("carol", []string{"on"}))
+	n, err := a.delUsers([]string{"carol", "nobody"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	info, err := os.Stat(a.path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := newACL(a.path, "")
+	assert.Nil(t, err)
+	assert.Equal(t, a.list(), loaded.list())
+	assert.Equal(t, []string{"alice", "bob", defaultUser}, loaded.userNames())
+	assert.True(t, loaded.authenticate("alice", "pass"))
+	assert.False(t, loaded.authenticate("alice", "wrong"))
+	assert.False(t, loaded.authenticate("bob", ""))
+	assert.NotNil(t, loaded.check("alice", "keys", nil))
+
+	// the default user can not be deleted, and nothing is deleted along with it.
+	_, err = a.delUsers([]string{"alice", defaultUser})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"alice", "bob", defaultUser}, a.userNames())
+
+	// invalid lines are rejected.
+	for _, content := range []string{"alice on\n", "user alice unknown\n"} {
+		path := filepath.Join(t.TempDir(), "users.acl")
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+		_, err := newACL(path, "")
+		assert.NotNil(t, err, content)
+	}
+}
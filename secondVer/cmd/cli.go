@@ -1,17 +1,53 @@
 package main
 
 import (
+	"context"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/reid00/kv_engine"
+	"github.com/reid00/kv_engine/cluster"
 	"github.com/tidwall/redcon"
 )
 
 type cmdHandler func(cli *Client, args [][]byte) (any, error)
 
+// maxScanCursors is the max number of scan cursors kept by a connection, the oldest one is dropped beyond it.
+const maxScanCursors = 64
+
 type Client struct {
 	svr *Server
 	db  *kv_engine.RoseDB
+	// the ACL user authenticated as, empty if not authenticated.
+	user string
+	// scan cursors of the connection, which map the cursor ids to the last keys returned.
+	cursors    map[uint64][]byte
+	lastCursor uint64
+	// ctx the commands run with, which carries the time of the commands applied from raft log, nil for the current time.
+	ctx context.Context
+}
+
+// context returns the context the commands of the client run with.
+func (cli *Client) context() context.Context {
+	if cli.ctx == nil {
+		return context.Background()
+	}
+	return cli.ctx
+}
+
+// saveCursor saves the last key returned by a scan, and returns the id of the new cursor.
+func (cli *Client) saveCursor(key []byte) uint64 {
+	if cli.cursors == nil {
+		cli.cursors = make(map[uint64][]byte)
+	}
+	cli.lastCursor++
+	cli.cursors[cli.lastCursor] = key
+	if cli.lastCursor > maxScanCursors {
+		delete(cli.cursors, cli.lastCursor-maxScanCursors)
+	}
+	return cli.lastCursor
 }
 
 func execClientCommand(conn redcon.Conn, cmd redcon.Command) {
@@ -25,13 +61,22 @@ func execClientCommand(conn redcon.Conn, cmd redcon.Command) {
 
 	if cli == nil {
 		conn.WriteError(errClientIsNil.Error())
+		return
+	}
+
+	if err := cli.svr.acl.check(cli.user, command, cmd.Args[1:]); err != nil {
+		conn.WriteError(err.Error())
+		return
 	}
 
 	switch command {
 	case "quit":
 		_ = conn.Close()
 	default:
-		if res, err := cmdFunc(cli, cmd.Args[1:]); err != nil {
+		start := time.Now()
+		res, err := cli.exec(command, cmdFunc, cmd.Args)
+		cli.svr.metrics.observeCommand(command, start, err)
+		if err != nil {
 			if err == kv_engine.ErrKeyNotFound {
 				conn.WriteNull()
 			} else {
@@ -44,19 +89,205 @@ func execClientCommand(conn redcon.Conn, cmd redcon.Command) {
 
 }
 
+// exec runs the command on the local db, or through raft log in cluster mode.
+func (cli *Client) exec(command string, cmdFunc cmdHandler, args [][]byte) (interface{}, error) {
+	node := cli.svr.node
+	if node == nil || cli.db != node.DB() {
+		return cmdFunc(cli, args[1:])
+	}
+	if _, ok := localCommands[command]; ok {
+		return cmdFunc(cli, args[1:])
+	}
+	if _, ok := writeCommands[command]; ok {
+		res, err := node.Apply(absoluteExpire(command, args, time.Now()))
+		if err == cluster.ErrNotLeader {
+			return nil, newNotLeaderError(node)
+		}
+		return res, err
+	}
+	// reads are linearizable, they are served by the leader only.
+	if err := node.ConsistentRead(); err != nil {
+		if err == cluster.ErrNotLeader {
+			return nil, newNotLeaderError(node)
+		}
+		return nil, err
+	}
+	return cmdFunc(cli, args[1:])
+}
+
+// applyCommand applies a command committed by raft to the db of database 0, with the time of the leader carried by ctx.
+func (svr *Server) applyCommand(ctx context.Context, db *kv_engine.RoseDB, args [][]byte) (interface{}, error) {
+	cmdFunc, ok := supportedCommands[strings.ToLower(string(args[0]))]
+	if !ok || cmdFunc == nil {
+		return nil, errSyntax
+	}
+	return cmdFunc(&Client{svr: svr, db: db, ctx: ctx}, args[1:])
+}
+
+// absoluteExpire rewrites the relative timeouts of a write command to absolute ones based on now.
+// Commands in raft log are applied by every node at different times, and again when the log is replayed,
+// so their timeouts must not depend on the time of applying. Invalid timeouts are left to the command to report.
+func absoluteExpire(command string, args [][]byte, now time.Time) [][]byte {
+	switch command {
+	case "setex":
+		// setex key seconds value => set key value pxat ms
+		if len(args) == 4 {
+			if at, ok := expireAtArg(args[2], time.Second, now); ok {
+				return [][]byte{[]byte("set"), args[1], args[3], []byte("pxat"), at}
+			}
+		}
+	case "set":
+		// set key value [ex seconds | px milliseconds] => set key value [pxat ms]
+		for i := 3; i+1 < len(args); i++ {
+			unit := time.Second
+			switch strings.ToLower(string(args[i])) {
+			case "px":
+				unit = time.Millisecond
+			case "ex":
+			default:
+				continue
+			}
+			if at, ok := expireAtArg(args[i+1], unit, now); ok {
+				res := append([][]byte{}, args...)
+				res[i], res[i+1] = []byte("pxat"), at
+				return res
+			}
+			break
+		}
+	case "expire", "pexpire":
+		// expire key seconds, pexpire key ms => pexpireat key ms
+		unit := time.Second
+		if command == "pexpire" {
+			unit = time.Millisecond
+		}
+		if len(args) == 3 {
+			if at, ok := expireAtArg(args[2], unit, now); ok {
+				return [][]byte{[]byte("pexpireat"), args[1], at}
+			}
+		}
+	}
+	return args
+}
+
+// expireAtArg returns the unix time in milliseconds after the positive timeout in unit from now.
+func expireAtArg(arg []byte, unit time.Duration, now time.Time) ([]byte, bool) {
+	ttl, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || ttl <= 0 || ttl > int64(math.MaxInt64/unit) {
+		return nil, false
+	}
+	return []byte(strconv.FormatInt(now.Add(time.Duration(ttl)*unit).UnixMilli(), 10)), true
+}
+
+// writeCommands are replicated through raft log in cluster mode.
+var writeCommands = map[string]struct{}{
+	"set":       {},
+	"setex":     {},
+	"setnx":     {},
+	"mset":      {},
+	"msetnx":    {},
+	"getdel":    {},
+	"append":    {},
+	"incr":      {},
+	"incrby":    {},
+	"decr":      {},
+	"decrby":    {},
+	"lpush":     {},
+	"rpush":     {},
+	"lpop":      {},
+	"rpop":      {},
+	"hset":      {},
+	"hmset":     {},
+	"hsetnx":    {},
+	"hdel":      {},
+	"del":       {},
+	"unlink":    {},
+	"expire":    {},
+	"pexpire":   {},
+	"expireat":  {},
+	"pexpireat": {},
+	"persist":   {},
+	"flushdb":   {},
+	"flushall":  {},
+}
+
+// localCommands never touch data, they are executed by the local node directly in cluster mode.
+var localCommands = map[string]struct{}{
+	"select":  {},
+	"ping":    {},
+	"auth":    {},
+	"info":    {},
+	"cluster": {},
+	"acl":     {},
+	"config":  {},
+}
+
 var supportedCommands = map[string]cmdHandler{
 	// string commands
-	"set": set,
+	"set":    set,
+	"setex":  setEX,
+	"setnx":  setNX,
+	"get":    get,
+	"mget":   mGet,
+	"getdel": getDel,
+	"mset":   mSet,
+	"msetnx": mSetNX,
+	"append": appendCmd,
+	"strlen": strLen,
+	"incr":   incr,
+	"incrby": incrBy,
+	"decr":   decr,
+	"decrby": decrBy,
+
+	// list commands
+	"lpush":  lPush,
+	"rpush":  rPush,
+	"lpop":   lPop,
+	"rpop":   rPop,
+	"llen":   lLen,
+	"lindex": lIndex,
+	"lrange": lRange,
+
+	// hash commands
+	"hset":    hSet,
+	"hmset":   hmSet,
+	"hsetnx":  hSetNX,
+	"hget":    hGet,
+	"hmget":   hmGet,
+	"hdel":    hDel,
+	"hexists": hExists,
+	"hlen":    hLen,
+	"hkeys":   hKeys,
+	"hvals":   hVals,
+	"hgetall": hGetAll,
+	"hstrlen": hStrLen,
 
 	// generic commands
-	"type": keyType,
-	"del":  del,
+	"type":      keyType,
+	"exists":    exists,
+	"del":       del,
+	"unlink":    del,
+	"keys":      keys,
+	"scan":      scan,
+	"expire":    expire,
+	"pexpire":   pExpire,
+	"expireat":  expireAt,
+	"pexpireat": pExpireAt,
+	"ttl":       ttl,
+	"pttl":      pTTL,
+	"persist":   persist,
+	"dbsize":    dbSize,
+	"flushdb":   flushDB,
+	"flushall":  flushAll,
 
 	// connection management commands
 	"select": selectDB,
 	"ping":   ping,
 	"quit":   nil,
+	"auth":   auth,
 
 	// server management commands
-	"info": info,
+	"info":    info,
+	"cluster": clusterCmd,
+	"acl":     aclCmd,
+	"config":  configCmd,
 }
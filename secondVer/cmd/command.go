@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/reid00/kv_engine"
+	"github.com/reid00/kv_engine/cluster"
 	"github.com/tidwall/redcon"
 )
 
@@ -21,18 +24,94 @@ var (
 	errSyntax            = errors.New("ERR syntax error")
 	errValueIsInvalid    = errors.New("ERR value is not an integer or out of range")
 	errDBIndexOutOfRange = errors.New("ERR DB index is out of range")
+	errOnlyDB0Replicated = errors.New("ERR only database 0 is available on a replica or cluster node")
+	errNotClusterMode    = errors.New("ERR this instance has cluster support disabled")
+	errIntegerOverflow   = errors.New("ERR increment or decrement would overflow")
+	errInvalidCursor     = errors.New("ERR invalid cursor")
 )
 
+// dataTypesByName are the data types of the names in dataTypeNames, for TYPE option of scan command.
+var dataTypesByName = map[string]kv_engine.DataType{
+	"string": kv_engine.String,
+	"list":   kv_engine.List,
+	"hash":   kv_engine.Hash,
+	"set":    kv_engine.Set,
+	"zset":   kv_engine.ZSet,
+}
+
+func newInvalidExpireError(cmd string) error {
+	return fmt.Errorf("ERR invalid expire time in '%s' command", cmd)
+}
+
 func newWrongNumOfArgsError(cmd string) error {
 	return fmt.Errorf("ERR wrong number of arguments for '%s' command", cmd)
 }
 
+func newNotLeaderError(node *cluster.Node) error {
+	addr, id := node.Leader()
+	return fmt.Errorf("ERR not leader, leader is %s(%s)", id, addr)
+}
+
 // +-------+--------+----------+------------+-----------+-------+---------+
 // |---------------------- server management commands --------------------|
 // +-------+--------+----------+------------+-----------+-------+---------+
+// info [section [section ...]]
 func info(cli *Client, args [][]byte) (interface{}, error) {
-	// todo
-	return "info", nil
+	sections := make([]string, len(args))
+	for i, arg := range args {
+		sections[i] = string(arg)
+	}
+	return cli.svr.info(sections), nil
+}
+
+// cluster join <node id> <raft addr> | cluster leave <node id> | cluster nodes | cluster leader | cluster snapshot
+func clusterCmd(cli *Client, args [][]byte) (interface{}, error) {
+	node := cli.svr.node
+	if node == nil {
+		return nil, errNotClusterMode
+	}
+	if len(args) < 1 {
+		return nil, newWrongNumOfArgsError("cluster")
+	}
+
+	var err error
+	switch strings.ToLower(string(args[0])) {
+	case "join":
+		if len(args) != 3 {
+			return nil, newWrongNumOfArgsError("cluster|join")
+		}
+		err = node.Join(string(args[1]), string(args[2]))
+	case "leave":
+		if len(args) != 2 {
+			return nil, newWrongNumOfArgsError("cluster|leave")
+		}
+		err = node.Leave(string(args[1]))
+	case "snapshot":
+		err = node.Snapshot()
+	case "leader":
+		addr, id := node.Leader()
+		return []string{id, addr}, nil
+	case "nodes":
+		members, err := node.Members()
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		for id, addr := range members {
+			res = append(res, id+" "+addr)
+		}
+		return res, nil
+	default:
+		return nil, errSyntax
+	}
+
+	if err == cluster.ErrNotLeader {
+		return nil, newNotLeaderError(node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString(resultOK), nil
 }
 
 // +-------+--------+----------+------------+-----------+-------+---------+
@@ -53,11 +132,14 @@ func selectDB(cli *Client, args [][]byte) (interface{}, error) {
 	if n < 0 || uint(n) >= cli.svr.opts.databases {
 		return nil, errDBIndexOutOfRange
 	}
+	if n != 0 && (cli.svr.opts.replicaOf != "" || cli.svr.node != nil) {
+		return nil, errOnlyDB0Replicated
+	}
 
 	db := cli.svr.dbs[n]
 	if db == nil {
 		path := filepath.Join(cli.svr.opts.dbPath, fmt.Sprintf(dbName, n))
-		opts := kv_engine.DefaultOptions(path)
+		opts := cli.svr.config.dbOptions(n, path)
 		newdb, err := kv_engine.Open(opts)
 		if err != nil {
 			return nil, err
@@ -69,6 +151,109 @@ func selectDB(cli *Client, args [][]byte) (interface{}, error) {
 	return resultOK, nil
 }
 
+// auth [username] password, username is default if not given.
+func auth(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, newWrongNumOfArgsError("auth")
+	}
+	name, password := defaultUser, string(args[0])
+	if len(args) == 2 {
+		name, password = string(args[0]), string(args[1])
+	} else if cli.svr.acl.initialUser() == defaultUser {
+		return nil, errNoPassSet
+	}
+	if !cli.svr.acl.authenticate(name, password) {
+		return nil, errWrongPass
+	}
+	cli.user = name
+	return redcon.SimpleString(resultOK), nil
+}
+
+// acl setuser username [rule ...] | acl deluser username [username ...] | acl list | acl users | acl whoami
+func aclCmd(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 1 {
+		return nil, newWrongNumOfArgsError("acl")
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "setuser":
+		if len(args) < 2 {
+			return nil, newWrongNumOfArgsError("acl|setuser")
+		}
+		rules := make([]string, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			rules = append(rules, string(arg))
+		}
+		if err := cli.svr.acl.setUser(string(args[1]), rules); err != nil {
+			return nil, err
+		}
+		return redcon.SimpleString(resultOK), nil
+	case "deluser":
+		if len(args) < 2 {
+			return nil, newWrongNumOfArgsError("acl|deluser")
+		}
+		names := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			names = append(names, string(arg))
+		}
+		n, err := cli.svr.acl.delUsers(names)
+		if err != nil {
+			return nil, err
+		}
+		return redcon.SimpleInt(n), nil
+	case "list":
+		return cli.svr.acl.list(), nil
+	case "users":
+		return cli.svr.acl.userNames(), nil
+	case "whoami":
+		return cli.user, nil
+	default:
+		return nil, errSyntax
+	}
+}
+
+// config get pattern [pattern ...] | config set param value [param value ...] | config rewrite
+func configCmd(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 1 {
+		return nil, newWrongNumOfArgsError("config")
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "get":
+		if len(args) < 2 {
+			return nil, newWrongNumOfArgsError("config|get")
+		}
+		patterns := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			patterns = append(patterns, string(arg))
+		}
+		return cli.svr.config.get(patterns), nil
+	case "set":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return nil, newWrongNumOfArgsError("config|set")
+		}
+		params := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			params = append(params, string(arg))
+		}
+		if err := cli.svr.setConfig(params); err != nil {
+			return nil, err
+		}
+		return redcon.SimpleString(resultOK), nil
+	case "rewrite":
+		if len(args) != 1 {
+			return nil, newWrongNumOfArgsError("config|rewrite")
+		}
+		if err := cli.svr.config.rewrite(); err != nil {
+			if err == errNoConfigFile {
+				return nil, err
+			}
+			return nil, fmt.Errorf("ERR Rewriting config file: %v", err)
+		}
+		return redcon.SimpleString(resultOK), nil
+	default:
+		return nil, errSyntax
+	}
+}
+
 func ping(cl *Client, args [][]byte) (any, error) {
 	if len(args) > 1 {
 		return nil, newWrongNumOfArgsError("ping")
@@ -83,55 +268,794 @@ func ping(cl *Client, args [][]byte) (any, error) {
 // +-------+--------+----------+------------+-----------+-------+---------+
 // |-------------------------- generic commands --------------------------|
 // +-------+--------+----------+------------+-----------+-------+---------+
+// del key [key ...], unlink is the same as del, returns the number of keys removed.
 func del(cli *Client, args [][]byte) (any, error) {
 	if len(args) < 1 {
 		return nil, newWrongNumOfArgsError("del")
 	}
+	var deleted int
+	for _, key := range args {
+		ok, err := cli.db.DeleteKeyCtx(cli.context(), key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return redcon.SimpleInt(deleted), nil
+}
 
+// exists key [key ...], a key is counted as many times as it is given.
+func exists(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 1 {
+		return nil, newWrongNumOfArgsError("exists")
+	}
+	var count int
 	for _, key := range args {
-		if err := cli.db.Delete(key); err != nil {
-			return 0, err
+		_, err := cli.db.TypeCtx(cli.context(), key)
+		if err == kv_engine.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
-		//TODO delete other db
+		count++
 	}
-	return redcon.SimpleInt(1), nil
+	return redcon.SimpleInt(count), nil
 }
 
 func keyType(cli *Client, args [][]byte) (any, error) {
-	// TODO
-	return "string", nil
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("type")
+	}
+	dataType, err := cli.db.TypeCtx(cli.context(), args[0])
+	if err == kv_engine.ErrKeyNotFound {
+		return redcon.SimpleString("none"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString(dataTypeNames[dataType]), nil
+}
+
+// keys pattern
+func keys(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("keys")
+	}
+	return arrayReply(cli.db.KeysCtx(cli.context(), string(args[0])))
+}
+
+// scan cursor [MATCH pattern] [COUNT count] [TYPE type]
+// Cursors are numbers like redis, which are mapped to the last key returned by the connection, see Client.cursors.
+func scan(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 1 || len(args)%2 != 1 {
+		return nil, newWrongNumOfArgsError("scan")
+	}
+	id, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor []byte
+	if id != 0 {
+		var ok bool
+		if cursor, ok = cli.cursors[id]; !ok {
+			return nil, errInvalidCursor
+		}
+		delete(cli.cursors, id)
+	}
+
+	var opts kv_engine.ScanOptions
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			opts.Match = string(args[i+1])
+		case "count":
+			count, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, errValueIsInvalid
+			}
+			if count < 1 {
+				return nil, errSyntax
+			}
+			opts.Count = count
+		case "type":
+			dataType, ok := dataTypesByName[strings.ToLower(string(args[i+1]))]
+			if !ok {
+				// no key of the type.
+				return []any{"0", [][]byte{}}, nil
+			}
+			opts.Types = []kv_engine.DataType{dataType}
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	keys, next, err := cli.db.ScanCtx(cli.context(), cursor, opts)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = [][]byte{}
+	}
+	var nextID uint64
+	if next != nil {
+		nextID = cli.saveCursor(next)
+	}
+	return []any{strconv.FormatUint(nextID, 10), keys}, nil
+}
+
+// expire key seconds
+func expire(cli *Client, args [][]byte) (any, error) {
+	return expireCmd(cli, args, "expire", time.Second)
+}
+
+// pexpire key milliseconds
+func pExpire(cli *Client, args [][]byte) (any, error) {
+	return expireCmd(cli, args, "pexpire", time.Millisecond)
+}
+
+// expireCmd sets the timeout of key, which is deleted if the timeout is not positive.
+func expireCmd(cli *Client, args [][]byte, cmd string, unit time.Duration) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError(cmd)
+	}
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	if ttl > int64(math.MaxInt64/unit) || ttl < int64(math.MinInt64/unit) {
+		return nil, newInvalidExpireError(cmd)
+	}
+	ok, err := cli.db.ExpireCtx(cli.context(), args[0], time.Duration(ttl)*unit)
+	if err != nil {
+		return nil, err
+	}
+	return boolToInt(ok), nil
+}
+
+// expireat key unix-time-seconds
+func expireAt(cli *Client, args [][]byte) (any, error) {
+	return expireAtCmd(cli, args, "expireat", time.Second)
+}
+
+// pexpireat key unix-time-milliseconds
+func pExpireAt(cli *Client, args [][]byte) (any, error) {
+	return expireAtCmd(cli, args, "pexpireat", time.Millisecond)
+}
+
+// expireAtCmd sets the timeout of key at an absolute time, key is deleted if the time is not in the future.
+func expireAtCmd(cli *Client, args [][]byte, cmd string, unit time.Duration) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError(cmd)
+	}
+	at, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	scale := int64(unit / time.Millisecond)
+	if at > math.MaxInt64/scale || at < math.MinInt64/scale {
+		return nil, newInvalidExpireError(cmd)
+	}
+	ok, err := cli.db.ExpireAtCtx(cli.context(), args[0], time.UnixMilli(at*scale))
+	if err != nil {
+		return nil, err
+	}
+	return boolToInt(ok), nil
+}
+
+// ttl key, returns -2 if the key does not exist, and -1 if the key has no timeout.
+func ttl(cli *Client, args [][]byte) (any, error) {
+	return ttlCmd(cli, args, "ttl", time.Second)
+}
+
+// pttl key, like ttl but in milliseconds.
+func pTTL(cli *Client, args [][]byte) (any, error) {
+	return ttlCmd(cli, args, "pttl", time.Millisecond)
+}
+
+func ttlCmd(cli *Client, args [][]byte, cmd string, unit time.Duration) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError(cmd)
+	}
+	ttl, err := cli.db.TTLCtx(cli.context(), args[0])
+	if err == kv_engine.ErrKeyNotFound {
+		return redcon.SimpleInt(-2), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ttl == kv_engine.NoExpiration {
+		return redcon.SimpleInt(-1), nil
+	}
+	return redcon.SimpleInt((ttl + unit/2) / unit), nil
+}
+
+func persist(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("persist")
+	}
+	ok, err := cli.db.PersistCtx(cli.context(), args[0])
+	if err != nil {
+		return nil, err
+	}
+	return boolToInt(ok), nil
+}
+
+func dbSize(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 0 {
+		return nil, newWrongNumOfArgsError("dbsize")
+	}
+	size, err := cli.db.DBSizeCtx(cli.context())
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(size), nil
+}
+
+// flushdb [ASYNC | SYNC], the data is always removed synchronously.
+func flushDB(cli *Client, args [][]byte) (any, error) {
+	if err := checkFlushArgs(args, "flushdb"); err != nil {
+		return nil, err
+	}
+	if err := cli.db.FlushAll(); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString(resultOK), nil
+}
+
+// flushall [ASYNC | SYNC], removes the data of all opened databases.
+func flushAll(cli *Client, args [][]byte) (any, error) {
+	if err := checkFlushArgs(args, "flushall"); err != nil {
+		return nil, err
+	}
+	cli.svr.mu.RLock()
+	defer cli.svr.mu.RUnlock()
+	for _, db := range cli.svr.dbs {
+		if err := db.FlushAll(); err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleString(resultOK), nil
+}
+
+func checkFlushArgs(args [][]byte, cmd string) error {
+	if len(args) > 1 {
+		return newWrongNumOfArgsError(cmd)
+	}
+	if len(args) == 1 {
+		if mode := strings.ToLower(string(args[0])); mode != "async" && mode != "sync" {
+			return errSyntax
+		}
+	}
+	return nil
 }
 
 // +-------+--------+----------+------------+-----------+-------+---------+
 // |-------------------------- String commands --------------------------|
 // +-------+--------+----------+------------+-----------+-------+---------+
+
+// set key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
 func set(cli *Client, args [][]byte) (any, error) {
 	if len(args) < 2 {
 		return nil, newWrongNumOfArgsError("set")
 	}
-
 	key, value := args[0], args[1]
 
-	var setErr error
-	if len(args) > 2 {
-		ex := strings.ToLower(string(args[2]))
-		if ex != "ex" || len(args) != 4 {
+	var (
+		opts             kv_engine.WriteOptions
+		setArgs          kv_engine.SetArgs
+		get, expireIsSet bool
+	)
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			setArgs.NX = true
+		case "xx":
+			setArgs.XX = true
+		case "get":
+			get = true
+		case "keepttl":
+			setArgs.KeepTTL = true
+		case "ex", "px":
+			if expireIsSet || i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			ttl, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, errValueIsInvalid
+			}
+			unit := time.Second
+			if strings.ToLower(string(args[i])) == "px" {
+				unit = time.Millisecond
+			}
+			if ttl <= 0 || ttl > int64(math.MaxInt64/unit) {
+				return nil, newInvalidExpireError("set")
+			}
+			opts.TTL = time.Duration(ttl) * unit
+			expireIsSet = true
+			i++
+		case "exat", "pxat":
+			if expireIsSet || i+1 >= len(args) {
+				return nil, errSyntax
+			}
+			at, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, errValueIsInvalid
+			}
+			if at <= 0 || (strings.ToLower(string(args[i])) == "exat" && at > math.MaxInt64/1000) {
+				return nil, newInvalidExpireError("set")
+			}
+			if strings.ToLower(string(args[i])) == "exat" {
+				at *= 1000
+			}
+			opts.ExpireAt = time.UnixMilli(at)
+			expireIsSet = true
+			i++
+		default:
 			return nil, errSyntax
 		}
+	}
+	if (setArgs.NX && setArgs.XX) || (setArgs.KeepTTL && expireIsSet) {
+		return nil, errSyntax
+	}
+
+	if !get && setArgs == (kv_engine.SetArgs{}) {
+		if err := cli.db.SetWithOptions(cli.context(), key, value, opts); err != nil {
+			return nil, err
+		}
+		return redcon.SimpleString(resultOK), nil
+	}
+
+	old, ok, err := cli.db.SetWithArgs(cli.context(), key, value, opts, setArgs)
+	if err != nil {
+		return nil, err
+	}
+	if get {
+		return bulkOrNil(old), nil
+	}
+	if !ok {
+		return nil, nil
+	}
+	return redcon.SimpleString(resultOK), nil
+}
+
+// setex key seconds value
+func setEX(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 3 {
+		return nil, newWrongNumOfArgsError("setex")
+	}
+	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	if seconds <= 0 {
+		return nil, newInvalidExpireError("setex")
+	}
+	if err := cli.db.SetEXCtx(cli.context(), args[0], args[2], time.Duration(seconds)*time.Second); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString(resultOK), nil
+}
 
-		second, err := strconv.Atoi(string(args[3]))
+// setnx key value
+func setNX(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("setnx")
+	}
+	_, ok, err := cli.db.SetWithArgs(cli.context(), args[0], args[1], kv_engine.WriteOptions{}, kv_engine.SetArgs{NX: true})
+	if err != nil {
+		return nil, err
+	}
+	return boolToInt(ok), nil
+}
+
+func get(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("get")
+	}
+	return cli.db.GetCtx(cli.context(), args[0])
+}
+
+func mGet(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 1 {
+		return nil, newWrongNumOfArgsError("mget")
+	}
+	values, err := cli.db.MGetCtx(cli.context(), args)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]any, len(values))
+	for i, value := range values {
+		res[i] = bulkOrNil(value)
+	}
+	return res, nil
+}
+
+func getDel(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("getdel")
+	}
+	value, err := cli.db.GetDelCtx(cli.context(), args[0])
+	if err != nil {
+		return nil, err
+	}
+	return bulkOrNil(value), nil
+}
+
+func mSet(cli *Client, args [][]byte) (any, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, newWrongNumOfArgsError("mset")
+	}
+	if err := cli.db.MSetCtx(cli.context(), args...); err != nil {
+		return nil, err
+	}
+	return redcon.SimpleString(resultOK), nil
+}
+
+func mSetNX(cli *Client, args [][]byte) (any, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, newWrongNumOfArgsError("msetnx")
+	}
+	ok, err := cli.db.MSetNXWithOptions(cli.context(), kv_engine.WriteOptions{}, args...)
+	if err != nil {
+		return nil, err
+	}
+	return boolToInt(ok), nil
+}
+
+// appendCmd returns the length of the string after the append.
+func appendCmd(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("append")
+	}
+	n, err := cli.db.AppendWithOptions(cli.context(), args[0], args[1], kv_engine.WriteOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+func strLen(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("strlen")
+	}
+	n, err := cli.db.StrLenCtx(cli.context(), args[0])
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+func incr(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("incr")
+	}
+	return incrReply(cli.db.IncrCtx(cli.context(), args[0]))
+}
+
+func incrBy(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("incrby")
+	}
+	incr, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	return incrReply(cli.db.IncrByCtx(cli.context(), args[0], incr))
+}
+
+func decr(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("decr")
+	}
+	return incrReply(cli.db.DecrCtx(cli.context(), args[0]))
+}
+
+func decrBy(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("decrby")
+	}
+	decr, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	return incrReply(cli.db.DecrByCtx(cli.context(), args[0], decr))
+}
+
+// +-------+--------+----------+------------+-----------+-------+---------+
+// |--------------------------- List commands ----------------------------|
+// +-------+--------+----------+------------+-----------+-------+---------+
+
+// lpush key element [element ...], returns the length of the list after the push.
+func lPush(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 2 {
+		return nil, newWrongNumOfArgsError("lpush")
+	}
+	n, err := cli.db.LPushWithOptions(cli.context(), args[0], kv_engine.WriteOptions{}, args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// rpush key element [element ...], returns the length of the list after the push.
+func rPush(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 2 {
+		return nil, newWrongNumOfArgsError("rpush")
+	}
+	n, err := cli.db.RPushWithOptions(cli.context(), args[0], kv_engine.WriteOptions{}, args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// lpop key [count]
+func lPop(cli *Client, args [][]byte) (any, error) {
+	return popCmd(cli, args, "lpop", cli.db.LPopCtx, cli.db.LPopNCtx)
+}
+
+// rpop key [count]
+func rPop(cli *Client, args [][]byte) (any, error) {
+	return popCmd(cli, args, "rpop", cli.db.RPopCtx, cli.db.RPopNCtx)
+}
+
+// popCmd pops an element, or an array of at most count elements if count is given.
+func popCmd(cli *Client, args [][]byte, cmd string, pop func(ctx context.Context, key []byte) ([]byte, error),
+	popN func(ctx context.Context, key []byte, count int) ([][]byte, error)) (any, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, newWrongNumOfArgsError(cmd)
+	}
+	if len(args) == 1 {
+		value, err := pop(cli.context(), args[0])
 		if err != nil {
-			return nil, errSyntax
+			return nil, err
 		}
+		return bulkOrNil(value), nil
+	}
 
-		setErr = cli.db.SetEX(key, value, time.Duration(second)*time.Second)
-	} else {
-		setErr = cli.db.Set(key, value)
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		return nil, errValueIsInvalid
+	}
+	values, err := popN(cli.context(), args[0], count)
+	if err != nil {
+		return nil, err
 	}
+	// the key does not exist.
+	if values == nil && count > 0 {
+		return nil, nil
+	}
+	if values == nil {
+		values = [][]byte{}
+	}
+	return values, nil
+}
 
-	if setErr != nil {
-		return nil, setErr
+func lLen(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("llen")
+	}
+	n, err := cli.db.LLenCtx(cli.context(), args[0])
+	if err != nil {
+		return nil, err
 	}
+	return redcon.SimpleInt(n), nil
+}
 
+// lindex key index
+func lIndex(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("lindex")
+	}
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	value, err := cli.db.LIndexCtx(cli.context(), args[0], index)
+	if err == kv_engine.ErrKeyNotFound || err == kv_engine.ErrIndexOutOfRange {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bulkOrNil(value), nil
+}
+
+// lrange key start stop, an empty array is returned if the range is empty.
+func lRange(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 3 {
+		return nil, newWrongNumOfArgsError("lrange")
+	}
+	start, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	stop, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return nil, errValueIsInvalid
+	}
+	values, err := cli.db.LRangeCtx(cli.context(), args[0], start, stop)
+	switch err {
+	case nil:
+	case kv_engine.ErrKeyNotFound, kv_engine.ErrIndexOutOfRange, kv_engine.ErrIndexStartLagerThanEnd:
+		return [][]byte{}, nil
+	default:
+		return nil, err
+	}
+	if values == nil {
+		values = [][]byte{}
+	}
+	return values, nil
+}
+
+// +-------+--------+----------+------------+-----------+-------+---------+
+// |--------------------------- Hash commands ----------------------------|
+// +-------+--------+----------+------------+-----------+-------+---------+
+
+// hset key field value [field value ...], returns the number of fields added.
+func hSet(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return nil, newWrongNumOfArgsError("hset")
+	}
+	added, err := cli.db.HMSetWithOptions(cli.context(), args[0], kv_engine.WriteOptions{}, args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(added), nil
+}
+
+// hmset key field value [field value ...]
+func hmSet(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return nil, newWrongNumOfArgsError("hmset")
+	}
+	if err := cli.db.HMSetCtx(cli.context(), args[0], args[1:]...); err != nil {
+		return nil, err
+	}
 	return redcon.SimpleString(resultOK), nil
 }
+
+func hSetNX(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 3 {
+		return nil, newWrongNumOfArgsError("hsetnx")
+	}
+	ok, err := cli.db.HSetNXCtx(cli.context(), args[0], args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	return boolToInt(ok), nil
+}
+
+func hGet(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("hget")
+	}
+	value, err := cli.db.HGetCtx(cli.context(), args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return bulkOrNil(value), nil
+}
+
+func hmGet(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 2 {
+		return nil, newWrongNumOfArgsError("hmget")
+	}
+	values, err := cli.db.HMGetCtx(cli.context(), args[0], args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]any, len(values))
+	for i, value := range values {
+		res[i] = bulkOrNil(value)
+	}
+	return res, nil
+}
+
+func hDel(cli *Client, args [][]byte) (any, error) {
+	if len(args) < 2 {
+		return nil, newWrongNumOfArgsError("hdel")
+	}
+	n, err := cli.db.HDelCtx(cli.context(), args[0], args[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+func hExists(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("hexists")
+	}
+	ok, err := cli.db.HExistsCtx(cli.context(), args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return boolToInt(ok), nil
+}
+
+func hLen(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("hlen")
+	}
+	n, err := cli.db.HLenCtx(cli.context(), args[0])
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+func hKeys(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("hkeys")
+	}
+	return arrayReply(cli.db.HKeysCtx(cli.context(), args[0]))
+}
+
+func hVals(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("hvals")
+	}
+	return arrayReply(cli.db.HValsCtx(cli.context(), args[0]))
+}
+
+func hGetAll(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 1 {
+		return nil, newWrongNumOfArgsError("hgetall")
+	}
+	return arrayReply(cli.db.HGetAllCtx(cli.context(), args[0]))
+}
+
+func hStrLen(cli *Client, args [][]byte) (any, error) {
+	if len(args) != 2 {
+		return nil, newWrongNumOfArgsError("hstrlen")
+	}
+	n, err := cli.db.HStrLenCtx(cli.context(), args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// arrayReply returns an empty array rather than the null reply for no values.
+func arrayReply(values [][]byte, err error) (any, error) {
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = [][]byte{}
+	}
+	return values, nil
+}
+
+// incrReply converts the result of incr and decr commands to the reply of redis.
+func incrReply(n int64, err error) (any, error) {
+	switch err {
+	case nil:
+		return redcon.SimpleInt(n), nil
+	case kv_engine.ErrWrongValueType:
+		return nil, errValueIsInvalid
+	case kv_engine.ErrIntegerOverflow:
+		return nil, errIntegerOverflow
+	default:
+		return nil, err
+	}
+}
+
+// bulkOrNil returns the null reply for a nil value, which is written as an empty bulk string otherwise.
+func bulkOrNil(value []byte) any {
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+func boolToInt(b bool) redcon.SimpleInt {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reid00/kv_engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/redcon"
+)
+
+func newTestClient(t *testing.T) *Client {
+	db, err := kv_engine.Open(kv_engine.DefaultOptions(t.TempDir()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return &Client{db: db}
+}
+
+func toArgs(args ...string) [][]byte {
+	res := make([][]byte, len(args))
+	for i, arg := range args {
+		res[i] = []byte(arg)
+	}
+	return res
+}
+
+func TestPExpire_PTTL(t *testing.T) {
+	cli := newTestClient(t)
+	_, err := set(cli, toArgs("k1", "v1"))
+	assert.Nil(t, err)
+
+	res, err := pTTL(cli, toArgs("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(-1), res)
+	res, err = pTTL(cli, toArgs("missing"))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(-2), res)
+
+	// sub-second timeouts are kept in milliseconds.
+	res, err = pExpire(cli, toArgs("k1", "1500"))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(1), res)
+	res, err = pTTL(cli, toArgs("k1"))
+	assert.Nil(t, err)
+	assert.True(t, res.(redcon.SimpleInt) > 1400 && res.(redcon.SimpleInt) <= 1500, res)
+	res, err = ttl(cli, toArgs("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(1), res)
+
+	_, err = set(cli, toArgs("k2", "v2", "PX", "300"))
+	assert.Nil(t, err)
+	res, err = pTTL(cli, toArgs("k2"))
+	assert.Nil(t, err)
+	assert.True(t, res.(redcon.SimpleInt) > 200 && res.(redcon.SimpleInt) <= 300, res)
+	time.Sleep(time.Millisecond * 400)
+	res, err = pTTL(cli, toArgs("k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(-2), res)
+
+	_, err = pExpire(cli, toArgs("k1", "abc"))
+	assert.Equal(t, errValueIsInvalid, err)
+	_, err = pExpire(cli, toArgs("k1"))
+	assert.NotNil(t, err)
+}
+
+func TestAbsoluteExpire(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	tests := []struct {
+		args, want []string
+	}{
+		{[]string{"setex", "k", "10", "v"}, []string{"set", "k", "v", "pxat", "1700000010000"}},
+		{[]string{"set", "k", "v", "NX", "PX", "1500", "GET"}, []string{"set", "k", "v", "NX", "pxat", "1700000001500", "GET"}},
+		{[]string{"set", "k", "ex", "EX", "2"}, []string{"set", "k", "ex", "pxat", "1700000002000"}},
+		{[]string{"expire", "k", "3"}, []string{"pexpireat", "k", "1700000003000"}},
+		{[]string{"pexpire", "k", "3"}, []string{"pexpireat", "k", "1700000000003"}},
+		// invalid or non-positive timeouts are left as they are.
+		{[]string{"setex", "k", "x", "v"}, []string{"setex", "k", "x", "v"}},
+		{[]string{"set", "k", "v", "EX", "0"}, []string{"set", "k", "v", "EX", "0"}},
+		{[]string{"expire", "k", "-1"}, []string{"expire", "k", "-1"}},
+		{[]string{"set", "k", "v"}, []string{"set", "k", "v"}},
+		{[]string{"incr", "k"}, []string{"incr", "k"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, toArgs(tt.want...), absoluteExpire(tt.args[0], toArgs(tt.args...), now), tt.args)
+	}
+}
+
+func TestExpireAt(t *testing.T) {
+	cli := newTestClient(t)
+	at := time.Now().Add(time.Hour).UnixMilli()
+	_, err := set(cli, toArgs("k1", "v1", "PXAT", strconv.FormatInt(at, 10)))
+	assert.Nil(t, err)
+	res, err := pTTL(cli, toArgs("k1"))
+	assert.Nil(t, err)
+	assert.True(t, res.(redcon.SimpleInt) > 3500000 && res.(redcon.SimpleInt) <= 3600000, res)
+
+	res, err = expireAt(cli, toArgs("k1", strconv.FormatInt(at/1000+7200, 10)))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(1), res)
+	res, err = ttl(cli, toArgs("k1"))
+	assert.Nil(t, err)
+	assert.True(t, res.(redcon.SimpleInt) > 10700 && res.(redcon.SimpleInt) <= 10800, res)
+
+	// a time in the past deletes the key.
+	res, err = pExpireAt(cli, toArgs("k1", "1"))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(1), res)
+	res, err = pTTL(cli, toArgs("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, redcon.SimpleInt(-2), res)
+
+	_, err = set(cli, toArgs("k1", "v1", "EXAT", "0"))
+	assert.NotNil(t, err)
+	_, err = set(cli, toArgs("k1", "v1", "PX", "10", "PXAT", "10"))
+	assert.Equal(t, errSyntax, err)
+}
+
+// cmdCase is a command run by runCmdCases, with its expected reply and error.
+type cmdCase struct {
+	args  []string
+	reply any
+	err   error
+}
+
+func runCmdCases(t *testing.T, cli *Client, cases []cmdCase) {
+	for _, c := range cases {
+		reply, err := supportedCommands[c.args[0]](cli, toArgs(c.args[1:]...))
+		assert.Equal(t, c.err, err, c.args)
+		assert.Equal(t, c.reply, reply, c.args)
+	}
+}
+
+func TestSet(t *testing.T) {
+	ok := redcon.SimpleString(resultOK)
+	// EXAT is truncated to seconds, so the remaining ttl rounds to 100 either way.
+	exAt := strconv.FormatInt(time.Now().Add(100*time.Second+time.Second/2).Unix(), 10)
+	pxAt := strconv.FormatInt(time.Now().Add(200*time.Second).UnixMilli(), 10)
+	runCmdCases(t, newTestClient(t), []cmdCase{
+		{args: []string{"set", "k", "v1"}, reply: ok},
+		{args: []string{"set", "k", "v2", "NX"}},
+		{args: []string{"set", "k", "v2", "xx"}, reply: ok},
+		{args: []string{"set", "k2", "v", "XX"}},
+		{args: []string{"get", "k2"}, reply: []byte(nil), err: kv_engine.ErrKeyNotFound},
+		{args: []string{"set", "k", "v3", "GET"}, reply: []byte("v2")},
+		{args: []string{"set", "k3", "v", "GET"}},
+		{args: []string{"set", "k", "v4", "NX", "GET"}, reply: []byte("v3")},
+		{args: []string{"get", "k"}, reply: []byte("v3")},
+
+		// the timeouts, which are replaced by a write without KEEPTTL.
+		{args: []string{"set", "k", "v", "EX", "100"}, reply: ok},
+		{args: []string{"ttl", "k"}, reply: redcon.SimpleInt(100)},
+		{args: []string{"set", "k", "v", "KEEPTTL"}, reply: ok},
+		{args: []string{"ttl", "k"}, reply: redcon.SimpleInt(100)},
+		{args: []string{"set", "k", "v", "PX", "50000"}, reply: ok},
+		{args: []string{"ttl", "k"}, reply: redcon.SimpleInt(50)},
+		{args: []string{"set", "k", "v", "EXAT", exAt}, reply: ok},
+		{args: []string{"ttl", "k"}, reply: redcon.SimpleInt(100)},
+		{args: []string{"set", "k", "v", "PXAT", pxAt}, reply: ok},
+		{args: []string{"ttl", "k"}, reply: redcon.SimpleInt(200)},
+		{args: []string{"set", "k", "v"}, reply: ok},
+		{args: []string{"ttl", "k"}, reply: redcon.SimpleInt(-1)},
+
+		// syntax errors and invalid timeouts.
+		{args: []string{"set", "k"}, err: newWrongNumOfArgsError("set")},
+		{args: []string{"set", "k", "v", "NX", "XX"}, err: errSyntax},
+		{args: []string{"set", "k", "v", "EX"}, err: errSyntax},
+		{args: []string{"set", "k", "v", "EX", "1", "PX", "1"}, err: errSyntax},
+		{args: []string{"set", "k", "v", "KEEPTTL", "EX", "1"}, err: errSyntax},
+		{args: []string{"set", "k", "v", "unknown"}, err: errSyntax},
+		{args: []string{"set", "k", "v", "EX", "abc"}, err: errValueIsInvalid},
+		{args: []string{"set", "k", "v", "EX", "0"}, err: newInvalidExpireError("set")},
+		{args: []string{"set", "k", "v", "PX", "-1"}, err: newInvalidExpireError("set")},
+		{args: []string{"set", "k", "v", "EX", "9223372036854775807"}, err: newInvalidExpireError("set")},
+		{args: []string{"set", "k", "v", "EXAT", "9223372036854775807"}, err: newInvalidExpireError("set")},
+		{args: []string{"set", "k", "v", "PXAT", "0"}, err: newInvalidExpireError("set")},
+		{args: []string{"ttl", "k"}, reply: redcon.SimpleInt(-1)},
+	})
+}
+
+func TestStringCommands(t *testing.T) {
+	runCmdCases(t, newTestClient(t), []cmdCase{
+		{args: []string{"setnx", "a", "1"}, reply: redcon.SimpleInt(1)},
+		{args: []string{"setnx", "a", "2"}, reply: redcon.SimpleInt(0)},
+		{args: []string{"get", "a"}, reply: []byte("1")},
+
+		// msetnx sets none of the keys if any of them exists.
+		{args: []string{"msetnx", "a", "3", "b", "3"}, reply: redcon.SimpleInt(0)},
+		{args: []string{"get", "b"}, reply: []byte(nil), err: kv_engine.ErrKeyNotFound},
+		{args: []string{"msetnx", "b", "3", "c", "3"}, reply: redcon.SimpleInt(1)},
+		{args: []string{"mget", "a", "b", "c", "d"}, reply: []any{[]byte("1"), []byte("3"), []byte("3"), nil}},
+		{args: []string{"msetnx", "d"}, err: newWrongNumOfArgsError("msetnx")},
+
+		{args: []string{"getdel", "b"}, reply: []byte("3")},
+		{args: []string{"getdel", "b"}},
+
+		{args: []string{"append", "s", "ab"}, reply: redcon.SimpleInt(2)},
+		{args: []string{"append", "s", "cde"}, reply: redcon.SimpleInt(5)},
+		{args: []string{"get", "s"}, reply: []byte("abcde")},
+
+		{args: []string{"incrby", "n", "5"}, reply: redcon.SimpleInt(5)},
+		{args: []string{"incrby", "n", "-7"}, reply: redcon.SimpleInt(-2)},
+		{args: []string{"incrby", "n", "x"}, err: errValueIsInvalid},
+		{args: []string{"incrby", "s", "1"}, err: errValueIsInvalid},
+		{args: []string{"set", "n", "9223372036854775807"}, reply: redcon.SimpleString(resultOK)},
+		{args: []string{"incrby", "n", "1"}, err: errIntegerOverflow},
+	})
+}
+
+func TestHSet(t *testing.T) {
+	runCmdCases(t, newTestClient(t), []cmdCase{
+		{args: []string{"hset", "h", "f1", "1", "f2", "2"}, reply: redcon.SimpleInt(2)},
+		{args: []string{"hset", "h", "f1", "3", "f3", "3"}, reply: redcon.SimpleInt(1)},
+		// a field given twice is added once, and the last value wins.
+		{args: []string{"hset", "h", "f4", "1", "f4", "2"}, reply: redcon.SimpleInt(1)},
+		{args: []string{"hget", "h", "f4"}, reply: []byte("2")},
+		{args: []string{"hset", "h", "f1", "4"}, reply: redcon.SimpleInt(0)},
+		{args: []string{"hlen", "h"}, reply: redcon.SimpleInt(4)},
+		{args: []string{"hset", "h", "f1"}, err: newWrongNumOfArgsError("hset")},
+	})
+}
+
+func TestListCommands(t *testing.T) {
+	runCmdCases(t, newTestClient(t), []cmdCase{
+		{args: []string{"lpush", "l", "b", "a"}, reply: redcon.SimpleInt(2)},
+		{args: []string{"rpush", "l", "c", "d", "e"}, reply: redcon.SimpleInt(5)},
+		{args: []string{"lpush", "l"}, err: newWrongNumOfArgsError("lpush")},
+		{args: []string{"lrange", "l", "0", "-1"}, reply: toArgs("a", "b", "c", "d", "e")},
+
+		// out of range.
+		{args: []string{"lindex", "l", "-1"}, reply: []byte("e")},
+		{args: []string{"lindex", "l", "5"}},
+		{args: []string{"lindex", "l", "-6"}},
+		{args: []string{"lindex", "missing", "0"}},
+		{args: []string{"lrange", "l", "3", "100"}, reply: toArgs("d", "e")},
+		{args: []string{"lrange", "l", "5", "10"}, reply: [][]byte{}},
+		{args: []string{"lrange", "l", "3", "1"}, reply: [][]byte{}},
+		{args: []string{"lrange", "missing", "0", "-1"}, reply: [][]byte{}},
+
+		// pops with a count.
+		{args: []string{"lpop", "l", "2"}, reply: toArgs("a", "b")},
+		{args: []string{"rpop", "l", "1"}, reply: toArgs("e")},
+		{args: []string{"lpop", "l", "0"}, reply: [][]byte{}},
+		{args: []string{"rpop", "l", "10"}, reply: toArgs("d", "c")},
+		{args: []string{"lpop", "l", "1"}},
+		{args: []string{"lpop", "l"}},
+		{args: []string{"lpop", "l", "-1"}, err: errValueIsInvalid},
+		{args: []string{"rpush", "l", "x"}, reply: redcon.SimpleInt(1)},
+		{args: []string{"rpop", "l"}, reply: []byte("x")},
+	})
+}
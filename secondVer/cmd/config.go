@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reid00/kv_engine"
+	"github.com/reid00/kv_engine/logger"
+	"github.com/reid00/kv_engine/util"
+)
+
+// configFlag is the flag of config file, which is not a param of the config file itself.
+const configFlag = "config"
+
+// logLevelParam is the param of log level, debug, info, warning, error or fatal.
+const logLevelParam = "loglevel"
+
+var errNoConfigFile = errors.New("ERR The server is running without a config file")
+
+// config is the config of server, loaded from the config file and flags.
+//
+// The config file has a param per line like redis.conf, blank lines and lines starting with # are ignored:
+//
+//	# server options are named after the flags.
+//	port 5200
+//	dbpath /data/rosedb
+//	# engine options are named after kv_engine.Options in lower case, and apply to every database.
+//	sync yes
+//	logfilegcratio 0.5
+//	# db<n>.<option> overrides an engine option for database n.
+//	db1.iotype mmap
+//	loglevel info
+//
+// Flags given on the command line take precedence over the config file.
+type config struct {
+	mu    sync.Mutex
+	path  string
+	flags *flag.FlagSet
+	// lines of the config file, kept by rewrite.
+	lines []string
+	// engine options and log level by name, including the ones of databases.
+	values map[string]string
+}
+
+// engineParam is an option of kv_engine.Options which can be set by the config file.
+type engineParam struct {
+	set func(opts *kv_engine.Options, value string) error
+	get func(opts *kv_engine.Options) string
+	// whether it can be changed by CONFIG SET, see Server.setConfig.
+	tunable bool
+}
+
+var engineParams = map[string]engineParam{
+	"indexmode":            indexModeParam(),
+	"iotype":               ioTypeParam(),
+	"lockfreereads":        boolParam(func(o *kv_engine.Options) *bool { return &o.LockFreeReads }),
+	"sync":                 boolParam(func(o *kv_engine.Options) *bool { return &o.Sync }),
+	"syncinterval":         durationParam(func(o *kv_engine.Options) *time.Duration { return &o.SyncInterval }),
+	"bytespersync":         bytesParam(func(o *kv_engine.Options) *int64 { return &o.BytesPerSync }),
+	"logfilegcinterval":    durationParam(func(o *kv_engine.Options) *time.Duration { return &o.LogFileGCInterval }),
+	"logfilegcratio":       gcRatioParam(),
+	"logfilesizethreshold": bytesParam(func(o *kv_engine.Options) *int64 { return &o.LogFileSizeThreshold }),
+	"discardbuffersize":    intParam(func(o *kv_engine.Options) *int { return &o.DiscardBufferSize }),
+	"maxdiskusage":         bytesParam(func(o *kv_engine.Options) *int64 { return &o.MaxDiskUsage }),
+}
+
+func boolParam(field func(o *kv_engine.Options) *bool) engineParam {
+	return engineParam{
+		set: func(o *kv_engine.Options, value string) error {
+			switch strings.ToLower(value) {
+			case "yes", "true":
+				*field(o) = true
+			case "no", "false":
+				*field(o) = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+			return nil
+		},
+		get: func(o *kv_engine.Options) string {
+			if *field(o) {
+				return "yes"
+			}
+			return "no"
+		},
+	}
+}
+
+func durationParam(field func(o *kv_engine.Options) *time.Duration) engineParam {
+	return engineParam{
+		set: func(o *kv_engine.Options, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return errors.New("argument must be a duration like 8h or 500ms")
+			}
+			*field(o) = d
+			return nil
+		},
+		get: func(o *kv_engine.Options) string { return field(o).String() },
+	}
+}
+
+func bytesParam(field func(o *kv_engine.Options) *int64) engineParam {
+	return engineParam{
+		set: func(o *kv_engine.Options, value string) error {
+			n, err := parseBytes(value)
+			if err != nil {
+				return err
+			}
+			*field(o) = n
+			return nil
+		},
+		get: func(o *kv_engine.Options) string { return strconv.FormatInt(*field(o), 10) },
+	}
+}
+
+func intParam(field func(o *kv_engine.Options) *int) engineParam {
+	return engineParam{
+		set: func(o *kv_engine.Options, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return errors.New("argument must be a positive integer")
+			}
+			*field(o) = n
+			return nil
+		},
+		get: func(o *kv_engine.Options) string { return strconv.Itoa(*field(o)) },
+	}
+}
+
+func gcRatioParam() engineParam {
+	return engineParam{
+		set: func(o *kv_engine.Options, value string) error {
+			ratio, err := strconv.ParseFloat(value, 64)
+			if err != nil || ratio <= 0 || ratio > 1 {
+				return errors.New("argument must be a number in (0, 1]")
+			}
+			o.LogFileGCRatio = ratio
+			return nil
+		},
+		get:     func(o *kv_engine.Options) string { return strconv.FormatFloat(o.LogFileGCRatio, 'f', -1, 64) },
+		tunable: true,
+	}
+}
+
+var ioTypeNames = map[kv_engine.IOType]string{kv_engine.FileIO: "fileio", kv_engine.MMap: "mmap", kv_engine.DirectIO: "directio"}
+
+func ioTypeParam() engineParam {
+	return engineParam{
+		set: func(o *kv_engine.Options, value string) error {
+			for ioType, name := range ioTypeNames {
+				if strings.EqualFold(value, name) {
+					o.IoType = ioType
+					return nil
+				}
+			}
+			return errors.New("argument must be one of fileio, mmap and directio")
+		},
+		get: func(o *kv_engine.Options) string { return ioTypeNames[o.IoType] },
+	}
+}
+
+var indexModeNames = map[kv_engine.DataIndexMode]string{kv_engine.KeyValueMemMode: "keyvalue", kv_engine.KeyOnlyMemMode: "keyonly"}
+
+func indexModeParam() engineParam {
+	return engineParam{
+		set: func(o *kv_engine.Options, value string) error {
+			for mode, name := range indexModeNames {
+				if strings.EqualFold(value, name) {
+					o.IndexMode = mode
+					return nil
+				}
+			}
+			return errors.New("argument must be keyvalue or keyonly")
+		},
+		get: func(o *kv_engine.Options) string { return indexModeNames[o.IndexMode] },
+	}
+}
+
+// parseBytes parses a memory size like redis.conf, e.g. 1k is 1000 bytes and 1kb is 1024 bytes.
+func parseBytes(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	}
+	lower, unit := strings.ToLower(value), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, unit = strings.TrimSuffix(lower, u.suffix), u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/unit {
+		return 0, errors.New("argument must be a memory value like 512mb")
+	}
+	return n * unit, nil
+}
+
+// logLevels are the values of loglevel, from the most verbose.
+var logLevels = []string{"debug", "info", "warning", "error", "fatal"}
+
+func logLevelName() string {
+	level := logger.GetLogLevel()
+	for _, name := range logLevels {
+		if logger.StringToLogLevel(name) == level {
+			return name
+		}
+	}
+	return "none"
+}
+
+// newConfig loads the config file at path, the params of server options are set to flags,
+// unless they are given on the command line. An empty path means no config file.
+func newConfig(path string, flags *flag.FlagSet) (*config, error) {
+	c := &config{path: path, flags: flags, values: make(map[string]string)}
+	if path == "" {
+		return c, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	onCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for line := 1; scanner.Scan(); line++ {
+		c.lines = append(c.lines, scanner.Text())
+		name, value, ok := parseConfigLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		if value == "" {
+			return nil, fmt.Errorf("invalid config file %s, line %d: no value of '%s'", path, line, name)
+		}
+		if c.isFlag(name) {
+			if onCommandLine[name] {
+				continue
+			}
+			if err := flags.Set(name, value); err != nil {
+				return nil, fmt.Errorf("invalid config file %s, line %d: %v", path, line, err)
+			}
+			continue
+		}
+		if err := c.set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid config file %s, line %d: '%s' %v", path, line, name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if level, ok := c.values[logLevelParam]; ok {
+		logger.SetLevelByString(level)
+	}
+	return c, nil
+}
+
+// parseConfigLine returns the param of a line, the value is the rest of the line so that it may contain spaces.
+func parseConfigLine(line string) (name, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	name = strings.Fields(line)[0]
+	return strings.ToLower(name), strings.TrimSpace(line[len(name):]), true
+}
+
+func (c *config) isFlag(name string) bool {
+	return name != configFlag && c.flags.Lookup(name) != nil
+}
+
+// set validates and saves the value of an engine option or log level, c.mu must be held if the config is shared.
+func (c *config) set(name, value string) error {
+	if err := validateParam(name, value); err != nil {
+		return err
+	}
+	if name == logLevelParam {
+		value = strings.ToLower(value)
+	}
+	c.values[name] = value
+	return nil
+}
+
+func validateParam(name, value string) error {
+	if name == logLevelParam {
+		for _, level := range logLevels {
+			if strings.EqualFold(value, level) {
+				return nil
+			}
+		}
+		return errors.New("argument must be one of " + strings.Join(logLevels, ", "))
+	}
+	param, err := parseEngineParam(name)
+	if err != nil {
+		return err
+	}
+	var opts kv_engine.Options
+	return param.set(&opts, value)
+}
+
+// parseEngineParam returns the engine option of a param, which is the option of all databases or db<n>.<option>.
+func parseEngineParam(name string) (engineParam, error) {
+	option := name
+	if strings.HasPrefix(name, "db") {
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if n, err := strconv.Atoi(name[2:i]); err != nil || n < 0 {
+				return engineParam{}, errors.New("invalid database")
+			}
+			option = name[i+1:]
+		}
+	}
+	param, ok := engineParams[option]
+	if !ok {
+		return engineParam{}, errors.New("unknown param")
+	}
+	return param, nil
+}
+
+// dbOptions returns the options of database n at path, the engine options of it override the ones of all databases.
+// The overrides are skipped if n is negative.
+func (c *config) dbOptions(n int, path string) kv_engine.Options {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	opts := kv_engine.DefaultOptions(path)
+	for name, param := range engineParams {
+		if value, ok := c.values[name]; ok {
+			_ = param.set(&opts, value)
+		}
+	}
+	if n < 0 {
+		return opts
+	}
+	for name, param := range engineParams {
+		if value, ok := c.values[fmt.Sprintf("db%d.%s", n, name)]; ok {
+			_ = param.set(&opts, value)
+		}
+	}
+	return opts
+}
+
+// get returns the params matching any of the glob-style patterns and their values, sorted by name.
+func (c *config) get(patterns []string) []string {
+	params := make(map[string]string)
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name != configFlag {
+			params[f.Name] = f.Value.String()
+		}
+	})
+	opts := c.dbOptions(-1, "")
+	for name, param := range engineParams {
+		params[name] = param.get(&opts)
+	}
+	c.mu.Lock()
+	for name, value := range c.values {
+		if strings.HasPrefix(name, "db") {
+			params[name] = value
+		}
+	}
+	c.mu.Unlock()
+	params[logLevelParam] = logLevelName()
+
+	var names []string
+	for name := range params {
+		for _, pattern := range patterns {
+			if util.GlobMatch([]byte(strings.ToLower(pattern)), []byte(name)) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	result := make([]string, 0, len(names)*2)
+	for _, name := range names {
+		result = append(result, name, params[name])
+	}
+	return result
+}
+
+// secretFlags are never copied from the command line to the config file by rewrite,
+// their lines in the config file are kept as they are.
+var secretFlags = map[string]bool{"requirepass": true}
+
+// rewrite writes the current config to the config file. The lines of params are updated in place,
+// comments are kept, and params not in the file yet are appended, including the flags on the command line
+// except secretFlags. The file keeps its mode, and a new one is only accessible by the owner.
+func (c *config) rewrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" {
+		return errNoConfigFile
+	}
+	current := make(map[string]string, len(c.values))
+	for name, value := range c.values {
+		current[name] = value
+	}
+	c.flags.Visit(func(f *flag.Flag) {
+		if f.Name != configFlag && !secretFlags[f.Name] {
+			current[f.Name] = f.Value.String()
+		}
+	})
+
+	var lines []string
+	written := make(map[string]bool)
+	for _, line := range c.lines {
+		name, _, ok := parseConfigLine(line)
+		if !ok || secretFlags[name] {
+			lines = append(lines, line)
+			continue
+		}
+		// duplicated params are merged into the first line.
+		if value, ok := current[name]; ok && !written[name] {
+			lines = append(lines, name+" "+value)
+			written[name] = true
+		}
+	}
+	var appended []string
+	for name := range current {
+		if !written[name] {
+			appended = append(appended, name)
+		}
+	}
+	sort.Strings(appended)
+	for _, name := range appended {
+		lines = append(lines, name+" "+current[name])
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(c.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), mode); err != nil {
+		return err
+	}
+	// the mode of an existing tmp file is not changed by WriteFile.
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.lines = lines
+	return nil
+}
+
+// setConfig changes the params of CONFIG SET at runtime, params are name and value pairs.
+// All of them are validated before any is changed.
+func (svr *Server) setConfig(params []string) error {
+	c := svr.config
+	c.mu.Lock()
+	for i := 0; i < len(params); i += 2 {
+		name, value := strings.ToLower(params[i]), params[i+1]
+		if err := checkTunable(c, name); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		if err := validateParam(name, value); err != nil {
+			c.mu.Unlock()
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", name, err)
+		}
+	}
+	for i := 0; i < len(params); i += 2 {
+		_ = c.set(strings.ToLower(params[i]), params[i+1])
+	}
+	level := c.values[logLevelParam]
+	c.mu.Unlock()
+
+	if level != "" {
+		logger.SetLevelByString(level)
+	}
+	// c.mu is released, as svr.mu is held before it when opening a database.
+	svr.mu.RLock()
+	defer svr.mu.RUnlock()
+	for n, db := range svr.dbs {
+		if err := db.SetLogFileGCRatio(c.dbOptions(n, "").LogFileGCRatio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTunable returns an error if the param can not be changed by CONFIG SET.
+func checkTunable(c *config, name string) error {
+	if name == logLevelParam {
+		return nil
+	}
+	if c.isFlag(name) {
+		return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+	}
+	param, err := parseEngineParam(name)
+	if err != nil {
+		return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", name)
+	}
+	if !param.tunable {
+		return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", name)
+	}
+	return nil
+}
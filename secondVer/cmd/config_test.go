@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reid00/kv_engine"
+	"github.com/reid00/kv_engine/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `# rosedb config
+port 5201
+host 10.0.0.1
+
+sync yes
+logfilegcratio 0.3
+maxdiskusage 1gb
+db1.iotype mmap
+db1.logfilegcratio 0.8
+loglevel warning
+`
+
+// newTestConfig loads content as the config file, with the flags of server options given on the command line.
+func newTestConfig(t *testing.T, content string, args ...string) (*config, *ServerOptions, error) {
+	path := filepath.Join(t.TempDir(), "rosedb.conf")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+
+	opts := new(ServerOptions)
+	flags := flag.NewFlagSet("rosedb", flag.ContinueOnError)
+	flags.StringVar(&opts.configFile, configFlag, "", "")
+	flags.StringVar(&opts.host, "host", defaultHost, "")
+	flags.StringVar(&opts.port, "port", defaultPort, "")
+	flags.StringVar(&opts.dbPath, "dbpath", defaultDBPath, "")
+	flags.StringVar(&opts.requirePass, "requirepass", "", "")
+	assert.Nil(t, flags.Parse(append([]string{"-config", path}, args...)))
+
+	c, err := newConfig(opts.configFile, flags)
+	t.Cleanup(func() { logger.SetLevel(logger.LogLevelInfo) })
+	return c, opts, err
+}
+
+func TestNewConfig(t *testing.T) {
+	c, opts, err := newTestConfig(t, testConfig, "-port", "5202")
+	assert.Nil(t, err)
+	// flags on the command line take precedence.
+	assert.Equal(t, "5202", opts.port)
+	assert.Equal(t, "10.0.0.1", opts.host)
+	assert.Equal(t, "warning", logLevelName())
+
+	opts0 := c.dbOptions(0, "/tmp/rosedb-0000")
+	assert.Equal(t, "/tmp/rosedb-0000", opts0.DBPath)
+	assert.True(t, opts0.Sync)
+	assert.Equal(t, 0.3, opts0.LogFileGCRatio)
+	assert.Equal(t, int64(1<<30), opts0.MaxDiskUsage)
+	assert.Equal(t, kv_engine.FileIO, opts0.IoType)
+	// the options of a database override the ones of all databases.
+	opts1 := c.dbOptions(1, "/tmp/rosedb-0001")
+	assert.True(t, opts1.Sync)
+	assert.Equal(t, 0.8, opts1.LogFileGCRatio)
+	assert.Equal(t, kv_engine.MMap, opts1.IoType)
+
+	assert.Equal(t, []string{"db1.iotype", "mmap", "db1.logfilegcratio", "0.8", "dbpath", defaultDBPath}, c.get([]string{"DB*"}))
+	assert.Equal(t, []string{"logfilegcinterval", "8h0m0s", "logfilegcratio", "0.3", "port", "5202"},
+		c.get([]string{"logfilegc*", "port"}))
+
+	for _, content := range []string{"unknown 1", "sync maybe", "port", "db1.unknown 1", "dbx.sync yes", "logfilegcratio 2", "loglevel verbose"} {
+		_, _, err := newTestConfig(t, content)
+		assert.NotNil(t, err, content)
+	}
+}
+
+func TestServer_SetConfig(t *testing.T) {
+	c, _, err := newTestConfig(t, testConfig)
+	assert.Nil(t, err)
+	svr := &Server{dbs: make(map[int]*kv_engine.RoseDB), config: c, mu: new(sync.RWMutex)}
+	for n := 0; n < 2; n++ {
+		opts := c.dbOptions(n, filepath.Join(t.TempDir(), "db"))
+		opts.InMemory = true
+		db, err := kv_engine.Open(opts)
+		assert.Nil(t, err)
+		defer db.Close()
+		svr.dbs[n] = db
+	}
+
+	assert.Nil(t, svr.setConfig([]string{"logfilegcratio", "0.6", "LogLevel", "ERROR"}))
+	assert.Equal(t, 0.6, svr.dbs[0].LogFileGCRatio())
+	assert.Equal(t, 0.8, svr.dbs[1].LogFileGCRatio())
+	assert.Equal(t, "error", logLevelName())
+	assert.Nil(t, svr.setConfig([]string{"db1.logfilegcratio", "0.2"}))
+	assert.Equal(t, 0.6, svr.dbs[0].LogFileGCRatio())
+	assert.Equal(t, 0.2, svr.dbs[1].LogFileGCRatio())
+
+	// nothing is changed if any of the params is invalid.
+	for _, params := range [][]string{
+		{"logfilegcratio", "0.1", "port", "5203"},
+		{"logfilegcratio", "0.1", "sync", "no"},
+		{"logfilegcratio", "0.1", "unknown", "1"},
+		{"logfilegcratio", "0.1", "loglevel", "verbose"},
+		{"logfilegcratio", "1.1"},
+	} {
+		assert.NotNil(t, svr.setConfig(params), params)
+	}
+	assert.Equal(t, 0.6, svr.dbs[0].LogFileGCRatio())
+	assert.Equal(t, "error", logLevelName())
+}
+
+func TestConfig_Rewrite(t *testing.T) {
+	c, opts, err := newTestConfig(t, testConfig, "-dbpath", "/data/rosedb")
+	assert.Nil(t, err)
+	svr := &Server{dbs: make(map[int]*kv_engine.RoseDB), config: c, mu: new(sync.RWMutex)}
+	assert.Nil(t, svr.setConfig([]string{"logfilegcratio", "0.6", "db2.logfilegcratio", "0.9", "loglevel", "debug"}))
+	assert.Nil(t, c.rewrite())
+
+	content, err := os.ReadFile(opts.configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, `# rosedb config
+port 5201
+host 10.0.0.1
+
+sync yes
+logfilegcratio 0.6
+maxdiskusage 1gb
+db1.iotype mmap
+db1.logfilegcratio 0.8
+loglevel debug
+db2.logfilegcratio 0.9
+dbpath /data/rosedb
+`, string(content))
+
+	// the rewritten file is loaded as the running config.
+	c, _, err = newTestConfig(t, string(content))
+	assert.Nil(t, err)
+	assert.Equal(t, 0.9, c.dbOptions(2, "").LogFileGCRatio)
+	assert.Equal(t, time.Hour*8, c.dbOptions(2, "").LogFileGCInterval)
+
+	assert.Equal(t, errNoConfigFile, (&config{}).rewrite())
+}
+
+func TestConfig_RewriteSecrets(t *testing.T) {
+	// the password on the command line is not written to the config file.
+	c, opts, err := newTestConfig(t, "port 5201\n", "-requirepass", "secret")
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chmod(opts.configFile, 0600))
+	assert.Nil(t, c.rewrite())
+	content, err := os.ReadFile(opts.configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "port 5201\n", string(content))
+	info, err := os.Stat(opts.configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// the password in the config file is kept as it is, and so is the mode of the file.
+	c, opts, err = newTestConfig(t, "requirepass secret\nport 5201\n", "-requirepass", "other", "-port", "5202")
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chmod(opts.configFile, 0640))
+	assert.Nil(t, c.rewrite())
+	content, err = os.ReadFile(opts.configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "requirepass secret\nport 5202\n", string(content))
+	info, err = os.Stat(opts.configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// a new config file is only accessible by the owner.
+	c, _, err = newTestConfig(t, "")
+	assert.Nil(t, err)
+	c.path = filepath.Join(t.TempDir(), "new.conf")
+	assert.Nil(t, c.rewrite())
+	info, err = os.Stat(c.path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/reid00/kv_engine"
+	"github.com/reid00/kv_engine/logger"
+)
+
+// serverVersion is the version of rosedb server reported by info command.
+const serverVersion = "2.0.0"
+
+// infoSections are the sections of info command in order, all of them are returned if no section is given.
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "keyspace"}
+
+// infoWriter writes the sections of info command in the format of redis, which is parsed by redis tooling:
+//
+//	# Section
+//	field:value
+type infoWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *infoWriter) section(name string) {
+	if w.buf.Len() > 0 {
+		w.buf.WriteString("\r\n")
+	}
+	w.buf.WriteString("# " + strings.ToUpper(name[:1]) + name[1:] + "\r\n")
+}
+
+func (w *infoWriter) field(name string, value interface{}) {
+	fmt.Fprintf(&w.buf, "%s:%v\r\n", name, value)
+}
+
+// info returns the sections of info command, unknown sections are ignored like redis.
+func (svr *Server) info(sections []string) string {
+	want := make(map[string]bool)
+	for _, section := range sections {
+		switch section = strings.ToLower(section); section {
+		case "all", "default", "everything":
+			for _, name := range infoSections {
+				want[name] = true
+			}
+		default:
+			want[section] = true
+		}
+	}
+	if len(sections) == 0 {
+		for _, name := range infoSections {
+			want[name] = true
+		}
+	}
+
+	// stats of databases are shared by the sections, as collecting them reads the discard files.
+	var dbStats map[int]*kv_engine.Stats
+	if want["memory"] || want["persistence"] || want["keyspace"] {
+		dbStats = svr.dbStats()
+	}
+
+	w := new(infoWriter)
+	for _, name := range infoSections {
+		if !want[name] {
+			continue
+		}
+		w.section(name)
+		switch name {
+		case "server":
+			svr.infoServer(w)
+		case "clients":
+			w.field("connected_clients", atomic.LoadInt64(&svr.metrics.clients))
+		case "memory":
+			infoMemory(w, dbStats)
+		case "persistence":
+			infoPersistence(w, dbStats)
+		case "stats":
+			svr.infoStats(w)
+		case "replication":
+			svr.infoReplication(w)
+		case "keyspace":
+			infoKeyspace(w, dbStats)
+		}
+	}
+	return w.buf.String()
+}
+
+// dbStats returns the stats of all opened databases, the databases failed to get stats are skipped.
+func (svr *Server) dbStats() map[int]*kv_engine.Stats {
+	svr.mu.RLock()
+	dbs := make(map[int]*kv_engine.RoseDB, len(svr.dbs))
+	for n, db := range svr.dbs {
+		dbs[n] = db
+	}
+	svr.mu.RUnlock()
+
+	dbStats := make(map[int]*kv_engine.Stats, len(dbs))
+	for n, db := range dbs {
+		stats, err := db.Stats()
+		if err != nil {
+			logger.Errorf("get stats of db %d err: %v", n, err)
+			continue
+		}
+		dbStats[n] = stats
+	}
+	return dbStats
+}
+
+func (svr *Server) infoServer(w *infoWriter) {
+	uptime := time.Since(svr.start)
+	w.field("rosedb_version", serverVersion)
+	w.field("go_version", runtime.Version())
+	w.field("os", runtime.GOOS+" "+runtime.GOARCH)
+	w.field("process_id", os.Getpid())
+	w.field("tcp_port", svr.opts.port)
+	w.field("tls_port", svr.opts.tlsPort)
+	w.field("uptime_in_seconds", int64(uptime.Seconds()))
+	w.field("uptime_in_days", int64(uptime.Hours()/24))
+	if executable, err := os.Executable(); err == nil {
+		w.field("executable", executable)
+	}
+
+	// the config of the server.
+	opts := svr.opts
+	w.field("config_file", opts.configFile)
+	w.field("bind", opts.host)
+	w.field("dbpath", opts.dbPath)
+	w.field("databases", opts.databases)
+	w.field("replport", opts.replPort)
+	w.field("replicaof", opts.replicaOf)
+	w.field("raftid", opts.raftID)
+	w.field("raftaddr", opts.raftAddr)
+	w.field("metricsaddr", opts.metricsAddr)
+}
+
+func infoMemory(w *infoWriter, dbStats map[int]*kv_engine.Stats) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var indexMemory int64
+	for _, stats := range dbStats {
+		indexMemory += stats.IndexMemory
+	}
+	w.field("used_memory", ms.HeapAlloc)
+	w.field("used_memory_human", humanBytes(int64(ms.HeapAlloc)))
+	w.field("used_memory_sys", ms.Sys)
+	w.field("used_memory_sys_human", humanBytes(int64(ms.Sys)))
+	w.field("used_memory_index", indexMemory)
+	w.field("used_memory_index_human", humanBytes(indexMemory))
+	w.field("gc_runs", ms.NumGC)
+}
+
+// infoPersistence writes the log files of every database, a field per data type like:
+//
+//	db0_string:active_log_files=1,archived_log_files=2,disk_bytes=1024,discarded_bytes=256,discard_ratio=0.25,...
+func infoPersistence(w *infoWriter, dbStats map[int]*kv_engine.Stats) {
+	var diskBytes int64
+	for _, stats := range dbStats {
+		diskBytes += stats.DiskBytes
+	}
+	w.field("disk_bytes", diskBytes)
+	w.field("disk_bytes_human", humanBytes(diskBytes))
+
+	for _, n := range sortedDBs(dbStats) {
+		stats := dbStats[n]
+		if stats.Degraded != nil {
+			w.field(fmt.Sprintf("db%d_degraded", n), 1)
+			w.field(fmt.Sprintf("db%d_degraded_since", n), stats.DegradedSince.Unix())
+			w.field(fmt.Sprintf("db%d_degraded_error", n), stats.Degraded)
+		} else {
+			w.field(fmt.Sprintf("db%d_degraded", n), 0)
+		}
+		for dataType := kv_engine.String; dataType <= kv_engine.ZSet; dataType++ {
+			st := stats.DataTypes[dataType]
+			if st == nil {
+				continue
+			}
+			var total, discarded int64
+			for _, record := range st.Discards {
+				total += record.Total
+				discarded += record.Discarded
+			}
+			var ratio float64
+			if total > 0 {
+				ratio = float64(discarded) / float64(total)
+			}
+			lastGC := int64(-1)
+			if !st.LastGC.IsZero() {
+				lastGC = st.LastGC.Unix()
+			}
+			w.field(fmt.Sprintf("db%d_%s", n, dataTypeNames[dataType]), fmt.Sprintf(
+				"active_log_files=%d,archived_log_files=%d,disk_bytes=%d,discarded_bytes=%d,discard_ratio=%.4f,"+
+					"syncs=%d,gc_runs=%d,gc_files=%d,gc_reclaimed_bytes=%d,last_gc_time=%d",
+				st.ActiveLogFiles, st.ArchivedLogFiles, st.DiskBytes, discarded, ratio,
+				st.Syncs, st.GCRuns, st.GCFiles, st.GCReclaimedBytes, lastGC))
+		}
+	}
+}
+
+func (svr *Server) infoStats(w *infoWriter) {
+	m := svr.metrics
+	w.field("total_connections_received", atomic.LoadInt64(&m.connAccepted))
+	w.field("total_commands_processed", atomic.LoadInt64(&m.processed))
+	w.field("total_error_replies", atomic.LoadInt64(&m.failed))
+	w.field("instantaneous_ops_per_sec", atomic.LoadInt64(&m.opsPerSec))
+}
+
+// infoReplication writes the replication state of database 0, which is the only one replicated.
+func (svr *Server) infoReplication(w *infoWriter) {
+	svr.mu.RLock()
+	db := svr.dbs[0]
+	svr.mu.RUnlock()
+
+	status := db.ReplicationStatus()
+	if status.IsReplica {
+		w.field("role", "slave")
+		host, port, _ := net.SplitHostPort(status.Primary)
+		w.field("master_host", host)
+		w.field("master_port", port)
+		linkStatus := "down"
+		if status.Connected {
+			linkStatus = "up"
+		}
+		w.field("master_link_status", linkStatus)
+		lastIO := int64(-1)
+		if !status.LastHeartbeat.IsZero() {
+			lastIO = int64(time.Since(status.LastHeartbeat).Seconds())
+		}
+		w.field("master_last_io_seconds_ago", lastIO)
+		w.field("master_lag_bytes", status.LagBytes)
+	} else {
+		w.field("role", "master")
+		w.field("connected_slaves", status.Replicas)
+	}
+
+	node := svr.node
+	if node == nil {
+		w.field("cluster_enabled", 0)
+		return
+	}
+	w.field("cluster_enabled", 1)
+	leaderAddr, leaderID := node.Leader()
+	w.field("raft_node_id", svr.opts.raftID)
+	w.field("raft_is_leader", boolToInt(node.IsLeader()))
+	w.field("raft_leader_id", leaderID)
+	w.field("raft_leader_addr", leaderAddr)
+}
+
+// infoKeyspace writes the keys of every database which is not empty, like:
+//
+//	db0:keys=3,string=1,list=1,hash=1,set=0,zset=0
+//
+// Keys are counted per data type, so a key holding values of several data types is counted more than once,
+// and expired keys which are not deleted yet are included.
+func infoKeyspace(w *infoWriter, dbStats map[int]*kv_engine.Stats) {
+	for _, n := range sortedDBs(dbStats) {
+		var total int
+		var perType []string
+		for dataType := kv_engine.String; dataType <= kv_engine.ZSet; dataType++ {
+			var keys int
+			if st := dbStats[n].DataTypes[dataType]; st != nil {
+				keys = st.Keys
+			}
+			total += keys
+			perType = append(perType, fmt.Sprintf("%s=%d", dataTypeNames[dataType], keys))
+		}
+		if total == 0 {
+			continue
+		}
+		w.field(fmt.Sprintf("db%d", n), fmt.Sprintf("keys=%d,%s", total, strings.Join(perType, ",")))
+	}
+}
+
+func sortedDBs(dbStats map[int]*kv_engine.Stats) []int {
+	dbs := make([]int, 0, len(dbStats))
+	for n := range dbStats {
+		dbs = append(dbs, n)
+	}
+	sort.Ints(dbs)
+	return dbs
+}
+
+// humanBytes formats n like the human readable fields of redis info, e.g. 1.50M.
+func humanBytes(n int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reid00/kv_engine"
+	"github.com/stretchr/testify/assert"
+)
+
+func newInfoServer(t *testing.T) *Server {
+	db, err := kv_engine.Open(kv_engine.DefaultOptions(t.TempDir()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	assert.Nil(t, db.Set([]byte("str"), []byte("v")))
+	assert.Nil(t, db.LPush([]byte("list"), []byte("a"), []byte("b")))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("f"), []byte("v")))
+
+	svr := &Server{
+		dbs:   map[int]*kv_engine.RoseDB{0: db},
+		opts:  ServerOptions{host: defaultHost, port: "5299", databases: defaultDataBasesNum},
+		mu:    new(sync.RWMutex),
+		start: time.Now(),
+	}
+	svr.metrics = newServerMetrics(svr)
+	return svr
+}
+
+// parseInfo returns the section headers of info in order, and the fields of all sections.
+func parseInfo(t *testing.T, info string) ([]string, map[string]string) {
+	var headers []string
+	fields := make(map[string]string)
+	if info == "" {
+		return headers, fields
+	}
+	assert.True(t, strings.HasSuffix(info, "\r\n"))
+	for _, line := range strings.Split(strings.TrimSuffix(info, "\r\n"), "\r\n") {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "# "):
+			headers = append(headers, line[2:])
+		default:
+			i := strings.IndexByte(line, ':')
+			assert.True(t, i > 0, line)
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	return headers, fields
+}
+
+func TestServer_InfoSections(t *testing.T) {
+	svr := newInfoServer(t)
+	all := []string{"Server", "Clients", "Memory", "Persistence", "Stats", "Replication", "Keyspace"}
+
+	for _, sections := range [][]string{nil, {"all"}, {"default"}, {"EVERYTHING"}, {"all", "server"}} {
+		headers, _ := parseInfo(t, svr.info(sections))
+		assert.Equal(t, all, headers, sections)
+	}
+
+	// sections are returned in order, and unknown sections are ignored.
+	headers, fields := parseInfo(t, svr.info([]string{"keyspace", "SERVER", "unknown"}))
+	assert.Equal(t, []string{"Server", "Keyspace"}, headers)
+	assert.Equal(t, "5299", fields["tcp_port"])
+	_, ok := fields["connected_clients"]
+	assert.False(t, ok)
+
+	assert.Equal(t, "", svr.info([]string{"unknown"}))
+
+	// sections are separated by a blank line.
+	info := svr.info([]string{"clients", "stats"})
+	assert.True(t, strings.HasPrefix(info, "# Clients\r\nconnected_clients:0\r\n\r\n# Stats\r\n"), info)
+}
+
+func TestServer_InfoFields(t *testing.T) {
+	svr := newInfoServer(t)
+	svr.metrics.connOpened()
+	_, fields := parseInfo(t, svr.info(nil))
+
+	assert.Equal(t, serverVersion, fields["rosedb_version"])
+	assert.Equal(t, defaultHost, fields["bind"])
+	assert.Equal(t, "16", fields["databases"])
+	assert.Equal(t, "1", fields["connected_clients"])
+	assert.Equal(t, "1", fields["total_connections_received"])
+	assert.Equal(t, "master", fields["role"])
+	assert.Equal(t, "0", fields["connected_slaves"])
+	assert.Equal(t, "0", fields["cluster_enabled"])
+	assert.Equal(t, "0", fields["db0_degraded"])
+	assert.Equal(t, "keys=3,string=1,list=1,hash=1,set=0,zset=0", fields["db0"])
+	assert.True(t, strings.HasPrefix(fields["db0_string"], "active_log_files=1,archived_log_files=0,"), fields["db0_string"])
+	assert.NotEqual(t, "0", fields["used_memory"])
+
+	// empty databases are not in keyspace.
+	assert.Nil(t, svr.dbs[0].FlushAll())
+	_, fields = parseInfo(t, svr.info([]string{"keyspace"}))
+	assert.Empty(t, fields)
+}
+
+func TestHumanBytes(t *testing.T) {
+	assert.Equal(t, "0B", humanBytes(0))
+	assert.Equal(t, "1023B", humanBytes(1023))
+	assert.Equal(t, "1.50K", humanBytes(1536))
+	assert.Equal(t, "2.00M", humanBytes(2<<20))
+	assert.Equal(t, "1.00T", humanBytes(1<<40))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/reid00/kv_engine"
+	"github.com/reid00/kv_engine/logger"
+)
+
+const metricsNamespace = "rosedb"
+
+var dataTypeNames = map[kv_engine.DataType]string{
+	kv_engine.String: "string",
+	kv_engine.List:   "list",
+	kv_engine.Hash:   "hash",
+	kv_engine.Set:    "set",
+	kv_engine.ZSet:   "zset",
+}
+
+type serverMetrics struct {
+	// counters reported by info command, accessed atomically.
+	clients      int64
+	connAccepted int64
+	processed    int64
+	failed       int64
+	opsPerSec    int64
+
+	registry        *prometheus.Registry
+	commands        *prometheus.CounterVec
+	commandErrors   *prometheus.CounterVec
+	commandDuration *prometheus.HistogramVec
+	connections     prometheus.Gauge
+	connReceived    prometheus.Counter
+}
+
+func newServerMetrics(svr *Server) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_total",
+			Help:      "Number of commands processed.",
+		}, []string{"cmd"}),
+		commandErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_errors_total",
+			Help:      "Number of commands failed with an error reply, key not found is not an error.",
+		}, []string{"cmd"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_duration_seconds",
+			Help:      "Latency of commands.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"cmd"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connected_clients",
+			Help:      "Number of client connections.",
+		}),
+		connReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_received_total",
+			Help:      "Number of connections accepted.",
+		}),
+	}
+	m.registry.MustRegister(m.commands, m.commandErrors, m.commandDuration, m.connections, m.connReceived,
+		&engineCollector{svr: svr},
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *serverMetrics) observeCommand(command string, start time.Time, err error) {
+	m.commands.WithLabelValues(command).Inc()
+	m.commandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	atomic.AddInt64(&m.processed, 1)
+	if err != nil && err != kv_engine.ErrKeyNotFound {
+		m.commandErrors.WithLabelValues(command).Inc()
+		atomic.AddInt64(&m.failed, 1)
+	}
+}
+
+func (m *serverMetrics) connOpened() {
+	m.connReceived.Inc()
+	m.connections.Inc()
+	atomic.AddInt64(&m.connAccepted, 1)
+	atomic.AddInt64(&m.clients, 1)
+}
+
+func (m *serverMetrics) connClosed() {
+	m.connections.Dec()
+	atomic.AddInt64(&m.clients, -1)
+}
+
+// sampleOpsPerSec samples the number of commands processed in the last second, until stop is closed.
+func (m *serverMetrics) sampleOpsPerSec(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := atomic.LoadInt64(&m.processed)
+	for {
+		select {
+		case <-ticker.C:
+			processed := atomic.LoadInt64(&m.processed)
+			atomic.StoreInt64(&m.opsPerSec, processed-last)
+			last = processed
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (svr *Server) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(svr.metrics.registry, promhttp.HandlerOpts{}))
+	logger.Infof("rosedb metrics is serving on %s/metrics", svr.opts.metricsAddr)
+	if err := http.ListenAndServe(svr.opts.metricsAddr, mux); err != nil {
+		logger.Errorf("serve metrics err: %v", err)
+	}
+}
+
+var (
+	keysDesc = prometheus.NewDesc(metricsNamespace+"_keys",
+		"Number of keys.", []string{"db", "type"}, nil)
+	logFilesDesc = prometheus.NewDesc(metricsNamespace+"_log_files",
+		"Number of log files.", []string{"db", "type", "state"}, nil)
+	diskBytesDesc = prometheus.NewDesc(metricsNamespace+"_disk_bytes",
+		"Size of log files on disk.", []string{"db", "type"}, nil)
+	discardedBytesDesc = prometheus.NewDesc(metricsNamespace+"_discarded_bytes",
+		"Size of invalid entries in log files, which can be reclaimed by log file gc.", []string{"db", "type"}, nil)
+	discardDroppedDesc = prometheus.NewDesc(metricsNamespace+"_discard_dropped_total",
+		"Number of discarded entries not recorded because the discard channel is full.", []string{"db", "type"}, nil)
+	gcRunsDesc = prometheus.NewDesc(metricsNamespace+"_gc_runs_total",
+		"Number of log file gc runs.", []string{"db", "type"}, nil)
+	gcFilesDesc = prometheus.NewDesc(metricsNamespace+"_gc_files_total",
+		"Number of log files removed by log file gc.", []string{"db", "type"}, nil)
+	gcReclaimedDesc = prometheus.NewDesc(metricsNamespace+"_gc_reclaimed_bytes_total",
+		"Bytes freed by log file gc.", []string{"db", "type"}, nil)
+	indexMemoryDesc = prometheus.NewDesc(metricsNamespace+"_index_memory_bytes",
+		"Estimated memory used by the index.", []string{"db", "type"}, nil)
+)
+
+// engineCollector collects the stats of all opened databases on every scrape.
+type engineCollector struct {
+	svr *Server
+}
+
+func (c *engineCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{keysDesc, logFilesDesc, diskBytesDesc, discardedBytesDesc,
+		discardDroppedDesc, gcRunsDesc, gcFilesDesc, gcReclaimedDesc, indexMemoryDesc} {
+		ch <- desc
+	}
+}
+
+func (c *engineCollector) Collect(ch chan<- prometheus.Metric) {
+	c.svr.mu.RLock()
+	dbs := make(map[int]*kv_engine.RoseDB, len(c.svr.dbs))
+	for n, db := range c.svr.dbs {
+		dbs[n] = db
+	}
+	c.svr.mu.RUnlock()
+
+	for n, db := range dbs {
+		stats, err := db.Stats()
+		if err != nil {
+			logger.Errorf("get stats of db %d err: %v", n, err)
+			continue
+		}
+		dbLabel := strconv.Itoa(n)
+		for dataType, st := range stats.DataTypes {
+			typ := dataTypeNames[dataType]
+			var discarded int64
+			for _, record := range st.Discards {
+				discarded += record.Discarded
+			}
+			ch <- prometheus.MustNewConstMetric(keysDesc, prometheus.GaugeValue, float64(st.Keys), dbLabel, typ)
+			ch <- prometheus.MustNewConstMetric(logFilesDesc, prometheus.GaugeValue, float64(st.ActiveLogFiles), dbLabel, typ, "active")
+			ch <- prometheus.MustNewConstMetric(logFilesDesc, prometheus.GaugeValue, float64(st.ArchivedLogFiles), dbLabel, typ, "archived")
+			ch <- prometheus.MustNewConstMetric(diskBytesDesc, prometheus.GaugeValue, float64(st.DiskBytes), dbLabel, typ)
+			ch <- prometheus.MustNewConstMetric(discardedBytesDesc, prometheus.GaugeValue, float64(discarded), dbLabel, typ)
+			ch <- prometheus.MustNewConstMetric(discardDroppedDesc, prometheus.CounterValue, float64(st.DiscardDropped), dbLabel, typ)
+			ch <- prometheus.MustNewConstMetric(gcRunsDesc, prometheus.CounterValue, float64(st.GCRuns), dbLabel, typ)
+			ch <- prometheus.MustNewConstMetric(gcFilesDesc, prometheus.CounterValue, float64(st.GCFiles), dbLabel, typ)
+			ch <- prometheus.MustNewConstMetric(gcReclaimedDesc, prometheus.CounterValue, float64(st.GCReclaimedBytes), dbLabel, typ)
+			ch <- prometheus.MustNewConstMetric(indexMemoryDesc, prometheus.GaugeValue, float64(st.IndexMemory), dbLabel, typ)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/reid00/kv_engine"
+	"github.com/reid00/kv_engine/cluster"
 	"github.com/reid00/kv_engine/logger"
 	"github.com/tidwall/redcon"
 )
@@ -39,32 +41,76 @@ func init() {
 }
 
 type Server struct {
-	dbs    map[int]*kv_engine.RoseDB
-	svr    *redcon.Server
-	singal chan os.Signal
-	opts   ServerOptions
-	mu     *sync.RWMutex
+	dbs     map[int]*kv_engine.RoseDB
+	svr     *redcon.Server
+	tlsSvr  *redcon.TLSServer
+	replLn  net.Listener
+	node    *cluster.Node
+	acl     *acl
+	config  *config
+	metrics *serverMetrics
+	singal  chan os.Signal
+	opts    ServerOptions
+	mu      *sync.RWMutex
+	start   time.Time
+	done    chan struct{}
 }
 
 type ServerOptions struct {
-	dbPath    string
-	host      string
-	port      string
-	databases uint
+	configFile     string
+	dbPath         string
+	host           string
+	port           string
+	databases      uint
+	replPort       string
+	replicaOf      string
+	raftID         string
+	raftAddr       string
+	raftDir        string
+	bootstrap      bool
+	metricsAddr    string
+	requirePass    string
+	aclFile        string
+	tlsPort        string
+	tlsCert        string
+	tlsKey         string
+	tlsCACert      string
+	tlsAuthClients string
 }
 
 func main() {
 
 	serverOpts := new(ServerOptions)
 
+	flag.StringVar(&serverOpts.configFile, configFlag, "", "config file of server and engine options, flags on the command line take precedence over it")
 	flag.StringVar(&serverOpts.dbPath, "dbpath", defaultDBPath, "db path")
 	flag.StringVar(&serverOpts.host, "host", defaultHost, "server host")
-	flag.StringVar(&serverOpts.port, "port", defaultPort, "server port")
+	flag.StringVar(&serverOpts.port, "port", defaultPort, "server port, plain tcp is disabled if 0")
 	flag.UintVar(&serverOpts.databases, "database", defaultDataBasesNum, "the number of database")
+	flag.StringVar(&serverOpts.replPort, "replport", "", "serve replicas of database 0 on this port, disabled if empty")
+	flag.StringVar(&serverOpts.replicaOf, "replicaof", "", "replicate database 0 from the primary's replport(host:port)")
+	flag.StringVar(&serverOpts.raftID, "raftid", "", "node id in raft cluster of database 0, cluster mode is disabled if empty")
+	flag.StringVar(&serverOpts.raftAddr, "raftaddr", "127.0.0.1:5300", "raft address of this node(host:port)")
+	flag.StringVar(&serverOpts.raftDir, "raftdir", "", "raft log and snapshots dir, default is raft-<raftid> under dbpath")
+	flag.BoolVar(&serverOpts.bootstrap, "bootstrap", false, "bootstrap a new raft cluster with this node")
+	flag.StringVar(&serverOpts.metricsAddr, "metricsaddr", "", "serve prometheus metrics on http://<metricsaddr>/metrics, disabled if empty")
+	flag.StringVar(&serverOpts.requirePass, "requirepass", "", "password of the default user, clients must AUTH before running commands if set")
+	flag.StringVar(&serverOpts.aclFile, "aclfile", "", "file to persist ACL users, default is users.acl under dbpath")
+	flag.StringVar(&serverOpts.tlsPort, "tlsport", "", "serve RESP over tls on this port, disabled if empty")
+	flag.StringVar(&serverOpts.tlsCert, "tlscert", "", "certificate file of the tls port")
+	flag.StringVar(&serverOpts.tlsKey, "tlskey", "", "private key file of the tls port")
+	flag.StringVar(&serverOpts.tlsCACert, "tlscacert", "", "CA certificate file to verify tls clients, mutual tls is enabled if set")
+	flag.StringVar(&serverOpts.tlsAuthClients, "tlsauthclients", tlsAuthClientsYes, "whether tls clients must present a certificate if tlscacert is set: yes, optional or no")
 	flag.Parse()
 
+	cfg, err := newConfig(serverOpts.configFile, flag.CommandLine)
+	if err != nil {
+		logger.Errorf("load config err, fail to start server. %v", err)
+		return
+	}
 	path := filepath.Join(serverOpts.dbPath, fmt.Sprintf(dbName, 0))
-	opts := kv_engine.DefaultOptions(path)
+	opts := cfg.dbOptions(0, path)
+	opts.ReplicaOf = serverOpts.replicaOf
 
 	now := time.Now()
 	db, err := kv_engine.Open(opts)
@@ -75,6 +121,16 @@ func main() {
 	}
 	logger.Infof("open db from [%s] successfully, time cost: %v", serverOpts.dbPath, time.Since(now))
 
+	aclFile := serverOpts.aclFile
+	if aclFile == "" {
+		aclFile = filepath.Join(serverOpts.dbPath, "users.acl")
+	}
+	serverACL, err := newACL(aclFile, serverOpts.requirePass)
+	if err != nil {
+		logger.Errorf("load acl users err, fail to start server. %v", err)
+		return
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
@@ -85,26 +141,73 @@ func main() {
 	// init and start server
 	svr := &Server{
 		dbs:    dbs,
+		acl:    serverACL,
+		config: cfg,
 		singal: sig,
 		opts:   *serverOpts,
 		mu:     new(sync.RWMutex),
+		start:  time.Now(),
+		done:   make(chan struct{}),
 	}
+	svr.metrics = newServerMetrics(svr)
+	go svr.metrics.sampleOpsPerSec(svr.done)
 
-	addr := svr.opts.host + ":" + svr.opts.port
-
-	redServer := redcon.NewServerNetwork("tcp", addr, execClientCommand, svr.redconAccept,
-		func(conn redcon.Conn, err error) {
-
-		},
-	)
+	closed := func(conn redcon.Conn, err error) {
+		svr.metrics.connClosed()
+	}
+	if svr.opts.port != "0" {
+		addr := svr.opts.host + ":" + svr.opts.port
+		svr.svr = redcon.NewServerNetwork("tcp", addr, execClientCommand, svr.redconAccept, closed)
+	}
+	if svr.opts.tlsPort != "" {
+		config, err := newTLSConfig(svr.opts)
+		if err != nil {
+			logger.Errorf("init tls err, fail to start server. %v", err)
+			return
+		}
+		addr := svr.opts.host + ":" + svr.opts.tlsPort
+		svr.tlsSvr = redcon.NewServerNetworkTLS("tcp", addr, execClientCommand, svr.redconAccept, closed, config)
+	}
+	if svr.svr == nil && svr.tlsSvr == nil {
+		logger.Errorf("both port and tlsport are disabled, fail to start server.")
+		return
+	}
 
-	svr.svr = redServer
+	if svr.opts.replPort != "" {
+		ln, err := net.Listen("tcp", svr.opts.host+":"+svr.opts.replPort)
+		if err != nil {
+			logger.Errorf("listen replication port err, fail to start server. %v", err)
+			return
+		}
+		svr.replLn = ln
+		go svr.serveReplication(db)
+	}
+	if svr.opts.raftID != "" {
+		if err := svr.startClusterNode(db); err != nil {
+			logger.Errorf("start cluster node err, fail to start server. %v", err)
+			return
+		}
+	}
+	if svr.opts.metricsAddr != "" {
+		go svr.serveMetrics()
+	}
 	go svr.listen()
 	<-svr.singal
 	svr.stop()
 }
 
 func (svr *Server) listen() {
+	if svr.tlsSvr != nil {
+		go func() {
+			logger.Infof("rosedb server is running on tls port %s, ready to accept conection", svr.opts.tlsPort)
+			if err := svr.tlsSvr.ListenAndServe(); err != nil {
+				logger.Fatalf("listen and serve tls err, fail to start. %v\n", err)
+			}
+		}()
+	}
+	if svr.svr == nil {
+		return
+	}
 	logger.Infof("rosedb server is running, ready to accept conection")
 	if err := svr.svr.ListenAndServe(); err != nil {
 		logger.Fatalf("listen and serve err, fail to start. %v\n", err)
@@ -112,15 +215,57 @@ func (svr *Server) listen() {
 	}
 }
 
+func (svr *Server) serveReplication(db *kv_engine.RoseDB) {
+	logger.Infof("rosedb is serving replicas on %s", svr.replLn.Addr())
+	if err := db.ServeReplication(svr.replLn); err != nil {
+		logger.Errorf("serve replication err: %v", err)
+	}
+}
+
+func (svr *Server) startClusterNode(db *kv_engine.RoseDB) error {
+	raftDir := svr.opts.raftDir
+	if raftDir == "" {
+		raftDir = filepath.Join(svr.opts.dbPath, "raft-"+svr.opts.raftID)
+	}
+	node, err := cluster.Open(db, cluster.Options{
+		NodeID:    svr.opts.raftID,
+		RaftAddr:  svr.opts.raftAddr,
+		RaftDir:   raftDir,
+		Bootstrap: svr.opts.bootstrap,
+	}, svr.applyCommand)
+	if err != nil {
+		return err
+	}
+	svr.node = node
+	logger.Infof("rosedb cluster node %s is running on %s", svr.opts.raftID, svr.opts.raftAddr)
+	return nil
+}
+
 func (svr *Server) stop() {
+	close(svr.done)
+	if svr.replLn != nil {
+		_ = svr.replLn.Close()
+	}
+	if svr.node != nil {
+		if err := svr.node.Close(); err != nil {
+			logger.Errorf("close cluster node err: %v", err)
+		}
+	}
 	for _, db := range svr.dbs {
 		if err := db.Close(); err != nil {
 			logger.Errorf("close db err: %v", err)
 		}
 	}
 
-	if err := svr.svr.Close(); err != nil {
-		logger.Errorf("close server err: %v", err)
+	if svr.svr != nil {
+		if err := svr.svr.Close(); err != nil {
+			logger.Errorf("close server err: %v", err)
+		}
+	}
+	if svr.tlsSvr != nil {
+		if err := svr.tlsSvr.Close(); err != nil {
+			logger.Errorf("close tls server err: %v", err)
+		}
 	}
 	logger.Info("rosedb is ready to exit, byt byte...")
 }
@@ -128,7 +273,11 @@ func (svr *Server) stop() {
 func (svr *Server) redconAccept(conn redcon.Conn) bool {
 	cli := new(Client)
 	cli.svr = svr
+	cli.user = svr.acl.initialUser()
 	svr.mu.RLock()
+	cli.db = svr.dbs[0]
+	svr.mu.RUnlock()
 	conn.SetContext(cli)
+	svr.metrics.connOpened()
 	return true
 }
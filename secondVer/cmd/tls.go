@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// values of tlsauthclients flag.
+const (
+	tlsAuthClientsYes      = "yes"
+	tlsAuthClientsOptional = "optional"
+	tlsAuthClientsNo       = "no"
+)
+
+// newTLSConfig returns the tls config of the RESP listener from the tls flags.
+// Clients are verified by tlsCACert if it is set, and they must present a certificate unless tlsAuthClients says otherwise.
+func newTLSConfig(opts ServerOptions) (*tls.Config, error) {
+	if opts.tlsCert == "" || opts.tlsKey == "" {
+		return nil, errors.New("tlscert and tlskey are required to serve tls")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.tlsCert, opts.tlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair err: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.tlsCACert == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(opts.tlsCACert)
+	if err != nil {
+		return nil, fmt.Errorf("read tls ca cert err: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in tls ca cert %s", opts.tlsCACert)
+	}
+	config.ClientCAs = pool
+	switch opts.tlsAuthClients {
+	case tlsAuthClientsYes, "":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case tlsAuthClientsOptional:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case tlsAuthClientsNo:
+		config.ClientAuth = tls.NoClientCert
+	default:
+		return nil, fmt.Errorf("invalid tlsauthclients %q, it must be one of yes, optional and no", opts.tlsAuthClients)
+	}
+	return config, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/redcon"
+)
+
+// testCert is a generated certificate and its key, signed by parent or self-signed if parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key in pem to dir, and returns their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	assert.Nil(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certPath, keyPath
+}
+
+// clientConfig returns a client config presenting the certificate, even if it is not signed by the CAs the server accepts.
+func (c *testCert) clientConfig(roots *x509.CertPool) *tls.Config {
+	cert := tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+	return &tls.Config{RootCAs: roots, GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	}}
+}
+
+// serveTLS serves ping over tls with config, and returns the address.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	svr := redcon.NewServerNetworkTLS("tcp", addr, func(conn redcon.Conn, cmd redcon.Command) {
+		conn.WriteString(resultPong)
+	}, nil, nil, config)
+	signal := make(chan error, 1)
+	go func() { _ = svr.ListenServeAndSignal(signal) }()
+	assert.Nil(t, <-signal)
+	t.Cleanup(func() { _ = svr.Close() })
+	return addr
+}
+
+func tlsPing(t *testing.T, addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "rosedb-ca", true, nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newTestCert(t, "rosedb-server", false, ca).write(t, dir, "server")
+	client := newTestCert(t, "rosedb-client", false, ca)
+	stranger := newTestCert(t, "stranger", false, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	t.Run("server-only", func(t *testing.T) {
+		config, err := newTLSConfig(ServerOptions{tlsCert: certPath, tlsKey: keyPath})
+		assert.Nil(t, err)
+		addr := serveTLS(t, config)
+
+		reply, err := tlsPing(t, addr, &tls.Config{RootCAs: roots})
+		assert.Nil(t, err)
+		assert.Equal(t, "+PONG\r\n", reply)
+		// the server certificate is verified by clients.
+		_, err = tlsPing(t, addr, &tls.Config{})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("mutual", func(t *testing.T) {
+		config, err := newTLSConfig(ServerOptions{tlsCert: certPath, tlsKey: keyPath, tlsCACert: caPath})
+		assert.Nil(t, err)
+		addr := serveTLS(t, config)
+
+		reply, err := tlsPing(t, addr, client.clientConfig(roots))
+		assert.Nil(t, err)
+		assert.Equal(t, "+PONG\r\n", reply)
+		_, err = tlsPing(t, addr, &tls.Config{RootCAs: roots})
+		assert.NotNil(t, err)
+		_, err = tlsPing(t, addr, stranger.clientConfig(roots))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("optional-client-cert", func(t *testing.T) {
+		config, err := newTLSConfig(ServerOptions{tlsCert: certPath, tlsKey: keyPath, tlsCACert: caPath,
+			tlsAuthClients: tlsAuthClientsOptional})
+		assert.Nil(t, err)
+		addr := serveTLS(t, config)
+
+		reply, err := tlsPing(t, addr, &tls.Config{RootCAs: roots})
+		assert.Nil(t, err)
+		assert.Equal(t, "+PONG\r\n", reply)
+		_, err = tlsPing(t, addr, stranger.clientConfig(roots))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newTLSConfig(ServerOptions{tlsCert: certPath})
+		assert.NotNil(t, err)
+		_, err = newTLSConfig(ServerOptions{tlsCert: certPath, tlsKey: filepath.Join(dir, "missing.key")})
+		assert.NotNil(t, err)
+		_, err = newTLSConfig(ServerOptions{tlsCert: certPath, tlsKey: keyPath, tlsCACert: keyPath})
+		assert.NotNil(t, err)
+		_, err = newTLSConfig(ServerOptions{tlsCert: certPath, tlsKey: keyPath, tlsCACert: caPath, tlsAuthClients: "maybe"})
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,159 @@
+package kv_engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reid00/kv_engine/logger"
+)
+
+// groupCommit makes the writes of a data type durable when Options.Sync is set.
+// Writers append entries while holding the index lock, and wait for durability after releasing it,
+// so the entries of all concurrent writers are covered by a single fsync of the active log file.
+type groupCommit struct {
+	// number of fsyncs, accessed atomically.
+	syncs uint64
+	// bytes written since the last sync, accessed atomically.
+	unsynced int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	// entries before synced are durable.
+	synced Position
+}
+
+func newGroupCommit() *groupCommit {
+	gc := &groupCommit{}
+	gc.cond = sync.NewCond(&gc.mu)
+	return gc
+}
+
+// unlockWrite releases the index lock of the data type after writing,
+// and waits until the writes are durable if Options.Sync is set, err is set if the sync fails.
+// It is deferred by write operations, so err must be the named result of them.
+func (db *RoseDB) unlockWrite(dataType DataType, err *error) {
+	db.unlockWriteSync(dataType, db.opts.Sync, err)
+}
+
+// unlockWriteSync is like unlockWrite, but the writes are synced only if sync is true.
+func (db *RoseDB) unlockWriteSync(dataType DataType, sync bool, err *error) {
+	db.releaseWrite(dataType, db.indexLock(dataType).Unlock, sync, err)
+}
+
+// releaseWrite calls unlock to release the locks held by a write, and waits until the writes are durable if sync is true.
+func (db *RoseDB) releaseWrite(dataType DataType, unlock func(), sync bool, err *error) {
+	if !sync {
+		unlock()
+		return
+	}
+	// entries written by this writer are all before the current end of active log file.
+	end, ok := db.writeEnd(dataType)
+	unlock()
+	if ok && *err == nil {
+		*err = db.waitDurable(dataType, end)
+	}
+}
+
+// writeEnd returns the end position of active log file.
+func (db *RoseDB) writeEnd(dataType DataType) (Position, bool) {
+	active := db.getActiveLogFile(dataType)
+	if active == nil {
+		return Position{}, false
+	}
+	return Position{DataType: dataType, Fid: active.Fid, Offset: atomic.LoadInt64(&active.WriteAt)}, true
+}
+
+// waitDurable blocks until entries before end are synced.
+// One of the waiters syncs the active log file for all of them, the others wait for it to finish.
+func (db *RoseDB) waitDurable(dataType DataType, end Position) error {
+	gc := db.commits[dataType]
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	for gc.synced.before(end) {
+		if gc.syncing {
+			gc.cond.Wait()
+			continue
+		}
+
+		// become the leader, entries written meanwhile will be covered by the next sync.
+		gc.syncing = true
+		gc.mu.Unlock()
+		// the archived log files were synced when the active log file was rotated.
+		active := db.getActiveLogFile(dataType)
+		if active == nil {
+			// the log files are removed by resetData, nothing to sync.
+			gc.mu.Lock()
+			gc.syncing = false
+			gc.cond.Broadcast()
+			return nil
+		}
+		atomic.StoreInt64(&gc.unsynced, 0)
+		target := Position{DataType: dataType, Fid: active.Fid, Offset: atomic.LoadInt64(&active.WriteAt)}
+		err := active.Sync()
+		atomic.AddUint64(&gc.syncs, 1)
+		gc.mu.Lock()
+		gc.syncing = false
+		if err == nil && gc.synced.before(target) {
+			gc.synced = target
+		}
+		gc.cond.Broadcast()
+		if err != nil {
+			// the written entries may be lost by the failed sync.
+			return db.degrade(err)
+		}
+	}
+	return nil
+}
+
+// countUnsynced counts the bytes written to active log file,
+// and wakes up the background sync once they reach Options.BytesPerSync.
+func (db *RoseDB) countUnsynced(dataType DataType, size int) {
+	if db.opts.Sync || db.opts.BytesPerSync <= 0 {
+		return
+	}
+	if atomic.AddInt64(&db.commits[dataType].unsynced, int64(size)) >= db.opts.BytesPerSync {
+		select {
+		case db.syncCh <- dataType:
+		default:
+		}
+	}
+}
+
+// handleBackgroundSync syncs active log files periodically, or after Options.BytesPerSync bytes are written.
+func (db *RoseDB) handleBackgroundSync() {
+	defer close(db.syncDone)
+
+	var tick <-chan time.Time
+	if db.opts.SyncInterval > 0 {
+		ticker := time.NewTicker(db.opts.SyncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			for dataType := String; dataType < logFileTypeNum; dataType++ {
+				db.syncInBackground(dataType)
+			}
+		case dataType := <-db.syncCh:
+			db.syncInBackground(dataType)
+		case <-db.syncStop:
+			return
+		}
+	}
+}
+
+func (db *RoseDB) syncInBackground(dataType DataType) {
+	end, ok := db.writeEnd(dataType)
+	if !ok {
+		return
+	}
+	// nothing is synced if there is no write since the last sync.
+	if err := db.waitDurable(dataType, end); err != nil {
+		logger.Errorf("sync active log file in background err, dataType: [%v], err: [%v]", dataType, err)
+	}
+}
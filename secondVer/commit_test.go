@@ -0,0 +1,170 @@
+package kv_engine
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reid00/kv_engine/ioselector"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoseDB_GroupCommit(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-commit")
+	opts := DefaultOptions(path)
+	opts.Sync = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// make fsync slow, so that writers pile up while syncing.
+	assert.Nil(t, db.Set(GetKey(0), []byte("value")))
+	assert.Nil(t, db.HSet([]byte("hash"), GetKey(0), []byte("value")))
+	for _, dataType := range []DataType{String, Hash} {
+		active := db.getActiveLogFile(dataType)
+		active.IoSelector = &slowSyncSelector{IOSelector: active.IoSelector, delay: time.Millisecond}
+	}
+
+	writers, writes := 32, 20
+	wg := new(sync.WaitGroup)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				assert.Nil(t, db.Set(GetKey(i*writes+j), []byte("value")))
+				assert.Nil(t, db.HSet([]byte("hash"), GetKey(i*writes+j), []byte("value")))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < writers*writes; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), v)
+	}
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	for _, dataType := range []DataType{String, Hash} {
+		syncs := stats.DataTypes[dataType].Syncs
+		assert.True(t, syncs > 0)
+		assert.True(t, syncs < uint64(writers*writes), "syncs %d of data type %d are not grouped", syncs, dataType)
+	}
+
+	// every write is durable when it returns.
+	end, ok := db.writeEnd(String)
+	assert.True(t, ok)
+	assert.False(t, db.commits[String].synced.before(end))
+}
+
+type slowSyncSelector struct {
+	ioselector.IOSelector
+	delay time.Duration
+}
+
+func (s *slowSyncSelector) Sync() error {
+	time.Sleep(s.delay)
+	return s.IOSelector.Sync()
+}
+
+func TestRoseDB_BackgroundSync(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-bgsync")
+
+	synced := func(db *RoseDB, dataType DataType) bool {
+		end, _ := db.writeEnd(dataType)
+		db.commits[dataType].mu.Lock()
+		defer db.commits[dataType].mu.Unlock()
+		return !db.commits[dataType].synced.before(end)
+	}
+
+	t.Run("interval", func(t *testing.T) {
+		opts := DefaultOptions(path)
+		opts.SyncInterval = 20 * time.Millisecond
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		defer destroyDB(db)
+
+		assert.Nil(t, db.Set(GetKey(1), []byte("value")))
+		assert.Nil(t, db.LPush([]byte("list"), []byte("value")))
+		time.Sleep(100 * time.Millisecond)
+		assert.True(t, synced(db, String))
+		assert.True(t, synced(db, List))
+
+		// no sync if nothing is written.
+		syncs := atomic.LoadUint64(&db.commits[String].syncs)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, syncs, atomic.LoadUint64(&db.commits[String].syncs))
+		assert.Nil(t, db.Close())
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		opts := DefaultOptions(path)
+		opts.BytesPerSync = 4 << 10
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		defer destroyDB(db)
+
+		assert.Nil(t, db.Set(GetKey(1), []byte("value")))
+		time.Sleep(50 * time.Millisecond)
+		assert.False(t, synced(db, String))
+
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Set(GetKey(i), GetValue128B()))
+		}
+		time.Sleep(50 * time.Millisecond)
+		assert.True(t, atomic.LoadUint64(&db.commits[String].syncs) > 0)
+		assert.True(t, atomic.LoadInt64(&db.commits[String].unsynced) < opts.BytesPerSync)
+		assert.Nil(t, db.Close())
+	})
+}
+
+func TestRoseDB_WriteOptions(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-write-opts")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	ctx := context.Background()
+	synced := WriteOptions{Sync: true}
+	assert.Nil(t, db.SetWithOptions(ctx, GetKey(1), []byte("value"), synced))
+	assert.Nil(t, db.MSetWithOptions(ctx, synced, GetKey(2), []byte("v2"), GetKey(3), []byte("v3")))
+	assert.Nil(t, db.DeleteWithOptions(ctx, GetKey(3), synced))
+	assert.Nil(t, db.HSetWithOptions(ctx, []byte("hash"), GetKey(1), []byte("value"), synced))
+	_, err = db.LPushWithOptions(ctx, []byte("list"), synced, []byte("value"))
+	assert.Nil(t, err)
+	// writes without Sync are not synced.
+	assert.Nil(t, db.Set(GetKey(4), []byte("value")))
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), stats.DataTypes[String].Syncs)
+	assert.Equal(t, uint64(1), stats.DataTypes[Hash].Syncs)
+	assert.Equal(t, uint64(1), stats.DataTypes[List].Syncs)
+
+	ttl := WriteOptions{TTL: time.Second}
+	assert.Nil(t, db.SetWithOptions(ctx, GetKey(5), []byte("value"), ttl))
+	assert.Nil(t, db.HSetWithOptions(ctx, []byte("hash"), GetKey(2), []byte("value"), ttl))
+	_, err = db.LPushWithOptions(ctx, []byte("ttl-list"), ttl, []byte("v1"))
+	assert.Nil(t, err)
+	// pushing without TTL keeps the expiration of the list.
+	assert.Nil(t, db.LPush([]byte("ttl-list"), []byte("v2")))
+	assert.Equal(t, 2, db.LLen([]byte("ttl-list")))
+
+	time.Sleep(2 * time.Second)
+	_, err = db.Get(GetKey(5))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v, err := db.HGet([]byte("hash"), GetKey(2))
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+	v, err = db.HGet([]byte("hash"), GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	assert.Equal(t, 0, db.LLen([]byte("ttl-list")))
+	assert.Equal(t, 1, db.LLen([]byte("list")))
+}
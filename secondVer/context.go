@@ -0,0 +1,81 @@
+package kv_engine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// long scans check whether the context is done every ctxCheckInterval elements.
+const ctxCheckInterval = 128
+
+type timeCtxKey struct{}
+
+// WithTime returns a copy of ctx which makes the operations with it evaluate expiration at t instead of the current time,
+// and compute the timeouts of TTL from t. It is used to apply the same commands on different nodes, or to replay them later,
+// with the same results.
+func WithTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, timeCtxKey{}, t)
+}
+
+// timeOf returns the time set by WithTime, the current time if not set.
+func timeOf(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(timeCtxKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// nowOf returns the time of ctx in milliseconds.
+func nowOf(ctx context.Context) int64 {
+	return timeOf(ctx).UnixMilli()
+}
+
+// lockCtx acquires the write lock of mu, it gives up and returns ctx.Err() once ctx is done.
+// The lock acquired after giving up will be released in background.
+func lockCtx(ctx context.Context, mu *sync.RWMutex) error {
+	return acquireCtx(ctx, mu.TryLock, mu.Lock, mu.Unlock)
+}
+
+// rlockCtx acquires the read lock of mu, it gives up and returns ctx.Err() once ctx is done.
+func rlockCtx(ctx context.Context, mu *sync.RWMutex) error {
+	return acquireCtx(ctx, mu.TryRLock, mu.RLock, mu.RUnlock)
+}
+
+func acquireCtx(ctx context.Context, tryLock func() bool, lock, unlock func()) error {
+	// context.Background and context.TODO can never be done.
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tryLock() {
+		return nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// checkCtx returns ctx.Err() if ctx is done, it is only checked every ctxCheckInterval elements of a scan.
+func checkCtx(ctx context.Context, n int) error {
+	if n%ctxCheckInterval != 0 {
+		return nil
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,312 @@
+package kv_engine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reid00/kv_engine/ds/art"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoseDB_Ctx(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-ctx")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.SetCtx(context.Background(), GetKey(1), []byte("value")))
+	assert.Nil(t, db.HSetCtx(context.Background(), []byte("hash"), GetKey(1), []byte("value")))
+
+	t.Run("lock-timeout", func(t *testing.T) {
+		// a long running writer holds the lock.
+		db.strIndex.mu.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := db.GetCtx(ctx, GetKey(1))
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Equal(t, context.DeadlineExceeded, db.SetCtx(ctx, GetKey(2), []byte("value")))
+		db.strIndex.mu.Unlock()
+
+		// the locks acquired after giving up are released.
+		ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second)
+		defer cancel2()
+		assert.Nil(t, db.SetCtx(ctx2, GetKey(2), []byte("value")))
+		v, err := db.GetCtx(ctx2, GetKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), v)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := db.HGetAllCtx(ctx, []byte("hash"))
+		assert.Equal(t, context.Canceled, err)
+		_, err = db.LRangeCtx(ctx, []byte("list"), 0, -1)
+		assert.Equal(t, context.Canceled, err)
+		n, err := db.HLenCtx(ctx, []byte("hash"))
+		assert.Equal(t, 0, n)
+		assert.Equal(t, context.Canceled, err)
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		pairs, err := db.HGetAllCtx(ctx, []byte("hash"))
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{GetKey(1), []byte("value")}, pairs)
+	})
+}
+
+func TestRoseDB_WithTime(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-ctx")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the expiration is evaluated at the time of ctx, whatever the current time is, timeouts are kept in milliseconds.
+	at := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	before, after := WithTime(context.Background(), at.Add(-time.Second)), WithTime(context.Background(), at)
+	assert.Nil(t, db.SetWithOptions(context.Background(), []byte("n"), []byte("10"), WriteOptions{ExpireAt: at}))
+	val, err := db.GetCtx(before, []byte("n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), val)
+	ttl, err := db.TTLCtx(before, []byte("n"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, ttl)
+
+	_, err = db.GetCtx(after, []byte("n"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v, err := db.IncrCtx(after, []byte("n"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), v)
+
+	// TTL is counted from the time of ctx.
+	past := WithTime(context.Background(), time.Now().Add(-time.Hour))
+	assert.Nil(t, db.HSetWithOptions(past, []byte("h"), []byte("f"), []byte("v"), WriteOptions{TTL: time.Minute}))
+	ok, err := db.HExists([]byte("h"), []byte("f"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, db.RPushCtx(past, []byte("l"), []byte("a")))
+	ok, err = db.ExpireAtCtx(past, []byte("l"), time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Type([]byte("l"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestRoseDB_LockFreeReads(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-lock-free")
+	opts := DefaultOptions(path)
+	opts.LockFreeReads = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.Set(GetKey(1), []byte("value")))
+	assert.Nil(t, db.HSet([]byte("hash"), GetKey(1), []byte("value")))
+	err = db.RPush([]byte("list"), []byte("a"), []byte("b"), []byte("c"))
+	assert.Nil(t, err)
+	_, err = db.LPop([]byte("list"))
+	assert.Nil(t, err)
+
+	// writers hold all the locks, reads do not wait for them.
+	db.strIndex.mu.Lock()
+	db.hashIndex.mu.Lock()
+	db.listIndex.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	v, err := db.GetCtx(ctx, GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	_, err = db.GetCtx(ctx, GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	v, err = db.HGetCtx(ctx, []byte("hash"), GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	v, err = db.HGetCtx(ctx, []byte("no-hash"), GetKey(1))
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+
+	v, err = db.LIndexCtx(ctx, []byte("list"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), v)
+	v, err = db.LIndexCtx(ctx, []byte("list"), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("c"), v)
+	_, err = db.LIndexCtx(ctx, []byte("list"), 2)
+	assert.Equal(t, ErrIndexOutOfRange, err)
+
+	db.listIndex.mu.Unlock()
+	db.hashIndex.mu.Unlock()
+	db.strIndex.mu.Unlock()
+
+	// reads see the latest writes.
+	assert.Nil(t, db.Delete(GetKey(1)))
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.HSet([]byte("hash"), GetKey(1), []byte("value2")))
+	v, err = db.HGet([]byte("hash"), GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value2"), v)
+}
+
+func TestRoseDB_LockFreeReadsDuringGC(t *testing.T) {
+	for _, ioType := range []IOType{FileIO, MMap} {
+		t.Run(fmt.Sprintf("io-type-%d", ioType), func(t *testing.T) {
+			testLockFreeReadsDuringGC(t, ioType)
+		})
+	}
+}
+
+func testLockFreeReadsDuringGC(t *testing.T, ioType IOType) {
+	path := filepath.Join("/tmp", "kv_engine-lock-free-gc")
+	opts := DefaultOptions(path)
+	opts.LockFreeReads = true
+	opts.IoType = ioType
+	opts.LogFileSizeThreshold = 256 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	const count = 4000
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("%0128d", i))
+	}
+	write := func() {
+		for i := 0; i < count; i++ {
+			assert.Nil(t, db.Set(GetKey(i), value(i)))
+			assert.Nil(t, db.HSet([]byte("hash"), GetKey(i), value(i)))
+		}
+	}
+	write()
+	for i := 0; i < count; i++ {
+		assert.Nil(t, db.RPush([]byte("list"), value(i)))
+	}
+
+	// the log file a snapshot points to is deleted by gc, the read is done on the latest snapshot.
+	stale := db.strIndex.snapshotOf(GetKey(0))
+	assert.Nil(t, db.RunLogFileGC(String, -1, 0))
+	_, err = db.getVal(stale, GetKey(0), String, time.Now().UnixMilli())
+	assert.True(t, isLogFileGone(err), err)
+	snapshots := []*art.Snapshot{stale, db.strIndex.snapshotOf(GetKey(0))}
+	v, err := db.readLatest(func() *art.Snapshot {
+		snap := snapshots[0]
+		if len(snapshots) > 1 {
+			snapshots = snapshots[1:]
+		}
+		return snap
+	}, func(idxTree indexReader) ([]byte, error) {
+		return db.getVal(idxTree, GetKey(0), String, time.Now().UnixMilli())
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, value(0), v)
+
+	// reads never fail while gc deletes the log files concurrently.
+	var (
+		wg     sync.WaitGroup
+		stop   = make(chan struct{})
+		mu     sync.Mutex
+		failed error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = err
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i = (i + 7) % count {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if v, err := db.Get(GetKey(i)); err != nil || string(v) != string(value(i)) {
+					fail(fmt.Errorf("get %d: %v", i, err))
+				}
+				if v, err := db.HGet([]byte("hash"), GetKey(i)); err != nil || string(v) != string(value(i)) {
+					fail(fmt.Errorf("hget %d: %v", i, err))
+				}
+				if v, err := db.LIndex([]byte("list"), i); err != nil || string(v) != string(value(i)) {
+					fail(fmt.Errorf("lindex %d: %v", i, err))
+				}
+			}
+		}(r)
+	}
+	for round := 0; round < 3; round++ {
+		write()
+		for _, dataType := range []DataType{String, Hash, List} {
+			assert.Nil(t, db.RunLogFileGC(dataType, -1, 0))
+		}
+	}
+	close(stop)
+	wg.Wait()
+	assert.Nil(t, failed)
+}
+
+func TestRoseDB_LockFreeReadsDuringFlushAll(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-lock-free-flush")
+	opts := DefaultOptions(path)
+	opts.LockFreeReads = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	const count = 200
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("%d-%0128d", i, i))
+	}
+
+	// a read on the snapshot taken before a reset may point to the entry of another key in the new log files.
+	var (
+		wg     sync.WaitGroup
+		stop   = make(chan struct{})
+		mu     sync.Mutex
+		failed error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = err
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i = (i + 7) % count {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if v, err := db.Get(GetKey(i)); err != ErrKeyNotFound && (err != nil || string(v) != string(value(i))) {
+					fail(fmt.Errorf("get %d: %s %v", i, v, err))
+				}
+				if v, err := db.HGet([]byte("hash"), GetKey(i)); v != nil && string(v) != string(value(i)) || err != nil {
+					fail(fmt.Errorf("hget %d: %s %v", i, v, err))
+				}
+			}
+		}(r)
+	}
+	for round := 0; round < 50; round++ {
+		assert.Nil(t, db.FlushAll())
+		// the keys are written in another order, so that their offsets change.
+		for j := 0; j < count; j++ {
+			i := (j*(round+1) + round) % count
+			assert.Nil(t, db.Set(GetKey(i), value(i)))
+			assert.Nil(t, db.HSet([]byte("hash"), GetKey(i), value(i)))
+		}
+	}
+	close(stop)
+	wg.Wait()
+	assert.Nil(t, failed)
+}
@@ -1,6 +1,7 @@
 package kv_engine
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -18,11 +19,11 @@ import (
 
 	"github.com/reid00/kv_engine/ds/art"
 	"github.com/reid00/kv_engine/ds/zset"
-	"github.com/reid00/kv_engine/flock"
 	"github.com/reid00/kv_engine/ioselector"
 	"github.com/reid00/kv_engine/logfile"
 	"github.com/reid00/kv_engine/logger"
 	"github.com/reid00/kv_engine/util"
+	"github.com/reid00/kv_engine/vfs"
 )
 
 var (
@@ -42,6 +43,20 @@ var (
 	ErrIndexOutOfRange = errors.New("index out of range")
 
 	ErrIndexStartLagerThanEnd = errors.New("start physical seq lager than end physical seq")
+
+	ErrReadOnly = errors.New("db is opened in read-only mode, mutation is not allowed")
+
+	// ErrInMemory operation needs the files of db, which an in-memory db does not have.
+	ErrInMemory = errors.New("operation is not supported by in-memory db")
+
+	// ErrDegraded writes failed, e.g. the disk is full, so the db is degraded to read-only until RoseDB.Recover succeeds.
+	ErrDegraded = errors.New("db is degraded to read-only by a write failure")
+
+	// ErrDiskUsageExceeded the write needs a new log file, which would make the log files exceed Options.MaxDiskUsage.
+	ErrDiskUsageExceeded = errors.New("disk usage of log files exceeds the limit")
+
+	// ErrInvalidGCRatio the ratio of log file gc is not in (0, 1].
+	ErrInvalidGCRatio = errors.New("log file gc ratio must be in (0, 1]")
 )
 
 const (
@@ -66,9 +81,24 @@ type (
 		setIndex         *setIndex
 		zsetIndex        *zsetIndex
 		mu               sync.RWMutex
-		fileLock         *flock.FileLockGuard
+		fileLock         io.Closer
 		closed           uint32
 		gcState          int32
+		gcRatio          uint64 // math.Float64bits of the ratio of periodic log file gc, see SetLogFileGCRatio.
+		resets           uint64 // incremented before and after resetData, so it is odd while the data is being reset.
+		subs             subscribers
+		changes          [logFileTypeNum]changeQueue // changes waiting for their writes to commit.
+		replica          *replica
+		replicas         int32
+		metrics          *metrics
+		commits          [logFileTypeNum]*groupCommit
+		appendMu         [logFileTypeNum]sync.Mutex // serializes appends to the active log file.
+		gcMu             [logFileTypeNum]sync.Mutex // held by the log file gc of the data type, see lockForReset.
+		syncCh           chan DataType
+		syncStop         chan struct{}
+		syncDone         chan struct{}
+		degradeMu        sync.Mutex
+		degraded         atomic.Value // *degradedState, nil if writes are allowed.
 	}
 
 	archivedFiles map[uint32]*logfile.LogFile
@@ -87,107 +117,164 @@ type (
 		expiredAt int64
 	}
 
+	// strIndex is split into shards by key hash, the tree of a shard is guarded by the stripe lock of its keys.
 	strIndex struct {
-		mu      *sync.RWMutex
-		idxTree *art.AdaptiveRadixTree
+		*keyLocks
+		snapshot bool
+		// *strShards, replaced by reset.
+		shards atomic.Value
+		// counts the keys and memory of all shards.
+		counter *art.Counter
 	}
 
-	listIndex struct {
-		mu      *sync.RWMutex
+	strShards [keyLockStripes]*art.AdaptiveRadixTree
+
+	// collIndex is the index of a collection data type, every key has its own index tree.
+	// Operations resolve the tree of the key locally, and the tree is guarded by the stripe lock of the key,
+	// so operations on different keys run in parallel.
+	collIndex struct {
+		*keyLocks
+		snapshot bool
+		// guards the map and names only.
+		treesMu *sync.RWMutex
 		trees   map[string]*art.AdaptiveRadixTree
-		idxTree *art.AdaptiveRadixTree
+		// the keys of trees in order, to scan them from a cursor.
+		names *art.AdaptiveRadixTree
+		// *hamt.Map of key to tree, the immutable version of trees for lock-free reads if snapshot is true.
+		treesSnap atomic.Value
+		// counts the keys, entries and memory of all trees.
+		counter *art.Counter
+	}
+
+	listIndex struct {
+		*collIndex
 	}
 
 	hashIndex struct {
-		mu      *sync.RWMutex
-		trees   map[string]*art.AdaptiveRadixTree
-		idxTree *art.AdaptiveRadixTree
+		*collIndex
 	}
 
 	setIndex struct {
-		mu      *sync.RWMutex
+		*collIndex
 		murhash *util.Murmur128
-		trees   map[string]*art.AdaptiveRadixTree
-		idxTree *art.AdaptiveRadixTree
 	}
 
 	zsetIndex struct {
-		mu      *sync.RWMutex
+		*collIndex
 		indexes *zset.SortedSet
 		murhash *util.Murmur128
-		trees   map[string]*art.AdaptiveRadixTree
-		idxTree *art.AdaptiveRadixTree
 	}
 )
 
-func newStrsIndex() *strIndex {
-	return &strIndex{
-		idxTree: art.NewART(),
-		mu:      new(sync.RWMutex),
-	}
+func newStrsIndex(snapshot bool) *strIndex {
+	si := &strIndex{keyLocks: newKeyLocks(), snapshot: snapshot, counter: art.NewCounter(0)}
+	si.reset()
+	return si
 }
 
-func newListIndex() *listIndex {
-	return &listIndex{
-		mu:    new(sync.RWMutex),
-		trees: make(map[string]*art.AdaptiveRadixTree),
+// newCollIndex returns a collection index, the first base entries of a tree are not counted as elements.
+func newCollIndex(snapshot bool, base int) *collIndex {
+	ci := &collIndex{
+		keyLocks: newKeyLocks(),
+		snapshot: snapshot,
+		treesMu:  new(sync.RWMutex),
+		counter:  art.NewCounter(base),
 	}
+	ci.reset()
+	return ci
 }
 
-func newHashIndex() *hashIndex {
-	return &hashIndex{
-		mu:    new(sync.RWMutex),
-		trees: make(map[string]*art.AdaptiveRadixTree),
-	}
+func newListIndex(snapshot bool) *listIndex {
+	// the head and tail seq of a list is also in its tree.
+	return &listIndex{collIndex: newCollIndex(snapshot, 1)}
+}
+
+func newHashIndex(snapshot bool) *hashIndex {
+	return &hashIndex{collIndex: newCollIndex(snapshot, 0)}
 }
 
-func newSetIndex() *setIndex {
+func newSetIndex(snapshot bool) *setIndex {
 	return &setIndex{
-		mu:      new(sync.RWMutex),
-		murhash: util.NewMurmur128(),
-		trees:   make(map[string]*art.AdaptiveRadixTree),
+		collIndex: newCollIndex(snapshot, 0),
+		murhash:   util.NewMurmur128(),
 	}
 }
 
-func newZSetIndex() *zsetIndex {
+func newZSetIndex(snapshot bool) *zsetIndex {
 	return &zsetIndex{
-		mu:      new(sync.RWMutex),
-		indexes: zset.New(),
-		murhash: util.NewMurmur128(),
-		trees:   make(map[string]*art.AdaptiveRadixTree),
+		collIndex: newCollIndex(snapshot, 0),
+		indexes:   zset.New(),
+		murhash:   util.NewMurmur128(),
+	}
+}
+
+// newIndexTree returns a tree counted in counter, which publishes its immutable versions if snapshot is true.
+func newIndexTree(snapshot bool, counter *art.Counter) *art.AdaptiveRadixTree {
+	if snapshot {
+		return art.NewARTWithSnapshot().CountIn(counter)
 	}
+	return art.NewART().CountIn(counter)
 }
 
 // Open a rosedb instance. You must call Close after using it.
-func Open(opts Options) (*RoseDB, error) {
-	if !util.PathExist(opts.DBPath) {
-		if err := os.MkdirAll(opts.DBPath, os.ModePerm); err != nil {
-			return nil, err
-		}
+func Open(opts Options) (_ *RoseDB, err error) {
+	if opts.FS == nil {
+		opts.FS = vfs.OS
 	}
-	// acquire file lock to prevent multiple processes from accessing the same directory.
-	lockPath := filepath.Join(opts.DBPath, lockFileName)
+	var lockGuard io.Closer
+	if opts.InMemory {
+		// there is nothing to read.
+		if opts.ReadOnly {
+			return nil, ErrInMemory
+		}
+	} else {
+		if opts.ReadOnly {
+			// never create anything in read-only mode.
+			if _, err := opts.FS.Stat(opts.DBPath); err != nil {
+				return nil, err
+			}
+		} else if !vfs.PathExist(opts.FS, opts.DBPath) {
+			if err := opts.FS.MkdirAll(opts.DBPath, os.ModePerm); err != nil {
+				return nil, err
+			}
+		}
+		// acquire file lock to prevent multiple processes from accessing the same directory.
+		// a shared lock is enough in read-only mode, so that many readers can open it concurrently.
+		lockPath := filepath.Join(opts.DBPath, lockFileName)
 
-	lockGuard, err := flock.AcquireFileLock(lockPath, false)
-	if err != nil {
-		return nil, err
+		if lockGuard, err = opts.FS.Lock(lockPath, opts.ReadOnly); err != nil {
+			return nil, err
+		}
 	}
 
 	db := &RoseDB{
 		activeLogFiles:   make(map[DataType]*logfile.LogFile),
 		archivedLogFiles: make(map[int8]archivedFiles),
 		opts:             opts,
+		gcRatio:          math.Float64bits(opts.LogFileGCRatio),
 		fileLock:         lockGuard,
-		strIndex:         newStrsIndex(),
-		listIndex:        newListIndex(),
-		hashIndex:        newHashIndex(),
-		setIndex:         newSetIndex(),
-		zsetIndex:        newZSetIndex(),
+		strIndex:         newStrsIndex(opts.LockFreeReads),
+		listIndex:        newListIndex(opts.LockFreeReads),
+		hashIndex:        newHashIndex(opts.LockFreeReads),
+		setIndex:         newSetIndex(opts.LockFreeReads),
+		zsetIndex:        newZSetIndex(opts.LockFreeReads),
+		metrics:          new(metrics),
+	}
+	for i := range db.commits {
+		db.commits[i] = newGroupCommit()
 	}
+	// release the file lock and the opened files if anything below fails.
+	defer func() {
+		if err != nil {
+			_ = db.Close()
+		}
+	}()
 
-	// init discard file
-	if err := db.initDiscard(); err != nil {
-		return nil, err
+	// init discard file, discard is only used by writes and log file gc.
+	if !opts.ReadOnly {
+		if err := db.initDiscard(); err != nil {
+			return nil, err
+		}
 	}
 
 	// load the log files from disk
@@ -200,18 +287,44 @@ func Open(opts Options) (*RoseDB, error) {
 		return nil, err
 	}
 
+	// replicate from the primary
+	if opts.ReplicaOf != "" {
+		if err := db.startReplica(); err != nil {
+			return nil, err
+		}
+	}
+
 	// handle log files garbage collections
-	go db.handleLogFileGC()
+	if !opts.ReadOnly {
+		go db.handleLogFileGC()
+	}
+
+	// sync active log files in background
+	if !opts.ReadOnly && !opts.Sync && (opts.SyncInterval > 0 || opts.BytesPerSync > 0) {
+		db.syncCh = make(chan DataType, logFileTypeNum)
+		db.syncStop = make(chan struct{})
+		db.syncDone = make(chan struct{})
+		go db.handleBackgroundSync()
+	}
 	return db, nil
 }
 
 // Closed db and save relative configs
 func (db *RoseDB) Close() error {
+	if db.replica != nil {
+		db.replica.close()
+	}
+	db.closeSubscriptions()
+	if db.syncStop != nil {
+		close(db.syncStop)
+		<-db.syncDone
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	if db.fileLock != nil {
-		_ = db.fileLock.Release()
+		_ = db.fileLock.Close()
 	}
 	// close and sync active file
 	for _, activeFile := range db.activeLogFiles {
@@ -220,7 +333,9 @@ func (db *RoseDB) Close() error {
 	// close the archived file
 	for _, archived := range db.archivedLogFiles {
 		for _, file := range archived {
-			file.Sync()
+			if !db.opts.ReadOnly {
+				file.Sync()
+			}
 			file.Close()
 		}
 	}
@@ -235,6 +350,9 @@ func (db *RoseDB) Close() error {
 
 // Sync persist the db files to stable storage
 func (db *RoseDB) Sync() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -247,21 +365,147 @@ func (db *RoseDB) Sync() error {
 	return nil
 }
 
+// Backup copies the log files of db to the directory path, it can be opened as a db directly.
+// All writes are blocked until the backup is done.
+// It is not supported by in-memory db.
+func (db *RoseDB) Backup(path string) error {
+	if db.opts.InMemory {
+		return ErrInMemory
+	}
+	// writes hold the locks of their keys only.
+	for i := String; i < logFileTypeNum; i++ {
+		kl := db.keyLocksOf(i)
+		kl.rlockAll()
+		defer kl.runlockAll()
+	}
+	// hold the lock to prevent log files from being deleted by gc.
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if err := db.opts.FS.MkdirAll(path, os.ModePerm); err != nil {
+		return err
+	}
+	// so that the backup can be opened in read-only mode.
+	if err := createLockFile(db.opts.FS, path); err != nil {
+		return err
+	}
+	for _, active := range db.activeLogFiles {
+		if err := active.Sync(); err != nil {
+			return err
+		}
+	}
+
+	dirEntries, err := db.opts.FS.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return err
+	}
+	for _, file := range dirEntries {
+		if !strings.HasPrefix(file.Name(), logfile.FilePrefix) {
+			continue
+		}
+		src, dst := filepath.Join(db.opts.DBPath, file.Name()), filepath.Join(path, file.Name())
+		if err := vfs.CopyFile(db.opts.FS, src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createLockFile creates the lock file in dir if it does not exist, so that dir can be opened read-only.
+func createLockFile(fs vfs.FS, dir string) error {
+	file, err := fs.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Restore replaces all data of db with the backup at path, which is created by Backup.
+// The subscriptions are closed with ErrDataReset, and replicas do a full sync once they reconnect.
+func (db *RoseDB) Restore(path string) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	// backups created by older versions have no lock file.
+	if err := createLockFile(db.opts.FS, path); err != nil {
+		return err
+	}
+	backup, err := Open(Options{DBPath: path, IoType: FileIO, FS: db.opts.FS, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	defer db.lockForReset()()
+	if err := db.resetData(); err != nil {
+		return err
+	}
+
+	for dataType, fids := range backup.fidMap {
+		sort.Slice(fids, func(i, j int) bool {
+			return fids[i] < fids[j]
+		})
+		for _, fid := range fids {
+			lf := backup.activeLogFiles[dataType]
+			if lf.Fid != fid {
+				lf = backup.archivedLogFiles[dataType][fid]
+			}
+			lf.Advise(true)
+			var offset int64
+			for {
+				ent, size, err := lf.ReadLogEntry(offset)
+				if err != nil {
+					if err == io.EOF || err == logfile.ErrEndOfEntry {
+						break
+					}
+					return err
+				}
+				offset += size
+				if _, err := db.rebuildLogEntry(dataType, ent); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return db.Sync()
+}
+
 func (db *RoseDB) RunLogFileGC(dataType DataType, fid int, gcRatio float64) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	if atomic.LoadInt32(&db.gcState) > 0 {
 		return ErrGCRunning
 	}
 	return db.doRunGC(dataType, fid, gcRatio)
 }
 
+// SetLogFileGCRatio changes Options.LogFileGCRatio of the periodic log file gc at runtime,
+// it takes effect from the next run. The ratio must be in (0, 1].
+func (db *RoseDB) SetLogFileGCRatio(ratio float64) error {
+	if ratio <= 0 || ratio > 1 {
+		return ErrInvalidGCRatio
+	}
+	atomic.StoreUint64(&db.gcRatio, math.Float64bits(ratio))
+	return nil
+}
+
+// LogFileGCRatio returns the ratio of the periodic log file gc, see SetLogFileGCRatio.
+func (db *RoseDB) LogFileGCRatio() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&db.gcRatio))
+}
+
 func (db *RoseDB) isClosed() bool {
 	return atomic.LoadUint32(&db.closed) == 1
 }
 
 func (db *RoseDB) initDiscard() error {
+	if db.opts.InMemory {
+		return db.initMemoryDiscard()
+	}
 	discardPath := filepath.Join(db.opts.DBPath, discardFilePath)
-	if !util.PathExist(discardPath) {
-		if err := os.MkdirAll(discardPath, os.ModePerm); err != nil {
+	if !vfs.PathExist(db.opts.FS, discardPath) {
+		if err := db.opts.FS.MkdirAll(discardPath, os.ModePerm); err != nil {
 			return err
 		}
 	}
@@ -269,7 +513,7 @@ func (db *RoseDB) initDiscard() error {
 	discards := make(map[DataType]*discard)
 	for i := String; i < logFileTypeNum; i++ {
 		name := logfile.FileNamesMap[logfile.FileType(i)] + discardFileName
-		dis, err := newDiscard(discardPath, name, db.opts.DiscardBufferSize)
+		dis, err := newDiscard(db.opts.FS, discardPath, name, db.opts.DiscardBufferSize)
 		if err != nil {
 			return err
 		}
@@ -280,11 +524,31 @@ func (db *RoseDB) initDiscard() error {
 	return nil
 }
 
+func (db *RoseDB) initMemoryDiscard() error {
+	discards := make(map[DataType]*discard)
+	for i := String; i < logFileTypeNum; i++ {
+		file, err := ioselector.NewMemorySelector(discardFileSize)
+		if err != nil {
+			return err
+		}
+		if discards[i], err = loadDiscard(file, db.opts.DiscardBufferSize); err != nil {
+			return err
+		}
+	}
+	db.discards = discards
+	return nil
+}
+
 func (db *RoseDB) LoadLogFiles() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	dirEntrys, err := os.ReadDir(db.opts.DBPath)
+	// an in-memory db always starts empty.
+	if db.opts.InMemory {
+		return nil
+	}
+
+	dirEntrys, err := db.opts.FS.ReadDir(db.opts.DBPath)
 	if err != nil {
 		return err
 	}
@@ -322,8 +586,13 @@ func (db *RoseDB) LoadLogFiles() error {
 		opts := db.opts
 
 		for i, fid := range fids {
-			ftype, iotype := logfile.FileType(dataType), logfile.IOType(opts.IoType)
-			lf, err := logfile.OpenLogFile(opts.DBPath, fid, opts.LogFileSizeThreshold, ftype, iotype)
+			ftype, iotype := logfile.FileType(dataType), db.logIOType()
+			var lf *logfile.LogFile
+			if opts.ReadOnly {
+				lf, err = logfile.OpenReadOnlyLogFile(opts.FS, opts.DBPath, fid, ftype, iotype)
+			} else {
+				lf, err = logfile.OpenLogFile(opts.FS, opts.DBPath, fid, opts.LogFileSizeThreshold, ftype, iotype)
+			}
 			if err != nil {
 				return err
 			}
@@ -332,6 +601,9 @@ func (db *RoseDB) LoadLogFiles() error {
 			if i == len(fids)-1 {
 				db.activeLogFiles[dataType] = lf
 			} else {
+				if err = lf.Seal(); err != nil {
+					return err
+				}
 				db.archivedLogFiles[dataType][fid] = lf
 			}
 		}
@@ -348,11 +620,11 @@ func (db *RoseDB) initLogFile(dataType DataType) error {
 	}
 
 	opts := db.opts
-	ftype, iotype := logfile.FileType(dataType), logfile.IOType(opts.IoType)
+	ftype, iotype := logfile.FileType(dataType), db.logIOType()
 
-	lf, err := logfile.OpenLogFile(opts.DBPath, logfile.InitialLogFileId, opts.LogFileSizeThreshold, ftype, iotype)
+	lf, err := logfile.OpenLogFile(opts.FS, opts.DBPath, logfile.InitialLogFileId, opts.LogFileSizeThreshold, ftype, iotype)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	db.discards[dataType].setTotal(lf.Fid, uint32(opts.LogFileSizeThreshold))
@@ -381,7 +653,7 @@ func (db *RoseDB) handleLogFileGC() {
 
 			for dType := String; dType < logFileTypeNum; dType++ {
 				go func(dataType DataType) {
-					err := db.doRunGC(dataType, -1, db.opts.LogFileGCRatio)
+					err := db.doRunGC(dataType, -1, db.LogFileGCRatio())
 					if err != nil {
 						logger.Errorf("log file gc err, dataType: [%v], err : [%v]", dataType, err)
 					}
@@ -395,13 +667,23 @@ func (db *RoseDB) handleLogFileGC() {
 }
 
 func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64) error {
+	db.gcMu[dataType].Lock()
+	defer db.gcMu[dataType].Unlock()
 	atomic.AddInt32(&db.gcState, 1)
 	defer atomic.AddInt32(&db.gcState, -1)
+	db.metrics.gcStarted(dataType)
+
+	// size of entries rewritten from the current archived file.
+	var rewritten int64
 
 	maybeRewriteStrs := func(fid uint32, offset int64, ent *logfile.LogEntry) error {
-		db.strIndex.mu.Lock()
-		defer db.strIndex.mu.Unlock()
-		indexVal := db.strIndex.idxTree.Get(ent.Key)
+		held, err := db.strIndex.lockKeys(context.Background(), true, ent.Key)
+		if err != nil {
+			return err
+		}
+		defer held.unlock()
+		idxTree := db.strIndex.tree(ent.Key)
+		indexVal := idxTree.Get(ent.Key)
 		if indexVal == nil {
 			return nil
 		}
@@ -409,12 +691,13 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 		node, _ := indexVal.(*indexNode)
 		if node != nil && node.fid == fid && node.offset == offset {
 			// rewrite entry
-			valuePos, err := db.writeLogEntry(ent, String)
+			valuePos, err := db.appendLogEntry(ent, String)
 			if err != nil {
 				return err
 			}
+			rewritten += int64(valuePos.entrySize)
 			// update index
-			if err = db.updateIndexTree(ent, valuePos, false, String); err != nil {
+			if err = db.updateIndexTree(idxTree, ent, valuePos, false, String); err != nil {
 				return err
 			}
 		}
@@ -422,28 +705,33 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 	}
 
 	maybeRewriteList := func(fid uint32, offset int64, ent *logfile.LogEntry) error {
-		db.listIndex.mu.Lock()
-		defer db.listIndex.mu.Unlock()
 		var listKey = ent.Key
 		if ent.Type != logfile.TypeListMeta {
 			listKey, _ = db.decodeListKey(ent.Key)
 		}
-		if db.listIndex.trees[string(listKey)] == nil {
+		held, err := db.listIndex.lockKeys(context.Background(), true, listKey)
+		if err != nil {
+			return err
+		}
+		defer held.unlock()
+		idxTree := db.listIndex.tree(listKey)
+		if idxTree == nil {
 			return nil
 		}
-		db.listIndex.idxTree = db.listIndex.trees[string(listKey)]
-		indexVal := db.listIndex.idxTree.Get(listKey)
+		// the meta and the elements of the list are all in its tree.
+		indexVal := idxTree.Get(ent.Key)
 		if indexVal == nil {
 			return nil
 		}
 
 		node, _ := indexVal.(*indexNode)
 		if node != nil && node.fid == fid && node.offset == offset {
-			valuePos, err := db.writeLogEntry(ent, List)
+			valuePos, err := db.appendLogEntry(ent, List)
 			if err != nil {
 				return err
 			}
-			if err = db.updateIndexTree(ent, valuePos, false, List); err != nil {
+			rewritten += int64(valuePos.entrySize)
+			if err = db.updateIndexTree(idxTree, ent, valuePos, false, List); err != nil {
 				return err
 			}
 		}
@@ -451,14 +739,17 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 	}
 
 	maybeRewriteHash := func(fid uint32, offset int64, ent *logfile.LogEntry) error {
-		db.hashIndex.mu.Lock()
-		defer db.hashIndex.mu.Unlock()
 		key, field := db.decodeKey(ent.Key)
-		if db.hashIndex.trees[string(key)] == nil {
+		held, err := db.hashIndex.lockKeys(context.Background(), true, key)
+		if err != nil {
+			return err
+		}
+		defer held.unlock()
+		idxTree := db.hashIndex.tree(key)
+		if idxTree == nil {
 			return nil
 		}
-		db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-		indexVal := db.hashIndex.idxTree.Get(field)
+		indexVal := idxTree.Get(field)
 		if indexVal == nil {
 			return nil
 		}
@@ -466,15 +757,16 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 		node, _ := indexVal.(*indexNode)
 		if node != nil && node.fid == fid && node.offset == offset {
 			// rewrite entry
-			valuePos, err := db.writeLogEntry(ent, Hash)
+			valuePos, err := db.appendLogEntry(ent, Hash)
 			if err != nil {
 				return err
 			}
+			rewritten += int64(valuePos.entrySize)
 			// update index
-			entry := &logfile.LogEntry{Key: field, Value: ent.Value}
+			entry := &logfile.LogEntry{Key: field, Value: ent.Value, ExpireAt: ent.ExpireAt}
 			_, size := logfile.EncodeEntry(ent)
 			valuePos.entrySize = size
-			if err = db.updateIndexTree(entry, valuePos, false, Hash); err != nil {
+			if err = db.updateIndexTree(idxTree, entry, valuePos, false, Hash); err != nil {
 				return err
 			}
 		}
@@ -482,34 +774,38 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 	}
 
 	maybeRewriteSets := func(fid uint32, offset int64, ent *logfile.LogEntry) error {
-		db.setIndex.mu.Lock()
-		defer db.setIndex.mu.Unlock()
-		if db.setIndex.trees[string(ent.Key)] == nil {
+		held, err := db.setIndex.lockKeys(context.Background(), true, ent.Key)
+		if err != nil {
+			return err
+		}
+		defer held.unlock()
+		idxTree := db.setIndex.tree(ent.Key)
+		if idxTree == nil {
 			return nil
 		}
-		db.setIndex.idxTree = db.setIndex.trees[string(ent.Key)]
 		if err := db.setIndex.murhash.Write(ent.Value); err != nil {
 			logger.Fatalf("fail to write murmur hash: %v", err)
 		}
 		sum := db.setIndex.murhash.EncodeSum128()
 		db.setIndex.murhash.Reset()
 
-		indexVal := db.setIndex.idxTree.Get(sum)
+		indexVal := idxTree.Get(sum)
 		if indexVal == nil {
 			return nil
 		}
 		node, _ := indexVal.(*indexNode)
 		if node != nil && node.fid == fid && node.offset == offset {
 			// rewrite entry
-			valuePos, err := db.writeLogEntry(ent, Set)
+			valuePos, err := db.appendLogEntry(ent, Set)
 			if err != nil {
 				return err
 			}
+			rewritten += int64(valuePos.entrySize)
 			// update index
 			entry := &logfile.LogEntry{Key: sum, Value: ent.Value}
 			_, size := logfile.EncodeEntry(ent)
 			valuePos.entrySize = size
-			if err = db.updateIndexTree(entry, valuePos, false, Set); err != nil {
+			if err = db.updateIndexTree(idxTree, entry, valuePos, false, Set); err != nil {
 				return err
 			}
 		}
@@ -517,33 +813,37 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 	}
 
 	maybeRewriteZSet := func(fid uint32, offset int64, ent *logfile.LogEntry) error {
-		db.zsetIndex.mu.Lock()
-		defer db.zsetIndex.mu.Unlock()
 		key, _ := db.decodeKey(ent.Key)
-		if db.zsetIndex.trees[string(key)] == nil {
+		held, err := db.zsetIndex.lockKeys(context.Background(), true, key)
+		if err != nil {
+			return err
+		}
+		defer held.unlock()
+		idxTree := db.zsetIndex.tree(key)
+		if idxTree == nil {
 			return nil
 		}
-		db.zsetIndex.idxTree = db.zsetIndex.trees[string(key)]
 		if err := db.zsetIndex.murhash.Write(ent.Value); err != nil {
 			logger.Fatalf("fail to write murmur hash: %v", err)
 		}
 		sum := db.zsetIndex.murhash.EncodeSum128()
 		db.zsetIndex.murhash.Reset()
 
-		indexVal := db.zsetIndex.idxTree.Get(sum)
+		indexVal := idxTree.Get(sum)
 		if indexVal == nil {
 			return nil
 		}
 		node, _ := indexVal.(*indexNode)
-		if node != nil && node.fid == fid && node.offset == node.offset {
-			valuePos, err := db.writeLogEntry(ent, ZSet)
+		if node != nil && node.fid == fid && node.offset == offset {
+			valuePos, err := db.appendLogEntry(ent, ZSet)
 			if err != nil {
 				return err
 			}
+			rewritten += int64(valuePos.entrySize)
 			entry := &logfile.LogEntry{Key: sum, Value: ent.Value}
 			_, size := logfile.EncodeEntry(ent)
 			valuePos.entrySize = size
-			if err = db.updateIndexTree(entry, valuePos, false, ZSet); err != nil {
+			if err = db.updateIndexTree(idxTree, entry, valuePos, false, ZSet); err != nil {
 				return err
 			}
 		}
@@ -571,6 +871,13 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 			continue
 		}
 
+		fileSize, err := archivedFile.Size()
+		if err != nil {
+			return err
+		}
+		rewritten = 0
+		// the file is scanned once and deleted after that.
+		archivedFile.Advise(true)
 		var offset int64
 		for {
 			ent, size, err := archivedFile.ReadLogEntry(offset)
@@ -585,7 +892,7 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 			if ent.Type == logfile.TypeDelete {
 				continue
 			}
-			ts := time.Now().Unix()
+			ts := time.Now().UnixMilli()
 			if ent.ExpireAt != 0 && ent.ExpireAt <= ts {
 				continue
 			}
@@ -607,6 +914,11 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 			}
 		}
 
+		// make sure the rewritten entries are durable before deleting the older log file.
+		if err := db.getActiveLogFile(dataType).Sync(); err != nil {
+			return db.degrade(err)
+		}
+
 		// delete older log file.
 		db.mu.Lock()
 		delete(db.archivedLogFiles[dataType], fid)
@@ -614,6 +926,7 @@ func (db *RoseDB) doRunGC(dataType DataType, specifiedFid int, gcRatio float64)
 		db.mu.Unlock()
 		// clear discard state.
 		db.discards[dataType].clear(fid)
+		db.metrics.gcFileRemoved(dataType, fileSize-rewritten)
 	}
 	return nil
 }
@@ -647,56 +960,110 @@ func (db *RoseDB) decodeKey(key []byte) ([]byte, []byte) {
 	return key[index:sep], key[sep:]
 }
 
-// write entry to log file.
+// write entry to log file, the subscribers are notified once the write is committed, see unlockKeysWrite.
 func (db *RoseDB) writeLogEntry(ent *logfile.LogEntry, dataType DataType) (*valuePos, error) {
-	if err := db.initLogFile(dataType); err != nil {
+	if db.opts.ReplicaOf != "" {
+		return nil, ErrReplicaReadOnly
+	}
+	// queue while holding the append lock, so changes are published in the order of their positions.
+	db.appendMu[dataType].Lock()
+	defer db.appendMu[dataType].Unlock()
+	pos, err := db.appendLogEntryLocked(ent, dataType, true)
+	if err != nil {
 		return nil, err
 	}
-	activeLogFile := db.getActiveLogFile(dataType)
-	if activeLogFile == nil {
-		return nil, ErrLogFileNotFound
+	db.queueChange(dataType, ent, pos)
+	return pos, nil
+}
+
+// append entry to log file, subscribers will not be notified, used by log file gc directly.
+// Options.MaxDiskUsage is not checked, as log file gc reclaims space and replicas must follow their primary.
+func (db *RoseDB) appendLogEntry(ent *logfile.LogEntry, dataType DataType) (*valuePos, error) {
+	db.appendMu[dataType].Lock()
+	defer db.appendMu[dataType].Unlock()
+	return db.appendLogEntryLocked(ent, dataType, false)
+}
+
+// appendLogEntryLocked appends the entry to the active log file, the append lock of the data type must be held.
+// A new log file is rejected if it would exceed Options.MaxDiskUsage and limited is true.
+// The db is degraded to read-only if the append fails, see degrade.
+func (db *RoseDB) appendLogEntryLocked(ent *logfile.LogEntry, dataType DataType, limited bool) (*valuePos, error) {
+	if db.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := db.degradedErr(); err != nil {
+		return nil, err
 	}
 
 	opts := db.opts
 	entBuf, esize := logfile.EncodeEntry(ent)
-	// activeLogFile 空间不足，需要新创建一个
-	if activeLogFile.WriteAt+int64(esize) > opts.LogFileSizeThreshold {
-		if err := activeLogFile.Sync(); err != nil {
-			return nil, err
+	activeLogFile := db.getActiveLogFile(dataType)
+	// a new log file is needed if there is no active log file, or it has no space for the entry.
+	if activeLogFile == nil || activeLogFile.WriteAt+int64(esize) > opts.LogFileSizeThreshold {
+		if limited {
+			if err := db.checkDiskUsage(); err != nil {
+				return nil, err
+			}
 		}
-
-		db.mu.Lock()
-		// save the old log file in archived files.
-		activeFileId := activeLogFile.Fid
-		if db.archivedLogFiles[dataType] == nil {
-			db.archivedLogFiles[dataType] = make(archivedFiles)
+		var err error
+		if activeLogFile == nil {
+			err = db.initLogFile(dataType)
+		} else {
+			err = db.rotateLogFile(dataType, activeLogFile)
 		}
-		db.archivedLogFiles[dataType][activeFileId] = activeLogFile
-
-		// open a new log file.
-		ftype, iotype := logfile.FileType(dataType), logfile.IOType(opts.IoType)
-		lf, err := logfile.OpenLogFile(opts.DBPath, activeFileId+1, opts.LogFileSizeThreshold, ftype, iotype)
 		if err != nil {
-			db.mu.Unlock()
-			return nil, err
+			return nil, db.degrade(err)
+		}
+		if activeLogFile = db.getActiveLogFile(dataType); activeLogFile == nil {
+			return nil, ErrLogFileNotFound
 		}
-		db.discards[dataType].setTotal(lf.Fid, uint32(opts.LogFileSizeThreshold))
-		db.activeLogFiles[dataType] = lf
-		activeLogFile = lf
-		db.mu.Unlock()
 	}
 
 	writeAt := atomic.LoadInt64(&activeLogFile.WriteAt)
-	// write entry and sync(if necessary)
+	// write entry, it will be synced by the writer after releasing the index lock if necessary, see unlockWrite.
 	if err := activeLogFile.Write(entBuf); err != nil {
-		return nil, err
+		return nil, db.degrade(err)
 	}
-	if opts.Sync {
-		if err := activeLogFile.Sync(); err != nil {
-			return nil, err
-		}
+	db.countUnsynced(dataType, esize)
+	return &valuePos{fid: activeLogFile.Fid, offset: writeAt, entrySize: esize}, nil
+}
+
+// rotateLogFile archives the full active log file, and opens the next one as the active log file.
+func (db *RoseDB) rotateLogFile(dataType DataType, activeLogFile *logfile.LogFile) error {
+	// open the new log file first, so the active log file is unchanged if it fails.
+	opts := db.opts
+	ftype, iotype := logfile.FileType(dataType), db.logIOType()
+	lf, err := logfile.OpenLogFile(opts.FS, opts.DBPath, activeLogFile.Fid+1, opts.LogFileSizeThreshold, ftype, iotype)
+	if err != nil {
+		return err
+	}
+	if err := activeLogFile.Sync(); err != nil {
+		_ = lf.Delete()
+		return err
+	}
+	if err := activeLogFile.Seal(); err != nil {
+		_ = lf.Delete()
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// save the old log file in archived files.
+	if db.archivedLogFiles[dataType] == nil {
+		db.archivedLogFiles[dataType] = make(archivedFiles)
+	}
+	db.archivedLogFiles[dataType][activeLogFile.Fid] = activeLogFile
+	db.discards[dataType].setTotal(lf.Fid, uint32(opts.LogFileSizeThreshold))
+	db.activeLogFiles[dataType] = lf
+	return nil
+}
+
+// logIOType returns the io type of log files.
+func (db *RoseDB) logIOType() logfile.IOType {
+	if db.opts.InMemory {
+		return logfile.MemoryIO
 	}
-	return &valuePos{fid: activeLogFile.Fid, offset: writeAt}, nil
+	return logfile.IOType(db.opts.IoType)
 }
 
 func (db *RoseDB) getActiveLogFile(dataType DataType) *logfile.LogFile {
@@ -723,9 +1090,5 @@ func (db *RoseDB) sendDiscard(oldVal interface{}, updated bool, dataType DataTyp
 	if node == nil || node.entrySize <= 0 {
 		return
 	}
-	select {
-	case db.discards[dataType].valChan <- node:
-	default:
-		logger.Warn("send to discard chan fail")
-	}
+	db.discards[dataType].send(node)
 }
@@ -3,7 +3,9 @@ package kv_engine
 import (
 	"bytes"
 	"fmt"
+	"github.com/reid00/kv_engine/logfile"
 	"github.com/reid00/kv_engine/logger"
+	"github.com/reid00/kv_engine/vfs"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -26,11 +28,319 @@ func TestOpen(t *testing.T) {
 
 	t.Run("mmap", func(t *testing.T) {
 		opts := DefaultOptions(path)
+		opts.IoType = MMap
 		db, err := Open(opts)
 		defer destroyDB(db)
 		assert.Nil(t, err)
 		assert.NotNil(t, db)
 	})
+
+	t.Run("directio", func(t *testing.T) {
+		opts := DefaultOptions(path)
+		opts.IoType = DirectIO
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		defer destroyDB(db)
+
+		assert.Nil(t, db.Set(GetKey(1), []byte("value")))
+		assert.Nil(t, db.HSet([]byte("hash"), GetKey(1), []byte("value")))
+		v, err := db.Get(GetKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), v)
+		v, err = db.HGet([]byte("hash"), GetKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), v)
+	})
+}
+
+func TestOpen_ReleaseLockOnError(t *testing.T) {
+	path := t.TempDir()
+	bad := filepath.Join(path, logfile.FilePrefix+"strs.bad")
+	assert.Nil(t, os.WriteFile(bad, nil, 0644))
+
+	_, err := Open(DefaultOptions(path))
+	assert.NotNil(t, err)
+
+	// the failed Open must not keep the directory locked.
+	assert.Nil(t, os.Remove(bad))
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_InMemory(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-memory")
+	opts := DefaultOptions(path)
+	opts.InMemory = true
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// nothing is written to disk.
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+	}
+	assert.Nil(t, db.Set(GetKey(0), []byte("value")))
+	v, err := db.Get(GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	// log files are rotated in memory too.
+	assert.True(t, len(db.archivedLogFiles[String]) > 0)
+	v, err = db.Get(GetKey(199))
+	assert.Nil(t, err)
+	assert.Equal(t, 16, len(v))
+
+	assert.Nil(t, db.HSet([]byte("hash"), GetKey(1), []byte("value")))
+	v, err = db.HGet([]byte("hash"), GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	assert.Nil(t, db.RPush([]byte("list"), []byte("a"), []byte("b")))
+	v, err = db.LIndex([]byte("list"), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), v)
+
+	// the overwritten keys of archived files are reclaimed by gc.
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+	}
+	assert.Nil(t, db.RunLogFileGC(String, -1, 0.1))
+	v, err = db.Get(GetKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, 16, len(v))
+
+	assert.Equal(t, ErrInMemory, db.Backup(path))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	opts.ReadOnly = true
+	_, err = Open(opts)
+	assert.Equal(t, ErrInMemory, err)
+}
+
+func TestRoseDB_CrashConsistency(t *testing.T) {
+	for _, crashAt := range []int64{0, 30, 1000, 4000, 20000} {
+		t.Run(fmt.Sprintf("crash-after-%d", crashAt), func(t *testing.T) {
+			path := filepath.Join("/tmp", "kv_engine-crash")
+			defer os.RemoveAll(path)
+			fs := vfs.NewFaultFS(vfs.OS)
+			opts := DefaultOptions(path)
+			opts.FS = fs
+			opts.Sync = true
+			opts.LogFileSizeThreshold = 4 << 10
+			db, err := Open(opts)
+			assert.Nil(t, err)
+
+			fs.CrashAfter(crashAt)
+			var strs, pushed, fields int
+			for i := 0; i < 500; i++ {
+				if err = db.Set(GetKey(i), GetKey(i)); err != nil {
+					break
+				}
+				strs++
+				if err = db.RPush([]byte("list"), GetKey(i)); err != nil {
+					break
+				}
+				pushed++
+				if err = db.HSet([]byte("hash"), GetKey(i), GetKey(i)); err != nil {
+					break
+				}
+				fields++
+			}
+			assert.NotNil(t, err)
+			assert.True(t, fs.Crashed())
+			_ = db.Close()
+
+			// every acknowledged write survives the crash.
+			opts.FS = vfs.OS
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			for i := 0; i < strs; i++ {
+				v, err := db.Get(GetKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, GetKey(i), v)
+			}
+			for i := 0; i < pushed; i++ {
+				v, err := db.LIndex([]byte("list"), i)
+				assert.Nil(t, err)
+				assert.Equal(t, GetKey(i), v)
+			}
+			for i := 0; i < fields; i++ {
+				v, err := db.HGet([]byte("hash"), GetKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, GetKey(i), v)
+			}
+
+			// the torn entries are discarded, so the db can be written and reopened again.
+			assert.Nil(t, db.Set([]byte("after-crash"), []byte("value")))
+			assert.Nil(t, db.Close())
+			db, err = Open(opts)
+			assert.Nil(t, err)
+			v, err := db.Get([]byte("after-crash"))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("value"), v)
+			assert.Nil(t, db.Close())
+		})
+	}
+}
+
+func TestOpen_ReadOnly(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine_readonly")
+	opts := DefaultOptions(path)
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Set(GetKey(i), GetValue16B())
+		assert.Nil(t, err)
+	}
+	err = db.HSet([]byte("hash"), []byte("field"), []byte("value"))
+	assert.Nil(t, err)
+
+	// exclusive lock is held by the writer.
+	opts.ReadOnly = true
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+	assert.Nil(t, db.Close())
+
+	t.Run("shared", func(t *testing.T) {
+		for _, ioType := range []IOType{FileIO, MMap} {
+			opts.IoType = ioType
+			db1, err := Open(opts)
+			assert.Nil(t, err)
+			db2, err := Open(opts)
+			assert.Nil(t, err)
+
+			v, err := db1.Get(GetKey(10))
+			assert.Nil(t, err)
+			assert.NotNil(t, v)
+			v, err = db2.HGet([]byte("hash"), []byte("field"))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("value"), v)
+
+			assert.Nil(t, db1.Close())
+			assert.Nil(t, db2.Close())
+		}
+	})
+
+	t.Run("mutation", func(t *testing.T) {
+		opts.IoType = FileIO
+		rdb, err := Open(opts)
+		assert.Nil(t, err)
+		defer rdb.Close()
+
+		assert.Equal(t, ErrReadOnly, rdb.Set(GetKey(1), GetValue16B()))
+		assert.Equal(t, ErrReadOnly, rdb.Delete(GetKey(1)))
+		assert.Equal(t, ErrReadOnly, rdb.HSet([]byte("hash"), []byte("f"), []byte("v")))
+		assert.Equal(t, ErrReadOnly, rdb.LPush([]byte("list"), []byte("v")))
+		assert.Equal(t, ErrReadOnly, rdb.RunLogFileGC(String, 0, 0.5))
+		_, err = rdb.Get(GetKey(1))
+		assert.Nil(t, err)
+	})
+
+	t.Run("not-exist", func(t *testing.T) {
+		_, err := Open(Options{DBPath: filepath.Join("/tmp", "kv_engine_readonly_none"), ReadOnly: true})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("no-lock-file", func(t *testing.T) {
+		path := t.TempDir()
+		_, err := Open(Options{DBPath: path, ReadOnly: true})
+		assert.NotNil(t, err)
+		// nothing is written to the directory.
+		entries, err := os.ReadDir(path)
+		assert.Nil(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("writer-excluded", func(t *testing.T) {
+		rdb, err := Open(opts)
+		assert.Nil(t, err)
+		wopts := opts
+		wopts.ReadOnly = false
+		_, err = Open(wopts)
+		assert.NotNil(t, err)
+		assert.Nil(t, rdb.Close())
+
+		wdb, err := Open(wopts)
+		assert.Nil(t, err)
+		assert.Nil(t, wdb.Close())
+	})
+}
+
+func TestRoseDB_BackupAndRestore(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 32 << 20
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+	}
+	assert.Nil(t, db.Delete(GetKey(0)))
+	assert.Nil(t, db.HSet([]byte("hash"), []byte("field"), []byte("value")))
+	assert.Nil(t, db.RPush([]byte("list"), []byte("a"), []byte("b")))
+
+	backupPath := filepath.Join("/tmp", "kv_engine_backup")
+	defer os.RemoveAll(backupPath)
+	assert.Nil(t, db.Backup(backupPath))
+	expected, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+
+	// changes after backup will be dropped by restore.
+	assert.Nil(t, db.Set(GetKey(1), GetValue16B()))
+	assert.Nil(t, db.Set([]byte("after-backup"), GetValue16B()))
+	// backups without the lock file, which are created by older versions, can be restored too.
+	assert.Nil(t, os.Remove(filepath.Join(backupPath, lockFileName)))
+	assert.Nil(t, db.Restore(backupPath))
+
+	v, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, v)
+	_, err = db.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("after-backup"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v, err = db.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	values, err := db.LRange([]byte("list"), 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, values)
+
+	// the backup can be opened as a db directly, even in read-only mode.
+	assert.Nil(t, os.RemoveAll(backupPath))
+	assert.Nil(t, db.Backup(backupPath))
+	opts.DBPath = backupPath
+	opts.ReadOnly = true
+	backup, err := Open(opts)
+	assert.Nil(t, err)
+	v, err = backup.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, v)
+	assert.Nil(t, backup.Close())
+}
+
+func TestRoseDB_SetLogFileGCRatio(t *testing.T) {
+	opts := DefaultOptions(filepath.Join("/tmp", "kv_engine-gcratio"))
+	opts.InMemory = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Equal(t, 0.5, db.LogFileGCRatio())
+	assert.Nil(t, db.SetLogFileGCRatio(0.2))
+	assert.Equal(t, 0.2, db.LogFileGCRatio())
+	for _, ratio := range []float64{0, -0.5, 1.5} {
+		assert.Equal(t, ErrInvalidGCRatio, db.SetLogFileGCRatio(ratio))
+	}
+	assert.Equal(t, 0.2, db.LogFileGCRatio())
 }
 
 func TestLogFileGC(t *testing.T) {
@@ -0,0 +1,130 @@
+package kv_engine
+
+import (
+	"time"
+
+	"github.com/reid00/kv_engine/logger"
+)
+
+// degradedState is the write failure which degraded the db to read-only.
+type degradedState struct {
+	err   *degradedError
+	since time.Time
+}
+
+// degradedError is returned by writes of a degraded db, errors.Is reports it as both ErrDegraded and its cause,
+// e.g. syscall.ENOSPC if the disk is full.
+type degradedError struct {
+	cause error
+}
+
+func (e *degradedError) Error() string {
+	return ErrDegraded.Error() + ": " + e.cause.Error()
+}
+
+func (e *degradedError) Is(target error) bool {
+	return target == ErrDegraded
+}
+
+func (e *degradedError) Unwrap() error {
+	return e.cause
+}
+
+// degrade switches the db into read-only mode after a write failure, and returns the error of writes from then on.
+// The error is sticky: the first failure is kept until Recover succeeds.
+//
+// The entries written before the failure stay in the log files and indexes, and the partial entry is rolled back,
+// so reads are still served, see logfile.LogFile.Write.
+func (db *RoseDB) degrade(cause error) error {
+	db.degradeMu.Lock()
+	defer db.degradeMu.Unlock()
+	if state := db.degradedState(); state != nil {
+		return state.err
+	}
+	logger.Errorf("write failed, db is degraded to read-only, err: %v", cause)
+	state := &degradedState{err: &degradedError{cause: cause}, since: time.Now()}
+	db.degraded.Store(state)
+	return state.err
+}
+
+func (db *RoseDB) degradedState() *degradedState {
+	state, _ := db.degraded.Load().(*degradedState)
+	return state
+}
+
+// degradedErr returns the error of writes if the db is degraded, nil otherwise.
+func (db *RoseDB) degradedErr() error {
+	if state := db.degradedState(); state != nil {
+		return state.err
+	}
+	return nil
+}
+
+// Recover resumes the writes of a db degraded by a write failure, e.g. once space is freed after the disk was full.
+// The partial entries left by the failure are cleared and active log files are synced to check that writes succeed,
+// the db stays degraded if it fails. It does nothing if the db is not degraded.
+func (db *RoseDB) Recover() error {
+	if db.degradedState() == nil {
+		return nil
+	}
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		db.appendMu[dataType].Lock()
+		defer db.appendMu[dataType].Unlock()
+	}
+
+	db.degradeMu.Lock()
+	defer db.degradeMu.Unlock()
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		active := db.getActiveLogFile(dataType)
+		if active == nil {
+			continue
+		}
+		// the rollback of the failed write may fail too.
+		if err := active.DiscardTail(active.WriteAt); err != nil {
+			return err
+		}
+	}
+	db.degraded.Store((*degradedState)(nil))
+	logger.Infof("db recovered from the write failure, writes are resumed")
+	return nil
+}
+
+// checkDiskUsage returns ErrDiskUsageExceeded if a new log file would make the log files exceed Options.MaxDiskUsage.
+func (db *RoseDB) checkDiskUsage() error {
+	if db.opts.MaxDiskUsage <= 0 {
+		return nil
+	}
+	usage, err := db.diskUsage()
+	if err != nil {
+		return err
+	}
+	if usage+db.opts.LogFileSizeThreshold > db.opts.MaxDiskUsage {
+		return ErrDiskUsageExceeded
+	}
+	return nil
+}
+
+// diskUsage returns the total size of log files.
+func (db *RoseDB) diskUsage() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var usage int64
+	for _, active := range db.activeLogFiles {
+		size, err := active.Size()
+		if err != nil {
+			return 0, err
+		}
+		usage += size
+	}
+	for _, archived := range db.archivedLogFiles {
+		for _, lf := range archived {
+			size, err := lf.Size()
+			if err != nil {
+				return 0, err
+			}
+			usage += size
+		}
+	}
+	return usage, nil
+}
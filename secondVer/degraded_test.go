@@ -0,0 +1,148 @@
+package kv_engine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/reid00/kv_engine/logfile"
+	"github.com/reid00/kv_engine/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoseDB_Degraded(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-degraded")
+	defer os.RemoveAll(path)
+	fs := vfs.NewFaultFS(vfs.OS)
+	opts := DefaultOptions(path)
+	opts.FS = fs
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetKey(i)))
+	}
+	assert.Nil(t, db.HSet([]byte("hash"), GetKey(1), GetKey(1)))
+
+	// the disk is full.
+	fs.Inject(vfs.NoSpace, "log.strs.*")
+	err = db.Set(GetKey(100), GetKey(100))
+	assert.True(t, errors.Is(err, ErrDegraded))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+
+	// writes of all data types fail with the sticky error, while reads still work.
+	assert.Equal(t, err, db.HSet([]byte("hash"), GetKey(2), GetKey(2)))
+	assert.Equal(t, err, db.Delete(GetKey(1)))
+	v, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, GetKey(1), v)
+	_, err = db.Get(GetKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(stats.Degraded, syscall.ENOSPC))
+	assert.False(t, stats.DegradedSince.IsZero())
+
+	// recovery fails until space is available.
+	assert.True(t, errors.Is(db.Recover(), syscall.ENOSPC))
+	assert.True(t, errors.Is(db.Set(GetKey(100), GetKey(100)), ErrDegraded))
+	fs.Reset()
+	assert.Nil(t, db.Recover())
+	assert.Nil(t, db.Set(GetKey(100), GetKey(100)))
+	assert.Nil(t, db.HSet([]byte("hash"), GetKey(2), GetKey(2)))
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	assert.Nil(t, stats.Degraded)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i <= 100; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetKey(i), v)
+	}
+	v, err = db.HGet([]byte("hash"), GetKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, GetKey(2), v)
+}
+
+func TestRoseDB_DegradedRollback(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-degraded")
+	fs := vfs.NewFaultFS(vfs.OS)
+	opts := DefaultOptions(path)
+	opts.FS = fs
+	opts.Sync = true
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	assert.Nil(t, db.Set(GetKey(1), GetValue128B()))
+
+	t.Run("short-write", func(t *testing.T) {
+		fs.Inject(vfs.ShortWrite, "")
+		err := db.Set(GetKey(2), GetValue128B())
+		assert.True(t, errors.Is(err, ErrDegraded))
+		fs.Reset()
+
+		// the partial entry is rolled back, and WriteAt is unchanged.
+		active := db.getActiveLogFile(String)
+		_, _, err = active.ReadLogEntry(active.WriteAt)
+		assert.Equal(t, logfile.ErrEndOfEntry, err)
+		assert.Nil(t, db.Recover())
+		assert.Nil(t, db.Set(GetKey(3), GetValue16B()))
+	})
+
+	t.Run("fail-sync", func(t *testing.T) {
+		fs.Inject(vfs.FailSync, "")
+		err := db.Set(GetKey(4), GetValue16B())
+		assert.True(t, errors.Is(err, ErrDegraded))
+		assert.True(t, errors.Is(err, vfs.ErrInjected))
+		fs.Reset()
+		assert.Nil(t, db.Recover())
+	})
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(GetKey(3))
+	assert.Nil(t, err)
+}
+
+func TestRoseDB_MaxDiskUsage(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-disk-usage")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.MaxDiskUsage = 4 * opts.LogFileSizeThreshold
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	var written int
+	for ; written < 1000; written++ {
+		if err = db.Set(GetKey(written), GetValue128B()); err != nil {
+			break
+		}
+	}
+	// the write is rejected before the limit is exceeded, and the db is not degraded.
+	assert.Equal(t, ErrDiskUsageExceeded, err)
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.True(t, stats.DiskBytes <= opts.MaxDiskUsage)
+	assert.Nil(t, stats.Degraded)
+
+	// writes fitting in the active log file still work.
+	assert.Nil(t, db.Delete(GetKey(0)))
+	_, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+
+	// other data types need new log files too.
+	assert.Equal(t, ErrDiskUsageExceeded, db.HSet([]byte("hash"), GetKey(1), GetKey(1)))
+}
@@ -7,9 +7,11 @@ import (
 	"github.com/reid00/kv_engine/ioselector"
 	"github.com/reid00/kv_engine/logfile"
 	"github.com/reid00/kv_engine/logger"
+	"github.com/reid00/kv_engine/vfs"
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -25,6 +27,8 @@ var ErrDiscardNoSpace = errors.New("not enough space can be allocated for the di
 // Discard is used to record total size and discarded size in a log file.
 // Mainly for log files compaction.
 type discard struct {
+	// number of discarded entries dropped because valChan is full, keep it first for 64-bit alignment.
+	dropped uint64
 	sync.Mutex
 	valChan chan *indexNode
 	file    ioselector.IOSelector
@@ -35,19 +39,24 @@ type discard struct {
 	location map[uint32]int64 // offset of each fid
 }
 
-func newDiscard(path, name string, bufferSize int) (*discard, error) {
+func newDiscard(fs vfs.FS, path, name string, bufferSize int) (*discard, error) {
 	fname := filepath.Join(path, name)
-	file, err := ioselector.NewMMapSelector(fname, discardFileSize)
+	file, err := ioselector.NewMMapSelector(fs, fname, discardFileSize)
 	if err != nil {
 		return nil, err
 	}
+	return loadDiscard(file, bufferSize)
+}
+
+// loadDiscard loads the records of the discard file.
+func loadDiscard(file ioselector.IOSelector, bufferSize int) (*discard, error) {
 
 	var freeList []int64
 	var offset int64
 	location := make(map[uint32]int64)
 	for {
-		// read fid and total is enough.
-		buf := make([]byte, 8)
+		// read the whole record, so the incomplete record at the end of file is never used.
+		buf := make([]byte, discardRecordSize)
 		if _, err := file.Read(buf, offset); err != nil {
 			if err == io.EOF || err == logfile.ErrEndOfEntry {
 				break
@@ -119,6 +128,33 @@ func (d *discard) getCCL(activeFid uint32, ratio float64) ([]uint32, error) {
 	return ccl, nil
 }
 
+// records returns the total and discarded size of all log files in discard file.
+func (d *discard) records() ([]FileDiscard, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	records := make([]FileDiscard, 0, len(d.location))
+	buf := make([]byte, discardRecordSize)
+	for fid, offset := range d.location {
+		if _, err := d.file.Read(buf, offset); err != nil {
+			return nil, err
+		}
+		record := FileDiscard{
+			Fid:       fid,
+			Total:     int64(binary.LittleEndian.Uint32(buf[4:8])),
+			Discarded: int64(binary.LittleEndian.Uint32(buf[8:12])),
+		}
+		if record.Total > 0 {
+			record.Ratio = float64(record.Discarded) / float64(record.Total)
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Fid < records[j].Fid
+	})
+	return records, nil
+}
+
 func (d *discard) listenUpdates() {
 
 	for v := range d.valChan {
@@ -135,6 +171,16 @@ func (d *discard) listenUpdates() {
 	// }
 }
 
+// send the discarded entry to valChan without blocking, it will be dropped if valChan is full.
+func (d *discard) send(node *indexNode) {
+	select {
+	case d.valChan <- node:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+		logger.Warn("send to discard chan fail")
+	}
+}
+
 func (d *discard) setTotal(fid uint32, totalSize uint32) {
 	d.Lock()
 	defer d.Unlock()
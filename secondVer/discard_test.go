@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/reid00/kv_engine/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,7 +39,7 @@ func TestDiscard_newDiscard(t *testing.T) {
 		path := filepath.Join("/tmp", "kv_engine_discard")
 		os.MkdirAll(path, os.ModePerm)
 		defer os.RemoveAll(path)
-		discard, err := newDiscard(path, discardFileName, 4096)
+		discard, err := newDiscard(vfs.OS, path, discardFileName, 4096)
 		assert.Nil(t, err)
 
 		assert.Equal(t, 682, len(discard.freeList))
@@ -49,7 +50,7 @@ func TestDiscard_newDiscard(t *testing.T) {
 		path := filepath.Join("/tmp", "kv_engine_discard")
 		os.MkdirAll(path, os.ModePerm)
 		defer os.RemoveAll(path)
-		discard, err := newDiscard(path, discardFileName, 4096)
+		discard, err := newDiscard(vfs.OS, path, discardFileName, 4096)
 		assert.Nil(t, err)
 
 		for i := 1; i < 300; i *= 5 {
@@ -61,7 +62,7 @@ func TestDiscard_newDiscard(t *testing.T) {
 		assert.Equal(t, 4, discard.location)
 
 		// reopen
-		dis2, err := newDiscard(path, discardFileName, 4096)
+		dis2, err := newDiscard(vfs.OS, path, discardFileName, 4096)
 		assert.Nil(t, err)
 		assert.Equal(t, 678, len(dis2.freeList))
 		assert.Equal(t, 4, len(dis2.location))
@@ -74,7 +75,7 @@ func TestDiscard_clear(t *testing.T) {
 	os.MkdirAll(path, os.ModePerm)
 	defer os.RemoveAll(path)
 
-	dis, err := newDiscard(path, discardFileName, 4096)
+	dis, err := newDiscard(vfs.OS, path, discardFileName, 4096)
 	assert.Nil(t, err)
 
 	for i := 0; i < 682; i++ {
@@ -123,7 +124,7 @@ func TestDiscard_increDiscard(t *testing.T) {
 	os.MkdirAll(path, os.ModePerm)
 	defer os.RemoveAll(path)
 
-	dis, err := newDiscard(path, discardFileName, 4096)
+	dis, err := newDiscard(vfs.OS, path, discardFileName, 4096)
 	assert.Nil(t, err)
 
 	for i := 1; i < 600; i *= 5 {
@@ -144,7 +145,7 @@ func TestDiscard_getCCL(t *testing.T) {
 	path := filepath.Join("/tmp", "kv_engine_discard")
 	os.MkdirAll(path, os.ModePerm)
 	defer os.RemoveAll(path)
-	dis, err := newDiscard(path, discardFileName, 4096)
+	dis, err := newDiscard(vfs.OS, path, discardFileName, 4096)
 	assert.Nil(t, err)
 
 	for i := 1; i < 2000; i *= 5 {
@@ -1,11 +1,25 @@
 package art
 
 import (
+	"bytes"
+	"math"
+	"sync/atomic"
+
 	goart "github.com/plar/go-adaptive-radix-tree"
+	"github.com/reid00/kv_engine/ds/hamt"
 )
 
 type AdaptiveRadixTree struct {
 	tree goart.Tree
+	// latest immutable version of the tree, only maintained by trees created by NewARTWithSnapshot.
+	snapshot *atomic.Value
+	// counts the writes of the tree if not nil, see CountIn.
+	counter *Counter
+}
+
+// Snapshot is an immutable version of a tree, it can be read concurrently with the writes of the tree without any lock.
+type Snapshot struct {
+	m *hamt.Map
 }
 
 func NewART() *AdaptiveRadixTree {
@@ -14,8 +28,35 @@ func NewART() *AdaptiveRadixTree {
 	}
 }
 
+// NewARTWithSnapshot returns a tree which publishes an immutable version of itself on every write, see Snapshot.
+// Writes are slower and use more memory, because the nodes on the path to the key are copied.
+func NewARTWithSnapshot() *AdaptiveRadixTree {
+	art := NewART()
+	art.snapshot = new(atomic.Value)
+	art.snapshot.Store(&Snapshot{m: hamt.New()})
+	return art
+}
+
+// CountIn makes the writes of the tree update c, it must be called before any write.
+func (art *AdaptiveRadixTree) CountIn(c *Counter) *AdaptiveRadixTree {
+	art.counter = c
+	return art
+}
+
 func (art *AdaptiveRadixTree) Put(key []byte, value any) (oldValue any, updated bool) {
-	return art.tree.Insert(key, value)
+	oldValue, updated = art.tree.Insert(key, value)
+	if art.snapshot != nil {
+		art.snapshot.Store(&Snapshot{m: art.Snapshot().m.Put(key, value)})
+	}
+	if art.counter != nil {
+		if updated {
+			art.counter.addMemory(key, oldValue, -1)
+		} else {
+			art.counter.inserted(art.tree.Size())
+		}
+		art.counter.addMemory(key, value, 1)
+	}
+	return
 }
 
 func (art *AdaptiveRadixTree) Get(key []byte) any {
@@ -24,13 +65,82 @@ func (art *AdaptiveRadixTree) Get(key []byte) any {
 }
 
 func (art *AdaptiveRadixTree) Delete(key []byte) (val any, updated bool) {
-	return art.tree.Delete(key)
+	val, updated = art.tree.Delete(key)
+	if updated && art.snapshot != nil {
+		art.snapshot.Store(&Snapshot{m: art.Snapshot().m.Delete(key)})
+	}
+	if updated && art.counter != nil {
+		art.counter.deleted(art.tree.Size())
+		art.counter.addMemory(key, val, -1)
+	}
+	return
 }
 
 func (art *AdaptiveRadixTree) Iterator() goart.Iterator {
 	return art.tree.Iterator()
 }
 
+// ForEachAfter calls callback with the keys greater than key and their values in order, until callback returns false.
+// All keys are visited if key is nil. The keys before key are not visited, only the subtrees after it are walked.
+func (art *AdaptiveRadixTree) ForEachAfter(key []byte, callback func(key []byte, value any) bool) {
+	var stopped bool
+	visit := func(node goart.Node) bool {
+		if node.Kind() != goart.Leaf || (key != nil && bytes.Compare(node.Key(), key) <= 0) {
+			return true
+		}
+		stopped = !callback(node.Key(), node.Value())
+		return !stopped
+	}
+	// keys prefixed by key come first, then the keys which differ from it at a byte, from the last byte to the first.
+	art.forEachPrefix(key, visit)
+	prefix := make([]byte, len(key))
+	for i := len(key) - 1; i >= 0 && !stopped; i-- {
+		if !art.hasPrefix(key[:i]) {
+			continue
+		}
+		copy(prefix, key[:i])
+		for b := int(key[i]) + 1; b <= math.MaxUint8 && !stopped; b++ {
+			prefix[i] = byte(b)
+			art.tree.ForEachPrefix(prefix[:i+1], visit)
+		}
+	}
+}
+
+// hasPrefix reports whether any key starts with prefix.
+func (art *AdaptiveRadixTree) hasPrefix(prefix []byte) bool {
+	var found bool
+	art.forEachPrefix(prefix, func(node goart.Node) bool {
+		found = node.Kind() == goart.Leaf
+		return !found
+	})
+	return found
+}
+
+// forEachPrefix is like ForEachPrefix of the underlying tree, but visits all nodes if prefix is empty.
+func (art *AdaptiveRadixTree) forEachPrefix(prefix []byte, callback goart.Callback) {
+	if len(prefix) == 0 {
+		art.tree.ForEach(callback, goart.TraverseAll)
+		return
+	}
+	art.tree.ForEachPrefix(prefix, callback)
+}
+
 func (art *AdaptiveRadixTree) Size() int {
 	return art.tree.Size()
-}
\ No newline at end of file
+}
+
+// Snapshot returns the latest version of the tree, nil if the tree is not created by NewARTWithSnapshot.
+func (art *AdaptiveRadixTree) Snapshot() *Snapshot {
+	if art.snapshot == nil {
+		return nil
+	}
+	return art.snapshot.Load().(*Snapshot)
+}
+
+// Get returns the value of key in this version, nil if not exists or the snapshot is nil.
+func (s *Snapshot) Get(key []byte) any {
+	if s == nil {
+		return nil
+	}
+	return s.m.Get(key)
+}
@@ -1,7 +1,9 @@
 package art
 
 import (
+	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -130,3 +132,158 @@ func TestAdaptiveRadixTree_Delete(t *testing.T) {
 
 	}
 }
+
+func TestNewMergeIterator(t *testing.T) {
+	trees := []*AdaptiveRadixTree{NewART(), NewART(), NewART()}
+	keys := []string{"a", "ab", "b", "ba", "c", "d", "e", "ee", "f"}
+	for i, key := range keys {
+		trees[(i*7)%len(trees)].Put([]byte(key), i)
+	}
+
+	tests := []struct {
+		name  string
+		trees []*AdaptiveRadixTree
+		want  []string
+	}{
+		{"no-tree", nil, nil},
+		{"empty", []*AdaptiveRadixTree{NewART(), NewART()}, nil},
+		{"one", trees[:1], []string{"a", "ba", "e"}},
+		{"all", trees, keys},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			iter := NewMergeIterator(tt.trees...)
+			for iter.HasNext() {
+				node, err := iter.Next()
+				if err != nil {
+					t.Fatalf("merge iterator Next() err: %v", err)
+				}
+				got = append(got, string(node.Key()))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("merge iterator got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveRadixTree_ForEachAfter(t *testing.T) {
+	tree := NewART()
+	keys := []string{"a", "ab", "abc", "abd", "ac", "b", "ba", "b\xff", "c"}
+	for i, key := range keys {
+		tree.Put([]byte(key), i)
+	}
+
+	tests := []struct {
+		name  string
+		key   []byte
+		count int
+		want  []string
+	}{
+		{"nil", nil, 0, keys},
+		{"first", []byte("a"), 0, keys[1:]},
+		{"prefix", []byte("ab"), 0, keys[2:]},
+		{"missing", []byte("abca"), 0, keys[3:]},
+		{"upper", []byte("b\xff"), 0, keys[8:]},
+		{"last", []byte("c"), 0, nil},
+		{"after-all", []byte("d"), 0, nil},
+		{"count", []byte("ab"), 3, keys[2:5]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			tree.ForEachAfter(tt.key, func(key []byte, value any) bool {
+				got = append(got, string(key))
+				return tt.count <= 0 || len(got) < tt.count
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("art tree.ForEachAfter() got: %q, want: %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("random", func(t *testing.T) {
+		tree := NewART()
+		var keys []string
+		for i := 0; i < 500; i++ {
+			key := make([]byte, 1+rand.Intn(4))
+			for j := range key {
+				key[j] = "ab\x00\xff"[rand.Intn(4)]
+			}
+			if _, updated := tree.Put(key, i); !updated {
+				keys = append(keys, string(key))
+			}
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			var got []string
+			tree.ForEachAfter([]byte(key), func(key []byte, value any) bool {
+				got = append(got, string(key))
+				return true
+			})
+			if want := keys[i+1:]; len(got) != len(want) || (len(got) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("art tree.ForEachAfter(%q) got: %q, want: %q", key, got, want)
+			}
+		}
+	})
+}
+
+func TestAdaptiveRadixTree_Snapshot(t *testing.T) {
+	if NewART().Snapshot() != nil {
+		t.Fatalf("snapshot of tree without snapshot should be nil")
+	}
+
+	tree := NewARTWithSnapshot()
+	tree.Put([]byte("1"), 1)
+	tree.Put([]byte("2"), 2)
+	snap := tree.Snapshot()
+	tree.Put([]byte("1"), 11)
+	tree.Delete([]byte("2"))
+
+	if snap.Get([]byte("1")) != 1 || snap.Get([]byte("2")) != 2 {
+		t.Errorf("old snapshot is changed by writes")
+	}
+	latest := tree.Snapshot()
+	if latest.Get([]byte("1")) != 11 || latest.Get([]byte("2")) != nil {
+		t.Errorf("latest snapshot got: %v, %v", latest.Get([]byte("1")), latest.Get([]byte("2")))
+	}
+}
+
+type sizedValue int64
+
+func (v sizedValue) MemSize() int64 {
+	return int64(v)
+}
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter(1)
+	tree1, tree2 := NewART().CountIn(counter), NewARTWithSnapshot().CountIn(counter)
+	check := func(keys, entries, memory int64) {
+		t.Helper()
+		if counter.Keys() != keys || counter.Entries() != entries || counter.Memory() != memory {
+			t.Errorf("counter got: %d, %d, %d, want: %d, %d, %d",
+				counter.Keys(), counter.Entries(), counter.Memory(), keys, entries, memory)
+		}
+	}
+
+	// the first entry of a tree is not counted as an entry, nor the tree as a key.
+	tree1.Put([]byte("a"), sizedValue(10))
+	check(0, 0, leafOverhead+1+10)
+	tree1.Put([]byte("b"), sizedValue(20))
+	tree2.Put([]byte("c"), 1)
+	tree2.Put([]byte("d"), 1)
+	check(2, 2, 4*leafOverhead+4+30)
+
+	// updates change the memory only, values which are not Sizer have no memory.
+	tree1.Put([]byte("b"), 1)
+	check(2, 2, 4*leafOverhead+4+10)
+	tree1.Delete([]byte("a"))
+	tree1.Delete([]byte("x"))
+	check(1, 1, 3*leafOverhead+3)
+	tree1.Delete([]byte("b"))
+	check(1, 1, 2*leafOverhead+2)
+
+	counter.Reset()
+	check(0, 0, 0)
+}
@@ -0,0 +1,76 @@
+package art
+
+import "sync/atomic"
+
+// leafOverhead approximate memory of a leaf and its slot in the inner node.
+const leafOverhead = 64
+
+// Sizer is implemented by the values of trees which know their memory, the memory of other values is not counted.
+type Sizer interface {
+	MemSize() int64
+}
+
+// Counter counts the keys, entries and memory of the trees sharing it.
+// It is updated by the writes of the trees, and can be read concurrently without any lock.
+type Counter struct {
+	// the first base entries of a tree are not counted as entries, e.g. the meta of a list,
+	// and a tree is counted as a key if it has more entries than base.
+	base    int
+	keys    int64
+	entries int64
+	memory  int64
+}
+
+func NewCounter(base int) *Counter {
+	return &Counter{base: base}
+}
+
+// Keys returns the number of trees having more entries than base.
+func (c *Counter) Keys() int64 {
+	return atomic.LoadInt64(&c.keys)
+}
+
+// Entries returns the number of entries of all trees, except the first base ones of every tree.
+func (c *Counter) Entries() int64 {
+	return atomic.LoadInt64(&c.entries)
+}
+
+// Memory returns the estimated memory of all entries.
+func (c *Counter) Memory() int64 {
+	return atomic.LoadInt64(&c.memory)
+}
+
+// Reset clears the counter, it is called when all trees sharing it are dropped.
+func (c *Counter) Reset() {
+	atomic.StoreInt64(&c.keys, 0)
+	atomic.StoreInt64(&c.entries, 0)
+	atomic.StoreInt64(&c.memory, 0)
+}
+
+// inserted counts an entry inserted to a tree, which has size entries after that.
+func (c *Counter) inserted(size int) {
+	if size > c.base {
+		atomic.AddInt64(&c.entries, 1)
+	}
+	if size == c.base+1 {
+		atomic.AddInt64(&c.keys, 1)
+	}
+}
+
+// deleted counts an entry deleted from a tree, which has size entries after that.
+func (c *Counter) deleted(size int) {
+	if size >= c.base {
+		atomic.AddInt64(&c.entries, -1)
+	}
+	if size == c.base {
+		atomic.AddInt64(&c.keys, -1)
+	}
+}
+
+func (c *Counter) addMemory(key []byte, value any, sign int64) {
+	size := leafOverhead + int64(len(key))
+	if sizer, ok := value.(Sizer); ok {
+		size += sizer.MemSize()
+	}
+	atomic.AddInt64(&c.memory, sign*size)
+}
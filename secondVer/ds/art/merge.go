@@ -0,0 +1,80 @@
+package art
+
+import (
+	"bytes"
+	"container/heap"
+
+	goart "github.com/plar/go-adaptive-radix-tree"
+)
+
+// mergeIterator iterates over the leaves of several trees in key order.
+// A key is expected to be in only one of the trees.
+type mergeIterator struct {
+	heads mergeHeap
+}
+
+type mergeHead struct {
+	node goart.Node
+	iter goart.Iterator
+}
+
+type mergeHeap []*mergeHead
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return bytes.Compare(h[i].node.Key(), h[j].node.Key()) < 0 }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// NewMergeIterator returns an iterator over the leaves of all trees in key order.
+// The trees must not be modified during the iteration.
+func NewMergeIterator(trees ...*AdaptiveRadixTree) goart.Iterator {
+	it := &mergeIterator{heads: make(mergeHeap, 0, len(trees))}
+	for _, tree := range trees {
+		head := &mergeHead{iter: tree.Iterator()}
+		if head.advance() {
+			it.heads = append(it.heads, head)
+		}
+	}
+	heap.Init(&it.heads)
+	return it
+}
+
+func (it *mergeIterator) HasNext() bool {
+	return len(it.heads) > 0
+}
+
+func (it *mergeIterator) Next() (goart.Node, error) {
+	if len(it.heads) == 0 {
+		return nil, goart.ErrNoMoreNodes
+	}
+	head := it.heads[0]
+	node := head.node
+	if head.advance() {
+		heap.Fix(&it.heads, 0)
+	} else {
+		heap.Pop(&it.heads)
+	}
+	return node, nil
+}
+
+// advance moves the head to the next leaf of its tree, it returns false if there is no more leaf.
+func (h *mergeHead) advance() bool {
+	for h.iter.HasNext() {
+		node, err := h.iter.Next()
+		if err != nil {
+			return false
+		}
+		if node.Kind() == goart.Leaf {
+			h.node = node
+			return true
+		}
+	}
+	return false
+}
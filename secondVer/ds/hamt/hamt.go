@@ -0,0 +1,235 @@
+package hamt
+
+import (
+	"math/bits"
+
+	"github.com/reid00/kv_engine/util"
+)
+
+// hamt is a persistent hash array mapped trie.
+// Every Put and Delete returns a new version of the map and leaves the old one untouched,
+// only the nodes on the path to the key are copied, so a version can be read concurrently without any lock.
+
+const (
+	bitsPerLevel = 5
+	fanout       = 1 << bitsPerLevel
+	levelMask    = fanout - 1
+)
+
+type (
+	// Map is an immutable version of the map, the zero value is an empty map.
+	Map struct {
+		root *node
+		size int
+	}
+
+	// children are either *node or *leaf, the index of a child is the popcount of the bitmap below its bit.
+	node struct {
+		bitmap   uint32
+		children []interface{}
+	}
+
+	// leaf holds the entries of the same hash.
+	leaf struct {
+		hash    uint64
+		entries []entry
+	}
+
+	entry struct {
+		key   string
+		value interface{}
+	}
+)
+
+// New returns an empty map.
+func New() *Map {
+	return &Map{}
+}
+
+// Len returns the number of keys.
+func (m *Map) Len() int {
+	if m == nil {
+		return 0
+	}
+	return m.size
+}
+
+// Get returns the value of key, nil if not exists.
+func (m *Map) Get(key []byte) interface{} {
+	if m == nil || m.root == nil {
+		return nil
+	}
+	return m.root.get(util.MemHash(key), string(key))
+}
+
+// Put returns a new version of the map with key set to value.
+func (m *Map) Put(key []byte, value interface{}) *Map {
+	root := m.rootOrEmpty()
+	newRoot, added := root.put(0, util.MemHash(key), string(key), value)
+	size := m.Len()
+	if added {
+		size++
+	}
+	return &Map{root: newRoot, size: size}
+}
+
+// Delete returns a new version of the map without key, the map itself is returned if key not exists.
+func (m *Map) Delete(key []byte) *Map {
+	if m == nil || m.root == nil {
+		return m
+	}
+	newRoot, deleted := m.root.delete(0, util.MemHash(key), string(key))
+	if !deleted {
+		return m
+	}
+	return &Map{root: newRoot, size: m.size - 1}
+}
+
+func (m *Map) rootOrEmpty() *node {
+	if m == nil || m.root == nil {
+		return &node{}
+	}
+	return m.root
+}
+
+func (n *node) index(bit uint32) int {
+	return bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *node) get(hash uint64, key string) interface{} {
+	for shift := uint(0); ; shift += bitsPerLevel {
+		bit := uint32(1) << ((hash >> shift) & levelMask)
+		if n.bitmap&bit == 0 {
+			return nil
+		}
+		switch child := n.children[n.index(bit)].(type) {
+		case *node:
+			n = child
+		case *leaf:
+			if child.hash != hash {
+				return nil
+			}
+			for _, e := range child.entries {
+				if e.key == key {
+					return e.value
+				}
+			}
+			return nil
+		}
+	}
+}
+
+func (n *node) clone() *node {
+	children := make([]interface{}, len(n.children))
+	copy(children, n.children)
+	return &node{bitmap: n.bitmap, children: children}
+}
+
+func (n *node) put(shift uint, hash uint64, key string, value interface{}) (*node, bool) {
+	bit := uint32(1) << ((hash >> shift) & levelMask)
+	idx := n.index(bit)
+	if n.bitmap&bit == 0 {
+		children := make([]interface{}, len(n.children)+1)
+		copy(children, n.children[:idx])
+		children[idx] = &leaf{hash: hash, entries: []entry{{key: key, value: value}}}
+		copy(children[idx+1:], n.children[idx:])
+		return &node{bitmap: n.bitmap | bit, children: children}, true
+	}
+
+	newNode := n.clone()
+	switch child := n.children[idx].(type) {
+	case *node:
+		newChild, added := child.put(shift+bitsPerLevel, hash, key, value)
+		newNode.children[idx] = newChild
+		return newNode, added
+	case *leaf:
+		if child.hash == hash {
+			newLeaf, added := child.put(key, value)
+			newNode.children[idx] = newLeaf
+			return newNode, added
+		}
+		// split the leaf, the hashes are different so they will be in different slots at some level.
+		sub, _ := newLeafNode(shift+bitsPerLevel, child).put(shift+bitsPerLevel, hash, key, value)
+		newNode.children[idx] = sub
+		return newNode, true
+	}
+	return newNode, false
+}
+
+// newLeafNode returns a node holding an existing leaf only.
+func newLeafNode(shift uint, l *leaf) *node {
+	bit := uint32(1) << ((l.hash >> shift) & levelMask)
+	return &node{bitmap: bit, children: []interface{}{l}}
+}
+
+func (n *node) delete(shift uint, hash uint64, key string) (*node, bool) {
+	bit := uint32(1) << ((hash >> shift) & levelMask)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	idx := n.index(bit)
+
+	var newChild interface{}
+	switch child := n.children[idx].(type) {
+	case *node:
+		sub, deleted := child.delete(shift+bitsPerLevel, hash, key)
+		if !deleted {
+			return n, false
+		}
+		if len(sub.children) > 0 {
+			newChild = sub
+		}
+	case *leaf:
+		if child.hash != hash {
+			return n, false
+		}
+		newLeaf, deleted := child.delete(key)
+		if !deleted {
+			return n, false
+		}
+		if newLeaf != nil {
+			newChild = newLeaf
+		}
+	}
+
+	if newChild != nil {
+		newNode := n.clone()
+		newNode.children[idx] = newChild
+		return newNode, true
+	}
+	// remove the empty child.
+	children := make([]interface{}, len(n.children)-1)
+	copy(children, n.children[:idx])
+	copy(children[idx:], n.children[idx+1:])
+	return &node{bitmap: n.bitmap &^ bit, children: children}, true
+}
+
+func (l *leaf) put(key string, value interface{}) (*leaf, bool) {
+	entries := make([]entry, len(l.entries), len(l.entries)+1)
+	copy(entries, l.entries)
+	for i := range entries {
+		if entries[i].key == key {
+			entries[i].value = value
+			return &leaf{hash: l.hash, entries: entries}, false
+		}
+	}
+	entries = append(entries, entry{key: key, value: value})
+	return &leaf{hash: l.hash, entries: entries}, true
+}
+
+// delete returns nil if the leaf becomes empty.
+func (l *leaf) delete(key string) (*leaf, bool) {
+	for i, e := range l.entries {
+		if e.key != key {
+			continue
+		}
+		if len(l.entries) == 1 {
+			return nil, true
+		}
+		entries := make([]entry, 0, len(l.entries)-1)
+		entries = append(entries, l.entries[:i]...)
+		entries = append(entries, l.entries[i+1:]...)
+		return &leaf{hash: l.hash, entries: entries}, true
+	}
+	return l, false
+}
@@ -0,0 +1,92 @@
+package hamt
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestMap_PutGetDelete(t *testing.T) {
+	m := New()
+	expected := make(map[string]int)
+	for i := 0; i < 20000; i++ {
+		key := strconv.Itoa(rand.Intn(5000))
+		if rand.Intn(3) == 0 {
+			m = m.Delete([]byte(key))
+			delete(expected, key)
+		} else {
+			m = m.Put([]byte(key), i)
+			expected[key] = i
+		}
+	}
+	if m.Len() != len(expected) {
+		t.Fatalf("hamt Len() got: %d, want: %d", m.Len(), len(expected))
+	}
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(i)
+		want, ok := expected[key]
+		got := m.Get([]byte(key))
+		if !ok && got != nil || ok && got != want {
+			t.Fatalf("hamt Get(%s) got: %v, want: %v", key, got, want)
+		}
+	}
+}
+
+func TestMap_Immutable(t *testing.T) {
+	var versions []*Map
+	m := New()
+	for i := 0; i < 1000; i++ {
+		m = m.Put([]byte(strconv.Itoa(i)), i)
+		versions = append(versions, m)
+	}
+	for i := 0; i < 1000; i++ {
+		m = m.Delete([]byte(strconv.Itoa(i)))
+	}
+	if m.Len() != 0 || m.Get([]byte("0")) != nil {
+		t.Fatalf("hamt is not empty after deleting all keys")
+	}
+	for i, v := range versions {
+		if v.Len() != i+1 {
+			t.Fatalf("version %d Len() got: %d", i, v.Len())
+		}
+		if got := v.Get([]byte(strconv.Itoa(i))); got != i {
+			t.Fatalf("version %d Get() got: %v", i, got)
+		}
+		if got := v.Get([]byte(strconv.Itoa(i + 1))); got != nil {
+			t.Fatalf("version %d Get() of later key got: %v", i, got)
+		}
+	}
+}
+
+func TestMap_HashCollision(t *testing.T) {
+	// keys of the same hash are in the same leaf.
+	root, _ := (&node{}).put(0, 42, "a", 1)
+	root, _ = root.put(0, 42, "b", 2)
+	root, _ = root.put(0, 42|1<<40, "c", 3)
+	root, added := root.put(0, 42, "a", 4)
+	if added {
+		t.Fatalf("put of existing key should not add")
+	}
+	for key, want := range map[string]interface{}{"a": 4, "b": 2, "d": nil} {
+		if got := root.get(42, key); got != want {
+			t.Fatalf("get(%s) got: %v, want: %v", key, got, want)
+		}
+	}
+	if got := root.get(42|1<<40, "c"); got != 3 {
+		t.Fatalf("get(c) got: %v", got)
+	}
+
+	root, deleted := root.delete(0, 42, "a")
+	if !deleted {
+		t.Fatalf("delete of existing key failed")
+	}
+	root, deleted = root.delete(0, 42, "a")
+	if deleted {
+		t.Fatalf("delete of deleted key should fail")
+	}
+	root, _ = root.delete(0, 42, "b")
+	root, _ = root.delete(0, 42|1<<40, "c")
+	if len(root.children) != 0 {
+		t.Fatalf("root is not empty after deleting all keys")
+	}
+}
@@ -26,7 +26,7 @@ func AcquireFileLock(path string, readOnly bool) (*FileLockGuard, error) {
 	}
 
 	file, err := os.OpenFile(path, flag, mode)
-	if os.IsNotExist(err) {
+	if os.IsNotExist(err) && !readOnly {
 		file, err = os.OpenFile(path, flag|os.O_CREATE, mode|0644)
 	}
 	if err != nil {
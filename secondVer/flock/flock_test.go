@@ -75,6 +75,38 @@ func TestAcquireFileLock_NotExist(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestAcquireFileLock_ReadOnlyNotCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "FLOCK")
+	_, err := AcquireFileLock(path, true)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAcquireFileLock_SharedExcludesExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "FLOCK")
+	writer, err := AcquireFileLock(path, false)
+	assert.Nil(t, err)
+	_, err = AcquireFileLock(path, true)
+	assert.NotNil(t, err)
+	assert.Nil(t, writer.Release())
+
+	reader1, err := AcquireFileLock(path, true)
+	assert.Nil(t, err)
+	reader2, err := AcquireFileLock(path, true)
+	assert.Nil(t, err)
+	_, err = AcquireFileLock(path, false)
+	assert.NotNil(t, err)
+	assert.Nil(t, reader1.Release())
+	_, err = AcquireFileLock(path, false)
+	assert.NotNil(t, err)
+	assert.Nil(t, reader2.Release())
+
+	writer, err = AcquireFileLock(path, false)
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Release())
+}
+
 func TestFileLockGuard_Release(t *testing.T) {
 	path, err := filepath.Abs(filepath.Join("/tmp", "flock-test"))
 	assert.Nil(t, err)
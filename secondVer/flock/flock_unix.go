@@ -18,14 +18,11 @@ type FileLockGuard struct {
 // AcquireFileLock acquire the lock on the directory by syscall.Flock.
 // Return a FileLockGuard or an error, if any.
 func AcquireFileLock(path string, readOnly bool) (*FileLockGuard, error) {
-	var flag = os.O_RDWR
+	var flag = os.O_RDWR | os.O_CREATE
 	if readOnly {
 		flag = os.O_RDONLY
 	}
-	file, err := os.OpenFile(path, flag, 0)
-	if os.IsNotExist(err) {
-		file, err = os.OpenFile(path, flag|os.O_CREATE, 0644)
-	}
+	file, err := os.OpenFile(path, flag, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -35,6 +32,7 @@ func AcquireFileLock(path string, readOnly bool) (*FileLockGuard, error) {
 		how = syscall.LOCK_SH | syscall.LOCK_NB
 	}
 	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 	return &FileLockGuard{fd: file}, nil
@@ -26,7 +26,7 @@ func AcquireFileLock(path string, readOnly bool) (*FileLockGuard, error) {
 	}
 
 	file, err := syscall.CreateFile(ptr, access, mode, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
-	if err == syscall.ERROR_FILE_NOT_FOUND {
+	if err == syscall.ERROR_FILE_NOT_FOUND && !readOnly {
 		file, err = syscall.CreateFile(ptr, access, mode, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
 	}
 	if err != nil {
@@ -1,85 +1,124 @@
 package kv_engine
 
 import (
+	"context"
+
 	"github.com/reid00/kv_engine/ds/art"
 	"github.com/reid00/kv_engine/logfile"
-	"github.com/reid00/kv_engine/logger"
 )
 
 // HSet sets field in the hash stored at key to value. If key does not exist, a new key holding a hash is created.
 // If field already exists in the hash, it is overwritten.
 // Return num of elements in hash of the specified key.
 func (db *RoseDB) HSet(key, field, value []byte) error {
-	db.hashIndex.mu.Lock()
-	defer db.hashIndex.mu.Unlock()
+	return db.HSetCtx(context.Background(), key, field, value)
+}
+
+// HSetCtx is like HSet, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HSetCtx(ctx context.Context, key, field, value []byte) error {
+	return db.HSetWithOptions(ctx, key, field, value, WriteOptions{})
+}
+
+// HSetWithOptions is like HSetCtx, with the durability and TTL of the write specified by opts.
+// TTL is the time to live of the field.
+func (db *RoseDB) HSetWithOptions(ctx context.Context, key, field, value []byte, opts WriteOptions) (err error) {
+	held, err := db.hashIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return err
+	}
+	defer db.unlockKeysWrite(Hash, held, db.opts.Sync || opts.Sync, &err)
+	return db.hset(key, field, value, opts.expireAt(nowOf(ctx)))
+}
 
+// hset writes the field of the hash and updates the index, the lock of the key must be held.
+func (db *RoseDB) hset(key, field, value []byte, expireAt int64) error {
 	hashKey := db.encodeKey(key, field)
-	ent := &logfile.LogEntry{Key: hashKey, Value: value}
+	ent := &logfile.LogEntry{Key: hashKey, Value: value, ExpireAt: expireAt}
 	valuePos, err := db.writeLogEntry(ent, Hash)
 	if err != nil {
 		return err
 	}
 
-	if db.hashIndex.trees[string(key)] == nil {
-		db.hashIndex.trees[string(key)] = art.NewART()
-	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-	entry := &logfile.LogEntry{Key: field, Value: value}
+	idxTree := db.hashIndex.treeOrCreate(key)
+	entry := &logfile.LogEntry{Key: field, Value: value, ExpireAt: ent.ExpireAt}
 	_, size := logfile.EncodeEntry(ent)
 	valuePos.entrySize = size
-	return db.updateIndexTree(entry, valuePos, true, Hash)
+	return db.updateIndexTree(idxTree, entry, valuePos, true, Hash)
 }
 
 // MSet is multiple set command. Parameter order should be like "key", "field", "value", "field", "value", ...
 func (db *RoseDB) HMSet(key []byte, args ...[]byte) error {
-	db.hashIndex.mu.Lock()
-	defer db.hashIndex.mu.Unlock()
+	return db.HMSetCtx(context.Background(), key, args...)
+}
+
+// HMSetCtx is like HMSet, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HMSetCtx(ctx context.Context, key []byte, args ...[]byte) error {
+	_, err := db.HMSetWithOptions(ctx, key, WriteOptions{}, args...)
+	return err
+}
+
+// HMSetWithOptions is like HMSetCtx, with the durability and TTL of the writes specified by opts.
+// All the field-value pairs are covered by a single sync.
+// It returns the number of fields added to the hash, a field given twice is counted once.
+func (db *RoseDB) HMSetWithOptions(ctx context.Context, key []byte, opts WriteOptions, args ...[]byte) (_ int, err error) {
+	held, err := db.hashIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.unlockKeysWrite(Hash, held, db.opts.Sync || opts.Sync, &err)
 
 	if len(args) == 0 || len(args)&1 == 1 {
-		return ErrWrongNumberOfArgs
+		return 0, ErrWrongNumberOfArgs
 	}
 
 	// add multiple field value pairs
+	idxTree := db.hashIndex.treeOrCreate(key)
+	now := nowOf(ctx)
+	expireAt := opts.expireAt(now)
+	var added int
 	for i := 0; i < len(args); i += 2 {
 		f, v := args[i], args[i+1]
+		if liveNode(idxTree.Get(f), now) == nil {
+			added++
+		}
 		hashKey := db.encodeKey(key, f)
-		entry := &logfile.LogEntry{Key: hashKey, Value: v}
+		entry := &logfile.LogEntry{Key: hashKey, Value: v, ExpireAt: expireAt}
 		valuePos, err := db.writeLogEntry(entry, Hash)
 		if err != nil {
-			return err
-		}
-
-		if db.hashIndex.trees[string(key)] == nil {
-			db.hashIndex.trees[string(key)] = art.NewART()
+			return 0, err
 		}
-		db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
 
-		ent := &logfile.LogEntry{Key: f, Value: v}
+		ent := &logfile.LogEntry{Key: f, Value: v, ExpireAt: expireAt}
 		_, size := logfile.EncodeEntry(entry)
 		valuePos.entrySize = size
-		err = db.updateIndexTree(ent, valuePos, true, Hash)
+		err = db.updateIndexTree(idxTree, ent, valuePos, true, Hash)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
-	return nil
+	return added, nil
 }
 
 // HSetNX sets the given value only if the field doesn't exist.
 // If the key doesn't exist, new hash is created.
 // If field already exist, HSetNX doesn't have side effect.
 func (db *RoseDB) HSetNX(key, field, value []byte) (bool, error) {
-	db.hashIndex.mu.Lock()
-	defer db.hashIndex.mu.Unlock()
+	return db.HSetNXCtx(context.Background(), key, field, value)
+}
 
-	if db.hashIndex.trees[string(key)] == nil {
-		db.hashIndex.trees[string(key)] = art.NewART()
-	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-	val, err := db.getVal(field, Hash)
+// HSetNXCtx is like HSetNX, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HSetNXCtx(ctx context.Context, key, field, value []byte) (_ bool, err error) {
+	held, err := db.hashIndex.lockKeys(ctx, true, key)
 	if err != nil {
 		return false, err
 	}
+	defer db.unlockKeysWrite(Hash, held, db.opts.Sync, &err)
+
+	idxTree := db.hashIndex.treeOrCreate(key)
+	val, err := db.getVal(idxTree, field, Hash, nowOf(ctx))
+	if err != nil && err != ErrKeyNotFound {
+		return false, err
+	}
 	// field exists in db
 	if val != nil {
 		return false, nil
@@ -91,11 +130,10 @@ func (db *RoseDB) HSetNX(key, field, value []byte) (bool, error) {
 		return false, err
 	}
 
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
 	entry := &logfile.LogEntry{Key: field, Value: value}
 	_, size := logfile.EncodeEntry(ent)
 	valuePos.entrySize = size
-	err = db.updateIndexTree(entry, valuePos, true, Hash)
+	err = db.updateIndexTree(idxTree, entry, valuePos, true, Hash)
 	if err != nil {
 		return false, err
 	}
@@ -104,14 +142,32 @@ func (db *RoseDB) HSetNX(key, field, value []byte) (bool, error) {
 
 // HGet returns the value associated with field in the hash stored at key.
 func (db *RoseDB) HGet(key, field []byte) ([]byte, error) {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	return db.HGetCtx(context.Background(), key, field)
+}
 
-	if db.hashIndex.trees[string(key)] == nil {
-		return nil, nil
+// HGetCtx is like HGet, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HGetCtx(ctx context.Context, key, field []byte) ([]byte, error) {
+	var (
+		val []byte
+		err error
+	)
+	if db.opts.LockFreeReads {
+		val, err = db.readLatest(func() *art.Snapshot { return db.hashIndex.snapshotOf(key) }, func(idxTree indexReader) ([]byte, error) {
+			return db.getVal(idxTree, field, Hash, nowOf(ctx))
+		})
+	} else {
+		var held *heldLocks
+		if held, err = db.hashIndex.lockKeys(ctx, false, key); err != nil {
+			return nil, err
+		}
+		defer held.unlock()
+
+		tree := db.hashIndex.tree(key)
+		if tree == nil {
+			return nil, nil
+		}
+		val, err = db.getVal(tree, field, Hash, nowOf(ctx))
 	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-	val, err := db.getVal(field, Hash)
 	if err == ErrKeyNotFound {
 		return nil, nil
 	}
@@ -123,22 +179,34 @@ func (db *RoseDB) HGet(key, field []byte) ([]byte, error) {
 // Because non-existing keys are treated as empty hashes,
 // running HMGET against a non-existing key will return a list of nil values.
 func (db *RoseDB) HMGet(key []byte, field ...[]byte) (vals [][]byte, err error) {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	return db.HMGetCtx(context.Background(), key, field...)
+}
+
+// HMGetCtx is like HMGet, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+// The scan is also stopped once ctx is done.
+func (db *RoseDB) HMGetCtx(ctx context.Context, key []byte, field ...[]byte) (vals [][]byte, err error) {
+	held, err := db.hashIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return nil, err
+	}
+	defer held.unlock()
 
 	length := len(field)
 	// key not exist
-	if db.hashIndex.trees[string(key)] == nil {
+	idxTree := db.hashIndex.tree(key)
+	if idxTree == nil {
 		for i := 0; i < length; i++ {
 			vals = append(vals, nil)
 		}
 		return vals, nil
 	}
-	// key exist
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
 
-	for _, v := range field {
-		val, err := db.getVal(v, Hash)
+	now := nowOf(ctx)
+	for i, v := range field {
+		if err := checkCtx(ctx, i); err != nil {
+			return nil, err
+		}
+		val, err := db.getVal(idxTree, v, Hash, now)
 		if err == ErrKeyNotFound {
 			vals = append(vals, nil)
 		} else {
@@ -152,52 +220,74 @@ func (db *RoseDB) HMGet(key []byte, field ...[]byte) (vals [][]byte, err error)
 // Specified fields that do not exist within this hash are ignored.
 // If key does not exist, it is treated as an empty hash and this command returns false.
 func (db *RoseDB) HDel(key []byte, fields ...[]byte) (int, error) {
-	db.hashIndex.mu.Lock()
-	defer db.hashIndex.mu.Unlock()
+	return db.HDelCtx(context.Background(), key, fields...)
+}
+
+// HDelCtx is like HDel, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HDelCtx(ctx context.Context, key []byte, fields ...[]byte) (_ int, err error) {
+	held, err := db.hashIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.unlockKeysWrite(Hash, held, db.opts.Sync, &err)
 
-	if db.hashIndex.trees[string(key)] == nil {
+	idxTree := db.hashIndex.tree(key)
+	if idxTree == nil {
 		return 0, nil
 	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
 
 	var count int
 	for _, field := range fields {
-		hashKey := db.encodeKey(key, field)
-		entry := &logfile.LogEntry{Key: hashKey, Type: logfile.TypeDelete}
-		valuePos, err := db.writeLogEntry(entry, Hash)
+		deleted, err := db.hdel(idxTree, key, field)
 		if err != nil {
 			return 0, err
 		}
-
-		val, updated := db.hashIndex.idxTree.Delete(field)
-		if updated {
+		if deleted {
 			count++
 		}
-		db.sendDiscard(val, updated, Hash)
-		// The deleted entry itself is also invalid.
-		_, size := logfile.EncodeEntry(entry)
-		node := &indexNode{fid: valuePos.fid, entrySize: size}
-		select {
-		case db.discards[Hash].valChan <- node:
-		default:
-			logger.Warn("send to discard chan fail")
-		}
 	}
 	return count, nil
 }
 
+// hdel writes the deleted entry of the field and removes it from idxTree, the lock of the key must be held.
+// It returns whether the field was in idxTree.
+func (db *RoseDB) hdel(idxTree *art.AdaptiveRadixTree, key, field []byte) (bool, error) {
+	hashKey := db.encodeKey(key, field)
+	entry := &logfile.LogEntry{Key: hashKey, Type: logfile.TypeDelete}
+	valuePos, err := db.writeLogEntry(entry, Hash)
+	if err != nil {
+		return false, err
+	}
+
+	val, updated := idxTree.Delete(field)
+	db.sendDiscard(val, updated, Hash)
+	// The deleted entry itself is also invalid.
+	_, size := logfile.EncodeEntry(entry)
+	node := &indexNode{fid: valuePos.fid, entrySize: size}
+	db.discards[Hash].send(node)
+	return updated, nil
+}
+
 // HExists returns whether the field exists in the hash stored at key.
 // If the hash contains field, it returns true.
 // If the hash does not contain field, or key does not exist, it returns false.
 func (db *RoseDB) HExists(key, field []byte) (bool, error) {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	return db.HExistsCtx(context.Background(), key, field)
+}
 
-	if db.hashIndex.trees[string(key)] == nil {
+// HExistsCtx is like HExists, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HExistsCtx(ctx context.Context, key, field []byte) (bool, error) {
+	held, err := db.hashIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return false, err
+	}
+	defer held.unlock()
+
+	idxTree := db.hashIndex.tree(key)
+	if idxTree == nil {
 		return false, nil
 	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-	val, err := db.getVal(field, Hash)
+	val, err := db.getVal(idxTree, field, Hash, nowOf(ctx))
 	if err != nil && err != ErrKeyNotFound {
 		return false, err
 	}
@@ -206,28 +296,51 @@ func (db *RoseDB) HExists(key, field []byte) (bool, error) {
 
 // HLen returns the number of fields contained in the hash stored at key.
 func (db *RoseDB) HLen(key []byte) int {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	v, _ := db.HLenCtx(context.Background(), key)
+	return v
+}
 
-	if db.hashIndex.trees[string(key)] == nil {
-		return 0
+// HLenCtx is like HLen, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HLenCtx(ctx context.Context, key []byte) (int, error) {
+	held, err := db.hashIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return 0, err
 	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-	return db.hashIndex.idxTree.Size()
+	defer held.unlock()
+
+	idxTree := db.hashIndex.tree(key)
+	if idxTree == nil {
+		return 0, nil
+	}
+	return idxTree.Size(), nil
 }
 
 // HKeys returns all field names in the hash stored at key.
 func (db *RoseDB) HKeys(key []byte) ([][]byte, error) {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	return db.HKeysCtx(context.Background(), key)
+}
+
+// HKeysCtx is like HKeys, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+// The scan is also stopped once ctx is done.
+func (db *RoseDB) HKeysCtx(ctx context.Context, key []byte) ([][]byte, error) {
+	held, err := db.hashIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return nil, err
+	}
+	defer held.unlock()
 
 	var keys [][]byte
-	tree, ok := db.hashIndex.trees[string(key)]
-	if !ok {
+	tree := db.hashIndex.tree(key)
+	if tree == nil {
 		return keys, nil
 	}
+	var n int
 	iter := tree.Iterator()
 	for iter.HasNext() {
+		if err := checkCtx(ctx, n); err != nil {
+			return nil, err
+		}
+		n++
 		node, err := iter.Next()
 		if err != nil {
 			return nil, err
@@ -239,23 +352,37 @@ func (db *RoseDB) HKeys(key []byte) ([][]byte, error) {
 
 // HVals return all values in the hash stored at key.
 func (db *RoseDB) HVals(key []byte) ([][]byte, error) {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	return db.HValsCtx(context.Background(), key)
+}
+
+// HValsCtx is like HVals, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+// The scan is also stopped once ctx is done.
+func (db *RoseDB) HValsCtx(ctx context.Context, key []byte) ([][]byte, error) {
+	held, err := db.hashIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return nil, err
+	}
+	defer held.unlock()
 
 	var values [][]byte
-	tree, ok := db.hashIndex.trees[string(key)]
-	if !ok {
+	tree := db.hashIndex.tree(key)
+	if tree == nil {
 		return values, nil
 	}
-	db.hashIndex.idxTree = tree
 
+	var n int
+	now := nowOf(ctx)
 	iter := tree.Iterator()
 	for iter.HasNext() {
+		if err := checkCtx(ctx, n); err != nil {
+			return nil, err
+		}
+		n++
 		node, err := iter.Next()
 		if err != nil {
 			return nil, err
 		}
-		val, err := db.getVal(node.Key(), Hash)
+		val, err := db.getVal(tree, node.Key(), Hash, now)
 		if err != nil && err != ErrKeyNotFound {
 			return nil, err
 		}
@@ -266,25 +393,39 @@ func (db *RoseDB) HVals(key []byte) ([][]byte, error) {
 
 // HGetAll return all fields and values of the hash stored at key.
 func (db *RoseDB) HGetAll(key []byte) ([][]byte, error) {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	return db.HGetAllCtx(context.Background(), key)
+}
 
-	tree, ok := db.hashIndex.trees[string(key)]
-	if !ok {
+// HGetAllCtx is like HGetAll, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+// The scan is also stopped once ctx is done.
+func (db *RoseDB) HGetAllCtx(ctx context.Context, key []byte) ([][]byte, error) {
+	held, err := db.hashIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return nil, err
+	}
+	defer held.unlock()
+
+	tree := db.hashIndex.tree(key)
+	if tree == nil {
 		return [][]byte{}, nil
 	}
-	db.hashIndex.idxTree = tree
 
 	var index int
 	pairs := make([][]byte, tree.Size()*2)
+	var n int
+	now := nowOf(ctx)
 	iter := tree.Iterator()
 	for iter.HasNext() {
+		if err := checkCtx(ctx, n); err != nil {
+			return nil, err
+		}
+		n++
 		node, err := iter.Next()
 		if err != nil {
 			return nil, err
 		}
 		field := node.Key()
-		val, err := db.getVal(field, Hash)
+		val, err := db.getVal(tree, field, Hash, now)
 		if err != nil && err != ErrKeyNotFound {
 			return nil, err
 		}
@@ -298,16 +439,25 @@ func (db *RoseDB) HGetAll(key []byte) ([][]byte, error) {
 // HStrLen returns the string length of the value associated with field in the hash stored at key.
 // If the key or the field do not exist, 0 is returned.
 func (db *RoseDB) HStrLen(key, field []byte) int {
-	db.hashIndex.mu.RLock()
-	defer db.hashIndex.mu.RUnlock()
+	v, _ := db.HStrLenCtx(context.Background(), key, field)
+	return v
+}
 
-	if db.hashIndex.trees[string(key)] == nil {
-		return 0
+// HStrLenCtx is like HStrLen, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) HStrLenCtx(ctx context.Context, key, field []byte) (int, error) {
+	held, err := db.hashIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return 0, err
 	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-	val, err := db.getVal(field, Hash)
+	defer held.unlock()
+
+	idxTree := db.hashIndex.tree(key)
+	if idxTree == nil {
+		return 0, nil
+	}
+	val, err := db.getVal(idxTree, field, Hash, nowOf(ctx))
 	if err == ErrKeyNotFound {
-		return 0
+		return 0, nil
 	}
-	return len(val)
+	return len(val), nil
 }
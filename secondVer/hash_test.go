@@ -1,9 +1,13 @@
 package kv_engine
 
 import (
+	"context"
 	"errors"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -159,3 +163,104 @@ func testRoseDBHSet(t *testing.T, ioType IOType, mode DataIndexMode) {
 	})
 
 }
+
+func TestRoseDB_HSetNX(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	ok, err := db.HSetNX(GetKey(1), GetKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.HSetNX(GetKey(1), GetKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	val, err := db.HGet(GetKey(1), GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	ok, err = db.HSetNX(GetKey(1), GetKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, db.HLen(GetKey(1)))
+}
+
+func TestRoseDB_HMSetWithOptions(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	ctx := context.Background()
+
+	added, err := db.HMSetWithOptions(ctx, GetKey(1), WriteOptions{}, GetKey(1), []byte("v1"), GetKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, added)
+	// an existing field and a field given twice.
+	added, err = db.HMSetWithOptions(ctx, GetKey(1), WriteOptions{}, GetKey(1), []byte("v3"), GetKey(3), []byte("v3"), GetKey(3), []byte("v4"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, added)
+	assert.Equal(t, 3, db.HLen(GetKey(1)))
+	val, err := db.HGet(GetKey(1), GetKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v4"), val)
+
+	_, err = db.HMSetWithOptions(ctx, GetKey(1), WriteOptions{}, GetKey(1))
+	assert.Equal(t, ErrWrongNumberOfArgs, err)
+}
+
+func TestRoseDB_ConcurrentHash(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-concurrent-hash")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 1 << 20
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	t.Run("different-keys", func(t *testing.T) {
+		// find two hashes locked by different stripes.
+		key1, key2 := []byte("hash-1"), []byte("hash-2")
+		for i := 3; stripeOf(key1) == stripeOf(key2); i++ {
+			key2 = []byte("hash-" + strconv.Itoa(i))
+		}
+		held, err := db.hashIndex.lockKeys(context.Background(), true, key1)
+		assert.Nil(t, err)
+		defer held.unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Nil(t, db.HSetCtx(ctx, key2, []byte("field"), []byte("value")))
+		ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel2()
+		assert.Equal(t, context.DeadlineExceeded, db.HSetCtx(ctx2, key1, []byte("field"), []byte("value")))
+	})
+
+	t.Run("parallel", func(t *testing.T) {
+		writers, writes := 8, 1000
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				key := GetKey(w)
+				for i := 0; i < writes; i++ {
+					assert.Nil(t, db.HSet(key, GetKey(i), GetKey(i)))
+					assert.Nil(t, db.HSet([]byte("shared"), GetKey(w*writes+i), GetKey(i)))
+					if i%100 == 0 {
+						_, err := db.HGetAll(GetKey((w + 1) % writers))
+						assert.Nil(t, err)
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for w := 0; w < writers; w++ {
+			assert.Equal(t, writes, db.HLen(GetKey(w)))
+			v, err := db.HGet(GetKey(w), GetKey(writes-1))
+			assert.Nil(t, err)
+			assert.Equal(t, GetKey(writes-1), v)
+		}
+		assert.Equal(t, writers*writes, db.HLen([]byte("shared")))
+	})
+}
@@ -1,7 +1,10 @@
 package kv_engine
 
 import (
+	"errors"
 	"io"
+	"os"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -25,28 +28,33 @@ const (
 	ZSet
 )
 
-func (db *RoseDB) buildIndex(dataType DataType, entry *logfile.LogEntry, pos *valuePos) {
+// buildIndex build index from the entry at pos, the older value will be sent to discard if sendDiscard is true.
+func (db *RoseDB) buildIndex(dataType DataType, entry *logfile.LogEntry, pos *valuePos, sendDiscard bool) {
+	var oldVal interface{}
+	var updated bool
 	switch dataType {
 	case String:
-		db.buildStrsIndex(entry, pos)
+		oldVal, updated = db.buildStrsIndex(entry, pos)
 	case List:
-		db.buildListIndex(entry, pos)
+		oldVal, updated = db.buildListIndex(entry, pos)
 	case Hash:
-		db.buildHashIndex(entry, pos)
+		oldVal, updated = db.buildHashIndex(entry, pos)
 	case Set:
-		db.buildSetsIndex(entry, pos)
+		oldVal, updated = db.buildSetsIndex(entry, pos)
 	case ZSet:
-		db.buildZSetIndex(entry, pos)
+		oldVal, updated = db.buildZSetIndex(entry, pos)
+	}
+	if sendDiscard {
+		db.sendDiscard(oldVal, updated, dataType)
 	}
 }
 
-func (db *RoseDB) buildStrsIndex(entry *logfile.LogEntry, pos *valuePos) {
-	ts := time.Now().Unix()
+func (db *RoseDB) buildStrsIndex(entry *logfile.LogEntry, pos *valuePos) (interface{}, bool) {
+	ts := time.Now().UnixMilli()
 
 	// 删除类型的Entry 或者已经过期
 	if entry.Type == logfile.TypeDelete || (entry.ExpireAt != 0 && entry.ExpireAt < ts) {
-		db.strIndex.idxTree.Delete(entry.Key)
-		return
+		return db.strIndex.tree(entry.Key).Delete(entry.Key)
 	}
 
 	_, size := logfile.EncodeEntry(entry)
@@ -64,24 +72,18 @@ func (db *RoseDB) buildStrsIndex(entry *logfile.LogEntry, pos *valuePos) {
 	if entry.ExpireAt != 0 {
 		idxNode.expiredAt = entry.ExpireAt
 	}
-	db.strIndex.idxTree.Put(entry.Key, idxNode)
+	return db.strIndex.tree(entry.Key).Put(entry.Key, idxNode)
 }
 
-func (db *RoseDB) buildListIndex(entry *logfile.LogEntry, pos *valuePos) {
+func (db *RoseDB) buildListIndex(entry *logfile.LogEntry, pos *valuePos) (interface{}, bool) {
 	var listKey = entry.Key
 	if entry.Type != logfile.TypeListMeta {
 		listKey, _ = db.decodeListKey(entry.Key)
 	}
 
-	if db.listIndex.trees[string(listKey)] == nil {
-		db.listIndex.trees[string(listKey)] = art.NewART()
-	}
-
-	db.listIndex.idxTree = db.listIndex.trees[string(listKey)]
-
+	idxTree := db.listIndex.treeOrCreate(listKey)
 	if entry.Type == logfile.TypeDelete {
-		db.listIndex.idxTree.Delete(entry.Key)
-		return
+		return idxTree.Delete(entry.Key)
 	}
 	_, size := logfile.EncodeEntry(entry)
 	idxNode := &indexNode{fid: pos.fid, offset: pos.offset, entrySize: size}
@@ -92,19 +94,14 @@ func (db *RoseDB) buildListIndex(entry *logfile.LogEntry, pos *valuePos) {
 	if entry.ExpireAt != 0 {
 		idxNode.expiredAt = entry.ExpireAt
 	}
-	db.listIndex.idxTree.Put(entry.Key, idxNode)
+	return idxTree.Put(entry.Key, idxNode)
 }
 
-func (db *RoseDB) buildHashIndex(entry *logfile.LogEntry, pos *valuePos) {
+func (db *RoseDB) buildHashIndex(entry *logfile.LogEntry, pos *valuePos) (interface{}, bool) {
 	key, field := db.decodeKey(entry.Key)
-	if db.hashIndex.trees[string(key)] == nil {
-		db.hashIndex.trees[string(key)] = art.NewART()
-	}
-	db.hashIndex.idxTree = db.hashIndex.trees[string(key)]
-
+	idxTree := db.hashIndex.treeOrCreate(key)
 	if entry.Type == logfile.TypeDelete {
-		db.hashIndex.idxTree.Delete(field)
-		return
+		return idxTree.Delete(field)
 	}
 	_, size := logfile.EncodeEntry(entry)
 	idxNode := &indexNode{fid: pos.fid, offset: pos.offset, entrySize: size}
@@ -112,18 +109,13 @@ func (db *RoseDB) buildHashIndex(entry *logfile.LogEntry, pos *valuePos) {
 		idxNode.value = entry.Value
 	}
 	idxNode.expiredAt = entry.ExpireAt
-	db.hashIndex.idxTree.Put(field, idxNode)
+	return idxTree.Put(field, idxNode)
 }
 
-func (db *RoseDB) buildSetsIndex(entry *logfile.LogEntry, pos *valuePos) {
-	if db.setIndex.trees[string(entry.Key)] == nil {
-		db.setIndex.trees[string(entry.Key)] = art.NewART()
-	}
-
-	db.setIndex.idxTree = db.hashIndex.trees[string(entry.Key)]
-
+func (db *RoseDB) buildSetsIndex(entry *logfile.LogEntry, pos *valuePos) (interface{}, bool) {
+	idxTree := db.setIndex.treeOrCreate(entry.Key)
 	if entry.Type == logfile.TypeDelete {
-		db.setIndex.idxTree.Delete(entry.Value)
+		idxTree.Delete(entry.Value)
 	}
 
 	if err := db.setIndex.murhash.Write(entry.Value); err != nil {
@@ -138,25 +130,22 @@ func (db *RoseDB) buildSetsIndex(entry *logfile.LogEntry, pos *valuePos) {
 		idxNode.value = entry.Value
 	}
 	idxNode.expiredAt = entry.ExpireAt
-	db.setIndex.idxTree.Put(sum, idxNode)
+	return idxTree.Put(sum, idxNode)
 }
 
-func (db *RoseDB) buildZSetIndex(entry *logfile.LogEntry, pos *valuePos) {
+func (db *RoseDB) buildZSetIndex(entry *logfile.LogEntry, pos *valuePos) (interface{}, bool) {
 	if entry.Type == logfile.TypeDelete {
 		db.zsetIndex.indexes.ZRem(string(entry.Key), string(entry.Value))
-		if db.zsetIndex.idxTree != nil {
-			db.zsetIndex.idxTree.Delete(entry.Value)
+		if idxTree := db.zsetIndex.tree(entry.Key); idxTree != nil {
+			return idxTree.Delete(entry.Value)
 		}
-		return
+		return nil, false
 	}
 
 	key, scoreBuf := db.decodeKey(entry.Key)
 	score, _ := util.StrToFloat64(string(scoreBuf))
 
-	if db.zsetIndex.trees[string(key)] == nil {
-		db.zsetIndex.trees[string(key)] = art.NewART()
-	}
-	db.zsetIndex.idxTree = db.zsetIndex.trees[string(key)]
+	idxTree := db.zsetIndex.treeOrCreate(key)
 
 	if err := db.zsetIndex.murhash.Write(entry.Value); err != nil {
 		logger.Fatalf("fail to write murmur hash: %v", err)
@@ -175,25 +164,51 @@ func (db *RoseDB) buildZSetIndex(entry *logfile.LogEntry, pos *valuePos) {
 		idxNode.expiredAt = entry.ExpireAt
 	}
 	db.zsetIndex.indexes.ZAdd(string(key), score, string(sum))
-	db.zsetIndex.idxTree.Put(sum, idxNode)
+	return idxTree.Put(sum, idxNode)
 }
 
-// getVal Get index info from a skip list in memory.
-func (db *RoseDB) getVal(key []byte, dataType DataType) ([]byte, error) {
-	var idxTree *art.AdaptiveRadixTree
-	switch dataType {
-	case String:
-		idxTree = db.strIndex.idxTree
-	case List:
-		idxTree = db.listIndex.idxTree
-	case Hash:
-		idxTree = db.hashIndex.idxTree
-	case Set:
-		idxTree = db.setIndex.idxTree
-	case ZSet:
-		idxTree = db.zsetIndex.idxTree
+// indexReader reads an index tree, it is either the tree itself or an immutable version of it.
+type indexReader interface {
+	Get(key []byte) any
+}
+
+// readLatest runs read on the latest snapshot returned by snapshot, ErrKeyNotFound is returned if it is nil.
+// GC deletes an archived log file once the values in it are rewritten and the index points to the new ones,
+// so a read on an older snapshot may find its log file gone. It is run again on the latest snapshot then.
+// The read is also run again if the data is reset meanwhile, as the fids of the log files start over,
+// and a stale snapshot may point to the entry of another key.
+func (db *RoseDB) readLatest(snapshot func() *art.Snapshot, read func(idxTree indexReader) ([]byte, error)) ([]byte, error) {
+	for {
+		resets := atomic.LoadUint64(&db.resets)
+		snap := snapshot()
+		val, err := []byte(nil), ErrKeyNotFound
+		if snap != nil {
+			val, err = read(snap)
+		}
+		if resets&1 == 1 || atomic.LoadUint64(&db.resets) != resets {
+			runtime.Gosched()
+			continue
+		}
+		if !isLogFileGone(err) {
+			return val, err
+		}
+		// the file is not deleted by GC if the index is not changed since.
+		if snapshot() == snap {
+			return val, err
+		}
 	}
+}
+
+// isLogFileGone returns whether err is returned by reading a log file which has been deleted.
+// A deleted file is closed with FileIO, and unmapped to be empty with MMap.
+func isLogFileGone(err error) bool {
+	return err == ErrLogFileNotFound || err == io.EOF || errors.Is(err, os.ErrClosed)
+}
 
+// getVal Get index info from a skip list in memory.
+// idxTree is the tree the key belongs to, which is resolved by the caller holding the lock of the key,
+// or a snapshot of the tree which needs no lock.
+func (db *RoseDB) getVal(idxTree indexReader, key []byte, dataType DataType, now int64) ([]byte, error) {
 	rawValue := idxTree.Get(key)
 	if rawValue == nil {
 		return nil, ErrKeyNotFound
@@ -204,10 +219,8 @@ func (db *RoseDB) getVal(key []byte, dataType DataType) ([]byte, error) {
 		return nil, ErrKeyNotFound
 	}
 
-	ts := time.Now().Unix()
-
 	// key 过期
-	if idxNode.expiredAt != 0 && idxNode.expiredAt <= ts {
+	if idxNode.expiredAt != 0 && idxNode.expiredAt <= now {
 		return nil, ErrKeyNotFound
 	}
 
@@ -218,8 +231,9 @@ func (db *RoseDB) getVal(key []byte, dataType DataType) ([]byte, error) {
 	}
 
 	// In KeyOnlyMemMode, the value not in memory, so get the value from log file at the offset.
+	// there is no active log file after the data is reset.
 	logFile := db.getActiveLogFile(dataType)
-	if logFile.Fid != idxNode.fid {
+	if logFile == nil || logFile.Fid != idxNode.fid {
 		logFile = db.getArchivedLogFile(dataType, idxNode.fid)
 	}
 	if logFile == nil {
@@ -232,7 +246,7 @@ func (db *RoseDB) getVal(key []byte, dataType DataType) ([]byte, error) {
 	}
 
 	// key exists, but is invalid(deleted or expired)
-	if entry.Type == logfile.TypeDelete || (entry.ExpireAt != 0 && entry.ExpireAt <= ts) {
+	if entry.Type == logfile.TypeDelete || (entry.ExpireAt != 0 && entry.ExpireAt <= now) {
 		return nil, ErrKeyNotFound
 	}
 	return entry.Value, nil
@@ -262,6 +276,7 @@ func (db *RoseDB) loadIndexFromLogFiles() error {
 				logger.Fatalf("log file is nil, failed to open db")
 			}
 
+			logFile.Advise(true)
 			var offset int64
 			for {
 				entry, esize, err := logFile.ReadLogEntry(offset)
@@ -269,15 +284,26 @@ func (db *RoseDB) loadIndexFromLogFiles() error {
 					if err == io.EOF || err == logfile.ErrEndOfEntry {
 						break
 					}
+					// a crash may leave a torn entry at the end of active log file, whose write was never acknowledged.
+					if err == logfile.ErrInvalidCrc && i == len(fids)-1 {
+						logger.Warnf("discard the torn entry at the end of log file, fid: %d, offset: %d", fid, offset)
+						if !db.opts.ReadOnly {
+							if err := logFile.DiscardTail(offset); err != nil {
+								logger.Fatalf("discard the torn entry err, failed to open db, err is: %v", err)
+							}
+						}
+						break
+					}
 					logger.Fatalf("read log entry from file err, failed to open db, err is: %v", err)
 				}
 				pos := &valuePos{
 					fid:    fid,
 					offset: offset,
 				}
-				db.buildIndex(dataType, entry, pos)
+				db.buildIndex(dataType, entry, pos, false)
 				offset += esize
 			}
+			logFile.Advise(false)
 
 			// set latest log file's writeAt
 			if i == len(fids)-1 {
@@ -297,7 +323,7 @@ func (db *RoseDB) loadIndexFromLogFiles() error {
 }
 
 // updateIndexTree 更新entry 这个entry 在IndexTree中的位置
-func (db *RoseDB) updateIndexTree(ent *logfile.LogEntry, pos *valuePos, sendDiscard bool, dType DataType) error {
+func (db *RoseDB) updateIndexTree(idxTree *art.AdaptiveRadixTree, ent *logfile.LogEntry, pos *valuePos, sendDiscard bool, dType DataType) error {
 	var size = pos.entrySize
 
 	if dType == String || dType == List {
@@ -318,20 +344,6 @@ func (db *RoseDB) updateIndexTree(ent *logfile.LogEntry, pos *valuePos, sendDisc
 		idxNode.expiredAt = ent.ExpireAt
 	}
 
-	var idxTree *art.AdaptiveRadixTree
-	switch dType {
-	case String:
-		idxTree = db.strIndex.idxTree
-	case List:
-		idxTree = db.listIndex.idxTree
-	case Hash:
-		idxTree = db.hashIndex.idxTree
-	case Set:
-		idxTree = db.setIndex.idxTree
-	case ZSet:
-		idxTree = db.zsetIndex.idxTree
-	}
-
 	oldVal, updated := idxTree.Put(ent.Key, idxNode)
 	if sendDiscard {
 		db.sendDiscard(oldVal, updated, dType)
@@ -0,0 +1,193 @@
+package ioselector
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/reid00/kv_engine/vfs"
+)
+
+// ErrDirectIOUnsupported direct io is not supported on this platform.
+var ErrDirectIOUnsupported = errors.New("direct io is not supported on this platform")
+
+// alignSize the offset, length and memory address of every direct io must be aligned to it.
+// 4096 is the logical block size of almost all disks and file systems.
+const alignSize = 4096
+
+// DirectIOSelector reads and writes the file bypassing the page cache of os,
+// so large sequential writes and scans do not evict the pages of other applications.
+// Writes at any offset are supported, the blocks they touch are read, padded and written as a whole.
+type DirectIOSelector struct {
+	fs       vfs.FS
+	fd       vfs.File
+	readOnly bool
+
+	// guards tail.
+	mu sync.Mutex
+	// the last block written, so that appending to it needs no read from disk.
+	tail    []byte
+	tailOff int64
+}
+
+// NewDirectIOSelector create a new direct io selector.
+func NewDirectIOSelector(fs vfs.FS, fname string, fsize int64) (IOSelector, error) {
+	if fsize <= 0 {
+		return nil, ErrInvalidFsize
+	}
+	file, err := openFile(fs, fname, fsize)
+	if err != nil {
+		return nil, err
+	}
+	// the file is created and truncated by a normal fd, then reopened for direct io.
+	_ = file.Close()
+	if file, err = openDirect(fs, fname, os.O_RDWR); err != nil {
+		return nil, err
+	}
+	return &DirectIOSelector{fs: fs, fd: file, tailOff: -1}, nil
+}
+
+// NewReadOnlyDirectIOSelector open an existing file for reading only.
+// The file will never be created or truncated.
+func NewReadOnlyDirectIOSelector(fs vfs.FS, fname string) (IOSelector, error) {
+	file, err := openDirect(fs, fname, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectIOSelector{fs: fs, fd: file, readOnly: true, tailOff: -1}, nil
+}
+
+// Write writes b at offset, the blocks partially covered by b keep their other contents.
+func (dio *DirectIOSelector) Write(b []byte, offset int64) (int, error) {
+	if dio.readOnly {
+		return 0, ErrReadOnly
+	}
+	if offset < 0 {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+
+	start := alignDown(offset)
+	end := alignUp(offset + int64(len(b)))
+	buf := alignedBlock(int(end - start))
+
+	// fill the parts of the first and the last block which are not covered by b.
+	if offset != start {
+		if err := dio.readBlock(buf[:alignSize], start); err != nil {
+			return 0, err
+		}
+	}
+	if lastOff := end - alignSize; offset+int64(len(b)) != end && (lastOff != start || offset == start) {
+		if err := dio.readBlock(buf[lastOff-start:], lastOff); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[offset-start:], b)
+
+	if _, err := dio.fd.WriteAt(buf, start); err != nil {
+		dio.tailOff = -1
+		return 0, err
+	}
+	if dio.tail == nil {
+		dio.tail = alignedBlock(alignSize)
+	}
+	dio.tailOff = end - alignSize
+	copy(dio.tail, buf[dio.tailOff-start:])
+	return len(b), nil
+}
+
+// readBlock reads the block at offset into buf, from the cached tail if possible.
+// The part beyond the end of file is zero.
+func (dio *DirectIOSelector) readBlock(buf []byte, offset int64) error {
+	if offset == dio.tailOff {
+		copy(buf, dio.tail)
+		return nil
+	}
+	n, err := dio.fd.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return nil
+}
+
+// Read reads len(b) bytes at offset, io.EOF is returned if there are not enough bytes in the file.
+func (dio *DirectIOSelector) Read(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	start := alignDown(offset)
+	end := alignUp(offset + int64(len(b)))
+	buf := alignedBlock(int(end - start))
+
+	n, err := dio.fd.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if int64(n) <= offset-start {
+		return 0, io.EOF
+	}
+	n = copy(b, buf[offset-start:n])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (dio *DirectIOSelector) Sync() error {
+	return dio.fd.Sync()
+}
+
+func (dio *DirectIOSelector) Close() error {
+	return dio.fd.Close()
+}
+
+// Delete close and remove the file.
+func (dio *DirectIOSelector) Delete() error {
+	if dio.readOnly {
+		return ErrReadOnly
+	}
+	if err := dio.fd.Close(); err != nil {
+		return err
+	}
+	return dio.fs.Remove(dio.fd.Name())
+}
+
+// Size returns the size of the file.
+func (dio *DirectIOSelector) Size() (int64, error) {
+	stat, err := dio.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (alignSize - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + alignSize - 1)
+}
+
+// alignedBlock returns a zeroed buffer of size whose memory address is aligned to alignSize.
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+alignSize)
+	var shift int
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (alignSize - 1)); rem != 0 {
+		shift = alignSize - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
@@ -0,0 +1,20 @@
+package ioselector
+
+import (
+	"golang.org/x/sys/unix"
+
+	"github.com/reid00/kv_engine/vfs"
+)
+
+// openDirect open the file and turn off data caching by F_NOCACHE, darwin has no O_DIRECT.
+func openDirect(fs vfs.FS, fname string, flag int) (vfs.File, error) {
+	file, err := fs.OpenFile(fname, flag, FilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = unix.FcntlInt(file.Fd(), unix.F_NOCACHE, 1); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,12 @@
+package ioselector
+
+import (
+	"syscall"
+
+	"github.com/reid00/kv_engine/vfs"
+)
+
+// openDirect open the file with O_DIRECT.
+func openDirect(fs vfs.FS, fname string, flag int) (vfs.File, error) {
+	return fs.OpenFile(fname, flag|syscall.O_DIRECT, FilePerm)
+}
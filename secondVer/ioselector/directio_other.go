@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package ioselector
+
+import "github.com/reid00/kv_engine/vfs"
+
+func openDirect(fs vfs.FS, fname string, flag int) (vfs.File, error) {
+	return nil, ErrDirectIOUnsupported
+}
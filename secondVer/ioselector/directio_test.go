@@ -0,0 +1,73 @@
+package ioselector
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reid00/kv_engine/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectIOSelector(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-directio.wal")
+	defer os.Remove(path)
+
+	selector, err := NewDirectIOSelector(vfs.OS, path, 3*alignSize)
+	if err != nil {
+		t.Skipf("direct io is not available: %v", err)
+	}
+
+	// appends of any size and offset, crossing block boundaries.
+	var data []byte
+	for i, size := range []int{1, 7, alignSize - 8, 100, 2*alignSize + 3, 9} {
+		b := bytes.Repeat([]byte{byte('a' + i)}, size)
+		n, err := selector.Write(b, int64(len(data)))
+		assert.Nil(t, err)
+		assert.Equal(t, size, n)
+		data = append(data, b...)
+	}
+
+	// overwrite in the middle keeps the contents around it.
+	n, err := selector.Write([]byte("overwrite"), alignSize-4)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, n)
+	copy(data[alignSize-4:], "overwrite")
+
+	check := func(s IOSelector) {
+		for _, r := range [][2]int{{0, len(data)}, {0, 1}, {5, 20}, {alignSize - 4, 9}, {alignSize + 50, 2 * alignSize}} {
+			b := make([]byte, r[1])
+			n, err := s.Read(b, int64(r[0]))
+			assert.Nil(t, err)
+			assert.Equal(t, r[1], n)
+			assert.Equal(t, data[r[0]:r[0]+r[1]], b)
+		}
+		size, err := s.Size()
+		assert.Nil(t, err)
+		_, err = s.Read(make([]byte, 10), size)
+		assert.Equal(t, io.EOF, err)
+		_, err = s.Read(make([]byte, 10), -1)
+		assert.Equal(t, io.EOF, err)
+	}
+	check(selector)
+	assert.Nil(t, selector.Sync())
+	assert.Nil(t, selector.Close())
+
+	readOnly, err := NewReadOnlyDirectIOSelector(vfs.OS, path)
+	assert.Nil(t, err)
+	check(readOnly)
+	_, err = readOnly.Write([]byte("a"), 0)
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Nil(t, readOnly.Close())
+
+	// blocks written before reopen are read back from disk.
+	selector, err = NewDirectIOSelector(vfs.OS, path, 3*alignSize)
+	assert.Nil(t, err)
+	_, err = selector.Write([]byte("tail"), int64(len(data)))
+	assert.Nil(t, err)
+	data = append(data, "tail"...)
+	check(selector)
+	assert.Nil(t, selector.Delete())
+}
@@ -1,26 +1,41 @@
 package ioselector
 
-import "os"
+import "github.com/reid00/kv_engine/vfs"
 
 type FileIOSelector struct {
-	fd *os.File
+	fs       vfs.FS
+	fd       vfs.File
+	readOnly bool
 }
 
-func NewFileIOSelector(fname string, fsize int64) (IOSelector, error) {
+func NewFileIOSelector(fs vfs.FS, fname string, fsize int64) (IOSelector, error) {
 	if fsize <= 0 {
 		return nil, ErrInvalidFsize
 	}
 
-	file, err := openFile(fname, fsize)
+	file, err := openFile(fs, fname, fsize)
 	if err != nil {
 		return nil, err
 	}
 
-	return &FileIOSelector{fd: file}, nil
+	return &FileIOSelector{fs: fs, fd: file}, nil
+}
+
+// NewReadOnlyFileIOSelector open an existing file for reading only.
+// The file will never be created or truncated.
+func NewReadOnlyFileIOSelector(fs vfs.FS, fname string) (IOSelector, error) {
+	file, err := vfs.Open(fs, fname)
+	if err != nil {
+		return nil, err
+	}
+	return &FileIOSelector{fs: fs, fd: file, readOnly: true}, nil
 }
 
 // Write is a wrapper of os.File WriteAt
 func (fio *FileIOSelector) Write(b []byte, offset int64) (int, error) {
+	if fio.readOnly {
+		return 0, ErrReadOnly
+	}
 	return fio.fd.WriteAt(b, offset)
 }
 
@@ -38,9 +53,21 @@ func (fio *FileIOSelector) Close() error {
 
 // delete file descriptor if we don't use it anymore
 func (fio *FileIOSelector) Delete() error {
+	if fio.readOnly {
+		return ErrReadOnly
+	}
 	if err := fio.fd.Close(); err != nil {
 		return err
 	}
 
-	return os.Remove(fio.fd.Name())
+	return fio.fs.Remove(fio.fd.Name())
+}
+
+// Size returns the size of the file.
+func (fio *FileIOSelector) Size() (int64, error) {
+	stat, err := fio.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
 }
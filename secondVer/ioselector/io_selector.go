@@ -3,10 +3,15 @@ package ioselector
 import (
 	"errors"
 	"os"
+
+	"github.com/reid00/kv_engine/vfs"
 )
 
 var ErrInvalidFsize = errors.New("fsize can't be sero or negative")
 
+// ErrReadOnly write or delete on a selector opened in read-only mode.
+var ErrReadOnly = errors.New("io selector is read-only")
+
 const FilePerm = 0644
 
 type IOSelector interface {
@@ -22,13 +27,26 @@ type IOSelector interface {
 	Close() error
 	// 删除文件
 	Delete() error
+
+	// Size returns the size of the file on disk.
+	Size() (int64, error)
+}
+
+// Sealer is implemented by selectors which can protect the file from writes once it is archived.
+type Sealer interface {
+	Seal() error
+}
+
+// Advisor is implemented by selectors which take hints about whether the file is read sequentially or randomly.
+type Advisor interface {
+	Advise(sequential bool) error
 }
 
 // 打开文件，并且当文件大小小于fsize 的时候，截断文件为fsize 大小
 // 保证文件的最大值相同
-func openFile(fname string, fsize int64) (*os.File, error) {
+func openFile(fs vfs.FS, fname string, fsize int64) (vfs.File, error) {
 
-	fd, err := os.OpenFile(fname, os.O_CREATE|os.O_RDWR, FilePerm)
+	fd, err := fs.OpenFile(fname, os.O_CREATE|os.O_RDWR, FilePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -2,10 +2,12 @@ package ioselector
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/reid00/kv_engine/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -85,10 +87,10 @@ func testNewIOSelector(t *testing.T, ioType uint8) {
 
 			var got IOSelector
 			if ioType == 0 {
-				got, err = NewFileIOSelector(absPath, tt.args.fsize)
+				got, err = NewFileIOSelector(vfs.OS, absPath, tt.args.fsize)
 			}
 			if ioType == 1 {
-				got, err = NewMMapSelector(absPath, tt.args.fsize)
+				got, err = NewMMapSelector(vfs.OS, absPath, tt.args.fsize)
 			}
 
 			defer func() {
@@ -114,10 +116,10 @@ func testIOSelectorWrite(t *testing.T, ioType uint8) {
 
 	var selector IOSelector
 	if ioType == 0 {
-		selector, err = NewFileIOSelector(absPath, size)
+		selector, err = NewFileIOSelector(vfs.OS, absPath, size)
 	}
 	if ioType == 1 {
-		selector, err = NewMMapSelector(absPath, size)
+		selector, err = NewMMapSelector(vfs.OS, absPath, size)
 	}
 	// 新建selector 产生的error
 	assert.Nil(t, err)
@@ -167,11 +169,6 @@ func testIOSelectorWrite(t *testing.T, ioType uint8) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got, err := tt.fields.selector.Write(tt.args.b, tt.args.offset)
-			// io.EOF err in Mmap
-			if tt.want == 1048577 && ioType == 1 {
-				tt.wantErr = true
-				tt.want = 0
-			}
 			if (err != nil) != tt.wantErr {
 				// err 存在，并且与 wantErr 不相同的时候
 				t.Errorf("Write() error= %v, wantErr %v", err, tt.wantErr)
@@ -190,10 +187,10 @@ func testIOSelectorRead(t *testing.T, ioType uint8) {
 
 	var selector IOSelector
 	if ioType == 0 {
-		selector, err = NewFileIOSelector(absPath, 100)
+		selector, err = NewFileIOSelector(vfs.OS, absPath, 100)
 	}
 	if ioType == 1 {
-		selector, err = NewMMapSelector(absPath, 100)
+		selector, err = NewMMapSelector(vfs.OS, absPath, 100)
 	}
 
 	assert.Nil(t, err)
@@ -291,10 +288,10 @@ func testIOSelectorSync(t *testing.T, ioType uint8) {
 
 		var selector IOSelector
 		if ioType == 0 {
-			selector, err = NewFileIOSelector(absPath, fsize)
+			selector, err = NewFileIOSelector(vfs.OS, absPath, fsize)
 		}
 		if ioType == 1 {
-			selector, err = NewMMapSelector(absPath, fsize)
+			selector, err = NewMMapSelector(vfs.OS, absPath, fsize)
 		}
 		assert.Nil(t, err)
 		defer func() {
@@ -322,11 +319,11 @@ func testIOSelectorClose(t *testing.T, ioType uint8) {
 		var selector IOSelector
 
 		if ioType == 0 {
-			selector, err = NewFileIOSelector(absPath, fsize)
+			selector, err = NewFileIOSelector(vfs.OS, absPath, fsize)
 		}
 
 		if ioType == 1 {
-			selector, err = NewMMapSelector(absPath, fsize)
+			selector, err = NewMMapSelector(vfs.OS, absPath, fsize)
 		}
 
 		assert.Nil(t, err)
@@ -363,10 +360,10 @@ func testIOSelectorDelete(t *testing.T, ioType uint8) {
 			assert.Nil(t, err)
 			var selector IOSelector
 			if ioType == 0 {
-				selector, err = NewFileIOSelector(absPath, int64(i+1)*100)
+				selector, err = NewFileIOSelector(vfs.OS, absPath, int64(i+1)*100)
 			}
 			if ioType == 1 {
-				selector, err = NewMMapSelector(absPath, int64((i+1)*100))
+				selector, err = NewMMapSelector(vfs.OS, absPath, int64((i+1)*100))
 			}
 
 			assert.Nil(t, err)
@@ -376,3 +373,112 @@ func testIOSelectorDelete(t *testing.T, ioType uint8) {
 		})
 	}
 }
+
+func TestMMapSelector_Remap(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-mmap.wal")
+	defer os.Remove(path)
+
+	s, err := NewMMapSelector(vfs.OS, path, 100)
+	assert.Nil(t, err)
+	selector := s.(*MMapSelector)
+
+	// an entry ending exactly at the end of file can be read.
+	n, err := selector.Write([]byte("0123456789"), 90)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	b := make([]byte, 10)
+	n, err = selector.Read(b, 90)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, []byte("0123456789"), b)
+
+	// reads beyond the end of file return the bytes read and io.EOF.
+	n, err = selector.Read(b, 95)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+	_, err = selector.Read(b, 100)
+	assert.Equal(t, io.EOF, err)
+
+	// writes beyond the end of file extend the file and the mapping.
+	n, err = selector.Write([]byte("extended"), 150)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	size, err := selector.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), size)
+	n, err = selector.Read(b[:8], 150)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("extended"), b[:8])
+	n, err = selector.Read(b, 90)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("0123456789"), b)
+
+	// the mapping of a reader grows with the file.
+	r, err := NewReadOnlyMMapSelector(vfs.OS, path)
+	assert.Nil(t, err)
+	defer r.Close()
+	_, err = selector.Write([]byte("more"), 300)
+	assert.Nil(t, err)
+	n, err = r.Read(b[:4], 300)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("more"), b[:4])
+
+	// a sealed mapping is read-only.
+	assert.Nil(t, selector.Seal())
+	_, err = selector.Write([]byte("a"), 0)
+	assert.Equal(t, ErrReadOnly, err)
+	n, err = selector.Read(b[:8], 150)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("extended"), b[:8])
+	assert.Nil(t, selector.Advise(true))
+	assert.Nil(t, selector.Sync())
+
+	// reads after close fail instead of touching the released mapping.
+	assert.Nil(t, selector.Close())
+	_, err = selector.Read(b, 0)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMemorySelector(t *testing.T) {
+	_, err := NewMemorySelector(0)
+	assert.Equal(t, ErrInvalidFsize, err)
+
+	selector, err := NewMemorySelector(100)
+	assert.Nil(t, err)
+	offsets := writeSomeData(selector, t)
+
+	b := make([]byte, 8)
+	n, err := selector.Read(b[:7], offsets[2])
+	assert.Nil(t, err)
+	assert.Equal(t, 7, n)
+	assert.Equal(t, []byte("Reidsdb"), b[:7])
+
+	// the bytes never written are zero, up to the size of the file.
+	n, err = selector.Read(b, 95)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, make([]byte, 5), b[:5])
+	_, err = selector.Read(b, 100)
+	assert.Equal(t, io.EOF, err)
+
+	// writes beyond the end of file extend it.
+	n, err = selector.Write([]byte("extended"), 150)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	size, err := selector.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(158), size)
+	n, err = selector.Read(b[:8], 150)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("extended"), b[:8])
+	n, err = selector.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1Reidsdb"), b)
+
+	assert.Nil(t, selector.Sync())
+	assert.Nil(t, selector.Delete())
+	_, err = selector.Read(b, 0)
+	assert.Equal(t, os.ErrClosed, err)
+	_, err = selector.Write(b, 0)
+	assert.Equal(t, os.ErrClosed, err)
+}
@@ -0,0 +1,122 @@
+package ioselector
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// MemorySelector keeps the file in memory, nothing is written to disk, and the data is lost once it is closed.
+// Like a file truncated to fsize, the bytes never written are read as zero, but take no memory.
+type MemorySelector struct {
+	// guards buf and size.
+	mu sync.RWMutex
+	// the written part of the file, which is a prefix of it.
+	buf []byte
+	// size of the file, it grows with the writes beyond it.
+	size   int64
+	closed bool
+}
+
+// NewMemorySelector create a new in-memory selector of fsize bytes.
+func NewMemorySelector(fsize int64) (IOSelector, error) {
+	if fsize <= 0 {
+		return nil, ErrInvalidFsize
+	}
+	return &MemorySelector{size: fsize}, nil
+}
+
+// Write copy b into the file at offset, the file is extended if b exceeds it.
+func (ms *MemorySelector) Write(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closed {
+		return 0, os.ErrClosed
+	}
+
+	end := offset + int64(len(b))
+	if end > int64(len(ms.buf)) {
+		if end > int64(cap(ms.buf)) {
+			// double the capacity to amortize the copying, but never beyond the file size unless necessary.
+			newCap := 2 * int64(cap(ms.buf))
+			if newCap > ms.size {
+				newCap = ms.size
+			}
+			if newCap < end {
+				newCap = end
+			}
+			buf := make([]byte, len(ms.buf), newCap)
+			copy(buf, ms.buf)
+			ms.buf = buf
+		}
+		ms.buf = ms.buf[:end]
+	}
+	if end > ms.size {
+		ms.size = end
+	}
+	return copy(ms.buf[offset:], b), nil
+}
+
+// Read copy the data of the file at offset into b.
+// Like os.File ReadAt, io.EOF is returned with the bytes read if there are not enough bytes in the file.
+func (ms *MemorySelector) Read(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, io.EOF
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return 0, os.ErrClosed
+	}
+	if offset >= ms.size {
+		return 0, io.EOF
+	}
+
+	n := len(b)
+	if rest := ms.size - offset; int64(n) > rest {
+		n = int(rest)
+	}
+	var copied int
+	if offset < int64(len(ms.buf)) {
+		copied = copy(b[:n], ms.buf[offset:])
+	}
+	// the part never written is zero.
+	for i := copied; i < n; i++ {
+		b[i] = 0
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Sync does nothing, there is nowhere to sync to.
+func (ms *MemorySelector) Sync() error {
+	return nil
+}
+
+// Close releases the memory of the file.
+func (ms *MemorySelector) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.buf, ms.size, ms.closed = nil, 0, true
+	return nil
+}
+
+// Delete is the same as Close.
+func (ms *MemorySelector) Delete() error {
+	return ms.Close()
+}
+
+// Size returns the size of the file.
+func (ms *MemorySelector) Size() (int64, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.size, nil
+}
@@ -2,79 +2,263 @@ package ioselector
 
 import (
 	"io"
-	"github.com/reid00/kv_engine/mmap"
 	"os"
+	"sync"
+
+	"github.com/reid00/kv_engine/mmap"
+	"github.com/reid00/kv_engine/vfs"
 )
 
+// MMapSelector reads and writes the file through a memory mapping of the whole file.
+// The mapping grows with the file: writes beyond it extend the file and remap it,
+// and reads beyond it remap it if the file has been extended by others.
 type MMapSelector struct {
-	fd     *os.File
+	fs vfs.FS
+	fd vfs.File
+	// guards buf, which is moved by remapping and released by Close and Delete.
+	mu     sync.RWMutex
 	buf    []byte
 	bufLen int64
+	// the file is opened for reading only.
+	readOnly bool
+	// the mapping is read-only, see Seal.
+	sealed bool
 }
 
 // NewMMapSelector create a new mmap selector.
-func NewMMapSelector(fname string, fsize int64) (IOSelector, error) {
+func NewMMapSelector(fs vfs.FS, fname string, fsize int64) (IOSelector, error) {
 	if fsize <= 0 {
 		return nil, ErrInvalidFsize
 	}
-	file, err := openFile(fname, fsize)
+	file, err := openFile(fs, fname, fsize)
 	if err != nil {
 		return nil, err
 	}
-	buf, err := mmap.Mmap(file, true, fsize)
+	stat, err := file.Stat()
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
+	// map the whole file, which may be larger than fsize.
+	buf, err := mmap.Mmap(file, true, stat.Size())
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	// entries are read by the index in random order.
+	_ = mmap.Advise(buf, mmap.Random)
+	return &MMapSelector{fs: fs, fd: file, buf: buf, bufLen: int64(len(buf))}, nil
+}
 
-	return &MMapSelector{fd: file, buf: buf, bufLen: int64(len(buf))}, nil
+// NewReadOnlyMMapSelector map an existing file for reading only, the whole file is mapped.
+// The file will never be created or truncated.
+func NewReadOnlyMMapSelector(fs vfs.FS, fname string) (IOSelector, error) {
+	file, err := vfs.Open(fs, fname)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if stat.Size() <= 0 {
+		_ = file.Close()
+		return nil, ErrInvalidFsize
+	}
+	buf, err := mmap.Mmap(file, false, stat.Size())
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	_ = mmap.Advise(buf, mmap.Random)
+	return &MMapSelector{fs: fs, fd: file, buf: buf, bufLen: int64(len(buf)), readOnly: true, sealed: true}, nil
 }
 
-func (m *MMapSelector) Write(b []byte, offset int64) (int, error) {
+// Write copy b into the mapped region at offset, the file is extended and remapped if b exceeds it.
+func (lm *MMapSelector) Write(b []byte, offset int64) (int, error) {
+	if lm.readOnly {
+		return 0, ErrReadOnly
+	}
 	length := int64(len(b))
-
 	if length <= 0 {
 		return 0, nil
 	}
-	if offset < 0 || length+offset > m.bufLen {
+	if offset < 0 {
 		return 0, io.EOF
 	}
 
-	return copy(m.buf[offset:], b), nil
+	lm.mu.RLock()
+	if length+offset > lm.bufLen && !lm.sealed {
+		lm.mu.RUnlock()
+		if err := lm.grow(offset + length); err != nil {
+			return 0, err
+		}
+		lm.mu.RLock()
+	}
+	defer lm.mu.RUnlock()
+	if lm.sealed {
+		return 0, ErrReadOnly
+	}
+	if lm.buf == nil {
+		return 0, os.ErrClosed
+	}
+	return copy(lm.buf[offset:], b), nil
+}
+
+// grow extends the file to at least size bytes, doubling its size to amortize the remapping, and remaps it.
+func (lm *MMapSelector) grow(size int64) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.buf == nil {
+		return os.ErrClosed
+	}
+	if lm.sealed || size <= lm.bufLen {
+		return nil
+	}
+	if size < 2*lm.bufLen {
+		size = 2 * lm.bufLen
+	}
+	if err := lm.fd.Truncate(size); err != nil {
+		return err
+	}
+	return lm.remap(size)
+}
+
+// remap maps size bytes of the file, mu must be held exclusively.
+func (lm *MMapSelector) remap(size int64) error {
+	buf, err := mmap.Mremap(lm.fd, lm.buf, !lm.sealed, size)
+	if err != nil {
+		// the old mapping may be gone, no more io on it.
+		lm.buf, lm.bufLen = nil, 0
+		return err
+	}
+	_ = mmap.Advise(buf, mmap.Random)
+	lm.buf, lm.bufLen = buf, int64(len(buf))
+	return nil
 }
 
 // Read copy data from mapped region(buf) into slice b at offset.
+// Like os.File ReadAt, io.EOF is returned with the bytes read if there are not enough bytes in the file.
 func (lm *MMapSelector) Read(b []byte, offset int64) (int, error) {
-	if offset < 0 || offset >= lm.bufLen {
+	if offset < 0 {
 		return 0, io.EOF
 	}
-	if offset+int64(len(b)) >= lm.bufLen {
+	lm.mu.RLock()
+	if offset+int64(len(b)) > lm.bufLen {
+		lm.mu.RUnlock()
+		// the file may be extended by others since it was mapped.
+		if err := lm.refresh(); err != nil {
+			return 0, err
+		}
+		lm.mu.RLock()
+	}
+	defer lm.mu.RUnlock()
+
+	if offset >= lm.bufLen {
 		return 0, io.EOF
 	}
-	return copy(b, lm.buf[offset:]), nil
+	n := copy(b, lm.buf[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
-// Sync synchronize the mapped buffer to the file's contents on disk.
-func (lm *MMapSelector) Sync() error {
-	return mmap.Msync(lm.buf)
+// refresh remaps the whole file if it is larger than the mapping.
+func (lm *MMapSelector) refresh() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.buf == nil {
+		return nil
+	}
+	stat, err := lm.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= lm.bufLen {
+		return nil
+	}
+	return lm.remap(stat.Size())
 }
 
-// Close sync/unmap mapped buffer and close fd.
-func (lm *MMapSelector) Close() error {
+// Seal flushes the mapping and maps the file read-only, further writes return ErrReadOnly.
+// It is called once the file is archived, so stray writes can never corrupt it.
+func (lm *MMapSelector) Seal() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.sealed || lm.buf == nil {
+		return nil
+	}
 	if err := mmap.Msync(lm.buf); err != nil {
 		return err
 	}
 	if err := mmap.Munmap(lm.buf); err != nil {
 		return err
 	}
+	lm.sealed = true
+	buf, err := mmap.Mmap(lm.fd, false, lm.bufLen)
+	if err != nil {
+		lm.buf, lm.bufLen = nil, 0
+		return err
+	}
+	_ = mmap.Advise(buf, mmap.Random)
+	lm.buf = buf
+	return nil
+}
+
+// Advise tells the os whether the file will be read sequentially, e.g. by a scan, or randomly.
+func (lm *MMapSelector) Advise(sequential bool) error {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	advice := mmap.Random
+	if sequential {
+		advice = mmap.Sequential
+	}
+	return mmap.Advise(lm.buf, advice)
+}
+
+// Sync synchronize the mapped buffer to the file's contents on disk.
+func (lm *MMapSelector) Sync() error {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	if lm.sealed || lm.buf == nil {
+		return nil
+	}
+	return mmap.Msync(lm.buf)
+}
+
+// Close sync/unmap mapped buffer and close fd.
+func (lm *MMapSelector) Close() error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.buf != nil {
+		if !lm.sealed {
+			if err := mmap.Msync(lm.buf); err != nil {
+				return err
+			}
+		}
+		if err := mmap.Munmap(lm.buf); err != nil {
+			return err
+		}
+		lm.buf, lm.bufLen = nil, 0
+	}
 	return lm.fd.Close()
 }
 
 // Delete delete mapped buffer and remove file on disk.
 func (lm *MMapSelector) Delete() error {
-	if err := mmap.Munmap(lm.buf); err != nil {
-		return err
+	if lm.readOnly {
+		return ErrReadOnly
+	}
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.buf != nil {
+		if err := mmap.Munmap(lm.buf); err != nil {
+			return err
+		}
+		lm.buf, lm.bufLen = nil, 0
 	}
-	lm.buf = nil
 
 	if err := lm.fd.Truncate(0); err != nil {
 		return err
@@ -82,5 +266,12 @@ func (lm *MMapSelector) Delete() error {
 	if err := lm.fd.Close(); err != nil {
 		return err
 	}
-	return os.Remove(lm.fd.Name())
+	return lm.fs.Remove(lm.fd.Name())
+}
+
+// Size returns the length of the mapping, which is the size of the file.
+func (lm *MMapSelector) Size() (int64, error) {
+	lm.mu.RLock()
+	defer lm.mu.RUnlock()
+	return lm.bufLen, nil
 }
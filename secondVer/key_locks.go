@@ -0,0 +1,267 @@
+package kv_engine
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	goart "github.com/plar/go-adaptive-radix-tree"
+	"github.com/reid00/kv_engine/ds/art"
+	"github.com/reid00/kv_engine/ds/hamt"
+	"github.com/reid00/kv_engine/util"
+)
+
+// number of lock stripes of an index, keys are mapped to stripes by hash.
+const keyLockStripes = 64
+
+// keyLocks lock the keys of an index by lock striping, so that operations on keys of different stripes run in parallel.
+// mu is held shared by operations on keys, and exclusively by operations on the whole index.
+type keyLocks struct {
+	mu      *sync.RWMutex
+	stripes [keyLockStripes]*sync.RWMutex
+	// the write operation holding each stripe, guarded by the stripe lock.
+	owners [keyLockStripes]*heldLocks
+}
+
+// heldLocks are the locks held by an operation on some keys, see lockKeys.
+type heldLocks struct {
+	kl      *keyLocks
+	stripes []int
+	write   bool
+}
+
+func newKeyLocks() *keyLocks {
+	kl := &keyLocks{mu: new(sync.RWMutex)}
+	for i := range kl.stripes {
+		kl.stripes[i] = new(sync.RWMutex)
+	}
+	return kl
+}
+
+func stripeOf(key []byte) int {
+	return int(util.MemHash(key) % keyLockStripes)
+}
+
+// lockKeys acquires mu shared and the locks of the stripes of keys, the stripe locks are exclusive if write is true.
+// Stripes are locked in order, so multi-key operations never deadlock.
+// It gives up and returns ctx.Err() once ctx is done.
+func (kl *keyLocks) lockKeys(ctx context.Context, write bool, keys ...[]byte) (*heldLocks, error) {
+	if err := rlockCtx(ctx, kl.mu); err != nil {
+		return nil, err
+	}
+	held := &heldLocks{kl: kl, write: write}
+
+	var ids []int
+	if len(keys) == 1 {
+		ids = []int{stripeOf(keys[0])}
+	} else {
+		var seen [keyLockStripes]bool
+		for _, key := range keys {
+			if id := stripeOf(key); !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		sort.Ints(ids)
+	}
+
+	lock := rlockCtx
+	if write {
+		lock = lockCtx
+	}
+	for _, id := range ids {
+		if err := lock(ctx, kl.stripes[id]); err != nil {
+			held.unlock()
+			return nil, err
+		}
+		held.stripes = append(held.stripes, id)
+		if write {
+			kl.owners[id] = held
+		}
+	}
+	return held, nil
+}
+
+// ownerOf returns the write operation holding the stripe lock of key, nil if it is not locked exclusively by lockKeys.
+// It must be called by the holder of the stripe lock.
+func (kl *keyLocks) ownerOf(key []byte) *heldLocks {
+	return kl.owners[stripeOf(key)]
+}
+
+func (h *heldLocks) unlock() {
+	for _, id := range h.stripes {
+		if h.write {
+			h.kl.owners[id] = nil
+			h.kl.stripes[id].Unlock()
+		} else {
+			h.kl.stripes[id].RUnlock()
+		}
+	}
+	h.kl.mu.RUnlock()
+}
+
+// rlockStripe acquires the read locks of mu and the stripe id, to read the keys of the stripe.
+func (kl *keyLocks) rlockStripe(ctx context.Context, id int) (*heldLocks, error) {
+	if err := rlockCtx(ctx, kl.mu); err != nil {
+		return nil, err
+	}
+	if err := rlockCtx(ctx, kl.stripes[id]); err != nil {
+		kl.mu.RUnlock()
+		return nil, err
+	}
+	return &heldLocks{kl: kl, stripes: []int{id}}, nil
+}
+
+// rlockAll acquires the read locks of mu and all stripes, to read the whole index without blocking other readers.
+func (kl *keyLocks) rlockAll() {
+	kl.mu.RLock()
+	for _, stripe := range kl.stripes {
+		stripe.RLock()
+	}
+}
+
+func (kl *keyLocks) runlockAll() {
+	for _, stripe := range kl.stripes {
+		stripe.RUnlock()
+	}
+	kl.mu.RUnlock()
+}
+
+// reset replaces all shards with empty ones, mu must be held exclusively if the index is in use.
+func (si *strIndex) reset() {
+	shards := new(strShards)
+	for i := range shards {
+		shards[i] = newIndexTree(si.snapshot, si.counter)
+	}
+	si.shards.Store(shards)
+	si.counter.Reset()
+}
+
+// tree returns the index tree of the shard the key belongs to, which is guarded by the stripe lock of the key.
+func (si *strIndex) tree(key []byte) *art.AdaptiveRadixTree {
+	return si.shards.Load().(*strShards)[stripeOf(key)]
+}
+
+// size returns the number of keys, all stripes must be locked.
+func (si *strIndex) size() int {
+	var size int
+	for _, shard := range si.shards.Load().(*strShards) {
+		size += shard.Size()
+	}
+	return size
+}
+
+// iterator returns an iterator over all keys in order, all stripes must be locked during the iteration.
+func (si *strIndex) iterator() goart.Iterator {
+	return art.NewMergeIterator(si.shards.Load().(*strShards)[:]...)
+}
+
+// shard returns the index tree of the stripe id, which is guarded by the stripe lock.
+func (si *strIndex) shard(id int) *art.AdaptiveRadixTree {
+	return si.shards.Load().(*strShards)[id]
+}
+
+// reset removes the trees of all keys, mu must be held exclusively if the index is in use.
+func (ci *collIndex) reset() {
+	ci.treesMu.Lock()
+	defer ci.treesMu.Unlock()
+	ci.trees = make(map[string]*art.AdaptiveRadixTree)
+	ci.names = art.NewART()
+	if ci.snapshot {
+		ci.treesSnap.Store(hamt.New())
+	}
+	ci.counter.Reset()
+}
+
+// tree returns the index tree of key, nil if not exists. The tree is guarded by the stripe lock of the key.
+func (ci *collIndex) tree(key []byte) *art.AdaptiveRadixTree {
+	ci.treesMu.RLock()
+	defer ci.treesMu.RUnlock()
+	return ci.trees[string(key)]
+}
+
+// keysAfter returns the keys of trees after cursor in order, at most count keys if count is positive.
+// All keys are returned if cursor is nil, the trees may be empty.
+func (ci *collIndex) keysAfter(cursor []byte, count int) [][]byte {
+	ci.treesMu.RLock()
+	defer ci.treesMu.RUnlock()
+	var keys [][]byte
+	ci.names.ForEachAfter(cursor, func(key []byte, _ any) bool {
+		keys = append(keys, append([]byte(nil), key...))
+		return count <= 0 || len(keys) < count
+	})
+	return keys
+}
+
+// treeOrCreate returns the index tree of key, an empty tree is created if not exists.
+// The stripe lock of the key must be held exclusively.
+func (ci *collIndex) treeOrCreate(key []byte) *art.AdaptiveRadixTree {
+	if tree := ci.tree(key); tree != nil {
+		return tree
+	}
+	ci.treesMu.Lock()
+	defer ci.treesMu.Unlock()
+	tree := newIndexTree(ci.snapshot, ci.counter)
+	ci.trees[string(key)] = tree
+	ci.names.Put([]byte(string(key)), nil)
+	if ci.snapshot {
+		ci.treesSnap.Store(ci.treesSnap.Load().(*hamt.Map).Put(key, tree))
+	}
+	return tree
+}
+
+// snapshotOf returns the latest immutable version of the tree of key without any lock, nil if the tree not exists.
+// It is only available if snapshot is true.
+func (ci *collIndex) snapshotOf(key []byte) *art.Snapshot {
+	tree, _ := ci.treesSnap.Load().(*hamt.Map).Get(key).(*art.AdaptiveRadixTree)
+	if tree == nil {
+		return nil
+	}
+	return tree.Snapshot()
+}
+
+// snapshotOf returns the latest immutable version of the shard the key belongs to without any lock.
+// It is only available if snapshot is true.
+func (si *strIndex) snapshotOf(key []byte) *art.Snapshot {
+	return si.tree(key).Snapshot()
+}
+
+// unlockKeysWrite releases the key locks held by a write, and waits until the writes are durable if sync is true.
+// The changes of the write are published afterwards, or dropped if it fails.
+// It is deferred by write operations, so err must be the named result of them.
+func (db *RoseDB) unlockKeysWrite(dataType DataType, held *heldLocks, sync bool, err *error) {
+	db.releaseWrite(dataType, held.unlock, sync, err)
+	db.commitChanges(dataType, held, *err == nil)
+}
+
+// indexCounter returns the counter of the index of the data type.
+func (db *RoseDB) indexCounter(dataType DataType) *art.Counter {
+	switch dataType {
+	case List:
+		return db.listIndex.counter
+	case Hash:
+		return db.hashIndex.counter
+	case Set:
+		return db.setIndex.counter
+	case ZSet:
+		return db.zsetIndex.counter
+	default:
+		return db.strIndex.counter
+	}
+}
+
+// keyLocksOf returns the key locks of the index of the data type.
+func (db *RoseDB) keyLocksOf(dataType DataType) *keyLocks {
+	switch dataType {
+	case List:
+		return db.listIndex.keyLocks
+	case Hash:
+		return db.hashIndex.keyLocks
+	case Set:
+		return db.setIndex.keyLocks
+	case ZSet:
+		return db.zsetIndex.keyLocks
+	default:
+		return db.strIndex.keyLocks
+	}
+}
@@ -0,0 +1,548 @@
+package kv_engine
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/reid00/kv_engine/ds/art"
+	"github.com/reid00/kv_engine/logfile"
+	"github.com/reid00/kv_engine/util"
+)
+
+// NoExpiration is returned by TTL for the keys without expiration.
+const NoExpiration time.Duration = -1
+
+// the data types of the keyspace operations, sets and sorted sets are not included as they have no public api yet.
+var keyspaceTypes = []DataType{String, List, Hash}
+
+// ScanOptions the options of Scan.
+type ScanOptions struct {
+	// Match only the keys matching the glob-style pattern are returned, see util.GlobMatch.
+	// Default value is empty, which matches all keys.
+	Match string
+
+	// Count the max number of keys returned by a Scan.
+	// Default value is 10.
+	Count int
+
+	// Types only the keys holding a value of these data types are returned.
+	// Default value is nil, which means String, List and Hash.
+	Types []DataType
+}
+
+// Keys of different data types are independent in RoseDB, e.g. a key can hold a string and a hash at the same time.
+// The keyspace operations below treat them as one key, like redis does.
+
+// Type returns the data type of the value stored at key, ErrKeyNotFound is returned if key does not exist.
+// If key holds values of several data types, the first one of String, List and Hash is returned.
+func (db *RoseDB) Type(key []byte) (DataType, error) {
+	return db.TypeCtx(context.Background(), key)
+}
+
+// TypeCtx is like Type, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) TypeCtx(ctx context.Context, key []byte) (DataType, error) {
+	now := nowOf(ctx)
+	for _, dataType := range keyspaceTypes {
+		held, err := db.keyLocksOf(dataType).lockKeys(ctx, false, key)
+		if err != nil {
+			return 0, err
+		}
+		exist, err := db.keyExists(dataType, key, now)
+		held.unlock()
+		if err != nil {
+			return 0, err
+		}
+		if exist {
+			return dataType, nil
+		}
+	}
+	return 0, ErrKeyNotFound
+}
+
+// DeleteKey removes the values of all data types stored at key, and returns whether key existed.
+func (db *RoseDB) DeleteKey(key []byte) (bool, error) {
+	return db.DeleteKeyCtx(context.Background(), key)
+}
+
+// DeleteKeyCtx is like DeleteKey, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) DeleteKeyCtx(ctx context.Context, key []byte) (bool, error) {
+	var deleted bool
+	for _, dataType := range keyspaceTypes {
+		ok, err := db.deleteKeyOf(ctx, dataType, key)
+		if err != nil {
+			return false, err
+		}
+		deleted = deleted || ok
+	}
+	return deleted, nil
+}
+
+func (db *RoseDB) deleteKeyOf(ctx context.Context, dataType DataType, key []byte) (_ bool, err error) {
+	held, err := db.keyLocksOf(dataType).lockKeys(ctx, true, key)
+	if err != nil {
+		return false, err
+	}
+	defer db.unlockKeysWrite(dataType, held, db.opts.Sync, &err)
+
+	now := nowOf(ctx)
+	exist, err := db.keyExists(dataType, key, now)
+	if err != nil || !exist {
+		return false, err
+	}
+	switch dataType {
+	case String:
+		err = db.deleteStr(key)
+	case List:
+		err = db.deleteList(db.listIndex.tree(key), key, now)
+	case Hash:
+		idxTree := db.hashIndex.tree(key)
+		for _, field := range treeKeys(idxTree) {
+			if _, err = db.hdel(idxTree, key, field); err != nil {
+				break
+			}
+		}
+	}
+	return err == nil, err
+}
+
+// Expire sets a timeout on key, after which the values of all data types stored at key are deleted.
+// Key is deleted right now if ttl is not positive. It returns whether key exists.
+// The timeout of a hash is set on all of its fields, and the timeout is in milliseconds like WriteOptions.TTL.
+func (db *RoseDB) Expire(key []byte, ttl time.Duration) (bool, error) {
+	return db.ExpireCtx(context.Background(), key, ttl)
+}
+
+// ExpireCtx is like Expire, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) ExpireCtx(ctx context.Context, key []byte, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return db.DeleteKeyCtx(ctx, key)
+	}
+	return db.setExpire(ctx, key, WriteOptions{TTL: ttl}.expireAt(nowOf(ctx)))
+}
+
+// ExpireAt is like Expire, but key is deleted at the time at, and right now if at is not after now.
+func (db *RoseDB) ExpireAt(key []byte, at time.Time) (bool, error) {
+	return db.ExpireAtCtx(context.Background(), key, at)
+}
+
+// ExpireAtCtx is like ExpireAt, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) ExpireAtCtx(ctx context.Context, key []byte, at time.Time) (bool, error) {
+	if at.UnixMilli() <= nowOf(ctx) {
+		return db.DeleteKeyCtx(ctx, key)
+	}
+	return db.setExpire(ctx, key, at.UnixMilli())
+}
+
+// Persist removes the timeout of key, and returns whether a timeout is removed.
+func (db *RoseDB) Persist(key []byte) (bool, error) {
+	return db.PersistCtx(context.Background(), key)
+}
+
+// PersistCtx is like Persist, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) PersistCtx(ctx context.Context, key []byte) (bool, error) {
+	return db.setExpire(ctx, key, 0)
+}
+
+func (db *RoseDB) setExpire(ctx context.Context, key []byte, expireAt int64) (bool, error) {
+	var updated bool
+	for _, dataType := range keyspaceTypes {
+		ok, err := db.setExpireOf(ctx, dataType, key, expireAt)
+		if err != nil {
+			return false, err
+		}
+		updated = updated || ok
+	}
+	return updated, nil
+}
+
+// setExpireOf rewrites the live value of the data type stored at key with expireAt, and returns whether it is rewritten.
+// Values without expiration are skipped if expireAt is zero.
+func (db *RoseDB) setExpireOf(ctx context.Context, dataType DataType, key []byte, expireAt int64) (_ bool, err error) {
+	held, err := db.keyLocksOf(dataType).lockKeys(ctx, true, key)
+	if err != nil {
+		return false, err
+	}
+	defer db.unlockKeysWrite(dataType, held, db.opts.Sync, &err)
+
+	now := nowOf(ctx)
+	switch dataType {
+	case String:
+		idxTree := db.strIndex.tree(key)
+		idxNode := liveNode(idxTree.Get(key), now)
+		if idxNode == nil || (expireAt == 0 && idxNode.expiredAt == 0) {
+			return false, nil
+		}
+		val, err := db.getVal(idxTree, key, String, now)
+		if err != nil {
+			return false, err
+		}
+		entry := &logfile.LogEntry{Key: key, Value: val, ExpireAt: expireAt}
+		pos, err := db.writeLogEntry(entry, String)
+		if err != nil {
+			return false, err
+		}
+		return true, db.updateIndexTree(idxTree, entry, pos, true, String)
+	case List:
+		idxTree := db.listIndex.tree(key)
+		if idxTree == nil {
+			return false, nil
+		}
+		// the node is read once, as the list may expire at any time.
+		idxNode := liveNode(idxTree.Get(key), now)
+		if idxNode == nil || (expireAt == 0 && idxNode.expiredAt == 0) {
+			return false, nil
+		}
+		headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
+		if err != nil || tailSeq-headSeq <= 1 {
+			return false, err
+		}
+		return true, db.saveListMetaExpire(idxTree, key, headSeq, tailSeq, expireAt)
+	case Hash:
+		idxTree := db.hashIndex.tree(key)
+		if idxTree == nil {
+			return false, nil
+		}
+		var updated bool
+		for _, field := range treeKeys(idxTree) {
+			idxNode := liveNode(idxTree.Get(field), now)
+			if idxNode == nil || (expireAt == 0 && idxNode.expiredAt == 0) {
+				continue
+			}
+			val, err := db.getVal(idxTree, field, Hash, now)
+			if err != nil {
+				return false, err
+			}
+			if err = db.hset(key, field, val, expireAt); err != nil {
+				return false, err
+			}
+			updated = true
+		}
+		return updated, nil
+	}
+	return false, nil
+}
+
+// TTL returns the remaining time to live of key, NoExpiration is returned if key has no timeout.
+// ErrKeyNotFound is returned if key does not exist.
+// The TTL of a hash is the latest timeout of its fields, and it has no timeout if any of its fields has none.
+func (db *RoseDB) TTL(key []byte) (time.Duration, error) {
+	return db.TTLCtx(context.Background(), key)
+}
+
+// TTLCtx is like TTL, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) TTLCtx(ctx context.Context, key []byte) (time.Duration, error) {
+	at := timeOf(ctx)
+	now := at.UnixMilli()
+	for _, dataType := range keyspaceTypes {
+		held, err := db.keyLocksOf(dataType).lockKeys(ctx, false, key)
+		if err != nil {
+			return 0, err
+		}
+		expireAt, exist, err := db.expireAtOf(dataType, key, now)
+		held.unlock()
+		if err != nil {
+			return 0, err
+		}
+		if !exist {
+			continue
+		}
+		if expireAt == 0 {
+			return NoExpiration, nil
+		}
+		return time.UnixMilli(expireAt).Sub(at), nil
+	}
+	return 0, ErrKeyNotFound
+}
+
+// expireAtOf returns the expiration timestamp of the value of the data type stored at key at now, zero if no timeout.
+func (db *RoseDB) expireAtOf(dataType DataType, key []byte, now int64) (int64, bool, error) {
+	switch dataType {
+	case String:
+		idxNode := liveNode(db.strIndex.tree(key).Get(key), now)
+		if idxNode == nil {
+			return 0, false, nil
+		}
+		return idxNode.expiredAt, true, nil
+	case List:
+		idxTree := db.listIndex.tree(key)
+		if idxTree == nil {
+			return 0, false, nil
+		}
+		// the node is read once, as the list may expire at any time.
+		idxNode := liveNode(idxTree.Get(key), now)
+		if idxNode == nil {
+			return 0, false, nil
+		}
+		headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
+		if err != nil || tailSeq-headSeq <= 1 {
+			return 0, false, err
+		}
+		return idxNode.expiredAt, true, nil
+	case Hash:
+		idxTree := db.hashIndex.tree(key)
+		if idxTree == nil {
+			return 0, false, nil
+		}
+		var expireAt int64
+		var exist bool
+		for _, field := range treeKeys(idxTree) {
+			idxNode := liveNode(idxTree.Get(field), now)
+			if idxNode == nil {
+				continue
+			}
+			if idxNode.expiredAt == 0 {
+				return 0, true, nil
+			}
+			if idxNode.expiredAt > expireAt {
+				expireAt = idxNode.expiredAt
+			}
+			exist = true
+		}
+		return expireAt, exist, nil
+	}
+	return 0, false, nil
+}
+
+// Scan returns at most opts.Count keys after cursor in order, and the cursor of the next Scan,
+// which is nil once all keys are returned. Scan starts from the first key if cursor is nil.
+// Keys existing during the whole iteration are returned exactly once.
+// A Scan takes time linear to the number of keys, as the indexes of data types are separate.
+func (db *RoseDB) Scan(cursor []byte, opts ScanOptions) ([][]byte, []byte, error) {
+	return db.ScanCtx(context.Background(), cursor, opts)
+}
+
+// ScanCtx is like Scan, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+// The scan is also stopped once ctx is done.
+func (db *RoseDB) ScanCtx(ctx context.Context, cursor []byte, opts ScanOptions) ([][]byte, []byte, error) {
+	count := opts.Count
+	if count <= 0 {
+		count = 10
+	}
+	dataTypes := opts.Types
+	if len(dataTypes) == 0 {
+		dataTypes = keyspaceTypes
+	}
+	keys, err := db.scanKeys(ctx, cursor, []byte(opts.Match), count, dataTypes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) < count {
+		return keys, nil, nil
+	}
+	return keys, keys[len(keys)-1], nil
+}
+
+// Keys returns all keys matching the glob-style pattern in order, see util.GlobMatch.
+func (db *RoseDB) Keys(pattern string) ([][]byte, error) {
+	return db.KeysCtx(context.Background(), pattern)
+}
+
+// KeysCtx is like Keys, but the scan is stopped once ctx is done.
+func (db *RoseDB) KeysCtx(ctx context.Context, pattern string) ([][]byte, error) {
+	return db.scanKeys(ctx, nil, []byte(pattern), 0, keyspaceTypes)
+}
+
+// DBSize returns the number of keys, which takes time linear to the number of keys.
+func (db *RoseDB) DBSize() (int, error) {
+	return db.DBSizeCtx(context.Background())
+}
+
+// DBSizeCtx is like DBSize, but the scan is stopped once ctx is done.
+func (db *RoseDB) DBSizeCtx(ctx context.Context) (int, error) {
+	keys, err := db.scanKeys(ctx, nil, nil, 0, keyspaceTypes)
+	return len(keys), err
+}
+
+// FlushAll removes all keys of all data types, including sets and sorted sets.
+// Like Restore, the subscriptions are closed with ErrDataReset, and replicas do a full sync once they reconnect.
+func (db *RoseDB) FlushAll() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.opts.ReplicaOf != "" {
+		return ErrReplicaReadOnly
+	}
+	defer db.lockForReset()()
+	return db.resetData()
+}
+
+// scanKeys returns the keys of dataTypes after cursor in order which match pattern, at most count keys if count is positive.
+func (db *RoseDB) scanKeys(ctx context.Context, cursor, pattern []byte, count int, dataTypes []DataType) ([][]byte, error) {
+	if len(pattern) == 0 || bytes.Equal(pattern, []byte("*")) {
+		pattern = nil
+	}
+	var keys [][]byte
+	for _, dataType := range dataTypes {
+		typeKeys, err := db.keysOf(ctx, dataType, cursor, pattern, count)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, typeKeys...)
+	}
+	if len(dataTypes) == 1 {
+		return keys, nil
+	}
+
+	// keys of different data types are merged.
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	merged := keys[:0]
+	for i, key := range keys {
+		if i > 0 && bytes.Equal(key, keys[i-1]) {
+			continue
+		}
+		merged = append(merged, key)
+	}
+	if count > 0 && len(merged) > count {
+		merged = merged[:count]
+	}
+	return merged, nil
+}
+
+// keysOf returns the live keys of the data type after cursor in order which match pattern,
+// at most count keys if count is positive.
+// Only a stripe or a key is locked at a time, and the scan starts right after cursor, so a page does not walk the keys before it.
+func (db *RoseDB) keysOf(ctx context.Context, dataType DataType, cursor, pattern []byte, count int) ([][]byte, error) {
+	match := func(key []byte) bool {
+		return pattern == nil || util.GlobMatch(pattern, key)
+	}
+	kl := db.keyLocksOf(dataType)
+	now := nowOf(ctx)
+
+	var keys [][]byte
+	var n int
+	if dataType == String {
+		// the first count keys of every shard are merged.
+		for id := 0; id < keyLockStripes; id++ {
+			held, err := kl.rlockStripe(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			var shardKeys int
+			db.strIndex.shard(id).ForEachAfter(cursor, func(key []byte, value any) bool {
+				if err = checkCtx(ctx, n); err != nil {
+					return false
+				}
+				n++
+				if match(key) && liveNode(value, now) != nil {
+					keys = append(keys, key)
+					shardKeys++
+				}
+				return count <= 0 || shardKeys < count
+			})
+			held.unlock()
+			if err != nil {
+				return nil, err
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return bytes.Compare(keys[i], keys[j]) < 0
+		})
+		if count > 0 && len(keys) > count {
+			keys = keys[:count]
+		}
+		return keys, nil
+	}
+
+	var index *collIndex
+	switch dataType {
+	case List:
+		index = db.listIndex.collIndex
+	case Hash:
+		index = db.hashIndex.collIndex
+	default:
+		return nil, nil
+	}
+	for {
+		// the trees may be empty or expired, so keys are taken in batches until there are enough live ones.
+		batch := index.keysAfter(cursor, count)
+		for _, key := range batch {
+			if err := checkCtx(ctx, n); err != nil {
+				return nil, err
+			}
+			n++
+			if !match(key) {
+				continue
+			}
+			held, err := kl.lockKeys(ctx, false, key)
+			if err != nil {
+				return nil, err
+			}
+			exist, err := db.keyExists(dataType, key, now)
+			held.unlock()
+			if err != nil {
+				return nil, err
+			}
+			if exist {
+				keys = append(keys, key)
+			}
+			if count > 0 && len(keys) >= count {
+				return keys, nil
+			}
+		}
+		if count <= 0 || len(batch) < count {
+			return keys, nil
+		}
+		cursor = batch[len(batch)-1]
+	}
+}
+
+// keyExists reports whether key holds a live value of the data type at now, the lock of the key must be held.
+func (db *RoseDB) keyExists(dataType DataType, key []byte, now int64) (bool, error) {
+	switch dataType {
+	case String:
+		return liveNode(db.strIndex.tree(key).Get(key), now) != nil, nil
+	case List:
+		idxTree := db.listIndex.tree(key)
+		if idxTree == nil {
+			return false, nil
+		}
+		headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
+		if err != nil {
+			return false, err
+		}
+		return tailSeq-headSeq > 1, nil
+	case Hash:
+		idxTree := db.hashIndex.tree(key)
+		if idxTree == nil {
+			return false, nil
+		}
+		iter := idxTree.Iterator()
+		for iter.HasNext() {
+			node, err := iter.Next()
+			if err != nil {
+				return false, err
+			}
+			if liveNode(node.Value(), now) != nil {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// liveNode returns the index node of v if it is not expired at now, nil otherwise.
+func liveNode(v interface{}, now int64) *indexNode {
+	idxNode, _ := v.(*indexNode)
+	if idxNode == nil || (idxNode.expiredAt != 0 && idxNode.expiredAt <= now) {
+		return nil
+	}
+	return idxNode
+}
+
+// treeKeys returns all keys of idxTree, so that the tree can be modified while visiting them.
+func treeKeys(idxTree *art.AdaptiveRadixTree) [][]byte {
+	var keys [][]byte
+	iter := idxTree.Iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		if err != nil {
+			break
+		}
+		keys = append(keys, node.Key())
+	}
+	return keys
+}
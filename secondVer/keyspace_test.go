@@ -0,0 +1,324 @@
+package kv_engine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openKeyspaceDB(t *testing.T) *RoseDB {
+	path := filepath.Join("/tmp", "rosedb-keyspace")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+		destroyDB(db)
+	})
+
+	assert.Nil(t, db.Set([]byte("str"), []byte("v")))
+	assert.Nil(t, db.LPush([]byte("list"), []byte("a"), []byte("b")))
+	assert.Nil(t, db.HMSet([]byte("hash"), []byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")))
+	// the key holds a string and a hash.
+	assert.Nil(t, db.Set([]byte("both"), []byte("v")))
+	assert.Nil(t, db.HSet([]byte("both"), []byte("f"), []byte("v")))
+	return db
+}
+
+func TestRoseDB_Type(t *testing.T) {
+	db := openKeyspaceDB(t)
+	for key, dataType := range map[string]DataType{"str": String, "list": List, "hash": Hash, "both": String} {
+		typ, err := db.Type([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, dataType, typ, key)
+	}
+	_, err := db.Type([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// emptied collections do not exist.
+	_, err = db.LPop([]byte("list"))
+	assert.Nil(t, err)
+	_, err = db.LPop([]byte("list"))
+	assert.Nil(t, err)
+	_, err = db.HDel([]byte("hash"), []byte("f1"), []byte("f2"))
+	assert.Nil(t, err)
+	_, err = db.Type([]byte("list"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Type([]byte("hash"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestRoseDB_DeleteKey(t *testing.T) {
+	db := openKeyspaceDB(t)
+	for _, key := range []string{"str", "list", "hash", "both"} {
+		deleted, err := db.DeleteKey([]byte(key))
+		assert.Nil(t, err)
+		assert.True(t, deleted, key)
+		_, err = db.Type([]byte(key))
+		assert.Equal(t, ErrKeyNotFound, err, key)
+	}
+	deleted, err := db.DeleteKey([]byte("missing"))
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+
+	// a deleted list starts over, and the deletes survive a reopen.
+	assert.Nil(t, db.RPush([]byte("list"), []byte("c")))
+	assert.Nil(t, db.Close())
+	db, err = Open(db.opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	values, err := db.LRange([]byte("list"), 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("c")}, values)
+	_, err = db.Get([]byte("str"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, db.HLen([]byte("hash")))
+}
+
+func TestRoseDB_Expire(t *testing.T) {
+	db := openKeyspaceDB(t)
+	for _, key := range []string{"str", "list", "hash"} {
+		ttl, err := db.TTL([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, NoExpiration, ttl)
+
+		ok, err := db.Expire([]byte(key), time.Hour)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		ttl, err = db.TTL([]byte(key))
+		assert.Nil(t, err)
+		assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour, key)
+
+		ok, err = db.Persist([]byte(key))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		ok, err = db.Persist([]byte(key))
+		assert.Nil(t, err)
+		assert.False(t, ok)
+		ttl, err = db.TTL([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, NoExpiration, ttl)
+	}
+
+	ok, err := db.Expire([]byte("missing"), time.Hour)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, err = db.TTL([]byte("missing"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the values are kept, and a non-positive ttl deletes the key.
+	ok, err = db.Expire([]byte("hash"), time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	v, err := db.HGet([]byte("hash"), []byte("f1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), v)
+	ok, err = db.Expire([]byte("str"), 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get([]byte("str"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the timeout is kept in milliseconds, and the keys expire.
+	_, err = db.Expire([]byte("list"), time.Millisecond*300)
+	assert.Nil(t, err)
+	ttl, err := db.TTL([]byte("list"))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Millisecond*200 && ttl <= time.Millisecond*300, ttl)
+	time.Sleep(time.Millisecond * 400)
+	_, err = db.Type([]byte("list"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, db.LLen([]byte("list")))
+
+	// ExpireAt sets the timeout at an absolute time, which is kept by the writes with WriteOptions.ExpireAt.
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	ok, err = db.ExpireAt([]byte("hash"), at)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	expireAt, _, err := db.expireAtOf(Hash, []byte("hash"), time.Now().UnixMilli())
+	assert.Nil(t, err)
+	assert.Equal(t, at.UnixMilli(), expireAt)
+	assert.Nil(t, db.SetWithOptions(context.Background(), []byte("str"), []byte("v"), WriteOptions{TTL: time.Second, ExpireAt: at}))
+	expireAt, _, err = db.expireAtOf(String, []byte("str"), time.Now().UnixMilli())
+	assert.Nil(t, err)
+	assert.Equal(t, at.UnixMilli(), expireAt)
+	ok, err = db.ExpireAt([]byte("str"), time.Now().Add(-time.Second))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get([]byte("str"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestRoseDB_ExpiringList(t *testing.T) {
+	db := openKeyspaceDB(t)
+	// the timeout of the list is read while it expires, which must not panic.
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.LPush([]byte("list"), []byte("a")))
+		ok, err := db.Expire([]byte("list"), time.Millisecond*2)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		for {
+			_, err := db.TTL([]byte("list"))
+			if err == ErrKeyNotFound {
+				break
+			}
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestRoseDB_Scan(t *testing.T) {
+	db := openKeyspaceDB(t)
+	for i := 0; i < 25; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("key-%02d", i)), GetValue16B()))
+	}
+	assert.Nil(t, db.HSet([]byte("key-25"), []byte("f"), []byte("v")))
+	assert.Nil(t, db.RPush([]byte("key-26"), []byte("v")))
+
+	keys, err := db.Keys("*")
+	assert.Nil(t, err)
+	assert.Equal(t, 31, len(keys))
+	size, err := db.DBSize()
+	assert.Nil(t, err)
+	assert.Equal(t, 31, size)
+
+	var scanned [][]byte
+	var cursor []byte
+	for {
+		keys, next, err := db.Scan(cursor, ScanOptions{Match: "key-*", Count: 10})
+		assert.Nil(t, err)
+		assert.True(t, len(keys) <= 10)
+		scanned = append(scanned, keys...)
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, 27, len(scanned))
+	for i, key := range scanned {
+		assert.Equal(t, fmt.Sprintf("key-%02d", i), string(key))
+	}
+
+	keys, next, err := db.Scan(nil, ScanOptions{Count: 100, Types: []DataType{Hash}})
+	assert.Nil(t, err)
+	assert.Nil(t, next)
+	assert.Equal(t, [][]byte{[]byte("both"), []byte("hash"), []byte("key-25")}, keys)
+
+	keys, err = db.Keys("key-0[0-2]")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("key-00"), []byte("key-01"), []byte("key-02")}, keys)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.KeysCtx(ctx, "*")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRoseDB_ScanPages(t *testing.T) {
+	db := openKeyspaceDB(t)
+	var want []string
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("page-%03d", i)
+		assert.Nil(t, db.Set([]byte(key), GetValue16B()))
+		want = append(want, key)
+	}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("page-h%02d", i)
+		assert.Nil(t, db.HSet([]byte(key), []byte("f"), []byte("v")))
+		if i%2 == 0 {
+			_, err := db.Expire([]byte(key), time.Millisecond)
+			assert.Nil(t, err)
+		} else {
+			want = append(want, key)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// every page starts right after the cursor, the expired hashes are skipped.
+	var scanned []string
+	var cursor []byte
+	for {
+		keys, next, err := db.Scan(cursor, ScanOptions{Match: "page-*", Count: 7})
+		assert.Nil(t, err)
+		assert.True(t, len(keys) <= 7)
+		for _, key := range keys {
+			scanned = append(scanned, string(key))
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, want, scanned)
+
+	keys, _, err := db.Scan([]byte("page-h"), ScanOptions{Count: 3, Types: []DataType{Hash}})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("page-h01"), []byte("page-h03"), []byte("page-h05")}, keys)
+}
+
+func TestRoseDB_FlushAll(t *testing.T) {
+	db := openKeyspaceDB(t)
+	assert.Nil(t, db.FlushAll())
+	size, err := db.DBSize()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, size)
+	_, err = db.Get([]byte("str"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the db is still writable, and the writes are durable.
+	assert.Nil(t, db.SetWithOptions(context.Background(), []byte("str"), []byte("v2"), WriteOptions{Sync: true}))
+	assert.Nil(t, db.LPush([]byte("list"), []byte("a")))
+	assert.Nil(t, db.Close())
+	db, err = Open(db.opts)
+	assert.Nil(t, err)
+	defer db.Close()
+	v, err := db.Get([]byte("str"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), v)
+	keys, err := db.Keys("*")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("list"), []byte("str")}, keys)
+}
+
+func TestRoseDB_FlushAllDuringGC(t *testing.T) {
+	for _, ioType := range []IOType{FileIO, MMap} {
+		t.Run(fmt.Sprintf("io-type-%d", ioType), func(t *testing.T) {
+			opts := DefaultOptions(filepath.Join("/tmp", "rosedb-flush-gc"))
+			opts.IoType = ioType
+			opts.LogFileSizeThreshold = 64 << 10
+			db, err := Open(opts)
+			assert.Nil(t, err)
+			defer destroyDB(db)
+
+			// the log files removed by FlushAll must not be synced or deleted by a running gc.
+			stop := make(chan struct{})
+			done := make(chan error)
+			go func() {
+				for {
+					select {
+					case <-stop:
+						close(done)
+						return
+					default:
+					}
+					if err := db.RunLogFileGC(String, -1, 0); err != nil && err != ErrGCRunning {
+						done <- err
+						return
+					}
+				}
+			}()
+			value := make([]byte, 1024)
+			for round := 0; round < 20; round++ {
+				for i := 0; i < 200; i++ {
+					assert.Nil(t, db.Set(GetKey(i%20), value))
+				}
+				assert.Nil(t, db.FlushAll())
+			}
+			close(stop)
+			assert.Nil(t, <-done)
+		})
+	}
+}
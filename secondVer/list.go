@@ -1,83 +1,175 @@
 package kv_engine
 
 import (
+	"context"
 	"encoding/binary"
 
 	"github.com/reid00/kv_engine/ds/art"
 	"github.com/reid00/kv_engine/logfile"
-	"github.com/reid00/kv_engine/logger"
 )
 
 // LPush insert all the specified values at the head of the list stored at key.
 // If key does not exist, it is created as empty list before performing the push operations.
 func (db *RoseDB) LPush(key []byte, values ...[]byte) error {
-	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
-
-	if db.listIndex.trees[string(key)] == nil {
-		db.listIndex.trees[string(key)] = art.NewART()
-	}
+	return db.LPushCtx(context.Background(), key, values...)
+}
 
-	db.listIndex.idxTree = db.listIndex.trees[string(key)]
+// LPushCtx is like LPush, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) LPushCtx(ctx context.Context, key []byte, values ...[]byte) error {
+	_, err := db.LPushWithOptions(ctx, key, WriteOptions{}, values...)
+	return err
+}
 
-	for _, val := range values {
-		if err := db.pushInternal(key, val, true); err != nil {
-			return err
-		}
-	}
-	return nil
+// LPushWithOptions is like LPushCtx, with the durability and TTL of the write specified by opts.
+// TTL is the time to live of the whole list, pushes and pops without TTL keep the expiration of the list.
+// It returns the length of the list after the push.
+func (db *RoseDB) LPushWithOptions(ctx context.Context, key []byte, opts WriteOptions, values ...[]byte) (int, error) {
+	return db.pushWithOptions(ctx, key, opts, values, true)
 }
 
 // RPush insert all the specified values at the tail of the list stored at key.
 // If key does not exist, it is created as empty list before performing the push operation.
 func (db *RoseDB) RPush(key []byte, values ...[]byte) error {
-	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
+	return db.RPushCtx(context.Background(), key, values...)
+}
+
+// RPushCtx is like RPush, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) RPushCtx(ctx context.Context, key []byte, values ...[]byte) error {
+	_, err := db.RPushWithOptions(ctx, key, WriteOptions{}, values...)
+	return err
+}
+
+// RPushWithOptions is like RPushCtx, with the durability and TTL of the write specified by opts like LPushWithOptions.
+// It returns the length of the list after the push.
+func (db *RoseDB) RPushWithOptions(ctx context.Context, key []byte, opts WriteOptions, values ...[]byte) (int, error) {
+	return db.pushWithOptions(ctx, key, opts, values, false)
+}
 
-	if db.listIndex.trees[string(key)] == nil {
-		db.listIndex.trees[string(key)] = art.NewART()
+func (db *RoseDB) pushWithOptions(ctx context.Context, key []byte, opts WriteOptions, values [][]byte, isLeft bool) (_ int, err error) {
+	held, err := db.listIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
 	}
-	db.listIndex.idxTree = db.listIndex.trees[string(key)]
+	defer db.unlockKeysWrite(List, held, db.opts.Sync || opts.Sync, &err)
 
+	idxTree := db.listIndex.treeOrCreate(key)
+	now := nowOf(ctx)
 	for _, val := range values {
-		if err := db.pushInternal(key, val, false); err != nil {
-			return err
+		if err := db.pushInternal(idxTree, key, val, isLeft, now); err != nil {
+			return 0, err
 		}
 	}
-	return nil
+	headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
+	if err != nil {
+		return 0, err
+	}
+	if expireAt := opts.expireAt(now); expireAt != 0 {
+		if err = db.saveListMetaExpire(idxTree, key, headSeq, tailSeq, expireAt); err != nil {
+			return 0, err
+		}
+	}
+	return int(tailSeq - headSeq - 1), nil
 }
 
 // LPop removes and returns the first elements of the list stored at key.
 func (db *RoseDB) LPop(key []byte) ([]byte, error) {
-	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
-	return db.popInternal(key, true)
+	return db.LPopCtx(context.Background(), key)
+}
+
+// LPopCtx is like LPop, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) LPopCtx(ctx context.Context, key []byte) (_ []byte, err error) {
+	held, err := db.listIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return nil, err
+	}
+	defer db.unlockKeysWrite(List, held, db.opts.Sync, &err)
+	return db.popInternal(db.listIndex.tree(key), key, true, nowOf(ctx))
 }
 
 // RPop Removes and returns the last elements of the list stored at key.
 func (db *RoseDB) RPop(key []byte) ([]byte, error) {
-	db.listIndex.mu.Lock()
-	defer db.listIndex.mu.Unlock()
-	return db.popInternal(key, false)
+	return db.RPopCtx(context.Background(), key)
+}
+
+// RPopCtx is like RPop, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) RPopCtx(ctx context.Context, key []byte) (_ []byte, err error) {
+	held, err := db.listIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return nil, err
+	}
+	defer db.unlockKeysWrite(List, held, db.opts.Sync, &err)
+	return db.popInternal(db.listIndex.tree(key), key, false, nowOf(ctx))
+}
+
+// LPopN removes and returns at most count elements from the head of the list stored at key.
+// It returns nil if the list does not exist.
+func (db *RoseDB) LPopN(key []byte, count int) ([][]byte, error) {
+	return db.LPopNCtx(context.Background(), key, count)
+}
+
+// LPopNCtx is like LPopN, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) LPopNCtx(ctx context.Context, key []byte, count int) ([][]byte, error) {
+	return db.popN(ctx, key, count, true)
+}
+
+// RPopN removes and returns at most count elements from the tail of the list stored at key.
+// It returns nil if the list does not exist.
+func (db *RoseDB) RPopN(key []byte, count int) ([][]byte, error) {
+	return db.RPopNCtx(context.Background(), key, count)
+}
+
+// RPopNCtx is like RPopN, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) RPopNCtx(ctx context.Context, key []byte, count int) ([][]byte, error) {
+	return db.popN(ctx, key, count, false)
+}
+
+func (db *RoseDB) popN(ctx context.Context, key []byte, count int, isLeft bool) (values [][]byte, err error) {
+	held, err := db.listIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return nil, err
+	}
+	defer db.unlockKeysWrite(List, held, db.opts.Sync, &err)
+
+	idxTree := db.listIndex.tree(key)
+	now := nowOf(ctx)
+	for len(values) < count {
+		val, err := db.popInternal(idxTree, key, isLeft, now)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			break
+		}
+		values = append(values, val)
+	}
+	return values, nil
 }
 
 // LLen returns the length of the list stored at key.
 // If key does not exist, it is interpreted as an empty list and 0 is returned.
 func (db *RoseDB) LLen(key []byte) int {
-	db.listIndex.mu.RLock()
-	defer db.listIndex.mu.RUnlock()
+	v, _ := db.LLenCtx(context.Background(), key)
+	return v
+}
 
-	if db.listIndex.trees[string(key)] == nil {
-		return 0
+// LLenCtx is like LLen, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) LLenCtx(ctx context.Context, key []byte) (int, error) {
+	held, err := db.listIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return 0, err
 	}
+	defer held.unlock()
 
-	db.listIndex.idxTree = db.listIndex.trees[string(key)]
+	idxTree := db.listIndex.tree(key)
+	if idxTree == nil {
+		return 0, nil
+	}
 
-	headSeq, tailSeq, err := db.listMeta(key)
+	headSeq, tailSeq, err := db.listMetaOf(idxTree, key, nowOf(ctx))
 	if err != nil {
-		return 0
+		return 0, nil
 	}
-	return int(tailSeq - headSeq - 1)
+	return int(tailSeq - headSeq - 1), nil
 
 }
 
@@ -86,16 +178,33 @@ func (db *RoseDB) LLen(key []byte) int {
 // Negative indices can be used to designate elements starting at the tail of the list.
 // Here, -1 means the last element, -2 means the penultimate and so forth.
 func (db *RoseDB) LIndex(key []byte, index int) ([]byte, error) {
-	db.listIndex.mu.RLock()
-	defer db.listIndex.mu.RUnlock()
+	return db.LIndexCtx(context.Background(), key, index)
+}
 
-	if db.listIndex.trees[string(key)] == nil {
-		return nil, ErrKeyNotFound
+// LIndexCtx is like LIndex, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) LIndexCtx(ctx context.Context, key []byte, index int) ([]byte, error) {
+	// the meta and the element are read from the same version of the tree.
+	if db.opts.LockFreeReads {
+		return db.readLatest(func() *art.Snapshot { return db.listIndex.snapshotOf(key) }, func(idxTree indexReader) ([]byte, error) {
+			return db.lindex(idxTree, key, index, nowOf(ctx))
+		})
+	}
+	held, err := db.listIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return nil, err
 	}
+	defer held.unlock()
 
-	db.listIndex.idxTree = db.listIndex.trees[string(key)]
+	tree := db.listIndex.tree(key)
+	if tree == nil {
+		return nil, ErrKeyNotFound
+	}
+	return db.lindex(tree, key, index, nowOf(ctx))
+}
 
-	headSeq, tailSeq, err := db.listMeta(key)
+// lindex returns the element at index of the list stored at key in idxTree.
+func (db *RoseDB) lindex(idxTree indexReader, key []byte, index int, now int64) ([]byte, error) {
+	headSeq, tailSeq, err := db.readListMeta(idxTree, key, now)
 	if err != nil {
 		return nil, err
 	}
@@ -114,7 +223,7 @@ func (db *RoseDB) LIndex(key []byte, index int) ([]byte, error) {
 
 	encKey := db.encodeListKey(key, seq)
 
-	val, err := db.getVal(encKey, List)
+	val, err := db.getVal(idxTree, encKey, List, now)
 	if err != nil {
 		return nil, err
 	}
@@ -130,16 +239,25 @@ func (db *RoseDB) LIndex(key []byte, index int) ([]byte, error) {
 // If start is larger than the end of the list, an empty list is returned.
 // If stop is larger than the actual end of the list, Redis will treat it like the last element of the list.
 func (db *RoseDB) LRange(key []byte, start, end int) (values [][]byte, err error) {
-	db.listIndex.mu.RLock()
-	defer db.listIndex.mu.RUnlock()
+	return db.LRangeCtx(context.Background(), key, start, end)
+}
 
-	if db.listIndex.trees[string(key)] == nil {
-		return nil, ErrKeyNotFound
+// LRangeCtx is like LRange, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+// The scan is also stopped once ctx is done.
+func (db *RoseDB) LRangeCtx(ctx context.Context, key []byte, start, end int) (values [][]byte, err error) {
+	held, err := db.listIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return nil, err
 	}
+	defer held.unlock()
 
-	db.listIndex.idxTree = db.listIndex.trees[string(key)]
+	idxTree := db.listIndex.tree(key)
+	if idxTree == nil {
+		return nil, ErrKeyNotFound
+	}
 	// get List DataType meta info
-	headSeq, tailSeq, err := db.listMeta(key)
+	now := nowOf(ctx)
+	headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
 	if err != nil {
 		return nil, err
 	}
@@ -176,8 +294,11 @@ func (db *RoseDB) LRange(key []byte, start, end int) (values [][]byte, err error
 
 	// the endSeq value is included
 	for seq := startSeq; seq < endSeq+1; seq++ {
+		if err := checkCtx(ctx, int(seq-startSeq)); err != nil {
+			return nil, err
+		}
 		encKey := db.encodeListKey(key, seq)
-		val, err := db.getVal(encKey, List)
+		val, err := db.getVal(idxTree, encKey, List, now)
 
 		if err != nil {
 			return nil, err
@@ -214,14 +335,28 @@ func (db *RoseDB) decodeListKey(buf []byte) ([]byte, uint32) {
 	return key, seq
 }
 
-func (db *RoseDB) listMeta(key []byte) (uint32, uint32, error) {
-	val, err := db.getVal(key, List)
-	if err != nil && err != ErrKeyNotFound {
-		return 0, 0, err
+// listMeta returns the head and tail seq of the list key at now, the lock of key must be held.
+func (db *RoseDB) listMeta(key []byte, now int64) (uint32, uint32, error) {
+	return db.listMetaOf(db.listIndex.tree(key), key, now)
+}
+
+// listMetaOf is like listMeta with the index tree of the list resolved, idxTree is nil if the list does not exist.
+func (db *RoseDB) listMetaOf(idxTree *art.AdaptiveRadixTree, key []byte, now int64) (uint32, uint32, error) {
+	var headSeq uint32 = initialListSeq
+	var tailSeq uint32 = initialListSeq + 1
+	if idxTree == nil {
+		return headSeq, tailSeq, nil
 	}
+	return db.readListMeta(idxTree, key, now)
+}
 
+func (db *RoseDB) readListMeta(idxTree indexReader, key []byte, now int64) (uint32, uint32, error) {
 	var headSeq uint32 = initialListSeq
 	var tailSeq uint32 = initialListSeq + 1
+	val, err := db.getVal(idxTree, key, List, now)
+	if err != nil && err != ErrKeyNotFound {
+		return 0, 0, err
+	}
 	if len(val) != 0 {
 		headSeq = binary.LittleEndian.Uint32(val[:4])
 		tailSeq = binary.LittleEndian.Uint32(val[4:8])
@@ -229,27 +364,38 @@ func (db *RoseDB) listMeta(key []byte) (uint32, uint32, error) {
 	return headSeq, tailSeq, nil
 }
 
-func (db *RoseDB) saveListMeta(key []byte, headSeq, tailSeq uint32) error {
+// saveListMeta saves the head and tail seq of a list, and keeps its expiration if it is not expired at now.
+func (db *RoseDB) saveListMeta(idxTree *art.AdaptiveRadixTree, key []byte, headSeq, tailSeq uint32, now int64) error {
+	var expireAt int64
+	if idxNode, _ := idxTree.Get(key).(*indexNode); idxNode != nil &&
+		idxNode.expiredAt > now {
+		expireAt = idxNode.expiredAt
+	}
+	return db.saveListMetaExpire(idxTree, key, headSeq, tailSeq, expireAt)
+}
+
+func (db *RoseDB) saveListMetaExpire(idxTree *art.AdaptiveRadixTree, key []byte, headSeq, tailSeq uint32, expireAt int64) error {
 	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint32(buf[:4], headSeq)
 	binary.LittleEndian.PutUint32(buf[4:8], tailSeq)
 
 	entry := &logfile.LogEntry{
-		Key:   key,
-		Value: buf,
-		Type:  logfile.TypeListMeta,
+		Key:      key,
+		Value:    buf,
+		Type:     logfile.TypeListMeta,
+		ExpireAt: expireAt,
 	}
 
 	pos, err := db.writeLogEntry(entry, List)
 	if err != nil {
 		return err
 	}
-	err = db.updateIndexTree(entry, pos, true, List)
+	err = db.updateIndexTree(idxTree, entry, pos, true, List)
 	return err
 }
 
-func (db *RoseDB) pushInternal(key, val []byte, isLeft bool) error {
-	headSeq, tailSeq, err := db.listMeta(key)
+func (db *RoseDB) pushInternal(idxTree *art.AdaptiveRadixTree, key, val []byte, isLeft bool, now int64) error {
+	headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
 	if err != nil {
 		return err
 	}
@@ -267,7 +413,7 @@ func (db *RoseDB) pushInternal(key, val []byte, isLeft bool) error {
 	if err != nil {
 		return err
 	}
-	if err = db.updateIndexTree(ent, valuePos, true, List); err != nil {
+	if err = db.updateIndexTree(idxTree, ent, valuePos, true, List); err != nil {
 		return err
 	}
 	if isLeft {
@@ -276,18 +422,16 @@ func (db *RoseDB) pushInternal(key, val []byte, isLeft bool) error {
 		tailSeq++
 	}
 
-	err = db.saveListMeta(key, headSeq, tailSeq)
+	err = db.saveListMeta(idxTree, key, headSeq, tailSeq, now)
 	return err
 }
 
-func (db *RoseDB) popInternal(key []byte, isLeft bool) ([]byte, error) {
-	if db.listIndex.trees[string(key)] == nil {
+func (db *RoseDB) popInternal(idxTree *art.AdaptiveRadixTree, key []byte, isLeft bool, now int64) ([]byte, error) {
+	if idxTree == nil {
 		return nil, nil
 	}
 
-	db.listIndex.idxTree = db.listIndex.trees[string(key)]
-
-	headSeq, tailSeq, err := db.listMeta(key)
+	headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
 	if err != nil {
 		return nil, err
 	}
@@ -298,7 +442,7 @@ func (db *RoseDB) popInternal(key []byte, isLeft bool) ([]byte, error) {
 		if headSeq != initialListSeq || tailSeq != initialListSeq+1 {
 			headSeq = initialListSeq
 			tailSeq = initialListSeq + 1
-			_ = db.saveListMeta(key, headSeq, tailSeq)
+			_ = db.saveListMeta(idxTree, key, headSeq, tailSeq, now)
 		}
 		return nil, nil
 	}
@@ -309,7 +453,7 @@ func (db *RoseDB) popInternal(key []byte, isLeft bool) ([]byte, error) {
 	}
 
 	encKey := db.encodeListKey(key, seq)
-	val, err := db.getVal(encKey, List)
+	val, err := db.getVal(idxTree, encKey, List, now)
 	if err != nil {
 		return nil, err
 	}
@@ -324,25 +468,49 @@ func (db *RoseDB) popInternal(key []byte, isLeft bool) ([]byte, error) {
 		return nil, err
 	}
 
-	oldVal, updated := db.listIndex.idxTree.Delete(encKey)
+	// the meta is updated before the element is removed from the index,
+	// so the elements of the list are always in the latest version of the tree read by LIndex.
 	if isLeft {
 		headSeq++
 	} else {
 		tailSeq--
 	}
-	if err = db.saveListMeta(key, headSeq, tailSeq); err != nil {
+	if err = db.saveListMeta(idxTree, key, headSeq, tailSeq, now); err != nil {
 		return nil, err
 	}
+	oldVal, updated := idxTree.Delete(encKey)
 
 	// send discard
 	db.sendDiscard(oldVal, updated, List)
 	_, entrySize := logfile.EncodeEntry(ent)
 	node := &indexNode{fid: pos.fid, entrySize: entrySize}
-	select {
-	case db.discards[List].valChan <- node:
-	default:
-		logger.Warn("send to discard chan fail")
-	}
+	db.discards[List].send(node)
 	return val, nil
 
 }
+
+// deleteList removes all elements of the list live at now, the lock of the key must be held.
+func (db *RoseDB) deleteList(idxTree *art.AdaptiveRadixTree, key []byte, now int64) error {
+	headSeq, tailSeq, err := db.listMetaOf(idxTree, key, now)
+	if err != nil {
+		return err
+	}
+	// the meta is reset rather than deleted, as the deleted entry of it would be taken as an element by buildListIndex.
+	// It is reset before the elements are removed, like popInternal.
+	if err = db.saveListMetaExpire(idxTree, key, initialListSeq, initialListSeq+1, 0); err != nil {
+		return err
+	}
+	for seq := headSeq + 1; seq < tailSeq; seq++ {
+		encKey := db.encodeListKey(key, seq)
+		ent := &logfile.LogEntry{Key: encKey, Type: logfile.TypeDelete}
+		pos, err := db.writeLogEntry(ent, List)
+		if err != nil {
+			return err
+		}
+		oldVal, updated := idxTree.Delete(encKey)
+		db.sendDiscard(oldVal, updated, List)
+		_, entrySize := logfile.EncodeEntry(ent)
+		db.discards[List].send(&indexNode{fid: pos.fid, entrySize: entrySize})
+	}
+	return nil
+}
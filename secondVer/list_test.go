@@ -1,8 +1,10 @@
 package kv_engine
 
 import (
+	"context"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -191,6 +193,34 @@ func testRoseDBRPop(t *testing.T, ioType IOType, mode DataIndexMode) {
 	assert.Equal(t, expected, values)
 }
 
+func TestRoseDB_PopN(t *testing.T) {
+	path := filepath.Join("/tmp", "rosedb")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	ctx := context.Background()
+
+	listKey := []byte("my_list")
+	values, err := db.LPopN(listKey, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, values)
+
+	n, err := db.LPushWithOptions(ctx, listKey, WriteOptions{}, GetKey(1), GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	n, err = db.RPushWithOptions(ctx, listKey, WriteOptions{}, GetKey(2), GetKey(3), GetKey(4))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+
+	values, err = db.LPopN(listKey, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{GetKey(0), GetKey(1)}, values)
+	values, err = db.RPopN(listKey, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{GetKey(4), GetKey(3), GetKey(2)}, values)
+	assert.Equal(t, 0, db.LLen(listKey))
+}
+
 func TestRoseDB_LLen(t *testing.T) {
 	path := filepath.Join("/tmp", "rosedb")
 	opts := DefaultOptions(path)
@@ -443,7 +473,7 @@ func testConvertLogicalIndexToSeq(t *testing.T, ioType IOType, mode DataIndexMod
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			start, end, err := db.listMeta(tt.args.key)
+			start, end, err := db.listMeta(tt.args.key, time.Now().UnixMilli())
 			assert.Nil(t, err)
 			actual, err := tt.db.convertLogicalIndexToSeq(start, end, tt.args.index)
 			assert.Equal(t, tt.expected, actual, "expected is not the same with actual")
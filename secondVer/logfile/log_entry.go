@@ -21,10 +21,15 @@ const (
 	TypeListMeta
 )
 
+// expireMilliFlag is set in the type byte of entries whose ExpireAt is in milliseconds.
+// Entries written before it have ExpireAt in seconds, which is converted to milliseconds when decoded.
+// It is only set if ExpireAt is not zero, so entries without expiration are encoded as before.
+const expireMilliFlag = 0x80
+
 type LogEntry struct {
 	Key      []byte
 	Value    []byte
-	ExpireAt int64 // time.Unix
+	ExpireAt int64 // time.UnixMilli
 	Type     EntryType
 }
 
@@ -34,6 +39,16 @@ type entryHeader struct {
 	kSize     uint32
 	vSize     uint32
 	expiredAt int64
+	// whether expiredAt is in milliseconds, see expireMilliFlag.
+	milli bool
+}
+
+// expireAt returns the expiration of the entry in milliseconds.
+func (h *entryHeader) expireAt() int64 {
+	if h.milli || h.expiredAt == 0 {
+		return h.expiredAt
+	}
+	return h.expiredAt * 1000
 }
 
 // EncodeEntry will encode entry into a byte slice.
@@ -53,6 +68,9 @@ func EncodeEntry(e *LogEntry) ([]byte, int) {
 	header := make([]byte, MaxHeaderSize)
 	// encoder header
 	header[4] = byte(e.Type)
+	if e.ExpireAt != 0 {
+		header[4] |= expireMilliFlag
+	}
 	var index = 5
 
 	index += binary.PutVarint(header[index:], int64(len(e.Key)))   //kSize 写入字节序
@@ -75,6 +93,29 @@ func EncodeEntry(e *LogEntry) ([]byte, int) {
 	return buf, size
 }
 
+// DecodeEntry decode an entry from buf, buf must be encoded by EncodeEntry.
+func DecodeEntry(buf []byte) (*LogEntry, error) {
+	if len(buf) <= crc32.Size {
+		return nil, ErrInvalidEntry
+	}
+	header, size := decodeHeader(buf)
+	kSize, vSize := int64(header.kSize), int64(header.vSize)
+	if int64(len(buf)) != size+kSize+vSize {
+		return nil, ErrInvalidEntry
+	}
+
+	e := &LogEntry{
+		Key:      buf[size : size+kSize],
+		Value:    buf[size+kSize:],
+		ExpireAt: header.expireAt(),
+		Type:     header.typ,
+	}
+	if crc := getEntryCrc(e, buf[crc32.Size:size]); crc != header.crc32 {
+		return nil, ErrInvalidCrc
+	}
+	return e, nil
+}
+
 // 解析entry 的header 和实际占用的字节长度.
 // entryheader 最大25个字节，使用putVarint编码，较小数字不会占满所有字
 func decodeHeader(buf []byte) (*entryHeader, int64) {
@@ -86,7 +127,8 @@ func decodeHeader(buf []byte) (*entryHeader, int64) {
 	entry.crc32 = binary.LittleEndian.Uint32(buf[:4])
 	// entry type
 	typ := buf[4]
-	entry.typ = EntryType(typ)
+	entry.typ = EntryType(typ &^ expireMilliFlag)
+	entry.milli = typ&expireMilliFlag != 0
 
 	index := 5
 	// entry kSize
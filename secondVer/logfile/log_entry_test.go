@@ -25,15 +25,15 @@ func TestEncodeEntry(t *testing.T) {
 			"no-fields", args{e: &LogEntry{}}, []byte{28, 223, 68, 33, 0, 0, 0, 0}, 8,
 		},
 		{
-			"no-key-value", args{e: &LogEntry{ExpireAt: 1615972690}}, []byte{167, 25, 217, 62, 0, 0, 0, 164, 165, 142, 133, 12}, 12,
+			"no-key-value", args{e: &LogEntry{ExpireAt: 1615972690}}, []byte{125, 156, 226, 109, 128, 0, 0, 164, 165, 142, 133, 12}, 12,
 		},
 		{
 			"with-key-value", args{e: &LogEntry{Key: []byte("kv"), Value: []byte("lotusdb"), ExpireAt: 1615972690}},
-			[]byte{61, 215, 197, 153, 0, 4, 14, 164, 165, 142, 133, 12, 107, 118, 108, 111, 116, 117, 115, 100, 98}, 21,
+			[]byte{213, 28, 73, 35, 128, 4, 14, 164, 165, 142, 133, 12, 107, 118, 108, 111, 116, 117, 115, 100, 98}, 21,
 		},
 		{
 			"type-delete", args{e: &LogEntry{Key: []byte("kv"), Value: []byte("lotusdb"), ExpireAt: 1615972690, Type: TypeDelete}},
-			[]byte{126, 28, 99, 30, 1, 4, 14, 164, 165, 142, 133, 12, 107, 118, 108, 111, 116, 117, 115, 100, 98}, 21,
+			[]byte{150, 215, 239, 164, 129, 4, 14, 164, 165, 142, 133, 12, 107, 118, 108, 111, 116, 117, 115, 100, 98}, 21,
 		},
 	}
 
@@ -52,6 +52,48 @@ func TestEncodeEntry(t *testing.T) {
 
 }
 
+func TestDecodeEntry(t *testing.T) {
+	entries := []*LogEntry{
+		{Key: []byte{}, Value: []byte{}},
+		{Key: []byte{}, Value: []byte{}, ExpireAt: 1615972690},
+		{Key: []byte("kv"), Value: []byte("lotusdb"), ExpireAt: 1615972690},
+		{Key: []byte("kv"), Value: []byte{}, Type: TypeDelete},
+	}
+	for _, e := range entries {
+		buf, _ := EncodeEntry(e)
+		got, err := DecodeEntry(buf)
+		if err != nil {
+			t.Errorf("DecodeEntry() err = %v", err)
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("DecodeEntry() got = %v, want %v", got, e)
+		}
+	}
+
+	buf, _ := EncodeEntry(entries[2])
+	if _, err := DecodeEntry(buf[:len(buf)-1]); err != ErrInvalidEntry {
+		t.Errorf("DecodeEntry() err = %v, want %v", err, ErrInvalidEntry)
+	}
+	buf[len(buf)-1]++
+	if _, err := DecodeEntry(buf); err != ErrInvalidCrc {
+		t.Errorf("DecodeEntry() err = %v, want %v", err, ErrInvalidCrc)
+	}
+	if _, err := DecodeEntry(nil); err != ErrInvalidEntry {
+		t.Errorf("DecodeEntry() err = %v, want %v", err, ErrInvalidEntry)
+	}
+
+	// entries written before expireMilliFlag have ExpireAt in seconds.
+	legacy := []byte{61, 215, 197, 153, 0, 4, 14, 164, 165, 142, 133, 12, 107, 118, 108, 111, 116, 117, 115, 100, 98}
+	got, err := DecodeEntry(legacy)
+	if err != nil {
+		t.Errorf("DecodeEntry() err = %v", err)
+	}
+	want := &LogEntry{Key: []byte("kv"), Value: []byte("lotusdb"), ExpireAt: 1615972690000}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeEntry() got = %v, want %v", got, want)
+	}
+}
+
 func Test_decodeHeader(t *testing.T) {
 	type args struct {
 		buf []byte
@@ -76,6 +118,9 @@ func Test_decodeHeader(t *testing.T) {
 			// 可以是这个logEntry Key: []byte("kv"), Value: []byte("lotusdb"), ExpireAt: 1615972690, type: TypeDelete
 			"delete", args{buf: []byte{126, 28, 99, 30, 1, 4, 14, 164, 165, 142, 133, 12}}, &entryHeader{crc32: 509811838, typ: 1, kSize: 2, vSize: 7, expiredAt: 1615972690}, 12,
 		},
+		{
+			"milli", args{buf: []byte{150, 215, 239, 164, 129, 4, 14, 164, 165, 142, 133, 12}}, &entryHeader{crc32: 2767181718, typ: 1, kSize: 2, vSize: 7, expiredAt: 1615972690, milli: true}, 12,
+		},
 	}
 
 	for _, tt := range tests {
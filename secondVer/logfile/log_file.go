@@ -4,11 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
 
 	"github.com/reid00/kv_engine/ioselector"
+	"github.com/reid00/kv_engine/vfs"
 )
 
 var (
@@ -18,10 +20,12 @@ var (
 
 	ErrEndOfEntry = errors.New("logfile: end of entry in log file")
 
-	// only support mmap and fileIO type
+	// only support mmap, fileIO, directIO and memoryIO type, memoryIO can't be opened read-only
 	ErrUnsupportedIoType = errors.New("unsupported io type")
 
 	ErrUnsupportedLogFileType = errors.New("unsupported log file type")
+
+	ErrInvalidEntry = errors.New("logfile: invalid entry")
 )
 
 const (
@@ -60,7 +64,7 @@ var (
 	}
 )
 
-// represents different types of file io: FileIO(standard file io) and MMap(Memory Map).
+// represents different types of file io: FileIO(standard file io), MMap(Memory Map), DirectIO and MemoryIO.
 type IOType uint8
 
 const (
@@ -68,6 +72,10 @@ const (
 	FileIO IOType = iota
 	// Memery File
 	MMap
+	// file io bypassing the page cache
+	DirectIO
+	// file kept in memory only, path is ignored
+	MemoryIO
 )
 
 // LogFile is an abstraction of a disk file, entry`s read and write will go through it.
@@ -83,7 +91,7 @@ type LogFile struct {
 // 如果offset 是无效的，返回的error 是IO.EOF
 func (lf *LogFile) ReadLogEntry(offset int64) (*LogEntry, int64, error) {
 	// read LogEntry header
-	headerBuf, err := lf.readBytes(offset, MaxHeaderSize)
+	headerBuf, err := lf.readHeader(offset)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -94,7 +102,7 @@ func (lf *LogFile) ReadLogEntry(offset int64) (*LogEntry, int64, error) {
 	}
 
 	e := &LogEntry{
-		ExpireAt: header.expiredAt,
+		ExpireAt: header.expireAt(),
 		Type:     header.typ,
 	}
 
@@ -135,6 +143,8 @@ func (lf *LogFile) Read(offset int64, size uint32) ([]byte, error) {
 
 // LogFile 中，在writeAt 处写入数据buf[:].
 // 注意写入时，要求计算writeat 时原子操作
+// If the write fails, e.g. the disk is full, the bytes written are rolled back to zeros
+// and WriteAt is unchanged, so the partial entry is never read.
 func (lf *LogFile) Write(buf []byte) error {
 	if len(buf) <= 0 {
 		return nil
@@ -142,12 +152,16 @@ func (lf *LogFile) Write(buf []byte) error {
 
 	offset := atomic.LoadInt64(&lf.WriteAt)
 	n, err := lf.IoSelector.Write(buf, offset)
+	if err == nil && n != len(buf) {
+		err = ErrWriteSizeNotEqual
+	}
 	if err != nil {
+		// the space of the bytes written is allocated, so overwriting them rarely fails.
+		if n > 0 {
+			_, _ = lf.IoSelector.Write(make([]byte, n), offset)
+		}
 		return err
 	}
-	if n != len(buf) {
-		return ErrWriteSizeNotEqual
-	}
 	atomic.AddInt64(&lf.WriteAt, int64(n))
 	return nil
 }
@@ -164,6 +178,76 @@ func (lf *LogFile) Delete() error {
 	return lf.IoSelector.Delete()
 }
 
+// Seal protects an archived log file from further writes if the io selector supports it.
+func (lf *LogFile) Seal() error {
+	if sealer, ok := lf.IoSelector.(ioselector.Sealer); ok {
+		return sealer.Seal()
+	}
+	return nil
+}
+
+// Advise tells the io selector whether the log file will be scanned sequentially or read randomly.
+// The hint is best effort, so it is ignored if not supported.
+func (lf *LogFile) Advise(sequential bool) {
+	if advisor, ok := lf.IoSelector.(ioselector.Advisor); ok {
+		_ = advisor.Advise(sequential)
+	}
+}
+
+// DiscardTail overwrites the torn entry at offset, which is left at the end of file by a crash, with zeros.
+// Otherwise its remains after the shorter entries written at offset could be read as a corrupted entry.
+func (lf *LogFile) DiscardTail(offset int64) error {
+	headerBuf, err := lf.readHeader(offset)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fsize, err := lf.Size()
+	if err != nil {
+		return err
+	}
+	header, size := decodeHeader(headerBuf)
+	end := offset + size + int64(header.kSize) + int64(header.vSize)
+	// the header itself may be torn.
+	if end < offset+MaxHeaderSize {
+		end = offset + MaxHeaderSize
+	}
+	if end > fsize {
+		end = fsize
+	}
+
+	zeros := make([]byte, 4096)
+	for offset < end {
+		n := end - offset
+		if n > int64(len(zeros)) {
+			n = int64(len(zeros))
+		}
+		if _, err := lf.IoSelector.Write(zeros[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return lf.IoSelector.Sync()
+}
+
+// Size returns the size of the log file on disk.
+func (lf *LogFile) Size() (int64, error) {
+	return lf.IoSelector.Size()
+}
+
+// readHeader reads MaxHeaderSize bytes at offset. The header of the last entry may end less than MaxHeaderSize
+// before the end of file, so the bytes beyond the end of file are read as zero.
+func (lf *LogFile) readHeader(offset int64) ([]byte, error) {
+	buf := make([]byte, MaxHeaderSize)
+	n, err := lf.IoSelector.Read(buf, offset)
+	if err == io.EOF && n > 0 {
+		return buf, nil
+	}
+	return buf, err
+}
+
 // LogFile 的指定位置处，读取长度为n的字节
 func (lf *LogFile) readBytes(offset, n int64) (buf []byte, err error) {
 	buf = make([]byte, n)
@@ -182,7 +266,45 @@ func (lf *LogFile) getLogFileName(path string, fid uint32, ftype FileType) (name
 
 // 打开一个已经存在的log 或者新建一个log 文件
 // fsize 必须是>0, 根据ioType 创建ioselector 类型
-func OpenLogFile(path string, fid uint32, fsize int64, ftype FileType, ioType IOType) (lf *LogFile, err error) {
+func OpenLogFile(fs vfs.FS, path string, fid uint32, fsize int64, ftype FileType, ioType IOType) (lf *LogFile, err error) {
+	lf = &LogFile{
+		Fid: fid,
+	}
+	fileName, err := lf.getLogFileName(path, fid, ftype)
+	if err != nil {
+		return nil, err
+	}
+
+	var selector ioselector.IOSelector
+
+	switch ioType {
+	case FileIO:
+		if selector, err = ioselector.NewFileIOSelector(fs, fileName, fsize); err != nil {
+			return
+		}
+	case MMap:
+		if selector, err = ioselector.NewMMapSelector(fs, fileName, fsize); err != nil {
+			return
+		}
+	case DirectIO:
+		if selector, err = ioselector.NewDirectIOSelector(fs, fileName, fsize); err != nil {
+			return
+		}
+	case MemoryIO:
+		if selector, err = ioselector.NewMemorySelector(fsize); err != nil {
+			return
+		}
+	default:
+		return nil, ErrUnsupportedIoType
+	}
+
+	lf.IoSelector = selector
+	return
+}
+
+// OpenReadOnlyLogFile open an existing log file for reading only.
+// Unlike OpenLogFile, the file will never be created or truncated, and any write to it will fail.
+func OpenReadOnlyLogFile(fs vfs.FS, path string, fid uint32, ftype FileType, ioType IOType) (lf *LogFile, err error) {
 	lf = &LogFile{
 		Fid: fid,
 	}
@@ -195,11 +317,15 @@ func OpenLogFile(path string, fid uint32, fsize int64, ftype FileType, ioType IO
 
 	switch ioType {
 	case FileIO:
-		if selector, err = ioselector.NewFileIOSelector(fileName, fsize); err != nil {
+		if selector, err = ioselector.NewReadOnlyFileIOSelector(fs, fileName); err != nil {
 			return
 		}
 	case MMap:
-		if selector, err = ioselector.NewMMapSelector(fileName, fsize); err != nil {
+		if selector, err = ioselector.NewReadOnlyMMapSelector(fs, fileName); err != nil {
+			return
+		}
+	case DirectIO:
+		if selector, err = ioselector.NewReadOnlyDirectIOSelector(fs, fileName); err != nil {
 			return
 		}
 	default:
@@ -2,10 +2,12 @@ package logfile
 
 import (
 	"fmt"
+	"os"
 	"reflect"
 	"sync/atomic"
 	"testing"
 
+	"github.com/reid00/kv_engine/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,6 +19,14 @@ func TestOpenLogFile(t *testing.T) {
 	t.Run("Mmapio", func(t *testing.T) {
 		testOpenLogFile(t, MMap)
 	})
+
+	t.Run("DirectIO", func(t *testing.T) {
+		testOpenLogFile(t, DirectIO)
+	})
+
+	t.Run("MemoryIO", func(t *testing.T) {
+		testOpenLogFile(t, MemoryIO)
+	})
 }
 
 func testOpenLogFile(t *testing.T, ioType IOType) {
@@ -46,7 +56,7 @@ func testOpenLogFile(t *testing.T, ioType IOType) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotLogF, err := OpenLogFile(tt.args.path, tt.args.fid, tt.args.fsize, tt.args.ftype, tt.args.ioType)
+			gotLogF, err := OpenLogFile(vfs.OS, tt.args.path, tt.args.fid, tt.args.fsize, tt.args.ftype, tt.args.ioType)
 			defer func() {
 				if gotLogF != nil && gotLogF.IoSelector != nil {
 					_ = gotLogF.Delete()
@@ -72,10 +82,18 @@ func TestLogFile_Write(t *testing.T) {
 	t.Run("Mmapio", func(t *testing.T) {
 		testLogFileWrite(t, MMap)
 	})
+
+	t.Run("DirectIO", func(t *testing.T) {
+		testLogFileWrite(t, DirectIO)
+	})
+
+	t.Run("MemoryIO", func(t *testing.T) {
+		testLogFileWrite(t, MemoryIO)
+	})
 }
 
 func testLogFileWrite(t *testing.T, ioType IOType) {
-	lf, err := OpenLogFile("/tmp", 1, 1<<20, List, ioType)
+	lf, err := OpenLogFile(vfs.OS, "/tmp", 1, 1<<20, List, ioType)
 	assert.Nil(t, err)
 	defer func() {
 		if lf != nil {
@@ -130,10 +148,18 @@ func TestLogFile_Read(t *testing.T) {
 	t.Run("Mmapio", func(t *testing.T) {
 		testLogFileRead(t, MMap)
 	})
+
+	t.Run("DirectIO", func(t *testing.T) {
+		testLogFileRead(t, DirectIO)
+	})
+
+	t.Run("MemoryIO", func(t *testing.T) {
+		testLogFileRead(t, MemoryIO)
+	})
 }
 
 func testLogFileRead(t *testing.T, ioType IOType) {
-	lf, err := OpenLogFile("/tmp", 1, 1<<20, List, ioType)
+	lf, err := OpenLogFile(vfs.OS, "/tmp", 1, 1<<20, List, ioType)
 	assert.Nil(t, err)
 	defer func() {
 		if lf != nil {
@@ -225,10 +251,18 @@ func TestLogFileReadEntry(t *testing.T) {
 	t.Run("MmapIO", func(t *testing.T) {
 		testLogFileReadEntry(t, MMap)
 	})
+
+	t.Run("DirectIO", func(t *testing.T) {
+		testLogFileReadEntry(t, DirectIO)
+	})
+
+	t.Run("MemoryIO", func(t *testing.T) {
+		testLogFileReadEntry(t, MemoryIO)
+	})
 }
 
 func testLogFileReadEntry(t *testing.T, ioType IOType) {
-	lf, err := OpenLogFile("/tmp", 1, 1<<20, Sets, ioType)
+	lf, err := OpenLogFile(vfs.OS, "/tmp", 1, 1<<20, Sets, ioType)
 	assert.Nil(t, err)
 	defer func() {
 		if lf != nil {
@@ -324,7 +358,7 @@ func testLogFileReadEntry(t *testing.T, ioType IOType) {
 
 func TestLogFile_Sync(t *testing.T) {
 	sync := func(ioType IOType) {
-		file, err := OpenLogFile("/tmp", 0, 100, Hash, ioType)
+		file, err := OpenLogFile(vfs.OS, "/tmp", 0, 100, Hash, ioType)
 		assert.Nil(t, err)
 		defer func() {
 			if file != nil {
@@ -342,6 +376,12 @@ func TestLogFile_Sync(t *testing.T) {
 	t.Run("MmapIO", func(t *testing.T) {
 		sync(MMap)
 	})
+	t.Run("DirectIO", func(t *testing.T) {
+		sync(DirectIO)
+	})
+	t.Run("MemoryIO", func(t *testing.T) {
+		sync(MemoryIO)
+	})
 
 }
 
@@ -349,7 +389,7 @@ func TestLogFile_Close(t *testing.T) {
 	var fid uint32 = 0
 
 	closeLf := func(ioType IOType) {
-		file, err := OpenLogFile("/tmp", fid, 100, Sets, ioType)
+		file, err := OpenLogFile(vfs.OS, "/tmp", fid, 100, Sets, ioType)
 		assert.Nil(t, err)
 
 		err = file.Close()
@@ -367,7 +407,7 @@ func TestLogFile_Close(t *testing.T) {
 
 func TestLogFile_Delete(t *testing.T) {
 	deleteLf := func(ioType IOType) {
-		file, err := OpenLogFile("/tmp", 0, 100, ZSet, ioType)
+		file, err := OpenLogFile(vfs.OS, "/tmp", 0, 100, ZSet, ioType)
 		assert.Nil(t, err)
 		err = file.Delete()
 		assert.Nil(t, err)
@@ -381,3 +421,37 @@ func TestLogFile_Delete(t *testing.T) {
 		deleteLf(MMap)
 	})
 }
+
+func TestLogFile_ReadEntryAtEnd(t *testing.T) {
+	readAtEnd := func(t *testing.T, ioType IOType) {
+		entry := &LogEntry{Key: []byte("k1"), Value: []byte("v1")}
+		buf, size := EncodeEntry(entry)
+
+		// the file ends exactly at the end of the entry, which is shorter than MaxHeaderSize.
+		lf, err := OpenLogFile(vfs.OS, "/tmp", 3, int64(size), Strs, ioType)
+		assert.Nil(t, err)
+		name, _ := lf.getLogFileName("/tmp", 3, Strs)
+		defer os.Remove(name)
+		assert.Nil(t, lf.Write(buf))
+		assert.Nil(t, lf.Close())
+
+		lf, err = OpenReadOnlyLogFile(vfs.OS, "/tmp", 3, Strs, ioType)
+		assert.Nil(t, err)
+		got, esize, err := lf.ReadLogEntry(0)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), esize)
+		assert.Equal(t, entry.Key, got.Key)
+		assert.Equal(t, entry.Value, got.Value)
+		assert.Nil(t, lf.Close())
+	}
+
+	t.Run("FileIO", func(t *testing.T) {
+		readAtEnd(t, FileIO)
+	})
+	t.Run("MmapIO", func(t *testing.T) {
+		readAtEnd(t, MMap)
+	})
+	t.Run("DirectIO", func(t *testing.T) {
+		readAtEnd(t, DirectIO)
+	})
+}
@@ -4,16 +4,29 @@ import (
 	"os"
 )
 
+// File is the file to be mapped, *os.File implements it.
+type File interface {
+	Fd() uintptr
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
 // 内存映射方法，写入文件时，使用mmap syscall,减少两次IO
 // 可以再用户空间直接读写page cache， 避免了，从 page cache -> use buffer -> socket buffer/page cahe
 // 减少两次上下文切换
 
 // Mmap uses the mmap system call to memory-map a file. If writable is true,
 // memory protection of the pages is set so that they may be written to as well.
-func Mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
+func Mmap(fd File, writable bool, size int64) ([]byte, error) {
 	return mmap(fd, writable, size)
 }
 
+// Mremap resizes a previously mapped slice to size, the returned slice may be moved to another address,
+// so the old one must not be used anymore. The file must be at least size bytes if writable is true.
+func Mremap(fd File, b []byte, writable bool, size int64) ([]byte, error) {
+	return remap(fd, b, writable, size)
+}
+
 // Munmap unmaps a previously mapped slice.
 func Munmap(b []byte) error {
 	return munmap(b)
@@ -26,6 +39,27 @@ func Madvise(b []byte, readahead bool) error {
 	return madvise(b, readahead)
 }
 
+// Advice is the expected access pattern of a memory-mapped slice.
+type Advice int8
+
+const (
+	// Normal no special treatment.
+	Normal Advice = iota
+	// Random pages are expected in random order, so there is no readahead.
+	Random
+	// Sequential pages are expected in sequential order, so they are read ahead aggressively,
+	// and may be freed soon after they are accessed.
+	Sequential
+)
+
+// Advise is like Madvise, but supports all kinds of Advice.
+func Advise(b []byte, advice Advice) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return advise(b, advice)
+}
+
 // Msync would call sync on the mmapped data.
 func Msync(b []byte) error {
 	return msync(b)
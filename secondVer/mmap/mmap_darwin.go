@@ -1,7 +1,6 @@
 package mmap
 
 import (
-	"os"
 	"syscall"
 	"unsafe"
 
@@ -10,7 +9,7 @@ import (
 
 // Mmap uses the mmap system call to memory-map a file. If writable is true,
 // memory protection of the pages is set so that they may be written to as well.
-func mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
+func mmap(fd File, writable bool, size int64) ([]byte, error) {
 	mtype := unix.PROT_READ
 	if writable {
 		mtype |= unix.PROT_WRITE
@@ -38,6 +37,30 @@ func madvise(b []byte, readahead bool) error {
 	return nil
 }
 
+func advise(b []byte, advice Advice) error {
+	flags := unix.MADV_NORMAL
+	switch advice {
+	case Random:
+		flags = unix.MADV_RANDOM
+	case Sequential:
+		flags = unix.MADV_SEQUENTIAL
+	}
+	_, _, e1 := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)), uintptr(flags))
+	if e1 != 0 {
+		return e1
+	}
+	return nil
+}
+
+// remap unmaps and maps the file again, there is no mremap.
+func remap(fd File, b []byte, writable bool, size int64) ([]byte, error) {
+	if err := munmap(b); err != nil {
+		return nil, err
+	}
+	return mmap(fd, writable, size)
+}
+
 func msync(b []byte) error {
 	return unix.Msync(b, unix.MS_SYNC)
 }
@@ -1,7 +1,6 @@
 package mmap
 
 import (
-	"os"
 	"reflect"
 	"unsafe"
 
@@ -10,7 +9,7 @@ import (
 
 // mmap uses the mmap system call to memory-map a file. If writable is true,
 // memory protection of the pages is set so that they may be written to as well.
-func mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
+func mmap(fd File, writable bool, size int64) ([]byte, error) {
 	mtype := unix.PROT_READ
 	if writable {
 		mtype |= unix.PROT_WRITE
@@ -64,6 +63,11 @@ func munmap(data []byte) error {
 	return nil
 }
 
+// remap resizes the mapping in place if possible, by mremap.
+func remap(fd File, data []byte, writable bool, size int64) ([]byte, error) {
+	return mremap(data, int(size))
+}
+
 // madvise uses the madvise system call to give advise about the use of memory
 // when using a slice that is memory-mapped to a file. Set the readahead flag to
 // false if page references are expected in random order.
@@ -75,6 +79,21 @@ func madvise(b []byte, readahead bool) error {
 	return unix.Madvise(b, flags)
 }
 
+func advise(b []byte, advice Advice) error {
+	return unix.Madvise(b, unixAdvice(advice))
+}
+
+func unixAdvice(advice Advice) int {
+	switch advice {
+	case Random:
+		return unix.MADV_RANDOM
+	case Sequential:
+		return unix.MADV_SEQUENTIAL
+	default:
+		return unix.MADV_NORMAL
+	}
+}
+
 // msync writes any modified data to persistent storage.
 func msync(b []byte) error {
 	return unix.Msync(b, unix.MS_SYNC)
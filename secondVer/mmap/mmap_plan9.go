@@ -1,13 +1,12 @@
 package mmap
 
 import (
-	"os"
 	"syscall"
 )
 
 // Mmap uses the mmap system call to memory-map a file. If writable is true,
 // memory protection of the pages is set so that they may be written to as well.
-func mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
+func mmap(fd File, writable bool, size int64) ([]byte, error) {
 	return nil, syscall.EPLAN9
 }
 
@@ -23,6 +22,14 @@ func madvise(b []byte, readahead bool) error {
 	return syscall.EPLAN9
 }
 
+func advise(b []byte, advice Advice) error {
+	return syscall.EPLAN9
+}
+
+func remap(fd File, b []byte, writable bool, size int64) ([]byte, error) {
+	return nil, syscall.EPLAN9
+}
+
 func msync(b []byte) error {
 	return syscall.EPLAN9
 }
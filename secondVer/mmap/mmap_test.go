@@ -77,3 +77,33 @@ func TestMunmap(t *testing.T) {
 	err = Munmap(buf)
 	assert.Nil(t, err)
 }
+
+func TestMremap(t *testing.T) {
+	fd, err := os.OpenFile(filepath.Join("/tmp", "mremap.txt"), os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer func() {
+		_ = fd.Close()
+		_ = os.Remove(fd.Name())
+	}()
+	assert.Nil(t, fd.Truncate(100))
+
+	buf, err := Mmap(fd, true, 100)
+	assert.Nil(t, err)
+	copy(buf[90:], "0123456789")
+	assert.Nil(t, Advise(buf, Sequential))
+
+	assert.Nil(t, fd.Truncate(8192))
+	buf, err = Mremap(fd, buf, true, 8192)
+	assert.Nil(t, err)
+	assert.Equal(t, 8192, len(buf))
+	assert.Equal(t, []byte("0123456789"), buf[90:100])
+	copy(buf[8000:], "extended")
+	assert.Nil(t, Advise(buf, Random))
+	assert.Nil(t, Msync(buf))
+	assert.Nil(t, Munmap(buf))
+
+	b := make([]byte, 8)
+	_, err = fd.ReadAt(b, 8000)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("extended"), b)
+}
@@ -3,14 +3,12 @@
 package mmap
 
 import (
-	"os"
-
 	"golang.org/x/sys/unix"
 )
 
 // Mmap uses the mmap system call to memory-map a file. If writable is true,
 // memory protection of the pages is set so that they may be written to as well.
-func mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
+func mmap(fd File, writable bool, size int64) ([]byte, error) {
 	mtype := unix.PROT_READ
 	if writable {
 		mtype |= unix.PROT_WRITE
@@ -34,6 +32,25 @@ func madvise(b []byte, readahead bool) error {
 	return unix.Madvise(b, flags)
 }
 
+func advise(b []byte, advice Advice) error {
+	flags := unix.MADV_NORMAL
+	switch advice {
+	case Random:
+		flags = unix.MADV_RANDOM
+	case Sequential:
+		flags = unix.MADV_SEQUENTIAL
+	}
+	return unix.Madvise(b, flags)
+}
+
+// remap unmaps and maps the file again, there is no mremap.
+func remap(fd File, b []byte, writable bool, size int64) ([]byte, error) {
+	if err := munmap(b); err != nil {
+		return nil, err
+	}
+	return mmap(fd, writable, size)
+}
+
 func msync(b []byte) error {
 	return unix.Msync(b, unix.MS_SYNC)
 }
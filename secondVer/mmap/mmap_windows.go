@@ -10,7 +10,7 @@ import (
 	"unsafe"
 )
 
-func mmap(fd *os.File, write bool, size int64) ([]byte, error) {
+func mmap(fd File, write bool, size int64) ([]byte, error) {
 	protect := syscall.PAGE_READONLY
 	access := syscall.FILE_MAP_READ
 
@@ -75,6 +75,18 @@ func madvise(b []byte, readahead bool) error {
 	return nil
 }
 
+func advise(b []byte, advice Advice) error {
+	return nil
+}
+
+// remap unmaps and maps the file again, mmap extends the file if necessary.
+func remap(fd File, b []byte, writable bool, size int64) ([]byte, error) {
+	if err := munmap(b); err != nil {
+		return nil, err
+	}
+	return mmap(fd, writable, size)
+}
+
 func msync(b []byte) error {
 	return syscall.FlushViewOfFile(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
 }
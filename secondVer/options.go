@@ -1,6 +1,10 @@
 package kv_engine
 
-import "time"
+import (
+	"time"
+
+	"github.com/reid00/kv_engine/vfs"
+)
 
 type DataIndexMode int
 
@@ -15,7 +19,7 @@ const (
 	KeyOnlyMemMode
 )
 
-// IOType represents different types of file io: FileIO(standard file io) and MMap(Memory Map).
+// IOType represents different types of file io: FileIO(standard file io), MMap(Memory Map) and DirectIO.
 type IOType int8
 
 const (
@@ -23,6 +27,9 @@ const (
 	FileIO IOType = iota
 	// MMap Memory Map.
 	MMap
+	// DirectIO file io bypassing the page cache of os, see ioselector.DirectIOSelector.
+	// It is supported on linux and darwin only, and not by some file systems like tmpfs.
+	DirectIO
 )
 
 // Options 打开db的基本配置
@@ -35,16 +42,47 @@ type Options struct {
 	// Default value is KeyOnlyMemMode.
 	IndexMode DataIndexMode
 
-	// IoType file r/w io type, support FileIO and MMap now.
+	// IoType file r/w io type, support FileIO, MMap and DirectIO now.
 	// Default value is FileIO.
 	IoType IOType
 
+	// InMemory all data is kept in memory and lost once the db is closed, nothing is written to disk,
+	// so DBPath, IoType and the file lock are ignored. It is for tests and throwaway caches.
+	// Backup and read-only mode are not supported.
+	// Default value is false.
+	InMemory bool
+
+	// FS the file system which every file and directory of the db is accessed through,
+	// e.g. vfs.NewFaultFS to inject io faults and crashes in tests. Writes to the mapped region of MMap bypass it.
+	// Default value is vfs.OS.
+	FS vfs.FS
+
+	// LockFreeReads every write publishes an immutable version of the index, so that Get, HGet and LIndex
+	// read the latest version without taking any lock, and never wait for writers.
+	// Reading values from log files in KeyOnlyMemMode may still wait for the rotation of active log file.
+	// Writes are slower, and the indexes take about twice the memory.
+	// Default value is false.
+	LockFreeReads bool
+
 	// Sync is whether to sync writes from the OS buffer cache through to actual disk.
 	// If false, and the machine crashes, then some recent writes may be lost.
 	// Note that if it is just the process that crashes (and the machine does not) then no writes will be lost.
+	// Writes return after they are synced, and concurrent writes of the same data type share a single fsync(group commit).
 	// Default value is false.
 	Sync bool
 
+	// SyncInterval a background goroutine will sync active log files periodically according to the interval,
+	// it bounds the writes lost on machine crash without syncing every write. Disabled if it is zero.
+	// It is useless if Sync is true.
+	// Default value is 0.
+	SyncInterval time.Duration
+
+	// BytesPerSync active log file will be synced in background once the bytes written to it since the last sync reach the threshold.
+	// It can be used together with SyncInterval. Disabled if it is zero.
+	// It is useless if Sync is true.
+	// Default value is 0.
+	BytesPerSync int64
+
 	// LogFileGCInterval a background goroutine will execute log file garbage collection periodically according to the interval.
 	// It will pick the log file that meet the conditions for GC, then rewrite the valid data one by one.
 	// Default value is 8 hours.
@@ -66,6 +104,51 @@ type Options struct {
 	// This option represents the size of that channel.
 	// If you got errors like `send discard chan fail`, you can increase this option to avoid it.
 	DiscardBufferSize int
+
+	// MaxDiskUsage the limit of the total size of log files, writes needing a new log file beyond it fail with ErrDiskUsageExceeded,
+	// so that the disk never fills up, which would degrade the db to read-only, see RoseDB.Recover.
+	// Log file gc still works beyond the limit to reclaim space. There is no limit if it is not positive.
+	// Default value is 0.
+	MaxDiskUsage int64
+
+	// ReadOnly open the db in read-only mode, a shared file lock will be acquired,
+	// so that many processes can open the same directory concurrently.
+	// No files will be written or created, log file gc is disabled, and all mutations return ErrReadOnly.
+	// The db directory must already exist in this mode.
+	// Default value is false.
+	ReadOnly bool
+
+	// ReplicaOf address of the primary, the db will be a replica of it if not empty.
+	// A replica does an initial sync from log files of the primary, then streams the new entries continuously,
+	// and reconnects automatically if disconnected. Mutations on a replica return ErrReplicaReadOnly.
+	// The primary must serve replicas by RoseDB.ServeReplication.
+	// Default value is empty.
+	ReplicaOf string
+}
+
+// WriteOptions options of a single write, see the WithOptions methods.
+type WriteOptions struct {
+	// Sync whether to sync the write to disk before returning, regardless of Options.Sync.
+	// Concurrent synced writes of the same data type share a single fsync.
+	Sync bool
+
+	// TTL time to live of the written key(field of hash, or the whole list), it never expires if TTL is zero.
+	TTL time.Duration
+
+	// ExpireAt the time when the written key expires, it takes precedence over TTL if not zero.
+	// Unlike TTL, it does not depend on the time of the write, so replaying a write gives the same expiration.
+	ExpireAt time.Time
+}
+
+// expireAt returns the expiration timestamp of the write made at now, zero if no TTL.
+func (wo WriteOptions) expireAt(now int64) int64 {
+	if !wo.ExpireAt.IsZero() {
+		return wo.ExpireAt.UnixMilli()
+	}
+	if wo.TTL <= 0 {
+		return 0
+	}
+	return time.UnixMilli(now).Add(wo.TTL).UnixMilli()
 }
 
 func DefaultOptions(path string) Options {
@@ -73,6 +156,7 @@ func DefaultOptions(path string) Options {
 		DBPath:               path,
 		IndexMode:            KeyOnlyMemMode,
 		IoType:               FileIO,
+		FS:                   vfs.OS,
 		Sync:                 false,
 		LogFileGCInterval:    time.Hour * 8,
 		LogFileGCRatio:       0.5,
@@ -0,0 +1,622 @@
+package kv_engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reid00/kv_engine/ds/zset"
+	"github.com/reid00/kv_engine/logfile"
+	"github.com/reid00/kv_engine/logger"
+	"github.com/reid00/kv_engine/vfs"
+)
+
+var (
+	// ErrReplicaReadOnly mutations are not allowed on a replica, write to the primary instead.
+	ErrReplicaReadOnly = errors.New("db is a replica, mutation is not allowed")
+
+	ErrInvalidReplicationFrame = errors.New("invalid replication frame")
+)
+
+const (
+	replicationFileName      = "REPLICATION"
+	replicaReconnectInterval = time.Second
+	replicaHeartbeatInterval = time.Second
+	replicaSavePosInterval   = time.Second
+	maxFullSyncRetries       = 3
+
+	frameHeaderSize    = 5
+	positionRecordSize = 12
+)
+
+// frame types of the replication protocol.
+// +------+--------+-----------+
+// | type | length |  payload  |
+// +------+--------+-----------+
+// 0------1--------5-----------n
+const (
+	frameHello byte = iota + 1
+	frameFullSync
+	frameEntry
+	frameHeartbeat
+)
+
+// ReplicationStatus is the replication state of a db.
+type ReplicationStatus struct {
+	// IsReplica whether the db is a replica.
+	IsReplica bool
+	// Primary address of the primary, only for replica.
+	Primary string
+	// Connected whether the replica is connected to the primary now.
+	Connected bool
+	// LagBytes log bytes of the primary not applied by the replica yet, as of the last heartbeat.
+	// Entries rewritten by log file gc of the primary are counted until next write.
+	LagBytes int64
+	// LastHeartbeat time of the last heartbeat received from the primary.
+	LastHeartbeat time.Time
+	// Positions primary positions applied by the replica of each data type.
+	Positions map[DataType]Position
+	// Replicas number of the connected replicas, only for primary.
+	Replicas int
+}
+
+type replica struct {
+	sync.Mutex
+	db            *RoseDB
+	primary       string
+	conn          net.Conn
+	connected     bool
+	synced        bool // whether full sync has been done, positions are valid only if true.
+	positions     [logFileTypeNum]Position
+	primaryEnd    [logFileTypeNum]Position
+	lastHeartbeat time.Time
+	dirty         bool
+	closed        chan struct{}
+	wg            sync.WaitGroup
+}
+
+// ServeReplication accepts replicas from the listener and streams log entries to them.
+// It blocks until the listener is closed.
+func (db *RoseDB) ServeReplication(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if db.isClosed() {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			atomic.AddInt32(&db.replicas, 1)
+			defer atomic.AddInt32(&db.replicas, -1)
+			if err := db.serveReplica(conn); err != nil && err != io.EOF {
+				logger.Warnf("replica %s disconnected: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ReplicationStatus returns the replication state of the db.
+func (db *RoseDB) ReplicationStatus() ReplicationStatus {
+	status := ReplicationStatus{Replicas: int(atomic.LoadInt32(&db.replicas))}
+	r := db.replica
+	if r == nil {
+		return status
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	status.IsReplica = true
+	status.Primary = r.primary
+	status.Connected = r.connected
+	status.LastHeartbeat = r.lastHeartbeat
+	status.Positions = make(map[DataType]Position)
+	for i := 0; i < logFileTypeNum; i++ {
+		pos, end := r.positions[i], r.primaryEnd[i]
+		status.Positions[DataType(i)] = pos
+		if pos.before(end) {
+			status.LagBytes += int64(end.Fid-pos.Fid)*db.opts.LogFileSizeThreshold + end.Offset - pos.Offset
+		}
+	}
+	return status
+}
+
+func (db *RoseDB) serveReplica(conn net.Conn) error {
+	defer conn.Close()
+
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	if typ != frameHello || len(payload) != 1+logFileTypeNum*positionRecordSize {
+		return ErrInvalidReplicationFrame
+	}
+
+	var sub *Subscription
+	if payload[0] == 1 {
+		from := make(map[DataType]Position)
+		for i, pos := range decodePositions(payload[1:]) {
+			from[DataType(i)] = pos
+		}
+		sub, err = db.Subscribe(ChangeFilter{From: from})
+	}
+	if payload[0] == 0 || err == ErrPositionCompacted {
+		sub, err = db.subscribeFullSync()
+		if err == nil {
+			err = writeFrame(conn, frameFullSync, nil)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	w := bufio.NewWriter(conn)
+	ticker := time.NewTicker(replicaHeartbeatInterval)
+	defer ticker.Stop()
+
+	// detect the closed connection, replicas never send anything after hello.
+	connClosed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(connClosed)
+	}()
+
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return sub.Err()
+			}
+			if err := writeFrame(w, frameEntry, encodeEntryFrame(ev)); err != nil {
+				return err
+			}
+			if len(sub.C) == 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			ends := db.endPositions()
+			if err := writeFrame(w, frameHeartbeat, encodePositions(ends[:])); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		case <-connClosed:
+			return io.EOF
+		}
+	}
+}
+
+// subscribeFullSync subscribes from the first entry of all existing log files.
+// Replaying them rebuilds the current state, because log file gc always rewrites valid entries to the active log file.
+func (db *RoseDB) subscribeFullSync() (sub *Subscription, err error) {
+	for i := 0; i < maxFullSyncRetries; i++ {
+		from := make(map[DataType]Position)
+		db.mu.RLock()
+		for dataType, active := range db.activeLogFiles {
+			first := active.Fid
+			for fid := range db.archivedLogFiles[dataType] {
+				if fid < first {
+					first = fid
+				}
+			}
+			from[dataType] = Position{DataType: dataType, Fid: first}
+		}
+		db.mu.RUnlock()
+
+		// the first log file may be compacted by gc in the meantime, just retry.
+		if sub, err = db.Subscribe(ChangeFilter{From: from}); err != ErrPositionCompacted {
+			return
+		}
+	}
+	return
+}
+
+func (db *RoseDB) endPositions() [logFileTypeNum]Position {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var ends [logFileTypeNum]Position
+	for dataType, active := range db.activeLogFiles {
+		ends[dataType] = Position{DataType: dataType, Fid: active.Fid, Offset: atomic.LoadInt64(&active.WriteAt)}
+	}
+	return ends
+}
+
+func (db *RoseDB) startReplica() error {
+	r := &replica{
+		db:      db,
+		primary: db.opts.ReplicaOf,
+		closed:  make(chan struct{}),
+	}
+	if err := r.loadPositions(); err != nil {
+		return err
+	}
+	db.replica = r
+
+	r.wg.Add(2)
+	go r.run()
+	go r.savePositionsPeriodically()
+	return nil
+}
+
+// run connects to the primary and applies the received entries, reconnect if disconnected.
+func (r *replica) run() {
+	defer r.wg.Done()
+	for {
+		err := r.sync()
+		if err != nil && err != io.EOF {
+			logger.Warnf("replicate from %s err: %v", r.primary, err)
+		}
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(replicaReconnectInterval):
+		}
+	}
+}
+
+func (r *replica) sync() error {
+	conn, err := net.DialTimeout("tcp", r.primary, replicaReconnectInterval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.Lock()
+	select {
+	case <-r.closed:
+		r.Unlock()
+		return nil
+	default:
+	}
+	r.conn = conn
+	r.connected = true
+	hello := make([]byte, 1, 1+logFileTypeNum*positionRecordSize)
+	if r.synced {
+		hello[0] = 1
+	}
+	hello = append(hello, encodePositions(r.positions[:])...)
+	r.Unlock()
+
+	defer func() {
+		r.Lock()
+		r.conn = nil
+		r.connected = false
+		r.Unlock()
+	}()
+
+	if err := writeFrame(conn, frameHello, hello); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		typ, payload, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case frameFullSync:
+			if err := r.db.resetForFullSync(); err != nil {
+				return err
+			}
+			r.Lock()
+			r.positions = [logFileTypeNum]Position{}
+			r.synced, r.dirty = true, true
+			r.Unlock()
+		case frameEntry:
+			dataType, pos, next, ent, err := decodeEntryFrame(payload)
+			if err != nil {
+				return err
+			}
+			if err := r.db.applyLogEntry(dataType, ent); err != nil {
+				return err
+			}
+			r.Lock()
+			r.positions[dataType] = next
+			r.dirty = true
+			if r.primaryEnd[dataType].before(pos) {
+				r.primaryEnd[dataType] = next
+			}
+			r.Unlock()
+		case frameHeartbeat:
+			if len(payload) != logFileTypeNum*positionRecordSize {
+				return ErrInvalidReplicationFrame
+			}
+			r.Lock()
+			copy(r.primaryEnd[:], decodePositions(payload))
+			r.lastHeartbeat = time.Now()
+			r.Unlock()
+		default:
+			return ErrInvalidReplicationFrame
+		}
+	}
+}
+
+func (r *replica) close() {
+	r.Lock()
+	close(r.closed)
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+	r.Unlock()
+	r.wg.Wait()
+	if err := r.savePositions(); err != nil {
+		logger.Errorf("save replication positions err: %v", err)
+	}
+}
+
+func (r *replica) savePositionsPeriodically() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(replicaSavePosInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.savePositions(); err != nil {
+				logger.Errorf("save replication positions err: %v", err)
+			}
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// format of replication file:
+// +--------+-------+--------+-------+--------+-----+
+// | synced |  fid  | offset |  fid  | offset | ... |
+// +--------+-------+--------+-------+--------+-----+
+// 0--------1-------5-------13------17-------25
+func (r *replica) savePositions() error {
+	// an in-memory replica syncs fully from the primary every time it is opened.
+	if r.db.opts.InMemory {
+		return nil
+	}
+	r.Lock()
+	if !r.dirty {
+		r.Unlock()
+		return nil
+	}
+	buf := []byte{0}
+	if r.synced {
+		buf[0] = 1
+	}
+	buf = append(buf, encodePositions(r.positions[:])...)
+	r.dirty = false
+	r.Unlock()
+
+	// entries are applied idempotently, so it is fine to lose the latest positions.
+	path := filepath.Join(r.db.opts.DBPath, replicationFileName)
+	if err := vfs.WriteFile(r.db.opts.FS, path+".tmp", buf, 0644); err != nil {
+		return err
+	}
+	return r.db.opts.FS.Rename(path+".tmp", path)
+}
+
+func (r *replica) loadPositions() error {
+	if r.db.opts.InMemory {
+		return nil
+	}
+	buf, err := vfs.ReadFile(r.db.opts.FS, filepath.Join(r.db.opts.DBPath, replicationFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(buf) != 1+logFileTypeNum*positionRecordSize {
+		return ErrInvalidReplicationFrame
+	}
+	r.synced = buf[0] == 1
+	copy(r.positions[:], decodePositions(buf[1:]))
+	return nil
+}
+
+// applyLogEntry writes the entry received from primary, and builds index the same way as loading from log files.
+// The change is published once the entry is committed, entries are applied one by one so they are still published in order.
+func (db *RoseDB) applyLogEntry(dataType DataType, ent *logfile.LogEntry) error {
+	pos, err := db.commitLogEntry(dataType, ent)
+	if err != nil {
+		return err
+	}
+	db.publishChange(dataType, ent, pos)
+	return nil
+}
+
+// commitLogEntry rebuilds the entry under the index lock, and waits until it is durable if Options.Sync is set.
+func (db *RoseDB) commitLogEntry(dataType DataType, ent *logfile.LogEntry) (_ *valuePos, err error) {
+	db.indexLock(dataType).Lock()
+	defer db.unlockWrite(dataType, &err)
+	return db.rebuildLogEntry(dataType, ent)
+}
+
+// rebuildLogEntry writes an entry from another db, and builds index for it.
+// The index lock of the data type must be held.
+func (db *RoseDB) rebuildLogEntry(dataType DataType, ent *logfile.LogEntry) (*valuePos, error) {
+	pos, err := db.appendLogEntry(ent, dataType)
+	if err != nil {
+		return nil, err
+	}
+	db.buildIndex(dataType, ent, pos, true)
+	if ent.Type == logfile.TypeDelete {
+		// the deleted entry itself is also invalid.
+		_, size := logfile.EncodeEntry(ent)
+		db.sendDiscard(&indexNode{fid: pos.fid, entrySize: size}, true, dataType)
+	}
+	return pos, nil
+}
+
+// resetForFullSync removes all data of the replica before a full sync.
+func (db *RoseDB) resetForFullSync() error {
+	defer db.lockForReset()()
+	return db.resetData()
+}
+
+// lockForReset locks the indexes of all data types for resetData, and returns the function to unlock them.
+// The running log file gcs are waited for, as they sync and delete the log files removed by resetData.
+func (db *RoseDB) lockForReset() func() {
+	for i := range db.gcMu {
+		db.gcMu[i].Lock()
+	}
+	for i := 0; i < logFileTypeNum; i++ {
+		db.indexLock(DataType(i)).Lock()
+	}
+	return func() {
+		for i := 0; i < logFileTypeNum; i++ {
+			db.indexLock(DataType(i)).Unlock()
+		}
+		for i := range db.gcMu {
+			db.gcMu[i].Unlock()
+		}
+	}
+}
+
+// resetData removes all log files and indexes, the locks of lockForReset must be held.
+func (db *RoseDB) resetData() error {
+	// lock-free reads started before the reset is done are run again, see readLatest.
+	atomic.AddUint64(&db.resets, 1)
+	defer atomic.AddUint64(&db.resets, 1)
+
+	// wait for the running syncs, and forget the synced positions as fids start over.
+	for _, gc := range db.commits {
+		gc.mu.Lock()
+		for gc.syncing {
+			gc.cond.Wait()
+		}
+		gc.synced = Position{}
+		defer gc.mu.Unlock()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for dataType, archived := range db.archivedLogFiles {
+		for fid, lf := range archived {
+			if err := lf.Delete(); err != nil {
+				return err
+			}
+			db.discards[dataType].clear(fid)
+		}
+		db.archivedLogFiles[dataType] = make(archivedFiles)
+	}
+	for dataType, active := range db.activeLogFiles {
+		if err := active.Delete(); err != nil {
+			return err
+		}
+		db.discards[dataType].clear(active.Fid)
+		delete(db.activeLogFiles, dataType)
+
+		// fids go on from the removed log files, so that positions taken before the reset are compacted ones.
+		lf, err := logfile.OpenLogFile(db.opts.FS, db.opts.DBPath, active.Fid+1, db.opts.LogFileSizeThreshold,
+			logfile.FileType(dataType), db.logIOType())
+		if err != nil {
+			return err
+		}
+		db.discards[dataType].setTotal(lf.Fid, uint32(db.opts.LogFileSizeThreshold))
+		db.activeLogFiles[dataType] = lf
+	}
+
+	db.strIndex.reset()
+	db.listIndex.reset()
+	db.hashIndex.reset()
+	db.setIndex.reset()
+	db.zsetIndex.reset()
+	db.zsetIndex.indexes = zset.New()
+
+	// subscribers and replicas resync from scratch.
+	db.dropQueuedChanges()
+	db.closeSubscriptionsWithErr(ErrDataReset)
+	return nil
+}
+
+// indexLock returns the lock of the whole index of the data type, see keyLocks.
+func (db *RoseDB) indexLock(dataType DataType) *sync.RWMutex {
+	return db.keyLocksOf(dataType).mu
+}
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = typ
+	binary.LittleEndian.PutUint32(buf[1:frameHeaderSize], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// format of entry frame payload:
+// +-----------+-------+--------+-------------+---------------+
+// | data type |  fid  | offset | next offset | encoded entry |
+// +-----------+-------+--------+-------------+---------------+
+// 0-----------1-------5-------13------------21
+func encodeEntryFrame(ev *ChangeEvent) []byte {
+	entBuf, _ := logfile.EncodeEntry(ev.entry)
+	buf := make([]byte, 21+len(entBuf))
+	buf[0] = byte(ev.DataType)
+	binary.LittleEndian.PutUint32(buf[1:5], ev.Pos.Fid)
+	binary.LittleEndian.PutUint64(buf[5:13], uint64(ev.Pos.Offset))
+	binary.LittleEndian.PutUint64(buf[13:21], uint64(ev.Next.Offset))
+	copy(buf[21:], entBuf)
+	return buf
+}
+
+func decodeEntryFrame(buf []byte) (DataType, Position, Position, *logfile.LogEntry, error) {
+	var pos, next Position
+	if len(buf) < 21 || int(buf[0]) >= logFileTypeNum {
+		return 0, pos, next, nil, ErrInvalidReplicationFrame
+	}
+	dataType := DataType(buf[0])
+	fid := binary.LittleEndian.Uint32(buf[1:5])
+	pos = Position{DataType: dataType, Fid: fid, Offset: int64(binary.LittleEndian.Uint64(buf[5:13]))}
+	next = Position{DataType: dataType, Fid: fid, Offset: int64(binary.LittleEndian.Uint64(buf[13:21]))}
+	ent, err := logfile.DecodeEntry(buf[21:])
+	if err != nil {
+		return 0, pos, next, nil, err
+	}
+	return dataType, pos, next, ent, nil
+}
+
+func encodePositions(positions []Position) []byte {
+	buf := make([]byte, len(positions)*positionRecordSize)
+	for i, pos := range positions {
+		off := i * positionRecordSize
+		binary.LittleEndian.PutUint32(buf[off:off+4], pos.Fid)
+		binary.LittleEndian.PutUint64(buf[off+4:off+positionRecordSize], uint64(pos.Offset))
+	}
+	return buf
+}
+
+func decodePositions(buf []byte) []Position {
+	positions := make([]Position, len(buf)/positionRecordSize)
+	for i := range positions {
+		off := i * positionRecordSize
+		positions[i] = Position{
+			DataType: DataType(i),
+			Fid:      binary.LittleEndian.Uint32(buf[off : off+4]),
+			Offset:   int64(binary.LittleEndian.Uint64(buf[off+4 : off+positionRecordSize])),
+		}
+	}
+	return positions
+}
@@ -0,0 +1,95 @@
+package kv_engine
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoseDB_Replication(t *testing.T) {
+	primary, err := Open(DefaultOptions(filepath.Join("/tmp", "rosedb-primary")))
+	assert.Nil(t, err)
+	defer destroyDB(primary)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go primary.ServeReplication(ln)
+
+	// data written before the replica starts will be synced at first.
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, primary.Set(GetKey(i), GetValue16B()))
+	}
+	assert.Nil(t, primary.HSet([]byte("hash"), []byte("field"), []byte("value")))
+	assert.Nil(t, primary.RPush([]byte("list"), []byte("a"), []byte("b")))
+	assert.Nil(t, primary.Delete(GetKey(0)))
+
+	replicaOpts := DefaultOptions(filepath.Join("/tmp", "rosedb-replica"))
+	replicaOpts.ReplicaOf = ln.Addr().String()
+	replica, err := Open(replicaOpts)
+	assert.Nil(t, err)
+	defer destroyDB(replica)
+
+	assert.Nil(t, primary.Set([]byte("new-key"), []byte("new-value")))
+	waitReplicated(t, replica, []byte("new-key"))
+
+	v, err := replica.Get(GetKey(1))
+	assert.Nil(t, err)
+	expected, _ := primary.Get(GetKey(1))
+	assert.Equal(t, expected, v)
+	_, err = replica.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v, err = replica.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), v)
+	values, err := replica.LRange([]byte("list"), 0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, values)
+
+	assert.Equal(t, ErrReplicaReadOnly, replica.Set(GetKey(1), GetValue16B()))
+
+	status := replica.ReplicationStatus()
+	assert.True(t, status.IsReplica)
+	assert.True(t, status.Connected)
+	assert.Equal(t, 1, primary.ReplicationStatus().Replicas)
+
+	// restart the replica, it resumes from the saved positions.
+	assert.Nil(t, replica.Close())
+	assert.Nil(t, primary.Set([]byte("offline-key"), []byte("offline-value")))
+	replica, err = Open(replicaOpts)
+	assert.Nil(t, err)
+	waitReplicated(t, replica, []byte("offline-key"))
+	v, err = replica.Get([]byte("new-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), v)
+
+	// the replica does a full sync after the primary is flushed, even if the primary writes past its positions.
+	assert.Nil(t, primary.FlushAll())
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, primary.Set(GetKey(1000+i), GetValue16B()))
+	}
+	assert.Nil(t, primary.Set([]byte("flushed-key"), []byte("v")))
+	waitReplicated(t, replica, []byte("flushed-key"))
+	_, err = replica.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = replica.Get([]byte("new-key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v, err = replica.HGet([]byte("hash"), []byte("field"))
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+	assert.Nil(t, replica.Close())
+}
+
+func waitReplicated(t *testing.T, replica *RoseDB, key []byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := replica.Get(key); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("key %s is not replicated", key)
+}
@@ -0,0 +1,191 @@
+package kv_engine
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/reid00/kv_engine/logfile"
+)
+
+var indexNodeSize = int64(unsafe.Sizeof(indexNode{}))
+
+// MemSize returns the memory of the index node, which is counted in the memory of index, see art.Sizer.
+func (n *indexNode) MemSize() int64 {
+	return indexNodeSize + int64(len(n.value))
+}
+
+// Stats is a point-in-time view of the engine internals.
+type Stats struct {
+	// DataTypes stats of each data type.
+	DataTypes map[DataType]*DataTypeStats
+
+	// DiskBytes total size of log files on disk.
+	DiskBytes int64
+
+	// IndexMemory estimated memory used by the indexes of all data types.
+	IndexMemory int64
+
+	// Degraded the write failure which degraded the db to read-only, nil if writes are allowed, see RoseDB.Recover.
+	Degraded error
+
+	// DegradedSince the time the db was degraded, zero if it is not.
+	DegradedSince time.Time
+}
+
+// DataTypeStats stats of the log files and index of a data type.
+type DataTypeStats struct {
+	// Keys number of keys, expired keys which are not deleted yet are included.
+	Keys int
+
+	// Entries number of entries in the index, which are fields of hashes, elements of lists and members of sets and zsets.
+	// Same as Keys for String.
+	Entries int
+
+	// ActiveLogFiles and ArchivedLogFiles number of log files.
+	ActiveLogFiles   int
+	ArchivedLogFiles int
+
+	// DiskBytes total size of log files on disk.
+	DiskBytes int64
+
+	// Discards total and discarded size of each log file, from the discard file.
+	// Nil in read-only mode.
+	Discards []FileDiscard
+
+	// DiscardDropped number of discarded entries not recorded because the discard channel is full.
+	// Log files of them are less likely to be chosen by log file gc.
+	DiscardDropped uint64
+
+	// Syncs number of fsyncs of active log file made by group commit and background sync.
+	Syncs uint64
+
+	// GCRuns number of log file gc runs.
+	GCRuns uint64
+
+	// GCFiles number of log files removed by log file gc.
+	GCFiles uint64
+
+	// GCReclaimedBytes bytes freed by log file gc, the valid entries rewritten to active log file are excluded.
+	GCReclaimedBytes int64
+
+	// LastGC start time of the last log file gc, zero if never run.
+	LastGC time.Time
+
+	// IndexMemory estimated memory used by the index, including keys and values in KeyValueMemMode.
+	IndexMemory int64
+}
+
+// FileDiscard total and discarded size of a log file.
+type FileDiscard struct {
+	Fid       uint32
+	Total     int64
+	Discarded int64
+	Ratio     float64
+}
+
+// metrics are the counters updated by the engine, fields are accessed atomically.
+type metrics struct {
+	gc [logFileTypeNum]gcMetrics
+}
+
+type gcMetrics struct {
+	runs      uint64
+	files     uint64
+	reclaimed int64
+	lastRun   int64
+}
+
+func (m *metrics) gcStarted(dataType DataType) {
+	atomic.AddUint64(&m.gc[dataType].runs, 1)
+	atomic.StoreInt64(&m.gc[dataType].lastRun, time.Now().UnixNano())
+}
+
+func (m *metrics) gcFileRemoved(dataType DataType, reclaimed int64) {
+	atomic.AddUint64(&m.gc[dataType].files, 1)
+	if reclaimed > 0 {
+		atomic.AddInt64(&m.gc[dataType].reclaimed, reclaimed)
+	}
+}
+
+// Stats returns the stats of the engine.
+// The stats of indexes are counted by the writes, so it neither iterates the indexes nor blocks the writes.
+func (db *RoseDB) Stats() (*Stats, error) {
+	stats := &Stats{DataTypes: make(map[DataType]*DataTypeStats)}
+	for dataType := String; dataType < logFileTypeNum; dataType++ {
+		st, err := db.dataTypeStats(dataType)
+		if err != nil {
+			return nil, err
+		}
+		stats.DataTypes[dataType] = st
+		stats.DiskBytes += st.DiskBytes
+		stats.IndexMemory += st.IndexMemory
+	}
+	if state := db.degradedState(); state != nil {
+		stats.Degraded, stats.DegradedSince = state.err, state.since
+	}
+	return stats, nil
+}
+
+func (db *RoseDB) dataTypeStats(dataType DataType) (*DataTypeStats, error) {
+	st := &DataTypeStats{}
+	db.indexStats(dataType, st)
+	if err := db.logFileStats(dataType, st); err != nil {
+		return nil, err
+	}
+
+	st.Syncs = atomic.LoadUint64(&db.commits[dataType].syncs)
+
+	gc := &db.metrics.gc[dataType]
+	st.GCRuns = atomic.LoadUint64(&gc.runs)
+	st.GCFiles = atomic.LoadUint64(&gc.files)
+	st.GCReclaimedBytes = atomic.LoadInt64(&gc.reclaimed)
+	if lastRun := atomic.LoadInt64(&gc.lastRun); lastRun > 0 {
+		st.LastGC = time.Unix(0, lastRun)
+	}
+
+	if dis := db.discards[dataType]; dis != nil {
+		records, err := dis.records()
+		if err != nil {
+			return nil, err
+		}
+		st.Discards = records
+		st.DiscardDropped = atomic.LoadUint64(&dis.dropped)
+	}
+	return st, nil
+}
+
+func (db *RoseDB) indexStats(dataType DataType, st *DataTypeStats) {
+	counter := db.indexCounter(dataType)
+	st.Entries = int(counter.Entries())
+	st.IndexMemory = counter.Memory()
+	if dataType == String {
+		// a tree of strings is a shard of keys.
+		st.Keys = st.Entries
+	} else {
+		st.Keys = int(counter.Keys())
+	}
+}
+
+func (db *RoseDB) logFileStats(dataType DataType, st *DataTypeStats) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	lfs := make([]*logfile.LogFile, 0, len(db.archivedLogFiles[dataType])+1)
+	if active := db.activeLogFiles[dataType]; active != nil {
+		st.ActiveLogFiles = 1
+		lfs = append(lfs, active)
+	}
+	for _, lf := range db.archivedLogFiles[dataType] {
+		st.ArchivedLogFiles++
+		lfs = append(lfs, lf)
+	}
+	for _, lf := range lfs {
+		size, err := lf.Size()
+		if err != nil {
+			return err
+		}
+		st.DiskBytes += size
+	}
+	return nil
+}
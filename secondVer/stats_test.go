@@ -0,0 +1,163 @@
+package kv_engine
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoseDB_Stats(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-stats")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 1 << 20
+	opts.LogFileGCInterval = 0
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue128B()))
+	}
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Delete(GetKey(i)))
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.HSet([]byte("hash"), GetKey(i), GetValue16B()))
+	}
+	assert.Nil(t, db.LPush([]byte("list"), GetValue16B(), GetValue16B()))
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	strs := stats.DataTypes[String]
+	assert.Equal(t, 5000, strs.Keys)
+	assert.Equal(t, 1, strs.ActiveLogFiles)
+	assert.True(t, strs.ArchivedLogFiles > 0)
+	assert.Equal(t, int64(strs.ActiveLogFiles+strs.ArchivedLogFiles)*opts.LogFileSizeThreshold, strs.DiskBytes)
+	assert.True(t, strs.IndexMemory > 0)
+	assert.Equal(t, 1, stats.DataTypes[Hash].Keys)
+	assert.Equal(t, 10, stats.DataTypes[Hash].Entries)
+	assert.Equal(t, 1, stats.DataTypes[List].Keys)
+	assert.Equal(t, 2, stats.DataTypes[List].Entries)
+	assert.Equal(t, 0, stats.DataTypes[Set].Keys)
+
+	// discard records are updated asynchronously.
+	time.Sleep(100 * time.Millisecond)
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	strs = stats.DataTypes[String]
+	assert.Equal(t, strs.ActiveLogFiles+strs.ArchivedLogFiles, len(strs.Discards))
+	first := strs.Discards[0]
+	assert.True(t, first.Discarded > 0)
+	assert.Equal(t, float64(first.Discarded)/float64(first.Total), first.Ratio)
+
+	assert.Nil(t, db.RunLogFileGC(String, int(first.Fid), 0.1))
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), stats.DataTypes[String].GCRuns)
+	assert.Equal(t, uint64(1), stats.DataTypes[String].GCFiles)
+	assert.True(t, stats.DataTypes[String].GCReclaimedBytes > 0)
+	assert.False(t, stats.DataTypes[String].LastGC.IsZero())
+	assert.Equal(t, strs.ArchivedLogFiles-1, stats.DataTypes[String].ArchivedLogFiles)
+}
+
+// countIndex counts the keys and entries of the index of the data type by iterating it.
+func countIndex(db *RoseDB, dataType DataType) (keys, entries int) {
+	if dataType == String {
+		size := db.strIndex.size()
+		return size, size
+	}
+	var ci *collIndex
+	switch dataType {
+	case List:
+		ci = db.listIndex.collIndex
+	case Hash:
+		ci = db.hashIndex.collIndex
+	}
+	for _, tree := range ci.trees {
+		size := tree.Size()
+		if dataType == List {
+			size--
+		}
+		if size > 0 {
+			keys++
+			entries += size
+		}
+	}
+	return
+}
+
+func TestRoseDB_StatsCounters(t *testing.T) {
+	opts := DefaultOptions(filepath.Join("/tmp", "kv_engine-stats"))
+	opts.IndexMode = KeyValueMemMode
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	check := func() {
+		t.Helper()
+		stats, err := db.Stats()
+		assert.Nil(t, err)
+		for _, dataType := range []DataType{String, List, Hash} {
+			keys, entries := countIndex(db, dataType)
+			assert.Equal(t, keys, stats.DataTypes[dataType].Keys, dataType)
+			assert.Equal(t, entries, stats.DataTypes[dataType].Entries, dataType)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+		assert.Nil(t, db.HSet([]byte("hash"), GetKey(i), GetValue16B()))
+		assert.Nil(t, db.RPush(GetKey(i%3), GetValue16B()))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B()))
+		assert.Nil(t, db.Delete(GetKey(i+50)))
+		_, err = db.HDel([]byte("hash"), GetKey(i))
+		assert.Nil(t, err)
+	}
+	// a list with only its meta left is not counted.
+	for i := 0; i < 34; i++ {
+		_, err = db.LPop(GetKey(0))
+		assert.Nil(t, err)
+	}
+	check()
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 50, stats.DataTypes[String].Keys)
+	assert.Equal(t, 2, stats.DataTypes[List].Keys)
+
+	// the memory of values is counted, which are kept in the index in KeyValueMemMode.
+	memory := stats.DataTypes[String].IndexMemory
+	assert.Nil(t, db.Set(GetKey(0), GetValue128B()))
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, memory+int64(len(GetValue128B())-len(GetValue16B())), stats.DataTypes[String].IndexMemory)
+
+	// the counters are rebuilt with the index.
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check()
+	assert.Nil(t, db.FlushAll())
+	check()
+
+	// stats are returned while writers hold all the locks.
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		_, err := db.Stats()
+		assert.Nil(t, err)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("stats are blocked by the writers")
+	}
+}
@@ -2,48 +2,84 @@ package kv_engine
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"math"
 	"strconv"
 	"time"
 
+	"github.com/reid00/kv_engine/ds/art"
 	"github.com/reid00/kv_engine/logfile"
-	"github.com/reid00/kv_engine/logger"
 	"github.com/reid00/kv_engine/util"
 )
 
 // Set set key to hold the string value. If key already holds a value, it is overwritten.
 // Any previous time to live associated with the key is discarded on successful Set operation.
 func (db *RoseDB) Set(key, value []byte) error {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.SetCtx(context.Background(), key, value)
+}
+
+// SetCtx is like Set, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) SetCtx(ctx context.Context, key, value []byte) error {
+	return db.SetWithOptions(ctx, key, value, WriteOptions{})
+}
+
+// SetWithOptions is like SetCtx, with the durability and TTL of the write specified by opts.
+func (db *RoseDB) SetWithOptions(ctx context.Context, key, value []byte, opts WriteOptions) (err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync || opts.Sync, &err)
 
 	// write entry to log file
-	entry := &logfile.LogEntry{Key: key, Value: value}
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpireAt: opts.expireAt(nowOf(ctx))}
 	valuePos, err := db.writeLogEntry(entry, String)
 	if err != nil {
 		return err
 	}
 
 	// set String index info, stored at adaptive radix tree.
-	err = db.updateIndexTree(entry, valuePos, true, String)
+	err = db.updateIndexTree(db.strIndex.tree(entry.Key), entry, valuePos, true, String)
 	return err
 }
 
 // Get get the value of key. If the key does not exist an error is returned.
 func (db *RoseDB) Get(key []byte) ([]byte, error) {
-	db.strIndex.mu.RLock()
-	defer db.strIndex.mu.RUnlock()
+	return db.GetCtx(context.Background(), key)
+}
 
-	return db.getVal(key, String)
+// GetCtx is like Get, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) GetCtx(ctx context.Context, key []byte) ([]byte, error) {
+	if db.opts.LockFreeReads {
+		return db.readLatest(func() *art.Snapshot { return db.strIndex.snapshotOf(key) }, func(idxTree indexReader) ([]byte, error) {
+			return db.getVal(idxTree, key, String, nowOf(ctx))
+		})
+	}
+	held, err := db.strIndex.lockKeys(ctx, false, key)
+	if err != nil {
+		return nil, err
+	}
+	defer held.unlock()
+
+	return db.getVal(db.strIndex.tree(key), key, String, nowOf(ctx))
 }
 
 // MGet get the values of all specified keys.
 // If the key that does not hold a string value or does not exist, nil is returned.
 func (db *RoseDB) MGet(keys [][]byte) ([][]byte, error) {
-	db.strIndex.mu.RLock()
-	defer db.strIndex.mu.RUnlock()
+	return db.MGetCtx(context.Background(), keys)
+}
+
+// MGetCtx is like MGet, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+// The scan is also stopped once ctx is done.
+func (db *RoseDB) MGetCtx(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	held, err := db.strIndex.lockKeys(ctx, false, keys...)
+	if err != nil {
+		return nil, err
+	}
+	defer held.unlock()
 
 	if len(keys) == 0 {
 		return nil, ErrWrongNumberOfArgs
@@ -51,7 +87,10 @@ func (db *RoseDB) MGet(keys [][]byte) ([][]byte, error) {
 
 	values := make([][]byte, len(keys))
 	for i, key := range keys {
-		val, err := db.getVal(key, String)
+		if err := checkCtx(ctx, i); err != nil {
+			return nil, err
+		}
+		val, err := db.getVal(db.strIndex.tree(key), key, String, nowOf(ctx))
 		if err != nil && !errors.Is(err, ErrKeyNotFound) {
 			return nil, err
 		}
@@ -63,117 +102,185 @@ func (db *RoseDB) MGet(keys [][]byte) ([][]byte, error) {
 // GetDel gets the value of the key and deletes the key. This method is similar
 // to Get method. It also deletes the key if it exists.
 func (db *RoseDB) GetDel(key []byte) ([]byte, error) {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.GetDelCtx(context.Background(), key)
+}
+
+// GetDelCtx is like GetDel, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) GetDelCtx(ctx context.Context, key []byte) (_ []byte, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return nil, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync, &err)
 
-	val, err := db.getVal(key, String)
+	val, err := db.getVal(db.strIndex.tree(key), key, String, nowOf(ctx))
 	if err != nil && !errors.Is(err, ErrKeyNotFound) {
 		return nil, err
 	}
 	if val == nil {
 		return nil, nil
 	}
-
-	entry := &logfile.LogEntry{Key: key, Type: logfile.TypeDelete}
-	pos, err := db.writeLogEntry(entry, String)
-	if err != nil {
+	if err = db.deleteStr(key); err != nil {
 		return nil, err
 	}
-	valDeleted, updated := db.strIndex.idxTree.Delete(key)
-	db.sendDiscard(valDeleted, updated, String)
-
-	_, size := logfile.EncodeEntry(entry)
-	node := &indexNode{fid: pos.fid, entrySize: size}
-	select {
-	case db.discards[String].valChan <- node:
-	default:
-		logger.Warn("send to discard chan fail")
-	}
 	return val, nil
 }
 
 // Delete value at the given key.
 func (db *RoseDB) Delete(key []byte) error {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx is like Delete, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) DeleteCtx(ctx context.Context, key []byte) error {
+	return db.DeleteWithOptions(ctx, key, WriteOptions{})
+}
+
+// DeleteWithOptions is like DeleteCtx, with the durability of the write specified by opts, TTL is ignored.
+func (db *RoseDB) DeleteWithOptions(ctx context.Context, key []byte, opts WriteOptions) (err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync || opts.Sync, &err)
+	return db.deleteStr(key)
+}
 
+// deleteStr writes the deleted entry of key and removes it from the index, the lock of the key must be held.
+func (db *RoseDB) deleteStr(key []byte) error {
 	entry := &logfile.LogEntry{Key: key, Type: logfile.TypeDelete}
 	pos, err := db.writeLogEntry(entry, String)
 	if err != nil {
 		return err
 	}
 	// 原先的旧值需要回收
-	val, updated := db.strIndex.idxTree.Delete(key)
+	val, updated := db.strIndex.tree(key).Delete(key)
 	db.sendDiscard(val, updated, String)
 	// the deleted entry itself is also invalid.
 	// 新写入的deletedEntry 也要被回收
 	_, size := logfile.EncodeEntry(entry)
 	node := &indexNode{fid: pos.fid, entrySize: size}
-	select {
-	case db.discards[String].valChan <- node:
-	default:
-		logger.Warn("send to discard chan fail")
-	}
+	db.discards[String].send(node)
 	return nil
 }
 
 // SetEX set key to hold the string value and set key to timeout after the given duration.
 func (db *RoseDB) SetEX(key, value []byte, duration time.Duration) error {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.SetEXCtx(context.Background(), key, value, duration)
+}
+
+// SetEXCtx is like SetEX, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) SetEXCtx(ctx context.Context, key, value []byte, duration time.Duration) (err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync, &err)
 
-	expiredAt := time.Now().Add(duration).Unix()
+	expiredAt := timeOf(ctx).Add(duration).UnixMilli()
 	entry := &logfile.LogEntry{Key: key, Value: value, ExpireAt: expiredAt}
 	valuePos, err := db.writeLogEntry(entry, String)
 	if err != nil {
 		return err
 	}
-	err = db.updateIndexTree(entry, valuePos, true, String)
+	err = db.updateIndexTree(db.strIndex.tree(entry.Key), entry, valuePos, true, String)
 	return err
 }
 
-// SetNX sets the key-value pair if it is not exist. It returns nil if the key already exists.
+// SetNX sets the key-value pair if it is not exist. It returns nil and leaves the value unchanged if the key already exists.
 func (db *RoseDB) SetNX(key, value []byte) error {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.SetNXCtx(context.Background(), key, value)
+}
 
-	val, err := db.getVal(key, String)
+// SetNXCtx is like SetNX, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) SetNXCtx(ctx context.Context, key, value []byte) error {
+	_, _, err := db.SetWithArgs(ctx, key, value, WriteOptions{}, SetArgs{NX: true})
+	return err
+}
+
+// SetArgs the conditions of SetWithArgs, like the options of redis SET command.
+type SetArgs struct {
+	// NX set the key only if it does not exist.
+	NX bool
+
+	// XX set the key only if it already exists.
+	XX bool
+
+	// KeepTTL retain the time to live of the existing key, the TTL of WriteOptions is used if the key does not exist.
+	KeepTTL bool
+}
+
+// SetWithArgs is like SetWithOptions, but the key is set only if the conditions of args are met.
+// It returns the old value of key, which is nil if the key does not exist, and whether the key is set.
+func (db *RoseDB) SetWithArgs(ctx context.Context, key, value []byte, opts WriteOptions, args SetArgs) (old []byte, set bool, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return nil, false, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync || opts.Sync, &err)
+
+	idxTree := db.strIndex.tree(key)
+	now := nowOf(ctx)
+	old, err = db.getVal(idxTree, key, String, now)
 	if err != nil && !errors.Is(err, ErrKeyNotFound) {
-		return err
+		return nil, false, err
 	}
-	// key not exist
-	if val == nil {
-		return nil
+	exist := err == nil
+	if (args.NX && exist) || (args.XX && !exist) {
+		return old, false, nil
 	}
 
-	entry := &logfile.LogEntry{Key: key, Value: value}
+	expireAt := opts.expireAt(now)
+	if args.KeepTTL && exist {
+		if idxNode, _ := idxTree.Get(key).(*indexNode); idxNode != nil {
+			expireAt = idxNode.expiredAt
+		}
+	}
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpireAt: expireAt}
 	valuePos, err := db.writeLogEntry(entry, String)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-
-	return db.updateIndexTree(entry, valuePos, true, String)
+	if err = db.updateIndexTree(idxTree, entry, valuePos, true, String); err != nil {
+		return nil, false, err
+	}
+	return old, true, nil
 }
 
 // MSet is multiple set command. Parameter order should be like "key", "value", "key", "value", ...
 func (db *RoseDB) MSet(args ...[]byte) error {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.MSetCtx(context.Background(), args...)
+}
+
+// MSetCtx is like MSet, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) MSetCtx(ctx context.Context, args ...[]byte) error {
+	return db.MSetWithOptions(ctx, WriteOptions{}, args...)
+}
+
+// MSetWithOptions is like MSetCtx, with the durability and TTL of the writes specified by opts.
+// All the key-value pairs are covered by a single sync.
+func (db *RoseDB) MSetWithOptions(ctx context.Context, opts WriteOptions, args ...[]byte) (err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, pairKeys(args)...)
+	if err != nil {
+		return err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync || opts.Sync, &err)
 
 	if len(args) == 0 || len(args)&1 == 1 {
 		return ErrWrongNumberOfArgs
 	}
 
 	// add multiple key-value pairs
+	expireAt := opts.expireAt(nowOf(ctx))
 	for i := 0; i < len(args); i += 2 {
 		key, value := args[i], args[i+1]
-		entry := &logfile.LogEntry{Key: key, Value: value}
+		entry := &logfile.LogEntry{Key: key, Value: value, ExpireAt: expireAt}
 		valuePos, err := db.writeLogEntry(entry, String)
 		if err != nil {
 			return err
 		}
 
-		err = db.updateIndexTree(entry, valuePos, true, String)
+		err = db.updateIndexTree(db.strIndex.tree(entry.Key), entry, valuePos, true, String)
 		if err != nil {
 			return err
 		}
@@ -184,29 +291,46 @@ func (db *RoseDB) MSet(args ...[]byte) error {
 // MSetNX sets given keys to their respective values. MSetNX will not perform
 // any operation at all even if just a single key already exists.
 func (db *RoseDB) MSetNX(args ...[]byte) error {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.MSetNXCtx(context.Background(), args...)
+}
+
+// MSetNXCtx is like MSetNX, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) MSetNXCtx(ctx context.Context, args ...[]byte) error {
+	_, err := db.MSetNXWithOptions(ctx, WriteOptions{}, args...)
+	return err
+}
+
+// MSetNXWithOptions is like MSetNXCtx, with the durability and TTL of the writes specified by opts.
+// It returns whether the keys are set, which is false if any of them already exists.
+func (db *RoseDB) MSetNXWithOptions(ctx context.Context, opts WriteOptions, args ...[]byte) (_ bool, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, pairKeys(args)...)
+	if err != nil {
+		return false, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync || opts.Sync, &err)
 
 	if len(args) == 0 || len(args)&1 == 1 {
-		return ErrWrongNumberOfArgs
+		return false, ErrWrongNumberOfArgs
 	}
 
 	// check key whether exists
+	now := nowOf(ctx)
 	for i := 0; i < len(args); i += 2 {
 		key := args[i]
-		val, err := db.getVal(key, String)
+		val, err := db.getVal(db.strIndex.tree(key), key, String, now)
 		if err != nil && !errors.Is(err, ErrKeyNotFound) {
-			return err
+			return false, err
 		}
 
 		// Key exists in db. We discard the rest of the key-value pairs. It
 		// provides the atomicity of the method.
 		if val != nil {
-			return nil
+			return false, nil
 		}
 	}
 
 	var addedKeys = make(map[uint64]struct{})
+	expireAt := opts.expireAt(now)
 	// set values for keys
 	for i := 0; i < len(args); i += 2 {
 		key, value := args[i], args[i+1]
@@ -215,29 +339,45 @@ func (db *RoseDB) MSetNX(args ...[]byte) error {
 			continue
 		}
 
-		entry := &logfile.LogEntry{Key: key, Value: value}
+		entry := &logfile.LogEntry{Key: key, Value: value, ExpireAt: expireAt}
 		valPos, err := db.writeLogEntry(entry, String)
 		if err != nil {
-			return err
+			return false, err
 		}
-		err = db.updateIndexTree(entry, valPos, true, String)
+		err = db.updateIndexTree(db.strIndex.tree(entry.Key), entry, valPos, true, String)
 		if err != nil {
-			return err
+			return false, err
 		}
 		addedKeys[h] = struct{}{}
 	}
-	return nil
+	return true, nil
 }
 
 // Append appends the value at the end of the old value if key already exists.
 // It will be similar to Set if key does not exist.
 func (db *RoseDB) Append(key, value []byte) error {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.AppendCtx(context.Background(), key, value)
+}
+
+// AppendCtx is like Append, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) AppendCtx(ctx context.Context, key, value []byte) error {
+	_, err := db.AppendWithOptions(ctx, key, value, WriteOptions{})
+	return err
+}
 
-	oldVal, err := db.getVal(key, String)
+// AppendWithOptions is like AppendCtx, with the durability and TTL of the write specified by opts.
+// It returns the length of the value after the append.
+func (db *RoseDB) AppendWithOptions(ctx context.Context, key, value []byte, opts WriteOptions) (_ int, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync || opts.Sync, &err)
+
+	now := nowOf(ctx)
+	oldVal, err := db.getVal(db.strIndex.tree(key), key, String, now)
 	if err != nil && !errors.Is(err, ErrKeyNotFound) {
-		return err
+		return 0, err
 	}
 
 	// key exists
@@ -246,14 +386,16 @@ func (db *RoseDB) Append(key, value []byte) error {
 	}
 
 	// write entry to log file
-	entry := &logfile.LogEntry{Key: key, Value: value}
+	entry := &logfile.LogEntry{Key: key, Value: value, ExpireAt: opts.expireAt(now)}
 	valuePos, err := db.writeLogEntry(entry, String)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	err = db.updateIndexTree(entry, valuePos, true, String)
-	return err
+	if err = db.updateIndexTree(db.strIndex.tree(entry.Key), entry, valuePos, true, String); err != nil {
+		return 0, err
+	}
+	return len(value), nil
 }
 
 // Decr decrements the number stored at key by one. If the key does not exist,
@@ -261,10 +403,18 @@ func (db *RoseDB) Append(key, value []byte) error {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after decrementing the value.
 func (db *RoseDB) Decr(key []byte) (int64, error) {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
+	return db.DecrCtx(context.Background(), key)
+}
+
+// DecrCtx is like Decr, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) DecrCtx(ctx context.Context, key []byte) (_ int64, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync, &err)
 
-	return db.incrDecrBy(key, -1)
+	return db.incrDecrBy(key, -1, nowOf(ctx))
 }
 
 // DecrBy decrements the number stored at key by decr. If the key doesn't
@@ -272,9 +422,17 @@ func (db *RoseDB) Decr(key []byte) (int64, error) {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after decrementing the value.
 func (db *RoseDB) DecrBy(key []byte, decr int64) (int64, error) {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
-	return db.incrDecrBy(key, -decr)
+	return db.DecrByCtx(context.Background(), key, decr)
+}
+
+// DecrByCtx is like DecrBy, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) DecrByCtx(ctx context.Context, key []byte, decr int64) (_ int64, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync, &err)
+	return db.incrDecrBy(key, -decr, nowOf(ctx))
 }
 
 // Incr increments the number stored at key by one. If the key does not exist,
@@ -282,9 +440,17 @@ func (db *RoseDB) DecrBy(key []byte, decr int64) (int64, error) {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after incrementing the value.
 func (db *RoseDB) Incr(key []byte) (int64, error) {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
-	return db.incrDecrBy(key, 1)
+	return db.IncrCtx(context.Background(), key)
+}
+
+// IncrCtx is like Incr, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) IncrCtx(ctx context.Context, key []byte) (_ int64, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync, &err)
+	return db.incrDecrBy(key, 1, nowOf(ctx))
 }
 
 // IncrBy increments the number stored at key by incr. If the key doesn't
@@ -292,14 +458,22 @@ func (db *RoseDB) Incr(key []byte) (int64, error) {
 // error if the value is not integer type. Also, it returns ErrIntegerOverflow
 // error if the value exceeds after incrementing the value.
 func (db *RoseDB) IncrBy(key []byte, incr int64) (int64, error) {
-	db.strIndex.mu.Lock()
-	defer db.strIndex.mu.Unlock()
-	return db.incrDecrBy(key, incr)
+	return db.IncrByCtx(context.Background(), key, incr)
+}
+
+// IncrByCtx is like IncrBy, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) IncrByCtx(ctx context.Context, key []byte, incr int64) (_ int64, err error) {
+	held, err := db.strIndex.lockKeys(ctx, true, key)
+	if err != nil {
+		return 0, err
+	}
+	defer db.unlockKeysWrite(String, held, db.opts.Sync, &err)
+	return db.incrDecrBy(key, incr, nowOf(ctx))
 }
 
-// incrDecrBy is a helper method for Incr, IncrBy, Decr, and DecrBy methods. It updates the key by incr.
-func (db *RoseDB) incrDecrBy(key []byte, incr int64) (int64, error) {
-	val, err := db.getVal(key, String)
+// incrDecrBy is a helper method for Incr, IncrBy, Decr, and DecrBy methods. It updates the key live at now by incr.
+func (db *RoseDB) incrDecrBy(key []byte, incr int64, now int64) (int64, error) {
+	val, err := db.getVal(db.strIndex.tree(key), key, String, now)
 	if err != nil && !errors.Is(err, ErrKeyNotFound) {
 		return 0, err
 	}
@@ -326,7 +500,7 @@ func (db *RoseDB) incrDecrBy(key []byte, incr int64) (int64, error) {
 		return 0, err
 	}
 
-	err = db.updateIndexTree(entry, valuePos, true, String)
+	err = db.updateIndexTree(db.strIndex.tree(entry.Key), entry, valuePos, true, String)
 	if err != nil {
 		return 0, err
 	}
@@ -337,13 +511,31 @@ func (db *RoseDB) incrDecrBy(key []byte, incr int64) (int64, error) {
 // StrLen returns the length of the string value stored at key. If the key
 // doesn't exist, it returns 0.
 func (db *RoseDB) StrLen(key []byte) int {
-	db.strIndex.mu.RLock()
-	defer db.strIndex.mu.RUnlock()
+	v, _ := db.StrLenCtx(context.Background(), key)
+	return v
+}
 
-	val, err := db.getVal(key, String)
+// StrLenCtx is like StrLen, but gives up waiting for the lock and returns ctx.Err() once ctx is done.
+func (db *RoseDB) StrLenCtx(ctx context.Context, key []byte) (int, error) {
+	held, err := db.strIndex.lockKeys(ctx, false, key)
 	if err != nil {
-		return 0
+		return 0, err
+	}
+	defer held.unlock()
+
+	val, err := db.getVal(db.strIndex.tree(key), key, String, nowOf(ctx))
+	if err != nil {
+		return 0, nil
 	}
 
-	return binary.Size(val)
+	return binary.Size(val), nil
+}
+
+// pairKeys returns the keys of key-value pairs.
+func pairKeys(args [][]byte) [][]byte {
+	keys := make([][]byte, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+	}
+	return keys
 }
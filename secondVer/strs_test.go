@@ -2,12 +2,15 @@ package kv_engine
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"math"
 	"math/rand"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -436,6 +439,30 @@ func testRoseDBSetEx(t *testing.T, mode DataIndexMode) {
 	assert.Equal(t, ErrKeyNotFound, err)
 }
 
+func TestRoseDB_Set_MilliTTL(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	// the expiration is kept in milliseconds, and so it is after reopening.
+	assert.Nil(t, db.SetWithOptions(context.Background(), GetKey(1), GetValue16B(), WriteOptions{TTL: time.Millisecond * 1500}))
+	assert.Nil(t, db.Close())
+	db, err = Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	ttl, err := db.TTL(GetKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Second && ttl <= time.Millisecond*1500, ttl)
+
+	assert.Nil(t, db.SetWithOptions(context.Background(), GetKey(2), GetValue16B(), WriteOptions{TTL: time.Millisecond * 300}))
+	time.Sleep(time.Millisecond * 100)
+	_, err = db.Get(GetKey(2))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 250)
+	_, err = db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
 func TestRoseDB_SetNX(t *testing.T) {
 	t.Run("default", func(t *testing.T) {
 		testRoseDBSetNX(t, FileIO, KeyOnlyMemMode)
@@ -534,6 +561,106 @@ func testRoseDBSetNX(t *testing.T, ioType IOType, mode DataIndexMode) {
 	}
 }
 
+func TestRoseDB_SetNX_SetsOnlyAbsentKey(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	assert.Nil(t, db.SetNX(GetKey(1), []byte("v1")))
+	v, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), v)
+
+	assert.Nil(t, db.SetNX(GetKey(1), []byte("v2")))
+	v, err = db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), v)
+}
+
+func TestRoseDB_SetWithArgs(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	ctx := context.Background()
+
+	// NX sets the key only if it does not exist.
+	old, set, err := db.SetWithArgs(ctx, GetKey(1), []byte("v1"), WriteOptions{}, SetArgs{NX: true})
+	assert.Nil(t, err)
+	assert.True(t, set)
+	assert.Nil(t, old)
+	old, set, err = db.SetWithArgs(ctx, GetKey(1), []byte("v2"), WriteOptions{}, SetArgs{NX: true})
+	assert.Nil(t, err)
+	assert.False(t, set)
+	assert.Equal(t, []byte("v1"), old)
+
+	// XX sets the key only if it exists.
+	_, set, err = db.SetWithArgs(ctx, GetKey(2), []byte("v1"), WriteOptions{}, SetArgs{XX: true})
+	assert.Nil(t, err)
+	assert.False(t, set)
+	_, err = db.Get(GetKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	old, set, err = db.SetWithArgs(ctx, GetKey(1), []byte("v2"), WriteOptions{}, SetArgs{XX: true})
+	assert.Nil(t, err)
+	assert.True(t, set)
+	assert.Equal(t, []byte("v1"), old)
+
+	// KeepTTL retains the expiration of the key.
+	assert.Nil(t, db.SetEX(GetKey(3), []byte("v1"), time.Second))
+	_, _, err = db.SetWithArgs(ctx, GetKey(3), []byte("v2"), WriteOptions{}, SetArgs{KeepTTL: true})
+	assert.Nil(t, err)
+	_, _, err = db.SetWithArgs(ctx, GetKey(1), []byte("v3"), WriteOptions{}, SetArgs{KeepTTL: true})
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 2100)
+	_, err = db.Get(GetKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), v)
+}
+
+func TestRoseDB_MSetNXWithOptions(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	ctx := context.Background()
+
+	set, err := db.MSetNXWithOptions(ctx, WriteOptions{}, GetKey(1), GetKey(1), GetKey(2), GetKey(2))
+	assert.Nil(t, err)
+	assert.True(t, set)
+	set, err = db.MSetNXWithOptions(ctx, WriteOptions{}, GetKey(3), GetKey(3), GetKey(2), GetKey(3))
+	assert.Nil(t, err)
+	assert.False(t, set)
+	_, err = db.Get(GetKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	_, err = db.MSetNXWithOptions(ctx, WriteOptions{}, GetKey(3))
+	assert.Equal(t, ErrWrongNumberOfArgs, err)
+}
+
+func TestRoseDB_AppendWithOptions(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	ctx := context.Background()
+
+	n, err := db.AppendWithOptions(ctx, GetKey(1), []byte("ab"), WriteOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	n, err = db.AppendWithOptions(ctx, GetKey(1), []byte("cde"), WriteOptions{TTL: time.Hour})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	v, err := db.Get(GetKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcde"), v)
+	ttl, err := db.TTL(GetKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour, ttl)
+}
+
 func TestRoseDB_MSet(t *testing.T) {
 	t.Run("default", func(t *testing.T) {
 		testRoseDBMSet(t, FileIO, KeyOnlyMemMode)
@@ -1433,6 +1560,61 @@ func TestRoseDB_StrsGC(t *testing.T) {
 
 	err = db.RunLogFileGC(String, 0, 0.6)
 	assert.Nil(t, err)
-	size := db.strIndex.idxTree.Size()
+	size := db.strIndex.size()
 	assert.Equal(t, writeCount-writeCount/4, size)
 }
+
+func TestRoseDB_ConcurrentStrs(t *testing.T) {
+	path := filepath.Join("/tmp", "kv_engine-concurrent-strs")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 1 << 20
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	writers, writes := 8, 2000
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := GetKey(w*writes + i)
+				assert.Nil(t, db.Set(key, key))
+				if i%4 == 0 {
+					_, err := db.Incr([]byte("counter"))
+					assert.Nil(t, err)
+				}
+				if i%100 == 0 {
+					_, err := db.MGet([][]byte{GetKey(i), GetKey(writes + i), key})
+					assert.Nil(t, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < writers*writes; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetKey(i), v)
+	}
+	v, err := db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, strconv.Itoa(writers*writes/4), string(v))
+
+	// keys of all shards are iterated in order.
+	db.strIndex.rlockAll()
+	var keys [][]byte
+	iter := db.strIndex.iterator()
+	for iter.HasNext() {
+		node, err := iter.Next()
+		assert.Nil(t, err)
+		keys = append(keys, node.Key())
+	}
+	db.strIndex.runlockAll()
+	assert.Equal(t, writers*writes+1, len(keys))
+	assert.True(t, sort.SliceIsSorted(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	}))
+}
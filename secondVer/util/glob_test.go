@@ -0,0 +1,36 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"*", "", true},
+		{"*", "any/key", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"*:1", "user:1", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a**b", "axyzb", true},
+		{"abc", "abcd", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.match, GlobMatch([]byte(tt.pattern), []byte(tt.str)), "pattern: %s, str: %s", tt.pattern, tt.str)
+	}
+}
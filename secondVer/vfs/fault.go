@@ -0,0 +1,213 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrInjected is returned by the operations failed by FaultFS.
+	ErrInjected = errors.New("vfs: injected fault")
+
+	// ErrCrashed is returned by every mutation after FaultFS crashed, see FaultFS.CrashAfter.
+	ErrCrashed = errors.New("vfs: file system crashed")
+)
+
+// Fault is a kind of fault injected by FaultFS.
+type Fault uint8
+
+const (
+	// FailWrite writes fail with ErrInjected, nothing is written.
+	FailWrite Fault = iota
+	// ShortWrite writes write the first half of the data only, and fail with io.ErrShortWrite.
+	ShortWrite
+	// FailSync syncs fail with ErrInjected.
+	FailSync
+	// NoSpace writes fail with ENOSPC as if the disk is full, nothing is written.
+	NoSpace
+
+	faultNum = 4
+)
+
+// FaultFS wraps a FS and injects faults into its files, so that tests can check how the engine handles them.
+// Faults are injected into the writes and syncs of the files opened through it,
+// so writes to memory-mapped files are never failed.
+type FaultFS struct {
+	FS
+
+	mu sync.Mutex
+	// patterns of the file names matched by each fault, see Inject.
+	faults [faultNum][]string
+	// bytes written since CrashAfter is called, and the limit of them, which is negative if no crash is planned.
+	written int64
+	crashAt int64
+	crashed bool
+}
+
+// NewFaultFS returns a FaultFS of fs without any fault.
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{FS: fs, crashAt: -1}
+}
+
+// Inject injects fault into the files whose base name matches pattern, see filepath.Match.
+// An empty pattern matches all files.
+func (f *FaultFS) Inject(fault Fault, pattern string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[fault] = append(f.faults[fault], pattern)
+}
+
+// CrashAfter crashes the file system once n more bytes are written: the write crossing the limit is cut at it,
+// and every write, sync and change of files fails with ErrCrashed from then on, while reads still work.
+// The files can then be opened by the wrapped FS to check what survived the crash.
+func (f *FaultFS) CrashAfter(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written, f.crashAt = 0, n
+}
+
+// Crashed reports whether the file system crashed.
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// Reset removes all faults and recovers the file system from crash.
+func (f *FaultFS) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = [faultNum][]string{}
+	f.written, f.crashAt, f.crashed = 0, -1, false
+}
+
+func (f *FaultFS) matches(fault Fault, name string) bool {
+	base := filepath.Base(name)
+	for _, pattern := range f.faults[fault] {
+		if pattern == "" {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowWrite returns how many bytes of a write of size to the file name can be written, and the error of the write.
+func (f *FaultFS) allowWrite(name string, size int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case f.crashed:
+		return 0, ErrCrashed
+	case f.matches(FailWrite, name):
+		return 0, ErrInjected
+	case f.matches(NoSpace, name):
+		return 0, &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+	case f.matches(ShortWrite, name) && size > 1:
+		size /= 2
+		return size, io.ErrShortWrite
+	}
+	if f.crashAt >= 0 && f.written+int64(size) > f.crashAt {
+		allowed := int(f.crashAt - f.written)
+		f.written, f.crashed = f.crashAt, true
+		return allowed, ErrCrashed
+	}
+	f.written += int64(size)
+	return size, nil
+}
+
+func (f *FaultFS) checkCrashed() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := f.checkCrashed(); err != nil {
+			return nil, err
+		}
+	}
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if err := f.checkCrashed(); err != nil {
+		return err
+	}
+	return f.FS.Remove(name)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if err := f.checkCrashed(); err != nil {
+		return err
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.checkCrashed(); err != nil {
+		return err
+	}
+	return f.FS.MkdirAll(path, perm)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (ff *faultFile) Write(b []byte) (int, error) {
+	allowed, err := ff.fs.allowWrite(ff.Name(), len(b))
+	if allowed > 0 {
+		n, werr := ff.File.Write(b[:allowed])
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return allowed, err
+}
+
+func (ff *faultFile) WriteAt(b []byte, off int64) (int, error) {
+	allowed, err := ff.fs.allowWrite(ff.Name(), len(b))
+	if allowed > 0 {
+		n, werr := ff.File.WriteAt(b[:allowed], off)
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return allowed, err
+}
+
+func (ff *faultFile) Sync() error {
+	ff.fs.mu.Lock()
+	crashed, failed := ff.fs.crashed, ff.fs.matches(FailSync, ff.Name())
+	ff.fs.mu.Unlock()
+	if crashed {
+		return ErrCrashed
+	}
+	if failed {
+		return ErrInjected
+	}
+	return ff.File.Sync()
+}
+
+func (ff *faultFile) Truncate(size int64) error {
+	if err := ff.fs.checkCrashed(); err != nil {
+		return err
+	}
+	return ff.File.Truncate(size)
+}
@@ -0,0 +1,119 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openFaultFile(t *testing.T, fs *FaultFS, name string) File {
+	file, err := fs.OpenFile(filepath.Join(t.TempDir(), name), os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = file.Close() })
+	return file
+}
+
+func readAll(t *testing.T, file File) []byte {
+	buf, err := ReadFile(OS, file.Name())
+	assert.Nil(t, err)
+	return buf
+}
+
+func TestFaultFS_Inject(t *testing.T) {
+	t.Run("fail-write", func(t *testing.T) {
+		fs := NewFaultFS(OS)
+		fs.Inject(FailWrite, "*.log")
+		file := openFaultFile(t, fs, "000.log")
+		n, err := file.Write([]byte("hello"))
+		assert.Equal(t, 0, n)
+		assert.Equal(t, ErrInjected, err)
+		assert.Empty(t, readAll(t, file))
+
+		// other files are not affected.
+		other := openFaultFile(t, fs, "000.data")
+		_, err = other.WriteAt([]byte("hello"), 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("hello"), readAll(t, other))
+	})
+
+	t.Run("short-write", func(t *testing.T) {
+		fs := NewFaultFS(OS)
+		fs.Inject(ShortWrite, "")
+		file := openFaultFile(t, fs, "000.log")
+		n, err := file.WriteAt([]byte("hello!"), 0)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, io.ErrShortWrite, err)
+		assert.Equal(t, []byte("hel"), readAll(t, file))
+	})
+
+	t.Run("fail-sync", func(t *testing.T) {
+		fs := NewFaultFS(OS)
+		fs.Inject(FailSync, "000.log")
+		file := openFaultFile(t, fs, "000.log")
+		_, err := file.Write([]byte("hello"))
+		assert.Nil(t, err)
+		assert.Equal(t, ErrInjected, file.Sync())
+	})
+
+	t.Run("no-space", func(t *testing.T) {
+		fs := NewFaultFS(OS)
+		fs.Inject(NoSpace, "")
+		file := openFaultFile(t, fs, "000.log")
+		_, err := file.Write([]byte("hello"))
+		assert.True(t, errors.Is(err, syscall.ENOSPC))
+		assert.Empty(t, readAll(t, file))
+	})
+}
+
+func TestFaultFS_CrashAfter(t *testing.T) {
+	fs := NewFaultFS(OS)
+	file := openFaultFile(t, fs, "000.log")
+	fs.CrashAfter(8)
+
+	_, err := file.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.False(t, fs.Crashed())
+
+	// the write crossing the limit is cut at it.
+	n, err := file.Write([]byte("world"))
+	assert.Equal(t, 3, n)
+	assert.Equal(t, ErrCrashed, err)
+	assert.True(t, fs.Crashed())
+	assert.Equal(t, []byte("hellowor"), readAll(t, file))
+
+	// nothing can be changed after the crash, but reads still work.
+	_, err = file.Write([]byte("!"))
+	assert.Equal(t, ErrCrashed, err)
+	assert.Equal(t, ErrCrashed, file.Sync())
+	assert.Equal(t, ErrCrashed, file.Truncate(0))
+	assert.Equal(t, ErrCrashed, fs.Remove(file.Name()))
+	_, err = fs.OpenFile(file.Name()+".new", os.O_CREATE|os.O_RDWR, 0644)
+	assert.Equal(t, ErrCrashed, err)
+
+	buf := make([]byte, 8)
+	_, err = file.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hellowor"), buf)
+}
+
+func TestFaultFS_Reset(t *testing.T) {
+	fs := NewFaultFS(OS)
+	fs.Inject(FailSync, "")
+	fs.CrashAfter(0)
+	file := openFaultFile(t, fs, "000.log")
+
+	_, err := file.Write([]byte("hello"))
+	assert.Equal(t, ErrCrashed, err)
+
+	fs.Reset()
+	assert.False(t, fs.Crashed())
+	_, err = file.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Sync())
+	assert.Equal(t, []byte("hello"), readAll(t, file))
+}
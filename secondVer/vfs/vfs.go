@@ -0,0 +1,177 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/reid00/kv_engine/flock"
+)
+
+// File is an open file of a FS, *os.File implements it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	Name() string
+	// Fd returns the file descriptor, which is used to lock or map the file.
+	Fd() uintptr
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is the file system used by the engine, every file and directory is accessed through it,
+// so that tests can replace the file system of os, e.g. by FaultFS to inject faults.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+
+	// Lock acquires the file lock at path, which is shared if readOnly is true, and exclusive otherwise.
+	// The lock file is never created in read-only mode, it must be created by a writer first.
+	// The lock is released by closing the returned io.Closer.
+	Lock(path string, readOnly bool) (io.Closer, error)
+}
+
+// OS is the file system of os.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// never return a non-nil interface holding a nil *os.File.
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lock(path string, readOnly bool) (io.Closer, error) {
+	guard, err := flock.AcquireFileLock(path, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return fileLock{guard}, nil
+}
+
+type fileLock struct {
+	guard *flock.FileLockGuard
+}
+
+func (fl fileLock) Close() error {
+	return fl.guard.Release()
+}
+
+// Open opens the named file for reading.
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// PathExist reports whether path exists.
+func PathExist(fs FS, path string) bool {
+	if _, err := fs.Stat(path); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+// ReadFile reads the whole named file.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	file, err := Open(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// WriteFile writes data to the named file, creating it if necessary.
+func WriteFile(fs FS, name string, data []byte, perm os.FileMode) error {
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CopyFile copies the file src to dst with the same mode.
+func CopyFile(fs FS, src, dst string) error {
+	srcInfo, err := fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	srcFile, err := Open(fs, src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, srcInfo.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		_ = dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+// CopyDir copies the directory src to dst recursively.
+func CopyDir(fs FS, src, dst string) error {
+	srcInfo, err := fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err = fs.MkdirAll(dst, srcInfo.Mode()); err != nil {
+		return err
+	}
+	dir, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir {
+		srcPath, dstPath := filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())
+		if entry.IsDir() {
+			err = CopyDir(fs, srcPath, dstPath)
+		} else {
+			err = CopyFile(fs, srcPath, dstPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
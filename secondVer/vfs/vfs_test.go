@@ -0,0 +1,37 @@
+package vfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyDir(t *testing.T) {
+	src, dst := filepath.Join(t.TempDir(), "src"), filepath.Join(t.TempDir(), "dst")
+	assert.Nil(t, OS.MkdirAll(filepath.Join(src, "sub"), os.ModePerm))
+	assert.Nil(t, WriteFile(OS, filepath.Join(src, "a"), []byte("a"), 0644))
+	assert.Nil(t, WriteFile(OS, filepath.Join(src, "sub", "b"), []byte("b"), 0600))
+
+	assert.Nil(t, CopyDir(OS, src, dst))
+	buf, err := ReadFile(OS, filepath.Join(dst, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), buf)
+	buf, err = ReadFile(OS, filepath.Join(dst, "sub", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), buf)
+
+	info, err := OS.Stat(filepath.Join(dst, "sub", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.False(t, PathExist(OS, filepath.Join(dst, "c")))
+}
+
+func TestOSFS_Lock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "FLOCK")
+	lock, err := OS.Lock(path, false)
+	assert.Nil(t, err)
+	assert.True(t, PathExist(OS, path))
+	assert.Nil(t, lock.Close())
+}